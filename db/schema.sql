@@ -1,18 +1,47 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    org_id INTEGER NULL REFERENCES organizations(id), -- tenant the user belongs to; NULL = no organization
     rate_limit_minute INTEGER DEFAULT 0,  -- 0 = use server default
     rate_limit_daily INTEGER DEFAULT 0,   -- 0 = use server default
+    rate_limit_attempts_minute INTEGER DEFAULT 0, -- upstream attempts incl. fallbacks; 0 = use server default
+    rate_limit_tokens_daily INTEGER DEFAULT 0, -- input + output tokens per day; 0 = use server default
+    previous_rate_limit_minute INTEGER NULL, -- limits still enforced until rate_limit_grace_until
+    previous_rate_limit_daily INTEGER NULL,
+    rate_limit_grace_until TIMESTAMP WITH TIME ZONE NULL,
+    monthly_token_quota BIGINT DEFAULT 0, -- input + output tokens per calendar month (UTC); 0 = use server default
+    is_admin BOOLEAN DEFAULT FALSE,
+    features JSONB NOT NULL DEFAULT '{}', -- per-user feature flags, e.g. {"streaming": false}
+    unsupported_param_policy VARCHAR(16) NULL, -- 'drop' or 'reject'; NULL = use server default
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- New emails are stored lowercase, but older rows may not be. This keeps one
+-- account per address whatever its case, and serves lookups by email.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email));
+
 CREATE TABLE IF NOT EXISTS api_keys (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES users(id),
     name VARCHAR(255) NOT NULL,
     key_hash VARCHAR(255) UNIQUE NOT NULL,
     prefix VARCHAR(10) NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE, -- revoked keys are rejected by AuthMiddleware
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id),
+    token_hash VARCHAR(255) UNIQUE NOT NULL, -- SHA-256 of the token; each token is used once
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -22,6 +51,7 @@ CREATE TABLE IF NOT EXISTS provider_keys (
     provider VARCHAR(50) NOT NULL, -- 'openai', 'anthropic'
     encrypted_key TEXT NOT NULL,
     label VARCHAR(255),
+    base_url VARCHAR(255) NULL, -- endpoint for providers that need one, e.g. an Azure OpenAI resource
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -35,6 +65,17 @@ CREATE TABLE IF NOT EXISTS model_aliases (
     use_light_model BOOLEAN DEFAULT FALSE,
     light_model_threshold INTEGER DEFAULT 100, -- Number of tokens that when we're under we fallback to smaller model
     light_model VARCHAR(255),
+    max_temperature REAL NULL, -- Requests above this temperature are clamped; NULL = server default
+    fallback_on_statuses INTEGER[] NULL, -- Upstream statuses that trigger the fallback; NULL = default classification
+    weighted_targets JSONB NULL, -- Canary targets, e.g. [{"model": "gpt-4o", "weight": 90}, {"model": "gpt-5", "weight": 10}]
+    native_passthrough BOOLEAN NOT NULL DEFAULT FALSE, -- serve the native Anthropic API on /v1/messages without translation
+    cache_ttl_seconds INTEGER NULL, -- Response cache TTL; 0 = never cache, NULL = server default
+    is_pattern BOOLEAN NOT NULL DEFAULT FALSE, -- alias is a glob (e.g. 'claude-*') matched when no exact alias exists
+    disabled BOOLEAN NOT NULL DEFAULT FALSE, -- disabled aliases are skipped in favour of their fallback
+    flagged_reason TEXT NULL, -- why the model poll flagged the alias, e.g. its target model vanished; NULL = healthy
+    response_format_fallback BOOLEAN NOT NULL DEFAULT FALSE, -- retry without response_format when the upstream rejects it
+    max_messages INTEGER NULL, -- Requests with more messages are rejected; NULL = no limit
+    system_prompt_override TEXT NULL, -- System message put ahead of the client's messages; NULL = none
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(user_id, alias)
 );
@@ -44,6 +85,7 @@ CREATE TABLE IF NOT EXISTS provider_models (
     provider VARCHAR(50) NOT NULL, -- e.g. 'openai', 'anthropic'
     model_id VARCHAR(255) NOT NULL,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP, -- last poll that listed the model
     UNIQUE(provider, model_id)
 );
 
@@ -55,6 +97,47 @@ CREATE TABLE IF NOT EXISTS request_logs (
     model_used VARCHAR(255),
     input_tokens INTEGER DEFAULT 0,
     output_tokens INTEGER DEFAULT 0,
+    estimated_input_tokens INTEGER NULL, -- proxy-side estimate, for measuring the estimator against input_tokens
+    latency_ms INTEGER NULL, -- duration of the upstream call; NULL where not measured
+    error TEXT NULL, -- why the request failed, for status codes >= 400
+    cache_hit BOOLEAN NOT NULL DEFAULT false, -- served from the response cache, without an upstream call
+    usage_estimated BOOLEAN NOT NULL DEFAULT false, -- provider reported no usage, so input/output_tokens are the proxy's estimate
     status_code INTEGER,
+    endpoint VARCHAR(32) NOT NULL DEFAULT 'chat_completions', -- chat_completions, messages, moderations
+    estimated_cost NUMERIC(14, 6) NULL, -- US dollars from the model price table; NULL = model has no price
+    response_id VARCHAR(255) NULL, -- id of the response sent to the client
+    upstream_response_id VARCHAR(255) NULL, -- provider's id, when the proxy rewrote it (STRICT_RESPONSE_IDS)
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
+
+CREATE TABLE IF NOT EXISTS failed_requests (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id),
+    requested_model VARCHAR(255),
+    attempted_aliases TEXT[] NOT NULL DEFAULT '{}', -- aliases tried in fallback order
+    status_code INTEGER,
+    error TEXT,
+    request_body TEXT, -- only stored when LOG_REQUEST_BODIES is enabled
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NULL REFERENCES users(id), -- NULL for unauthenticated calls such as signup and login
+    action VARCHAR(255) NOT NULL, -- method and route, e.g. 'PATCH /manage/aliases/{alias}'
+    target TEXT NOT NULL, -- request path
+    status_code INTEGER NOT NULL,
+    source_ip VARCHAR(64) NOT NULL,
+    details JSONB NULL, -- request body with secrets redacted
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS stored_responses (
+    id VARCHAR(255) NOT NULL, -- response id returned to the client
+    user_id INTEGER REFERENCES users(id),
+    model VARCHAR(255),
+    metadata JSONB NOT NULL DEFAULT '{}',
+    response JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, id)
+);
@@ -2,41 +2,96 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"flag"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	"tokentracer-proxy/pkg/admin"
+	"tokentracer-proxy/pkg/audit"
 	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/cors"
 	"tokentracer-proxy/pkg/crypto"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/denylist"
 	"tokentracer-proxy/pkg/handler"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
 	"tokentracer-proxy/pkg/management"
+	"tokentracer-proxy/pkg/pricing"
 	"tokentracer-proxy/pkg/ratelimit"
+	"tokentracer-proxy/pkg/status"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
 func main() {
+	rotateKeys := flag.Bool("rotate-keys", false, "re-encrypt all provider keys with ENCRYPTION_KEY, decrypting with ENCRYPTION_KEY_OLD where needed, then exit")
+	flag.Parse()
+
+	logging.Init()
+
+	// Cancelled on SIGINT or SIGTERM, which starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	r := chi.NewRouter()
 
-	r.Use(middleware.Logger)
+	r.Use(logging.RequestID)
+	r.Use(logging.AccessLog)
 	r.Use(middleware.Recoverer)
+	r.Use(cors.Middleware)
+	r.Use(httperr.LimitBody)
 
 	// Init Auth & Crypto
 	auth.Init()
 	crypto.Init()
 
+	if err := denylist.Init(); err != nil {
+		logging.Printf(ctx, "Failed to load denylist: %v", err)
+		os.Exit(1)
+	}
+
+	if err := pricing.Init(); err != nil {
+		logging.Printf(ctx, "Failed to load model prices: %v", err)
+		os.Exit(1)
+	}
+
+	if err := handler.InitTokenizer(); err != nil {
+		logging.Printf(ctx, "Failed to load tokenizer: %v", err)
+		os.Exit(1)
+	}
+
+	if err := ratelimit.Init(); err != nil {
+		logging.Printf(ctx, "Failed to connect to Redis: %v", err)
+		os.Exit(1)
+	}
+
 	// Init DB
 	if err := db.InitDB(); err != nil {
-		fmt.Printf("Failed to init DB: %v\n", err)
+		logging.Printf(ctx, "Failed to init DB: %v", err)
 		os.Exit(1)
 	}
 	defer db.CloseDB()
 
-	// Background: Fetch models for all provider keys every 12 hours
-	management.StartModelPolling(context.Background())
+	if *rotateKeys {
+		n, err := admin.RotateProviderKeys(ctx)
+		if err != nil {
+			logging.Printf(ctx, "Failed to rotate provider keys: %v", err)
+			db.CloseDB()
+			os.Exit(1)
+		}
+		logging.Printf(ctx, "Re-encrypted %d provider keys", n)
+		return
+	}
+
+	// Seed the model cache, then fetch models for all provider keys every 12 hours
+	management.SeedModels(ctx)
+	management.StartModelPolling(ctx)
 
 	// Serve static UI
 	fs := http.FileServer(http.Dir("./web"))
@@ -51,46 +106,95 @@ func main() {
 	})
 
 	// Auth Routes
-	r.Post("/auth/signup", auth.SignupHandler)
-	r.Post("/auth/login", auth.LoginHandler)
+	r.With(audit.Middleware).Post("/auth/signup", auth.SignupHandler)
+	r.With(audit.Middleware).Post("/auth/login", auth.LoginHandler)
+	r.With(audit.Middleware).Post("/auth/refresh", auth.RefreshHandler)
 
 	// Protected Routes
 	r.Group(func(r chi.Router) {
 		r.Use(auth.AuthMiddleware)
 
-		// User info and key generation
+		// User info, for either kind of token
 		r.Get("/auth/me", auth.UserInfoHandler)
-		r.Post("/auth/key", auth.GenerateAPIKeyHandler)
 
-		// Management API
-		r.Route("/manage", management.RegisterRoutes)
+		// Key management and the management APIs take session tokens
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireScope(auth.ScopeSession))
 
-		// The main proxy endpoint - now protected and rate limited
-		ps := handler.NewProxyServer(db.Repo)
-		r.With(ratelimit.RateLimitMiddleware).Post("/v1/chat/completions", ps.ProxyHandler)
-	})
+			r.Get("/auth/key", auth.ListAPIKeysHandler)
+			r.With(audit.Middleware).Post("/auth/key", auth.GenerateAPIKeyHandler)
+			r.With(audit.Middleware).Delete("/auth/key/{keyID}", auth.RevokeAPIKeyHandler)
 
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		// TODO: add ping to db?
-		if _, err := w.Write([]byte("OK")); err != nil {
-			log.Printf("health check: write response error: %v", err)
-		}
+			// Management API
+			r.With(audit.Middleware).Route("/manage", management.RegisterRoutes)
+
+			// Operator-only API
+			r.With(auth.AdminMiddleware, audit.Middleware).Route("/admin", admin.RegisterRoutes)
+		})
+
+		// The main proxy endpoint - now protected and rate limited, and only
+		// for API keys
+		r.Group(func(r chi.Router) {
+			r.Use(auth.RequireScope(auth.ScopeAPIKey))
+
+			ps := handler.NewProxyServer(db.Repo)
+			r.With(ratelimit.RateLimitMiddleware, ratelimit.TokenQuotaMiddleware).Post("/v1/chat/completions", ps.ProxyHandler)
+			r.With(ratelimit.RateLimitMiddleware, ratelimit.TokenQuotaMiddleware).Post("/v1/messages", ps.MessagesHandler)
+			r.With(ratelimit.RateLimitMiddleware).Post("/v1/moderations", ps.ModerationsHandler)
+			r.Get("/v1/responses/{id}", ps.GetResponseHandler)
+		})
 	})
 
+	r.Get("/health", status.HealthHandler)
+	r.Get("/livez", status.LivezHandler)
+	r.Get("/readyz", status.ReadyzHandler)
+
+	r.Get("/status", status.Handler)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	fmt.Printf("Starting server on :%s\n", port)
+	logging.Printf(ctx, "Starting server on :%s", port)
 	srv := &http.Server{
 		Addr:         ":" + port,
 		Handler:      r,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
-	if err := srv.ListenAndServe(); err != nil {
-		log.Printf("Server failed to start: %v", err)
+	// A second signal during the grace period kills the process
+	context.AfterFunc(ctx, stop)
+	if ln, err := net.Listen("tcp", srv.Addr); err != nil {
+		logging.Printf(ctx, "Server failed to start: %v", err)
+	} else if err := serve(ctx, srv, ln, config.Duration("SHUTDOWN_TIMEOUT", 30*time.Second)); err != nil {
+		logging.Printf(ctx, "Server shutdown: %v", err)
+	}
+
+	// Write out queued request logs before the DB is closed
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := handler.FlushLogs(flushCtx); err != nil {
+		logging.Printf(flushCtx, "flush request logs: %v (%d writes lost)", err, handler.PendingLogWrites())
 	}
 }
+
+// serve serves srv on ln until ctx is cancelled, then shuts it down, giving
+// in-flight requests, streams included, up to grace to finish.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, grace time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logging.Printf(ctx, "Shutting down, waiting up to %s for in-flight requests", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServe_GracefulShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		grace   time.Duration
+		wantErr error
+	}{
+		// The in-flight request finishes within the grace period
+		{name: "finishes in time", grace: 5 * time.Second},
+		{name: "grace period expires", grace: 20 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			started, release := make(chan struct{}), make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				w.Write([]byte("done"))
+			})}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() { served <- serve(ctx, srv, ln, tt.grace) }()
+
+			type result struct {
+				body string
+				err  error
+			}
+			got := make(chan result, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String())
+				if err != nil {
+					got <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				got <- result{body: string(body), err: err}
+			}()
+
+			<-started
+			cancel()
+			if tt.wantErr == nil {
+				// Shutdown waits for the request rather than cutting it off
+				select {
+				case err := <-served:
+					t.Fatalf("Expected shutdown to wait for the in-flight request, returned %v", err)
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(release)
+				if r := <-got; r.err != nil || r.body != "done" {
+					t.Errorf("Expected the in-flight request to complete, got %q, %v", r.body, r.err)
+				}
+			}
+
+			err = <-served
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v from serve, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr != nil {
+				close(release)
+				<-got
+			}
+
+			// New connections are refused once shut down
+			if _, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+				t.Error("Expected the listener to be closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/features"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/ratelimit"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// GetUserFeatures returns a user's effective feature flags
+func GetUserFeatures(w http.ResponseWriter, r *http.Request) {
+	targetID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	stored, err := db.Repo.GetUserFeatures(r.Context(), targetID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		httperr.Lookup(w, r, err, "User")
+		return
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "admin get features error for user %d: %v", targetID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	effective := make(map[string]bool, len(features.Defaults))
+	for name, def := range features.Defaults {
+		effective[name] = def
+	}
+	for name, enabled := range stored {
+		effective[name] = enabled
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(effective); err != nil {
+		logging.Printf(r.Context(), "admin get features: encode response error: %v", err)
+	}
+}
+
+// SetUserFeatures replaces a user's explicit feature flags
+func SetUserFeatures(w http.ResponseWriter, r *http.Request) {
+	targetID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var flags map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&flags); err != nil {
+		httperr.BadBody(w, err, "Invalid request body")
+		return
+	}
+	for name := range flags {
+		if !features.IsKnown(name) {
+			http.Error(w, "Unknown feature: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = db.Repo.SetUserFeatures(r.Context(), targetID, flags)
+	if errors.Is(err, pgx.ErrNoRows) {
+		httperr.Lookup(w, r, err, "User")
+		return
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "admin set features error for user %d: %v", targetID, err)
+		http.Error(w, "Failed to update features", http.StatusInternalServerError)
+		return
+	}
+	features.Invalidate(targetID)
+	w.WriteHeader(http.StatusOK)
+}
+
+type RateLimitsRequest struct {
+	RateLimitMinute int `json:"rate_limit_minute"`
+	RateLimitDaily  int `json:"rate_limit_daily"`
+	// GracePeriodSeconds keeps the current limits enforced for this long while
+	// the new ones are announced in response headers. 0 applies them at once.
+	GracePeriodSeconds int `json:"grace_period_seconds"`
+}
+
+// SetUserRateLimits changes a user's per-minute and daily rate limits
+func SetUserRateLimits(w http.ResponseWriter, r *http.Request) {
+	targetID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RateLimitsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httperr.BadBody(w, err, "Invalid request body")
+		return
+	}
+	if req.RateLimitMinute < 0 || req.RateLimitDaily < 0 || req.GracePeriodSeconds < 0 {
+		http.Error(w, "Limits and grace_period_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var graceUntil *time.Time
+	if req.GracePeriodSeconds > 0 {
+		t := time.Now().Add(time.Duration(req.GracePeriodSeconds) * time.Second)
+		graceUntil = &t
+	}
+
+	err = db.Repo.SetUserRateLimits(r.Context(), targetID, req.RateLimitMinute, req.RateLimitDaily, graceUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		httperr.Lookup(w, r, err, "User")
+		return
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "admin set rate limits error for user %d: %v", targetID, err)
+		http.Error(w, "Failed to update rate limits", http.StatusInternalServerError)
+		return
+	}
+	ratelimit.InvalidateUserLimits(targetID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// ListAuditLog returns the most recent audit log entries, newest first
+func ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := db.Repo.ListAuditEntries(r.Context(), limit)
+	if err != nil {
+		logging.Printf(r.Context(), "admin list audit log error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		var details json.RawMessage
+		if e.Details != nil {
+			details = e.Details
+		}
+		out = append(out, map[string]interface{}{
+			"id": e.ID, "user_id": e.UserID, "action": e.Action, "target": e.Target,
+			"status_code": e.StatusCode, "source_ip": e.SourceIP, "details": details, "created_at": e.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		logging.Printf(r.Context(), "admin list audit log: encode response error: %v", err)
+	}
+}
+
+func RegisterRoutes(r chi.Router) {
+	r.Handle("/metrics", expvar.Handler())
+	r.Get("/users/{userID}/features", GetUserFeatures)
+	r.Put("/users/{userID}/features", SetUserFeatures)
+	r.Put("/users/{userID}/rate-limits", SetUserRateLimits)
+	r.Get("/audit-log", ListAuditLog)
+}
@@ -0,0 +1,199 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/admin"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/features"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestGetUserFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+		want     map[string]bool
+	}{
+		{
+			name: "defaults",
+			path: "/users/5/features",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT features FROM users").WithArgs(5).
+					WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool(nil)))
+			},
+			wantCode: http.StatusOK,
+			want:     map[string]bool{"streaming": true, "caching": false, "tool_calling": true},
+		},
+		{
+			name: "overrides",
+			path: "/users/5/features",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT features FROM users").WithArgs(5).
+					WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool{"caching": true, "streaming": false}))
+			},
+			wantCode: http.StatusOK,
+			want:     map[string]bool{"streaming": false, "caching": true, "tool_calling": true},
+		},
+		{
+			name: "unknown user",
+			path: "/users/5/features",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT features FROM users").WithArgs(5).WillReturnError(pgx.ErrNoRows)
+			},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid ID",
+			path:     "/users/abc/features",
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			admin.RegisterRoutes(r)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.want != nil {
+				var got map[string]bool
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if !maps.Equal(got, tt.want) {
+					t.Errorf("Expected %v, got %v", tt.want, got)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestSetUserFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+	}{
+		{
+			name: "updated",
+			body: `{"caching":true}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectExec("UPDATE users SET features").WithArgs(5, map[string]bool{"caching": true}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "unknown flag",
+			body:     `{"caching":true,"telepathy":true}`,
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid body",
+			body:     `{"caching":"yes"}`,
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "unknown user",
+			body: `{"caching":true}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectExec("UPDATE users SET features").WithArgs(5, map[string]bool{"caching": true}).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+			},
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			admin.RegisterRoutes(r)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/users/5/features", strings.NewReader(tt.body)))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+// TestSetUserFeatures_Invalidates checks a toggle takes effect at once rather
+// than after the cached flags expire.
+func TestSetUserFeatures_Invalidates(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 6
+	defer features.Invalidate(userID)
+	ctx := context.Background()
+	mock.ExpectQuery("SELECT features FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool{}))
+	if features.HasFeature(ctx, db.Repo, userID, features.Caching) {
+		t.Fatal("Expected caching off by default")
+	}
+
+	mock.ExpectExec("UPDATE users SET features").WithArgs(userID, map[string]bool{"caching": true}).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	r := chi.NewRouter()
+	admin.RegisterRoutes(r)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/users/6/features", strings.NewReader(`{"caching":true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	mock.ExpectQuery("SELECT features FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool{"caching": true}))
+	if !features.HasFeature(ctx, db.Repo, userID, features.Caching) {
+		t.Error("Expected caching on straight after the toggle")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,19 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+)
+
+// RotateProviderKeys re-encrypts every stored provider key with the current
+// ENCRYPTION_KEY. Keys still encrypted with ENCRYPTION_KEY_OLD are decrypted
+// with it, so once this has run the old key can be dropped. Either all keys
+// are rewritten or, if any can't be decrypted with either key, none are.
+func RotateProviderKeys(ctx context.Context) (int, error) {
+	if !crypto.Initialized() {
+		return 0, errors.New("encryption key not initialized")
+	}
+	return db.Repo.ReencryptProviderKeys(ctx, crypto.Reencrypt)
+}
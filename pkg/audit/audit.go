@@ -0,0 +1,146 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// enabled turns the audit log on; it is on unless AUDIT_LOG=false.
+var enabled = config.Bool("AUDIT_LOG", true)
+
+// maxDetailsBytes bounds how much of a request body is kept in an entry.
+// Larger bodies are still passed on whole, just not recorded.
+const maxDetailsBytes = 64 << 10
+
+// secretFields are JSON keys whose values are never written to the log.
+var secretFields = map[string]bool{
+	"password":      true,
+	"api_key":       true,
+	"key":           true,
+	"token":         true,
+	"refresh_token": true,
+	"secret":        true,
+	"encrypted_key": true,
+}
+
+const redacted = "[REDACTED]"
+
+// Middleware appends an audit_log entry for every POST, PUT, PATCH and
+// DELETE it wraps, once the handler has run: who made the call, the route,
+// the path, the response status, the source IP and the request body with
+// secrets redacted. Safe methods pass straight through.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled || !isMutation(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			if err != nil {
+				httperr.BadBody(w, err, "Invalid request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		entry := db.AuditEntry{
+			Action:     r.Method + " " + routePattern(r),
+			Target:     r.URL.Path,
+			StatusCode: status,
+			SourceIP:   sourceIP(r),
+			Details:    redactBody(body),
+		}
+		if userID, ok := r.Context().Value(auth.KeyUser).(int); ok {
+			entry.UserID = &userID
+		}
+		if err := db.Repo.InsertAuditEntry(context.Background(), entry); err != nil {
+			logging.Printf(r.Context(), "audit: insert entry for %s error: %v", entry.Action, err)
+		}
+	})
+}
+
+func isMutation(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// routePattern returns the matched chi route, e.g. /manage/aliases/{alias},
+// falling back to the path when the request didn't go through chi.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if p := rctx.RoutePattern(); p != "" {
+			return p
+		}
+	}
+	return r.URL.Path
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// redactBody returns the JSON body with secret fields replaced, or nil when
+// the body is empty, too large or not JSON.
+func redactBody(body []byte) []byte {
+	if len(body) == 0 || len(body) > maxDetailsBytes {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(redact(v))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if secretFields[strings.ToLower(k)] {
+				t[k] = redacted
+				continue
+			}
+			t[k] = redact(val)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = redact(val)
+		}
+	}
+	return v
+}
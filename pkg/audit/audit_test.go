@@ -0,0 +1,60 @@
+package audit_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/audit"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestMiddleware_RecordsRedactedMutation(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 5
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(&userID, "POST /manage/providers", "/manage/providers", http.StatusCreated, "192.0.2.1",
+			[]byte(`{"api_key":"[REDACTED]","label":"prod","provider":"openai"}`)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	var gotBody string
+	r := chi.NewRouter()
+	r.With(audit.Middleware).Route("/manage", func(r chi.Router) {
+		r.Post("/providers", func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			gotBody = string(b)
+			w.WriteHeader(http.StatusCreated)
+		})
+		r.Get("/providers", func(w http.ResponseWriter, r *http.Request) {})
+	})
+
+	body := `{"provider":"openai","api_key":"sk-live-secret","label":"prod"}`
+	req := httptest.NewRequest("POST", "/manage/providers", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if gotBody != body {
+		t.Errorf("Expected the handler to get the full body, got %q", gotBody)
+	}
+
+	// Reads are not audited, so no further expectations
+	req = httptest.NewRequest("GET", "/manage/providers", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/db"
+)
+
+// apiKeyPepper is a server-side secret mixed into stored API key hashes so a
+// leaked api_keys table alone can't be used to check guessed tokens offline.
+var apiKeyPepper = []byte(os.Getenv("API_KEY_PEPPER"))
+
+// hmacHashPrefix marks key_hash values computed with HMAC-SHA256 and the
+// pepper. Hashes without it are legacy plain SHA-256 hex digests.
+const hmacHashPrefix = "hmac-sha256:"
+
+// HashAPIKey returns the value stored in api_keys.key_hash for a token:
+// HMAC-SHA256(token, pepper) when API_KEY_PEPPER is set, otherwise the legacy
+// plain SHA-256 digest.
+func HashAPIKey(token string) string {
+	if len(apiKeyPepper) == 0 {
+		return legacyAPIKeyHash(token)
+	}
+	mac := hmac.New(sha256.New, apiKeyPepper)
+	mac.Write([]byte(token))
+	return hmacHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAPIKeyHash reports, in constant time, whether storedHash was produced
+// from token. Both peppered and legacy hashes are accepted.
+func VerifyAPIKeyHash(token, storedHash string) bool {
+	expected := legacyAPIKeyHash(token)
+	if strings.HasPrefix(storedHash, hmacHashPrefix) {
+		if len(apiKeyPepper) == 0 {
+			return false
+		}
+		expected = HashAPIKey(token)
+	}
+	return hmac.Equal([]byte(expected), []byte(storedHash))
+}
+
+// keyPrefix returns the prefix an API key is listed and revoked by: the start
+// of the token's signature, since every JWT starts with the same header.
+func keyPrefix(token string) string {
+	sig := token[strings.LastIndex(token, ".")+1:]
+	if len(sig) > 8 {
+		sig = sig[:8]
+	}
+	return sig
+}
+
+// keyPrefixes returns the prefixes a token may be stored under: its current
+// prefix, and the first 8 characters it was stored under before that.
+func keyPrefixes(token string) []string {
+	return []string{keyPrefix(token), token[:min(8, len(token))]}
+}
+
+type revocationEntry struct {
+	revoked   bool
+	fetchedAt time.Time
+}
+
+// Revocation checks are cached briefly so API key requests don't each hit
+// the DB. A revocation takes effect on other instances within the TTL.
+var (
+	revocationCache    = make(map[string]revocationEntry)
+	revocationCacheMu  sync.RWMutex
+	revocationCacheTTL = 30 * time.Second
+)
+
+// apiKeyRevoked reports whether the user's API key token was revoked. Keys
+// missing from api_keys count as revoked, since every issued key is stored.
+// The user's keys are fetched by prefix and each stored hash compared with
+// VerifyAPIKeyHash, so the token is only ever checked in constant time.
+func apiKeyRevoked(ctx context.Context, userID int, token string) (bool, error) {
+	hash := HashAPIKey(token)
+
+	revocationCacheMu.RLock()
+	cached, ok := revocationCache[hash]
+	revocationCacheMu.RUnlock()
+	if ok && time.Since(cached.fetchedAt) < revocationCacheTTL {
+		return cached.revoked, nil
+	}
+
+	stored, err := db.Repo.ListAPIKeyHashes(ctx, userID, keyPrefixes(token))
+	if err != nil {
+		return false, err
+	}
+	revoked := true
+	for _, s := range stored {
+		if VerifyAPIKeyHash(token, s.Hash) {
+			revoked = s.Revoked
+			break
+		}
+	}
+
+	revocationCacheMu.Lock()
+	revocationCache[hash] = revocationEntry{revoked: revoked, fetchedAt: time.Now()}
+	revocationCacheMu.Unlock()
+	return revoked, nil
+}
+
+// invalidateRevocations drops every cached revocation check, so a key revoked
+// on this instance stops working at once.
+func invalidateRevocations() {
+	revocationCacheMu.Lock()
+	clear(revocationCache)
+	revocationCacheMu.Unlock()
+}
+
+func legacyAPIKeyHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -2,57 +2,121 @@ package auth
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
 
-// Init ensures we have a secret
+var (
+	// sessionTTL is how long a session token from login or refresh is
+	// valid, SESSION_TOKEN_TTL when set
+	sessionTTL = 24 * time.Hour
+	// apiKeyTTL is how long a generated API key is valid, API_KEY_TTL when set
+	apiKeyTTL = 365 * 24 * time.Hour
+)
+
+// Init ensures we have a secret and valid token lifetimes
 func Init() {
 	if len(jwtSecret) == 0 {
 		panic("JWT_SECRET must be set")
 	}
+	if err := loadTTLs(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// loadTTLs reads the token lifetimes from SESSION_TOKEN_TTL and API_KEY_TTL,
+// keeping the defaults for those unset.
+func loadTTLs() error {
+	for key, ttl := range map[string]*time.Duration{"SESSION_TOKEN_TTL": &sessionTTL, "API_KEY_TTL": &apiKeyTTL} {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", key, v)
+		}
+		*ttl = d
+	}
+	return nil
+}
+
+// Initialized reports whether a JWT secret is configured.
+func Initialized() bool {
+	return len(jwtSecret) > 0
 }
 
 type Credentials struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Remember asks login for a refresh token as well
+	Remember bool `json:"remember"`
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 // SignupHandler registers a new user
 func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	var creds Credentials
 	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		httperr.BadBody(w, err, "Invalid request")
+		return
+	}
+	email, err := normalizeEmail(creds.Email)
+	if err != nil {
+		http.Error(w, "Invalid email: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(creds.Password); err != nil {
+		http.Error(w, "Invalid password: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("signup: bcrypt error: %v", err)
+		logging.Printf(r.Context(), "signup: bcrypt error: %v", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
+	// Accounts from before emails were normalized may differ only in case
+	_, _, err = db.Repo.GetUserByEmail(r.Context(), email)
+	if err == nil {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		logging.Printf(r.Context(), "signup: lookup error: %v", err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
 	// Insert into DB
-	_, err = db.Repo.CreateUser(context.Background(), creds.Email, string(hashedPassword))
+	_, err = db.Repo.CreateUser(context.Background(), email, string(hashedPassword))
 
 	if err != nil {
-		log.Printf("signup error: %v", err)
+		logging.Printf(r.Context(), "signup error: %v", err)
 		http.Error(w, "User already exists or DB error", http.StatusConflict)
 		return
 	}
@@ -60,7 +124,7 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(map[string]string{"message": "User created"}); err != nil {
-		log.Printf("signup: encode response error: %v", err)
+		logging.Printf(r.Context(), "signup: encode response error: %v", err)
 	}
 }
 
@@ -68,14 +132,19 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds Credentials
 	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		httperr.BadBody(w, err, "Invalid request")
+		return
+	}
+	email, err := normalizeEmail(creds.Email)
+	if err != nil {
+		http.Error(w, "Invalid email: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	id, storedHash, err := db.Repo.GetUserByEmail(context.Background(), creds.Email)
+	id, storedHash, err := db.Repo.GetUserByEmail(context.Background(), email)
 
 	if err != nil {
-		log.Printf("login error: %v", err)
+		logging.Printf(r.Context(), "login error: %v", err)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
@@ -85,17 +154,34 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	orgID, err := db.Repo.GetUserOrgID(context.Background(), id)
+	if err != nil {
+		logging.Printf(r.Context(), "login: get org for user %d error: %v", id, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
 	// Identify this as a session token
-	token, err := generateJWT(id, "session", 24*time.Hour)
+	token, err := generateJWT(id, orgID, ScopeSession, sessionTTL)
 	if err != nil {
-		log.Printf("generate token error: %v", err)
+		logging.Printf(r.Context(), "generate token error: %v", err)
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
+	resp := AuthResponse{Token: token}
+	if creds.Remember {
+		resp.RefreshToken, err = issueRefreshToken(r.Context(), id)
+		if err != nil {
+			logging.Printf(r.Context(), "login: create refresh token for user %d error: %v", id, err)
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(AuthResponse{Token: token}); err != nil {
-		log.Printf("login: encode response error: %v", err)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Printf(r.Context(), "login: encode response error: %v", err)
 	}
 }
 
@@ -111,56 +197,114 @@ func GenerateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 	// Create a random name or take from request
 	keyName := "api-key-" + time.Now().Format("20060102-150405")
 
-	// Generate a long-lived JWT (e.g., 1 year)
+	// Generate a long-lived JWT, valid for API_KEY_TTL (a year by default)
 	// We mark this as an 'api_key' type claim to distinguish scope if needed
-	token, err := generateJWT(userID.(int), "api_key", 365*24*time.Hour)
+	// API keys carry the session's organization
+	var orgID *int
+	if id, ok := OrgID(r.Context()); ok {
+		orgID = &id
+	}
+	token, err := generateJWT(userID.(int), orgID, ScopeAPIKey, apiKeyTTL)
 	if err != nil {
-		log.Printf("generate key error: %v", err)
+		logging.Printf(r.Context(), "generate key error: %v", err)
 		http.Error(w, "Failed to generate key", http.StatusInternalServerError)
 		return
 	}
 
-	// Store a SHA-256 hash of the token (not the raw token) for revocation/tracking.
-	prefix := token[:8]
-	hash := sha256.Sum256([]byte(token))
-	keyHash := hex.EncodeToString(hash[:])
+	// Store a (peppered) hash of the token, not the raw token, for revocation/tracking.
+	prefix := keyPrefix(token)
+	keyHash := HashAPIKey(token)
 
 	err = db.Repo.CreateAPIKey(context.Background(), userID.(int), keyName, keyHash, prefix)
 
 	if err != nil {
-		log.Printf("create api key error: %v", err)
+		logging.Printf(r.Context(), "create api key error: %v", err)
 		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(AuthResponse{Token: token}); err != nil {
-		log.Printf("generate api key: encode response error: %v", err)
+		logging.Printf(r.Context(), "generate api key: encode response error: %v", err)
+	}
+}
+
+// APIKeyInfo describes an issued API key without the key itself
+type APIKeyInfo struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Revoked   bool      `json:"revoked"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListAPIKeysHandler lists the caller's API keys, newest first. Keys are
+// identified by id and prefix; the tokens themselves are never stored.
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(KeyUser).(int)
+
+	results, err := db.Repo.ListAPIKeys(r.Context(), userID)
+	if err != nil {
+		logging.Printf(r.Context(), "list api keys error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]APIKeyInfo, 0, len(results))
+	for _, k := range results {
+		keys = append(keys, APIKeyInfo{ID: k.ID, Name: k.Name, Prefix: k.Prefix, Revoked: k.Revoked, CreatedAt: k.CreatedAt})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		logging.Printf(r.Context(), "list api keys: encode response error: %v", err)
 	}
 }
 
+// RevokeAPIKeyHandler revokes the caller's API key with the given id. Keys
+// are revoked by id because prefixes aren't unique: every key issued before
+// prefixes were taken from the signature shares one.
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(KeyUser).(int)
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		http.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Repo.RevokeAPIKey(r.Context(), userID, keyID); err != nil {
+		httperr.Lookup(w, r, err, "API key")
+		return
+	}
+	invalidateRevocations()
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // UserInfoHandler returns details about the authenticated user
 func UserInfoHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(KeyUser).(int)
 	email, _, _, err := db.Repo.GetUserByID(context.Background(), userID)
 	if err != nil {
-		log.Printf("User not found : %v", err)
-		http.Error(w, "User not found", http.StatusNotFound)
+		httperr.Lookup(w, r, err, "User")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{"email": email}); err != nil {
-		log.Printf("user info: encode response error: %v", err)
+		logging.Printf(r.Context(), "user info: encode response error: %v", err)
 	}
 }
 
-func generateJWT(userID int, scope string, duration time.Duration) (string, error) {
+// generateJWT signs a token for the user. orgID is added as the org_id claim
+// when the user belongs to an organization.
+func generateJWT(userID int, orgID *int, scope string, duration time.Duration) (string, error) {
 	claims := jwt.MapClaims{
 		"sub":   userID,
 		"scope": scope,
 		"exp":   time.Now().Add(duration).Unix(),
 		"iat":   time.Now().Unix(),
 	}
+	if orgID != nil {
+		claims["org_id"] = *orgID
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
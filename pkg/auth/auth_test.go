@@ -2,13 +2,19 @@ package auth_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 	"tokentracer-proxy/pkg/auth"
 	"tokentracer-proxy/pkg/db"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/pashagolub/pgxmock/v4"
 )
 
@@ -25,11 +31,13 @@ func TestSignupHandler(t *testing.T) {
 	defer func() { db.Repo = originalRepo }()
 
 	t.Run("Success", func(t *testing.T) {
-		creds := auth.Credentials{Email: "test@example.com", Password: "password123"}
+		creds := auth.Credentials{Email: "test@example.com", Password: "correct horse battery"}
 		body, _ := json.Marshal(creds)
 		req := httptest.NewRequest("POST", "/signup", bytes.NewBuffer(body))
 		w := httptest.NewRecorder()
 
+		mock.ExpectQuery("SELECT id, password_hash FROM users").WithArgs("test@example.com").
+			WillReturnError(pgx.ErrNoRows)
 		// Expect INSERT
 		// Note: bcrypt generation is non-deterministic so we can't match exact arguments easily with simple regex,
 		// but we can match the SQL.
@@ -48,11 +56,13 @@ func TestSignupHandler(t *testing.T) {
 	})
 
 	t.Run("Duplicate User", func(t *testing.T) {
-		creds := auth.Credentials{Email: "existing@example.com", Password: "password123"}
+		creds := auth.Credentials{Email: "existing@example.com", Password: "correct horse battery"}
 		body, _ := json.Marshal(creds)
 		req := httptest.NewRequest("POST", "/signup", bytes.NewBuffer(body))
 		w := httptest.NewRecorder()
 
+		mock.ExpectQuery("SELECT id, password_hash FROM users").WithArgs("existing@example.com").
+			WillReturnError(pgx.ErrNoRows)
 		// Simulate error
 		mock.ExpectQuery("INSERT INTO users").
 			WithArgs("existing@example.com", pgxmock.AnyArg()).
@@ -64,6 +74,81 @@ func TestSignupHandler(t *testing.T) {
 			t.Errorf("expected status 409, got %d", w.Code)
 		}
 	})
+
+	t.Run("Normalized Email", func(t *testing.T) {
+		creds := auth.Credentials{Email: " Test@Example.COM ", Password: "correct horse battery"}
+		body, _ := json.Marshal(creds)
+		req := httptest.NewRequest("POST", "/signup", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+
+		mock.ExpectQuery("SELECT id, password_hash FROM users").WithArgs("test@example.com").
+			WillReturnError(pgx.ErrNoRows)
+		mock.ExpectQuery("INSERT INTO users").
+			WithArgs("test@example.com", pgxmock.AnyArg()).
+			WillReturnRows(mock.NewRows([]string{"id"}).AddRow(2))
+
+		auth.SignupHandler(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("expected status 201, got %d", w.Code)
+		}
+	})
+
+	t.Run("Legacy Mixed Case Email", func(t *testing.T) {
+		creds := auth.Credentials{Email: "legacy@example.com", Password: "correct horse battery"}
+		body, _ := json.Marshal(creds)
+		req := httptest.NewRequest("POST", "/signup", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+
+		// An account stored as Legacy@Example.com matches on lower(email),
+		// so nothing is inserted
+		mock.ExpectQuery("SELECT id, password_hash FROM users WHERE lower\\(email\\)").WithArgs("legacy@example.com").
+			WillReturnRows(mock.NewRows([]string{"id", "password_hash"}).AddRow(3, "hash"))
+
+		auth.SignupHandler(w, req)
+
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status 409, got %d", w.Code)
+		}
+	})
+
+	// Invalid emails and weak passwords are rejected before anything is stored
+	for _, tt := range []struct {
+		name     string
+		email    string
+		password string
+		wantMsg  string
+	}{
+		{name: "Missing Email", email: " ", password: "correct horse battery", wantMsg: "email is required"},
+		{name: "Invalid Email", email: "not-an-email", password: "correct horse battery", wantMsg: "email is not a valid address"},
+		{name: "Email With Name", email: "Test <test@example.com>", password: "correct horse battery", wantMsg: "email is not a valid address"},
+		{name: "Undotted Domain", email: "test@localhost", password: "correct horse battery", wantMsg: "email is not a valid address"},
+		{name: "Empty Password", password: "", wantMsg: "password is required"},
+		{name: "Short Password", password: "hunter2", wantMsg: "password must be at least 8 characters"},
+		{name: "Common Password", password: "Password123", wantMsg: "password is too common"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			email := tt.email
+			if email == "" {
+				email = "weak@example.com"
+			}
+			body, _ := json.Marshal(auth.Credentials{Email: email, Password: tt.password})
+			req := httptest.NewRequest("POST", "/signup", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+
+			auth.SignupHandler(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantMsg) {
+				t.Errorf("expected %q in the response, got %q", tt.wantMsg, w.Body.String())
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 }
 
 // Simple internal mock error to satisfy error interface
@@ -87,3 +172,98 @@ func TestLoginHandler(t *testing.T) {
     // ... expect query select ... return hash ...
 }
 */
+
+func TestLoginHandler_NormalizesEmail(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	originalRepo := db.Repo
+	db.Repo = db.NewPostgresRepository(mock)
+	defer func() { db.Repo = originalRepo }()
+
+	// The lookup uses the normalized address; an unknown user is a 401
+	mock.ExpectQuery("SELECT id, password_hash FROM users").
+		WithArgs("test@example.com").
+		WillReturnError(pdMockError{msg: "no rows in result set"})
+
+	body, _ := json.Marshal(auth.Credentials{Email: "Test@Example.com ", Password: "correct horse battery"})
+	w := httptest.NewRecorder()
+	auth.LoginHandler(w, httptest.NewRequest("POST", "/login", bytes.NewBuffer(body)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+
+	body, _ = json.Marshal(auth.Credentials{Email: "test@", Password: "correct horse battery"})
+	w = httptest.NewRecorder()
+	auth.LoginHandler(w, httptest.NewRequest("POST", "/login", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid email, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIKeyHashing(t *testing.T) {
+	token := "eyJhbGciOiJIUzI1NiJ9.test-token"
+	stored := auth.HashAPIKey(token)
+
+	if !auth.VerifyAPIKeyHash(token, stored) {
+		t.Errorf("Expected token to verify against its own hash")
+	}
+	if auth.VerifyAPIKeyHash("other-token", stored) {
+		t.Errorf("Expected a different token not to verify")
+	}
+
+	// Legacy plain SHA-256 hashes keep working during the transition
+	legacy := sha256.Sum256([]byte(token))
+	legacyHash := hex.EncodeToString(legacy[:])
+	if !auth.VerifyAPIKeyHash(token, legacyHash) {
+		t.Errorf("Expected token to verify against its legacy hash")
+	}
+}
+
+func TestListAPIKeysHandler(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT id, name, prefix, revoked, created_at FROM api_keys").
+		WithArgs(4).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "prefix", "revoked", "created_at"}).
+			AddRow(12, "api-key-2", "b2c3d4e5", false, created).
+			AddRow(11, "api-key-1", "a1b2c3d4", true, created.Add(-time.Hour)))
+
+	req := httptest.NewRequest("GET", "/auth/key", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, 4))
+	w := httptest.NewRecorder()
+	auth.ListAPIKeysHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var keys []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0]["id"] != float64(12) || keys[0]["prefix"] != "b2c3d4e5" || keys[1]["revoked"] != true {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	for field := range keys[0] {
+		if field != "id" && field != "name" && field != "prefix" && field != "revoked" && field != "created_at" {
+			t.Errorf("Unexpected field %q in the listing", field)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
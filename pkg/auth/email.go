@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// maxEmailLength is the size of users.email.
+const maxEmailLength = 255
+
+// normalizeEmail trims and lowercases email, so the same address always maps
+// to the same user, and rejects anything that isn't a bare address with a
+// dotted domain.
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", errors.New("email is required")
+	}
+	if len(email) > maxEmailLength {
+		return "", errors.New("email is too long")
+	}
+	// ParseAddress also accepts display names and comments; only the bare
+	// address is allowed
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", errors.New("email is not a valid address")
+	}
+	at := strings.LastIndexByte(email, '@')
+	if domain := email[at+1:]; !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", errors.New("email is not a valid address")
+	}
+	return email, nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -14,8 +16,17 @@ type ContextKey string
 const (
 	KeyUser  ContextKey = "user_id"
 	KeyScope ContextKey = "scope"
+	// KeyOrg is only set for tokens with an org_id claim
+	KeyOrg ContextKey = "org_id"
 )
 
+// OrgID returns the organization of the authenticated request. ok is false
+// when the token carries no org_id, e.g. in single-user deployments.
+func OrgID(ctx context.Context) (int, bool) {
+	orgID, ok := ctx.Value(KeyOrg).(int)
+	return orgID, ok
+}
+
 // AuthMiddleware verifies the JWT token
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -33,41 +44,137 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 		tokenString := parts[1]
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseToken(tokenString)
+		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
-
 		// Add claims to context (use safe type assertions to avoid panics)
-		subClaim, ok := claims["sub"].(float64)
+		userID, scope, ok := tokenSubject(claims)
 		if !ok {
 			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
 			return
 		}
-		userID := int(subClaim)
 
-		scope, ok := claims["scope"].(string)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
+		if scope == ScopeAPIKey {
+			revoked, err := apiKeyRevoked(r.Context(), userID, tokenString)
+			if err != nil {
+				logging.Printf(r.Context(), "auth middleware: revocation check error for user %d: %v", userID, err)
+				http.Error(w, "Authentication failed", http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				http.Error(w, "API key revoked", http.StatusUnauthorized)
+				return
+			}
 		}
 
+		logging.SetUser(r.Context(), userID)
 		ctx := context.WithValue(r.Context(), KeyUser, userID)
 		ctx = context.WithValue(ctx, KeyScope, scope)
 
+		// org_id is optional, but must be a number when present
+		if rawOrg, present := claims["org_id"]; present {
+			orgClaim, ok := rawOrg.(float64)
+			if !ok {
+				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+				return
+			}
+			ctx = context.WithValue(ctx, KeyOrg, int(orgClaim))
+		}
+
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// parseToken verifies a JWT's signature and expiry and returns its claims.
+func parseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+	return claims, nil
+}
+
+// tokenSubject returns the user and scope claims; ok is false when either is
+// missing or of the wrong type.
+func tokenSubject(claims jwt.MapClaims) (userID int, scope string, ok bool) {
+	subClaim, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, "", false
+	}
+	scope, ok = claims["scope"].(string)
+	if !ok {
+		return 0, "", false
+	}
+	return int(subClaim), scope, true
+}
+
+// Token scopes: session tokens come from login and are for the dashboard
+// and management API, api_key tokens from /auth/key are for the proxy.
+const (
+	ScopeSession = "session"
+	ScopeAPIKey  = "api_key"
+)
+
+// RequireScope rejects requests whose token scope, as set in KeyScope by
+// AuthMiddleware, is not scope. It must run after AuthMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ := r.Context().Value(KeyScope).(string)
+			if got != scope {
+				http.Error(w, fmt.Sprintf("This endpoint requires a %s token, got a %s token", scopeName(scope), scopeName(got)), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// scopeName describes a scope in error messages
+func scopeName(scope string) string {
+	switch scope {
+	case ScopeSession:
+		return "session"
+	case ScopeAPIKey:
+		return "API key"
+	case "":
+		return "unscoped"
+	default:
+		return fmt.Sprintf("%q", scope)
+	}
+}
+
+// AdminMiddleware rejects requests from users without the is_admin flag.
+// It must run after AuthMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(KeyUser).(int)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		isAdmin, err := db.Repo.IsAdmin(r.Context(), userID)
+		if err != nil || !isAdmin {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestAuthMiddleware_OrgClaim(t *testing.T) {
+	orig := jwtSecret
+	jwtSecret = []byte("test-secret")
+	defer func() { jwtSecret = orig }()
+
+	orgID := 12
+	tests := []struct {
+		name    string
+		orgID   *int
+		wantOrg bool
+	}{
+		{name: "with org", orgID: &orgID, wantOrg: true},
+		{name: "without org", orgID: nil, wantOrg: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := generateJWT(3, tt.orgID, "session", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotOrg int
+			var gotOK bool
+			h := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotOrg, gotOK = OrgID(r.Context())
+			}))
+			req := httptest.NewRequest("GET", "/auth/me", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if gotOK != tt.wantOrg || (tt.wantOrg && gotOrg != orgID) {
+				t.Errorf("Expected org (%d, %v), got (%d, %v)", orgID, tt.wantOrg, gotOrg, gotOK)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware_RevokedAPIKey(t *testing.T) {
+	orig := jwtSecret
+	jwtSecret = []byte("test-secret")
+	defer func() { jwtSecret = orig }()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+	defer invalidateRevocations()
+
+	token, err := generateJWT(4, nil, "api_key", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func() int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A legacy key sharing the prefix is passed over for the token's own
+	mock.ExpectQuery("SELECT key_hash, revoked FROM api_keys").
+		WithArgs(4, keyPrefixes(token)).
+		WillReturnRows(mock.NewRows([]string{"key_hash", "revoked"}).
+			AddRow(HashAPIKey("eyJhbGci.other.key"), true).
+			AddRow(HashAPIKey(token), false))
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("Expected status 200 for a live key, got %d", code)
+	}
+	// Cached, so no second query
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("Expected status 200 from the cache, got %d", code)
+	}
+
+	mock.ExpectExec("UPDATE api_keys SET revoked = TRUE WHERE user_id = \\$1 AND id = \\$2").
+		WithArgs(4, 12).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	r := chi.NewRouter()
+	r.Delete("/auth/key/{keyID}", RevokeAPIKeyHandler)
+	req := httptest.NewRequest("DELETE", "/auth/key/12", nil)
+	req = req.WithContext(context.WithValue(req.Context(), KeyUser, 4))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204 from revoke, got %d", w.Code)
+	}
+
+	mock.ExpectQuery("SELECT key_hash, revoked FROM api_keys").
+		WithArgs(4, keyPrefixes(token)).
+		WillReturnRows(mock.NewRows([]string{"key_hash", "revoked"}).AddRow(HashAPIKey(token), true))
+	if code := do(); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a revoked key, got %d", code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// TestAPIKeyRevoked_Unknown checks a token matching none of the user's stored
+// hashes is treated as revoked.
+func TestAPIKeyRevoked_Unknown(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+	defer invalidateRevocations()
+
+	token := "eyJhbGciOiJIUzI1NiJ9.e30.unknownsig"
+	mock.ExpectQuery("SELECT key_hash, revoked FROM api_keys").
+		WithArgs(5, []string{"unknowns", "eyJhbGci"}).
+		WillReturnRows(mock.NewRows([]string{"key_hash", "revoked"}).AddRow(HashAPIKey("eyJhbGci.other.key"), false))
+
+	revoked, err := apiKeyRevoked(context.Background(), 5, token)
+	if err != nil || !revoked {
+		t.Errorf("Expected an unknown key to count as revoked, got %v, %v", revoked, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	orig := jwtSecret
+	jwtSecret = []byte("test-secret")
+	defer func() { jwtSecret = orig }()
+
+	token, err := generateJWT(3, nil, ScopeSession, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		scope    string
+		wantCode int
+	}{
+		{name: "matching scope", scope: ScopeSession, wantCode: http.StatusOK},
+		{name: "session token on the proxy", scope: ScopeAPIKey, wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := AuthMiddleware(RequireScope(tt.scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestLoadTTLs(t *testing.T) {
+	defer func(s, k time.Duration) { sessionTTL, apiKeyTTL = s, k }(sessionTTL, apiKeyTTL)
+
+	t.Setenv("SESSION_TOKEN_TTL", "8h")
+	t.Setenv("API_KEY_TTL", "")
+	if err := loadTTLs(); err != nil {
+		t.Fatalf("loadTTLs: %v", err)
+	}
+	if sessionTTL != 8*time.Hour || apiKeyTTL != 365*24*time.Hour {
+		t.Errorf("Expected 8h sessions and the default key lifetime, got %s and %s", sessionTTL, apiKeyTTL)
+	}
+
+	for _, v := range []string{"90d", "-1h", "0s"} {
+		t.Setenv("API_KEY_TTL", v)
+		if err := loadTTLs(); err == nil {
+			t.Errorf("Expected API_KEY_TTL=%q to be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// minPasswordLength follows NIST SP 800-63B's minimum for user-chosen
+	// passwords.
+	minPasswordLength = 8
+	// maxPasswordBytes is as much as bcrypt hashes; longer passwords are
+	// rejected by bcrypt.GenerateFromPassword.
+	maxPasswordBytes = 72
+)
+
+// commonPasswords are among the most used passwords in public breach
+// corpora, long enough to pass the length check. Compared case-insensitively.
+var commonPasswords = map[string]bool{
+	"password":    true,
+	"password1":   true,
+	"password12":  true,
+	"password123": true,
+	"passw0rd":    true,
+	"p@ssw0rd":    true,
+	"12345678":    true,
+	"123456789":   true,
+	"1234567890":  true,
+	"87654321":    true,
+	"11111111":    true,
+	"00000000":    true,
+	"qwertyui":    true,
+	"qwerty123":   true,
+	"qwertyuiop":  true,
+	"1q2w3e4r":    true,
+	"1qaz2wsx":    true,
+	"asdfghjk":    true,
+	"zaq12wsx":    true,
+	"abcd1234":    true,
+	"abc12345":    true,
+	"iloveyou":    true,
+	"sunshine":    true,
+	"princess":    true,
+	"football":    true,
+	"baseball":    true,
+	"superman":    true,
+	"trustno1":    true,
+	"welcome1":    true,
+	"letmein1":    true,
+	"changeme":    true,
+	"starwars":    true,
+	"whatever":    true,
+	"computer":    true,
+	"michelle":    true,
+	"jennifer":    true,
+	"corvette":    true,
+	"mercedes":    true,
+	"admin123":    true,
+}
+
+// validatePassword checks a new password against the strength rules and
+// returns the first one it fails.
+func validatePassword(password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		return errors.New("password is too common")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// refreshTokenTTL is how long a refresh token can be exchanged
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshHandler issues a fresh session token. It takes either a refresh
+// token in the body, which is used up and replaced by a new one, or a valid,
+// unexpired session token in the Authorization header.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		httperr.BadBody(w, err, "Invalid request")
+		return
+	}
+
+	var userID int
+	if req.RefreshToken != "" {
+		id, err := db.Repo.ConsumeRefreshToken(r.Context(), hashRefreshToken(req.RefreshToken))
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logging.Printf(r.Context(), "refresh: consume refresh token error: %v", err)
+			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+			return
+		}
+		userID = id
+	} else {
+		tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "Missing refresh_token or Authorization header", http.StatusUnauthorized)
+			return
+		}
+		claims, err := parseToken(tokenString)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		id, scope, ok := tokenSubject(claims)
+		if !ok {
+			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+			return
+		}
+		if scope != ScopeSession {
+			http.Error(w, "Only session tokens can be refreshed", http.StatusForbidden)
+			return
+		}
+		userID = id
+	}
+
+	orgID, err := db.Repo.GetUserOrgID(r.Context(), userID)
+	if err != nil {
+		logging.Printf(r.Context(), "refresh: get org for user %d error: %v", userID, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	token, err := generateJWT(userID, orgID, ScopeSession, sessionTTL)
+	if err != nil {
+		logging.Printf(r.Context(), "refresh: generate token error: %v", err)
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	resp := AuthResponse{Token: token}
+	if req.RefreshToken != "" {
+		resp.RefreshToken, err = issueRefreshToken(r.Context(), userID)
+		if err != nil {
+			logging.Printf(r.Context(), "refresh: create refresh token for user %d error: %v", userID, err)
+			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Printf(r.Context(), "refresh: encode response error: %v", err)
+	}
+}
+
+// issueRefreshToken creates a random refresh token for the user and stores
+// its hash.
+func issueRefreshToken(ctx context.Context, userID int) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := db.Repo.CreateRefreshToken(ctx, userID, hashRefreshToken(token), time.Now().Add(refreshTokenTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// hashRefreshToken returns the stored form of a refresh token. The tokens
+// are random, so a plain SHA-256 digest is enough.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestRefreshHandler(t *testing.T) {
+	orig := jwtSecret
+	jwtSecret = []byte("test-secret")
+	defer func() { jwtSecret = orig }()
+
+	session, _ := generateJWT(3, nil, ScopeSession, time.Hour)
+	apiKey, _ := generateJWT(3, nil, ScopeAPIKey, time.Hour)
+	expired, _ := generateJWT(3, nil, ScopeSession, -time.Minute)
+
+	tests := []struct {
+		name        string
+		bearer      string
+		body        string
+		expect      func(mock pgxmock.PgxPoolIface)
+		wantCode    int
+		wantRefresh bool
+	}{
+		{
+			name:   "session token",
+			bearer: session,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT org_id FROM users").WithArgs(3).
+					WillReturnRows(mock.NewRows([]string{"org_id"}).AddRow(nil))
+			},
+			wantCode: http.StatusOK,
+		},
+		{name: "api key", bearer: apiKey, wantCode: http.StatusForbidden},
+		{name: "expired session token", bearer: expired, wantCode: http.StatusUnauthorized},
+		{name: "no credentials", wantCode: http.StatusUnauthorized},
+		{
+			name: "refresh token",
+			body: `{"refresh_token": "abc"}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("DELETE FROM refresh_tokens").WithArgs(hashRefreshToken("abc")).
+					WillReturnRows(mock.NewRows([]string{"user_id"}).AddRow(3))
+				mock.ExpectQuery("SELECT org_id FROM users").WithArgs(3).
+					WillReturnRows(mock.NewRows([]string{"org_id"}).AddRow(nil))
+				mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(3, pgxmock.AnyArg(), pgxmock.AnyArg()).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+			wantCode:    http.StatusOK,
+			wantRefresh: true,
+		},
+		{
+			name: "used refresh token",
+			body: `{"refresh_token": "abc"}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("DELETE FROM refresh_tokens").WithArgs(hashRefreshToken("abc")).
+					WillReturnError(pgx.ErrNoRows)
+			},
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+
+			req := httptest.NewRequest("POST", "/auth/refresh", strings.NewReader(tt.body))
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			RefreshHandler(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.wantCode == http.StatusOK {
+				var resp AuthResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				claims, err := parseToken(resp.Token)
+				if err != nil || claims["scope"] != ScopeSession {
+					t.Errorf("Expected a valid session token, got %v (%v)", claims, err)
+				}
+				if (resp.RefreshToken != "") != tt.wantRefresh {
+					t.Errorf("Expected a new refresh token: %v, got %q", tt.wantRefresh, resp.RefreshToken)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// String returns the environment variable key, or fallback when unset.
+func String(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Int parses the environment variable key as an integer, returning fallback
+// when it is unset or invalid.
+func Int(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logging.Printf(context.Background(), "config: invalid integer for %s=%q, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Float parses the environment variable key as a float. The boolean is false
+// when it is unset or invalid.
+func Float(key string) (float64, bool) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		logging.Printf(context.Background(), "config: invalid number for %s=%q, ignoring", key, v)
+		return 0, false
+	}
+	return f, true
+}
+
+// Bool parses the environment variable key as a boolean, returning fallback
+// when it is unset or invalid.
+func Bool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logging.Printf(context.Background(), "config: invalid boolean for %s=%q, using %t", key, v, fallback)
+		return fallback
+	}
+	return b
+}
+
+// Duration parses the environment variable key with time.ParseDuration,
+// returning fallback when it is unset or invalid.
+func Duration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logging.Printf(context.Background(), "config: invalid duration for %s=%q, using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// List splits a comma-separated environment variable into trimmed, non-empty values.
+func List(key string) []string {
+	var out []string
+	for _, part := range strings.Split(os.Getenv(key), ",") {
+		if p := strings.TrimSpace(part); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+// Package cors lets browser apps on other origins call the API. Origins are
+// allowed with CORS_ALLOWED_ORIGINS; with none set, only same-origin pages,
+// such as the bundled dashboard, can make requests.
+package cors
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"tokentracer-proxy/pkg/config"
+)
+
+var (
+	// allowedOrigins are the origins that may make cross-origin requests,
+	// e.g. https://app.example.com; "*" allows any origin.
+	allowedOrigins = config.List("CORS_ALLOWED_ORIGINS")
+	allowedMethods = config.String("CORS_ALLOWED_METHODS", "GET, POST, PUT, PATCH, DELETE")
+	maxAge         = config.Duration("CORS_MAX_AGE", 10*time.Minute)
+)
+
+// allowedHeaders are the request headers clients need: the bearer token and
+// JSON bodies, a request ID to correlate logs, X-Fallback to pick a fallback
+// alias, and the Anthropic version headers the native Messages API reads.
+const allowedHeaders = "Authorization, Content-Type, X-Request-ID, X-Fallback, anthropic-version, anthropic-beta"
+
+// exposedHeaders are the response headers scripts may read.
+const exposedHeaders = "X-Request-ID, X-Cache, X-Fallback, X-Fallback-Chain, X-Usage-Estimated, " +
+	"X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, " +
+	"X-RateLimit-Pending-Limit-Minute, X-RateLimit-Pending-Limit-Daily, X-RateLimit-Pending-Effective-At, " +
+	"X-Quota-Limit-Tokens, X-Quota-Remaining-Tokens, " +
+	"X-Upstream-RateLimit-Remaining, X-Upstream-RateLimit-Remaining-Requests"
+
+// Middleware sets the CORS headers for requests from allowed origins and
+// answers their preflight OPTIONS requests itself, before authentication.
+// Requests from other origins get no CORS headers, so browsers block them.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(allowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+		if !allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", exposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", allowedMethods)
+		h.Set("Access-Control-Allow-Headers", allowedHeaders)
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// allowed reports whether origin may make cross-origin requests.
+func allowed(origin string) bool {
+	return slices.Contains(allowedOrigins, "*") || slices.ContainsFunc(allowedOrigins, func(o string) bool {
+		return strings.EqualFold(o, origin)
+	})
+}
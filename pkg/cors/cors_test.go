@@ -0,0 +1,71 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	defer func(o []string) { allowedOrigins = o }(allowedOrigins)
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name       string
+		origins    []string
+		method     string
+		origin     string
+		wantCode   int
+		wantOrigin string
+	}{
+		{name: "same-origin by default", method: "POST", origin: "https://app.example.com", wantCode: http.StatusTeapot},
+		{name: "allowed origin", origins: []string{"https://app.example.com"}, method: "POST", origin: "https://app.example.com", wantCode: http.StatusTeapot, wantOrigin: "https://app.example.com"},
+		{name: "other origin", origins: []string{"https://app.example.com"}, method: "POST", origin: "https://evil.example.com", wantCode: http.StatusTeapot},
+		{name: "any origin", origins: []string{"*"}, method: "GET", origin: "https://evil.example.com", wantCode: http.StatusTeapot, wantOrigin: "https://evil.example.com"},
+		// Preflights are answered without reaching the handler
+		{name: "preflight", origins: []string{"https://app.example.com"}, method: "OPTIONS", origin: "https://app.example.com", wantCode: http.StatusNoContent, wantOrigin: "https://app.example.com"},
+		{name: "disallowed preflight", origins: []string{"https://app.example.com"}, method: "OPTIONS", origin: "https://evil.example.com", wantCode: http.StatusTeapot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedOrigins = tt.origins
+			req := httptest.NewRequest(tt.method, "/v1/chat/completions", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method == "OPTIONS" {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tt.wantOrigin, got)
+			}
+			if tt.wantCode == http.StatusNoContent && w.Header().Get("Access-Control-Allow-Headers") != allowedHeaders {
+				t.Errorf("Expected the allowed headers on a preflight, got %q", w.Header().Get("Access-Control-Allow-Headers"))
+			}
+		})
+	}
+}
+
+// TestHeaderLists guards against the lists falling behind headers the proxy
+// reads from clients or sets on responses.
+func TestHeaderLists(t *testing.T) {
+	for _, h := range []string{"X-Fallback", "anthropic-version", "anthropic-beta"} {
+		if !strings.Contains(allowedHeaders, h) {
+			t.Errorf("Expected %s in the allowed headers", h)
+		}
+	}
+	for _, h := range []string{"X-RateLimit-Pending-Limit-Minute", "X-RateLimit-Pending-Limit-Daily", "X-RateLimit-Pending-Effective-At"} {
+		if !strings.Contains(exposedHeaders, h) {
+			t.Errorf("Expected %s in the exposed headers", h)
+		}
+	}
+}
@@ -11,16 +11,36 @@ import (
 	"os"
 )
 
-var encryptionKey []byte
+var (
+	encryptionKey []byte
+	// previousKey still decrypts values encrypted before a key rotation;
+	// nil when there is none
+	previousKey []byte
+)
 
-// Init derives a 32-byte AES key from the ENCRYPTION_KEY environment variable.
+// Init derives a 32-byte AES key from the ENCRYPTION_KEY environment
+// variable, and the key being rotated away from, if any, from
+// ENCRYPTION_KEY_OLD.
 func Init() {
 	raw := os.Getenv("ENCRYPTION_KEY")
 	if raw == "" {
 		panic("ENCRYPTION_KEY environment variable is required")
 	}
+	encryptionKey = deriveKey(raw)
+	previousKey = nil
+	if old := os.Getenv("ENCRYPTION_KEY_OLD"); old != "" && old != raw {
+		previousKey = deriveKey(old)
+	}
+}
+
+func deriveKey(raw string) []byte {
 	hash := sha256.Sum256([]byte(raw))
-	encryptionKey = hash[:]
+	return hash[:]
+}
+
+// Initialized reports whether Init has set up the encryption key.
+func Initialized() bool {
+	return len(encryptionKey) > 0
 }
 
 // Encrypt encrypts plaintext using AES-256-GCM and returns a base64-encoded ciphertext.
@@ -44,14 +64,36 @@ func Encrypt(plaintext string) (string, error) {
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-// Decrypt decodes a base64-encoded ciphertext and decrypts it using AES-256-GCM.
+// Decrypt decodes a base64-encoded ciphertext and decrypts it using AES-256-GCM,
+// with the current key or, failing that, the previous one.
 func Decrypt(encoded string) (string, error) {
 	data, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return "", fmt.Errorf("base64 decode: %w", err)
 	}
 
-	block, err := aes.NewCipher(encryptionKey)
+	plaintext, err := open(encryptionKey, data)
+	if err != nil && previousKey != nil {
+		if old, oldErr := open(previousKey, data); oldErr == nil {
+			return old, nil
+		}
+	}
+	return plaintext, err
+}
+
+// Reencrypt decrypts encoded with either key and encrypts it again with the
+// current one.
+func Reencrypt(encoded string) (string, error) {
+	plaintext, err := Decrypt(encoded)
+	if err != nil {
+		return "", err
+	}
+	return Encrypt(plaintext)
+}
+
+// open decrypts data, the nonce followed by the ciphertext, with key.
+func open(key, data []byte) (string, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", fmt.Errorf("create cipher: %w", err)
 	}
@@ -0,0 +1,36 @@
+package crypto
+
+import "testing"
+
+func TestDecrypt_PreviousKey(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "old-key")
+	t.Setenv("ENCRYPTION_KEY_OLD", "")
+	Init()
+	legacy, err := Encrypt("sk-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new key alone can't read values encrypted with the old one
+	t.Setenv("ENCRYPTION_KEY", "new-key")
+	Init()
+	if _, err := Decrypt(legacy); err == nil {
+		t.Fatal("Expected decrypting with the wrong key to fail")
+	}
+
+	t.Setenv("ENCRYPTION_KEY_OLD", "old-key")
+	Init()
+	if got, err := Decrypt(legacy); err != nil || got != "sk-secret" {
+		t.Fatalf("Expected the previous key to decrypt, got %q, %v", got, err)
+	}
+
+	rotated, err := Reencrypt(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENCRYPTION_KEY_OLD", "")
+	Init()
+	if got, err := Decrypt(rotated); err != nil || got != "sk-secret" {
+		t.Errorf("Expected the re-encrypted value to decrypt with the new key alone, got %q, %v", got, err)
+	}
+}
@@ -3,8 +3,10 @@ package db
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"tokentracer-proxy/pkg/config"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -29,13 +31,13 @@ func InitDB() error {
 		return fmt.Errorf("DATABASE_URL environment variable is required")
 	}
 
-	if !strings.HasSuffix(dbURL, "/tokentracer") {
-		dbURL += "/tokentracer"
+	poolConfig, err := newPoolConfig(dbURL, config.String("DB_NAME", "tokentracer"), config.String("DB_SCHEMA", ""))
+	if err != nil {
+		return fmt.Errorf("invalid DATABASE_URL: %v", err)
 	}
 
-	var err error
 	var realPool *pgxpool.Pool
-	realPool, err = pgxpool.New(context.Background(), dbURL)
+	realPool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		return fmt.Errorf("unable to connect to database: %v", err)
 	}
@@ -45,6 +47,47 @@ func InitDB() error {
 	return nil
 }
 
+// newPoolConfig parses dbURL, defaulting the database to dbName. A non-empty
+// schema isolates environments sharing one database: it is set as the
+// search_path, so all of the repository's unqualified table names resolve
+// within it. Schemas take the place of a table prefix, which would mean
+// qualifying every query.
+func newPoolConfig(dbURL, dbName, schema string) (*pgxpool.Config, error) {
+	dbURL, err := withDefaultDatabase(dbURL, dbName)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if schema != "" {
+		poolConfig.ConnConfig.RuntimeParams["search_path"] = pgx.Identifier{schema}.Sanitize()
+	}
+	return poolConfig, nil
+}
+
+// withDefaultDatabase sets the database name on a connection string that
+// doesn't already name one. URLs keep their query parameters (e.g. sslmode);
+// keyword/value strings get a dbname added.
+func withDefaultDatabase(dbURL, dbName string) (string, error) {
+	if !strings.HasPrefix(dbURL, "postgres://") && !strings.HasPrefix(dbURL, "postgresql://") {
+		if strings.Contains(dbURL, "dbname=") {
+			return dbURL, nil
+		}
+		return strings.TrimSpace(dbURL + " dbname=" + dbName), nil
+	}
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/" + dbName
+	}
+	return u.String(), nil
+}
+
 func CloseDB() {
 	if Pool != nil {
 		Pool.Close()
@@ -0,0 +1,23 @@
+// Package dbtest builds pgxmock fixtures for the repository's rows, so tests
+// don't each spell out the column lists.
+package dbtest
+
+import (
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// aliasColumns are the columns the repository reads for a model alias, in
+// order. A new alias column is added here and in AliasRows.
+var aliasColumns = []string{"id", "alias", "target_model", "provider_key_id", "fallback_alias_id", "use_light_model", "light_model_threshold", "light_model", "max_temperature", "fallback_on_statuses", "weighted_targets", "native_passthrough", "cache_ttl_seconds", "is_pattern", "disabled", "flagged_reason", "response_format_fallback", "max_messages", "system_prompt_override"}
+
+// AliasRows returns model_aliases rows for aliases, in order. With none, it
+// returns an empty result.
+func AliasRows(mock pgxmock.PgxCommonIface, aliases ...db.ModelAlias) *pgxmock.Rows {
+	rows := mock.NewRows(aliasColumns)
+	for _, a := range aliases {
+		rows.AddRow(a.ID, a.Alias, a.TargetModel, a.ProviderKeyID, a.FallbackAliasID, a.UseLightModel, a.LightModelThreshold, a.LightModel, a.MaxTemperature, a.FallbackOnStatuses, a.WeightedTargets, a.NativePassthrough, a.CacheTTLSeconds, a.IsPattern, a.Disabled, a.FlaggedReason, a.ResponseFormatFallback, a.MaxMessages, a.SystemPromptOverride)
+	}
+	return rows
+}
@@ -2,8 +2,13 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 // ModelAlias represents a routing rule in the database
@@ -17,6 +22,40 @@ type ModelAlias struct {
 	UseLightModel       bool
 	LightModelThreshold int
 	LightModel          *string
+	MaxTemperature      *float64
+	FallbackOnStatuses  []int
+	WeightedTargets     []WeightedTarget
+	NativePassthrough   bool
+	// CacheTTLSeconds overrides the response cache TTL; 0 disables caching,
+	// nil uses the server default.
+	CacheTTLSeconds *int
+	// IsPattern makes Alias a glob, where * matches any run of characters,
+	// used for requested models that have no exact alias.
+	IsPattern bool
+	// Disabled aliases are not routed to; FlaggedReason says why the model
+	// poll flagged the alias, nil when it is healthy.
+	Disabled      bool
+	FlaggedReason *string
+	// ResponseFormatFallback opts in to downgrading response_format to a
+	// system prompt instruction when the target model can't honour it.
+	ResponseFormatFallback bool
+	// MaxMessages rejects conversations longer than this many messages; nil
+	// means no limit.
+	MaxMessages *int
+	// SystemPromptOverride is sent as a system message ahead of the client's
+	// messages; nil means none.
+	SystemPromptOverride *string
+}
+
+// ModelPlaceholder in a pattern alias's target is replaced with the model
+// the client requested.
+const ModelPlaceholder = "{model}"
+
+// WeightedTarget is one of an alias's canary targets, chosen with
+// probability weight / sum(weights)
+type WeightedTarget struct {
+	Model  string `json:"model"`
+	Weight int    `json:"weight"`
 }
 
 // ProviderKey represents a downstream provider's key
@@ -26,9 +65,27 @@ type ProviderKey struct {
 	Provider     string
 	EncryptedKey string
 	Label        string
+	BaseURL      *string
 	CreatedAt    time.Time
 }
 
+// APIKey is an issued API key as listed to its owner. Neither the token nor
+// its hash is loaded.
+type APIKey struct {
+	ID        int
+	Name      string
+	Prefix    string
+	Revoked   bool
+	CreatedAt time.Time
+}
+
+// APIKeyHash is the stored hash of an issued API key, for checking a
+// presented token against.
+type APIKeyHash struct {
+	Hash    string
+	Revoked bool
+}
+
 // RequestLog represents a logged request
 type RequestLog struct {
 	UserID       int
@@ -37,7 +94,68 @@ type RequestLog struct {
 	ModelUsed    string
 	InputTokens  int
 	OutputTokens int
-	StatusCode   int
+	// EstimatedInputTokens is the proxy's own estimate, nil when not computed
+	EstimatedInputTokens *int
+	StatusCode           int
+	// Endpoint is the proxy endpoint that served the request, one of the
+	// Endpoint* constants
+	Endpoint string
+	// EstimatedCost is in US dollars, nil when the model has no price
+	EstimatedCost *float64
+	// ResponseID is the id the client got; UpstreamResponseID is the
+	// provider's, set only when the two differ. Empty is stored as NULL.
+	ResponseID         string
+	UpstreamResponseID string
+	// LatencyMS is how long the upstream call took, nil when not measured
+	LatencyMS *int
+	// Error says why a failed request failed; empty is stored as NULL
+	Error string
+	// CacheHit is set when the response came from the response cache
+	CacheHit bool
+	// UsageEstimated is set when the provider reported no usage and the
+	// token counts are the proxy's estimate
+	UsageEstimated bool
+}
+
+// Endpoints recorded in request logs
+const (
+	EndpointChatCompletions = "chat_completions"
+	EndpointMessages        = "messages"
+	EndpointModerations     = "moderations"
+)
+
+// FailedRequest represents a request that failed after all fallbacks
+type FailedRequest struct {
+	ID               int
+	UserID           int
+	RequestedModel   string
+	AttemptedAliases []string
+	StatusCode       int
+	Error            string
+	RequestBody      *string
+	CreatedAt        time.Time
+}
+
+// AuditEntry records one mutating call to the management or auth API
+type AuditEntry struct {
+	ID         int
+	UserID     *int
+	Action     string
+	Target     string
+	StatusCode int
+	SourceIP   string
+	Details    []byte
+	CreatedAt  time.Time
+}
+
+// StoredResponse is a completion persisted for a request sent with store: true
+type StoredResponse struct {
+	ID        string
+	UserID    int
+	Model     string
+	Metadata  map[string]string
+	Response  []byte // JSON-encoded OpenAIResponse
+	CreatedAt time.Time
 }
 
 // UsageStats represents aggregated usage data
@@ -47,39 +165,124 @@ type UsageStats struct {
 	Input    int
 	Output   int
 	Reqs     int
+	// Cost is the estimated cost in US dollars of the priced requests;
+	// UnpricedModels lists the models used that have no price.
+	Cost           float64
+	UnpricedModels []string
+	// AvgLatencyMS and P95LatencyMS are over the requests with a recorded
+	// latency, nil when there are none.
+	AvgLatencyMS *float64
+	P95LatencyMS *float64
+	// Successes counts the requests answered without an error status
+	Successes int
+}
+
+// UsageTotals represents request and token totals over a period
+type UsageTotals struct {
+	Reqs   int
+	Input  int
+	Output int
+}
+
+// UsageBucket holds the totals for one period of a usage time series
+type UsageBucket struct {
+	Start time.Time
+	UsageTotals
+}
+
+// timeSeriesBuckets is how many buckets GetUsageTimeSeries returns per
+// granularity, ending with the current one.
+var timeSeriesBuckets = map[string]int{
+	"hour": 48,
+	"day":  30,
+	"week": 12,
+}
+
+// ErrInvalidGranularity is returned by GetUsageTimeSeries for a granularity
+// other than hour, day or week.
+var ErrInvalidGranularity = errors.New("invalid granularity")
+
+// ProviderErrorRate represents how often requests to a provider failed
+type ProviderErrorRate struct {
+	Provider string
+	Reqs     int
+	Errors   int
 }
 
 // Repository defines the interface for all database operations
 type Repository interface {
+	// Ping checks the database is reachable
+	Ping(ctx context.Context) error
+
 	// Auth & Users
 	CreateUser(ctx context.Context, email, passwordHash string) (int, error)
 	GetUserByEmail(ctx context.Context, email string) (int, string, error)
 	GetUserByID(ctx context.Context, userID int) (email string, rateLimitMinute, rateLimitDaily int, err error)
+	GetUserOrgID(ctx context.Context, userID int) (*int, error)
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+	GetUserFeatures(ctx context.Context, userID int) (map[string]bool, error)
+	SetUserFeatures(ctx context.Context, userID int, features map[string]bool) error
+	GetUserParamPolicy(ctx context.Context, userID int) (*string, error)
+	SetUserParamPolicy(ctx context.Context, userID int, policy *string) error
+	SetUserRateLimits(ctx context.Context, userID, minute, daily int, graceUntil *time.Time) error
 
 	// API Keys
 	CreateAPIKey(ctx context.Context, userID int, name, keyHash, prefix string) error
+	ListAPIKeyHashes(ctx context.Context, userID int, prefixes []string) ([]APIKeyHash, error)
+	RevokeAPIKey(ctx context.Context, userID, keyID int) error
+	ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error)
+	CreateRefreshToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	ConsumeRefreshToken(ctx context.Context, tokenHash string) (int, error)
 
 	// Model Aliases
-	UpsertModelAlias(ctx context.Context, userID int, alias, targetModel string, providerKeyID int, fallbackAliasID *int, useLightModel bool, lightModelThreshold int, lightModel *string) error
+	UpsertModelAlias(ctx context.Context, a ModelAlias) error
+	ImportModelAliases(ctx context.Context, aliases []ModelAlias) error
 	GetModelAlias(ctx context.Context, userID int, alias string) (*ModelAlias, error)
 	GetModelAliasByID(ctx context.Context, id int) (string, error)
-	ListModelAliases(ctx context.Context, userID int) ([]ModelAlias, error)
+	GetUserModelAliasByID(ctx context.Context, userID, id int) (string, error)
+	MatchModelAlias(ctx context.Context, userID int, model string) (*ModelAlias, error)
+	ListModelAliases(ctx context.Context, userID int, sort string) ([]ModelAlias, error)
 	PatchModelAlias(ctx context.Context, userID int, alias string, updates map[string]interface{}) error
+	DeleteModelAlias(ctx context.Context, userID int, alias string) error
+	ListAliasModelRefs(ctx context.Context) ([]AliasModelRef, error)
+	SetAliasFlag(ctx context.Context, aliasID int, reason *string, disable bool) error
 
 	// Provider Keys
-	CreateProviderKey(ctx context.Context, userID int, provider, encryptedKey, label string) error
+	CreateProviderKey(ctx context.Context, userID int, provider, encryptedKey, label string, baseURL *string) error
 	GetProviderKey(ctx context.Context, keyID int, userID int) (string, string, error)
-	ListProviderKeys(ctx context.Context, userID int) ([]ProviderKey, error)
+	GetProviderKeyBaseURL(ctx context.Context, keyID int, userID int) (string, error)
+	DeleteProviderKey(ctx context.Context, keyID int, userID int) error
+	ListProviderKeys(ctx context.Context, userID int, sort string) ([]ProviderKey, error)
 	ListUniqueProviderKeysPerProvider(ctx context.Context) ([]ProviderKey, error)
+	FindProviderKeysForModel(ctx context.Context, userID int, modelID string) ([]ProviderKey, error)
+	ReencryptProviderKeys(ctx context.Context, reencrypt func(encryptedKey string) (string, error)) (int, error)
 
 	// Provider Models
 	InsertProviderModel(ctx context.Context, provider, modelID string) error
-	ListProviderModelsByType(ctx context.Context, providerType string) ([]string, error)
+	SeedProviderModels(ctx context.Context, provider string, modelIDs []string) error
+	PruneProviderModels(ctx context.Context, provider string, seenBefore time.Time) (int64, error)
+	ListProviderModelsByType(ctx context.Context, providerType string, filter ModelFilter) ([]string, error)
 	ListAllProviderModels(ctx context.Context) (map[string][]string, error)
 
 	// Request Logs
 	InsertRequestLog(ctx context.Context, log RequestLog) error
 	GetUsageStats(ctx context.Context, userID int) ([]UsageStats, error)
+	GetUsageTotals(ctx context.Context, userID int, from, to time.Time) (UsageTotals, error)
+	GetUsageTimeSeries(ctx context.Context, userID int, granularity string) ([]UsageBucket, error)
+	GetTopAliases(ctx context.Context, userID int, from, to time.Time, limit int) ([]UsageStats, error)
+	GetProviderErrorRates(ctx context.Context, userID int, from, to time.Time) ([]ProviderErrorRate, error)
+
+	// Failed Requests
+	InsertFailedRequest(ctx context.Context, f FailedRequest) error
+	ListFailedRequests(ctx context.Context, userID, limit int) ([]FailedRequest, error)
+
+	// Audit Log
+	InsertAuditEntry(ctx context.Context, e AuditEntry) error
+	ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error)
+
+	// Stored Responses
+	InsertStoredResponse(ctx context.Context, sr StoredResponse) error
+	GetStoredResponse(ctx context.Context, userID int, id string) (*StoredResponse, error)
 }
 
 type PostgresRepository struct {
@@ -90,16 +293,23 @@ func NewPostgresRepository(pool DB) *PostgresRepository {
 	return &PostgresRepository{pool: pool}
 }
 
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	var one int
+	return r.pool.QueryRow(ctx, "SELECT 1").Scan(&one)
+}
+
 func (r *PostgresRepository) CreateUser(ctx context.Context, email, passwordHash string) (int, error) {
 	var id int
 	err := r.pool.QueryRow(ctx, "INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id", email, passwordHash).Scan(&id)
 	return id, err
 }
 
+// GetUserByEmail looks up a user by their normalized, lowercase email.
+// Addresses stored before emails were normalized are matched case-insensitively.
 func (r *PostgresRepository) GetUserByEmail(ctx context.Context, email string) (int, string, error) {
 	var id int
 	var storedHash string
-	err := r.pool.QueryRow(ctx, "SELECT id, password_hash FROM users WHERE email = $1", email).Scan(&id, &storedHash)
+	err := r.pool.QueryRow(ctx, "SELECT id, password_hash FROM users WHERE lower(email) = $1", email).Scan(&id, &storedHash)
 	return id, storedHash, err
 }
 
@@ -110,46 +320,406 @@ func (r *PostgresRepository) GetUserByID(ctx context.Context, userID int) (strin
 	return email, rateLimitMinute, rateLimitDaily, err
 }
 
+// GetUserOrgID returns the organization the user belongs to, or nil if none.
+func (r *PostgresRepository) GetUserOrgID(ctx context.Context, userID int) (*int, error) {
+	var orgID *int
+	err := r.pool.QueryRow(ctx, "SELECT org_id FROM users WHERE id = $1", userID).Scan(&orgID)
+	return orgID, err
+}
+
+func (r *PostgresRepository) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	var isAdmin bool
+	err := r.pool.QueryRow(ctx, "SELECT COALESCE(is_admin, FALSE) FROM users WHERE id = $1", userID).Scan(&isAdmin)
+	return isAdmin, err
+}
+
+func (r *PostgresRepository) GetUserFeatures(ctx context.Context, userID int) (map[string]bool, error) {
+	var features map[string]bool
+	err := r.pool.QueryRow(ctx, "SELECT features FROM users WHERE id = $1", userID).Scan(&features)
+	if err != nil {
+		return nil, err
+	}
+	if features == nil {
+		features = make(map[string]bool)
+	}
+	return features, nil
+}
+
+func (r *PostgresRepository) SetUserFeatures(ctx context.Context, userID int, features map[string]bool) error {
+	tag, err := r.pool.Exec(ctx, "UPDATE users SET features = $2 WHERE id = $1", userID, features)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetUserParamPolicy returns the user's policy for unsupported request
+// parameters, or nil when they use the server default.
+func (r *PostgresRepository) GetUserParamPolicy(ctx context.Context, userID int) (*string, error) {
+	var policy *string
+	err := r.pool.QueryRow(ctx, "SELECT unsupported_param_policy FROM users WHERE id = $1", userID).Scan(&policy)
+	return policy, err
+}
+
+// SetUserParamPolicy sets the user's policy for unsupported request
+// parameters; nil returns them to the server default.
+func (r *PostgresRepository) SetUserParamPolicy(ctx context.Context, userID int, policy *string) error {
+	tag, err := r.pool.Exec(ctx, "UPDATE users SET unsupported_param_policy = $2 WHERE id = $1", userID, policy)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// SetUserRateLimits updates a user's limits. With a non-nil graceUntil the
+// current limits are kept as the previous ones, to be enforced until then.
+// Limits changed again during a running grace period keep the previous limits
+// from before it, so clients always get the full grace period from the limits
+// they were last told about.
+func (r *PostgresRepository) SetUserRateLimits(ctx context.Context, userID, minute, daily int, graceUntil *time.Time) error {
+	sql := `UPDATE users SET
+	            previous_rate_limit_minute = CASE WHEN $4::timestamptz IS NULL THEN NULL
+	                WHEN rate_limit_grace_until > NOW() THEN COALESCE(previous_rate_limit_minute, rate_limit_minute)
+	                ELSE rate_limit_minute END,
+	            previous_rate_limit_daily = CASE WHEN $4::timestamptz IS NULL THEN NULL
+	                WHEN rate_limit_grace_until > NOW() THEN COALESCE(previous_rate_limit_daily, rate_limit_daily)
+	                ELSE rate_limit_daily END,
+	            rate_limit_grace_until = $4,
+	            rate_limit_minute = $2,
+	            rate_limit_daily = $3
+	        WHERE id = $1`
+	tag, err := r.pool.Exec(ctx, sql, userID, minute, daily, graceUntil)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteModelAlias deletes one of the user's aliases, first clearing the
+// fallback of any alias that pointed at it, in one transaction. It returns
+// pgx.ErrNoRows if the user has no such alias.
+func (r *PostgresRepository) DeleteModelAlias(ctx context.Context, userID int, alias string) error {
+	return r.withTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx,
+			"UPDATE model_aliases SET fallback_alias_id = NULL WHERE fallback_alias_id IN (SELECT id FROM model_aliases WHERE user_id = $1 AND alias = $2)",
+			userID, alias)
+		if err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, "DELETE FROM model_aliases WHERE user_id = $1 AND alias = $2", userID, alias)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return nil
+	})
+}
+
 func (r *PostgresRepository) CreateAPIKey(ctx context.Context, userID int, name, keyHash, prefix string) error {
 	_, err := r.pool.Exec(ctx, "INSERT INTO api_keys (user_id, name, key_hash, prefix) VALUES ($1, $2, $3, $4)", userID, name, keyHash, prefix)
 	return err
 }
 
-func (r *PostgresRepository) UpsertModelAlias(ctx context.Context, userID int, alias, targetModel string, providerKeyID int, fallbackAliasID *int, useLightModel bool, lightModelThreshold int, lightModel *string) error {
-	sql := `INSERT INTO model_aliases (user_id, alias, target_model, provider_key_id, fallback_alias_id, use_light_model, light_model_threshold, light_model)
-	        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+// ListAPIKeyHashes returns the hashes of the user's API keys stored under
+// any of prefixes. Prefixes aren't unique, so the caller compares each hash
+// against the presented token.
+func (r *PostgresRepository) ListAPIKeyHashes(ctx context.Context, userID int, prefixes []string) ([]APIKeyHash, error) {
+	rows, err := r.pool.Query(ctx, "SELECT key_hash, revoked FROM api_keys WHERE user_id = $1 AND prefix = ANY($2)", userID, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []APIKeyHash
+	for rows.Next() {
+		var h APIKeyHash
+		if err := rows.Scan(&h.Hash, &h.Revoked); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+// RevokeAPIKey revokes the user's API key with the given id. It returns
+// pgx.ErrNoRows when the user has no such key.
+func (r *PostgresRepository) RevokeAPIKey(ctx context.Context, userID, keyID int) error {
+	tag, err := r.pool.Exec(ctx, "UPDATE api_keys SET revoked = TRUE WHERE user_id = $1 AND id = $2", userID, keyID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (r *PostgresRepository) CreateRefreshToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := r.pool.Exec(ctx, "INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)", userID, tokenHash, expiresAt)
+	return err
+}
+
+// ConsumeRefreshToken deletes the unexpired refresh token with the given hash
+// and returns its user, so each token can be used once. It returns
+// pgx.ErrNoRows when there is no such token.
+func (r *PostgresRepository) ConsumeRefreshToken(ctx context.Context, tokenHash string) (int, error) {
+	var userID int
+	err := r.pool.QueryRow(ctx, "DELETE FROM refresh_tokens WHERE token_hash = $1 AND expires_at > NOW() RETURNING user_id", tokenHash).Scan(&userID)
+	return userID, err
+}
+
+// ListAPIKeys returns the user's API keys, newest first.
+func (r *PostgresRepository) ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error) {
+	rows, err := r.pool.Query(ctx, "SELECT id, name, prefix, revoked, created_at FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Revoked, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// withTx runs fn in a transaction, committing it when fn succeeds and
+// rolling it back when fn returns an error, so multi-row writes are never
+// left half done.
+func (r *PostgresRepository) withTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(ctx); rbErr != nil {
+			return fmt.Errorf("%w (rollback: %v)", err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// upsertModelAliasSQL creates an alias or replaces the settings of the
+// user's alias with the same name.
+const upsertModelAliasSQL = `INSERT INTO model_aliases (user_id, alias, target_model, provider_key_id, fallback_alias_id, use_light_model, light_model_threshold, light_model, max_temperature, fallback_on_statuses, weighted_targets, native_passthrough, cache_ttl_seconds, is_pattern, response_format_fallback, max_messages, system_prompt_override)
+	        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 			ON CONFLICT (user_id, alias)
 			DO UPDATE SET target_model = EXCLUDED.target_model,
 			              provider_key_id = EXCLUDED.provider_key_id,
 						  fallback_alias_id = EXCLUDED.fallback_alias_id,
 						  use_light_model = EXCLUDED.use_light_model,
 						  light_model_threshold = EXCLUDED.light_model_threshold,
-						  light_model = EXCLUDED.light_model`
-	_, err := r.pool.Exec(ctx, sql, userID, alias, targetModel, providerKeyID, fallbackAliasID, useLightModel, lightModelThreshold, lightModel)
+						  light_model = EXCLUDED.light_model,
+						  max_temperature = EXCLUDED.max_temperature,
+						  fallback_on_statuses = EXCLUDED.fallback_on_statuses,
+						  weighted_targets = EXCLUDED.weighted_targets,
+						  native_passthrough = EXCLUDED.native_passthrough,
+						  cache_ttl_seconds = EXCLUDED.cache_ttl_seconds,
+						  is_pattern = EXCLUDED.is_pattern,
+						  response_format_fallback = EXCLUDED.response_format_fallback,
+						  max_messages = EXCLUDED.max_messages,
+						  system_prompt_override = EXCLUDED.system_prompt_override`
+
+// execer is satisfied by both the pool and a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func upsertModelAlias(ctx context.Context, q execer, a ModelAlias) error {
+	_, err := q.Exec(ctx, upsertModelAliasSQL, a.UserID, a.Alias, a.TargetModel, a.ProviderKeyID, a.FallbackAliasID, a.UseLightModel, a.LightModelThreshold, a.LightModel, a.MaxTemperature, a.FallbackOnStatuses, a.WeightedTargets, a.NativePassthrough, a.CacheTTLSeconds, a.IsPattern, a.ResponseFormatFallback, a.MaxMessages, a.SystemPromptOverride)
 	return err
 }
 
+func (r *PostgresRepository) UpsertModelAlias(ctx context.Context, a ModelAlias) error {
+	return upsertModelAlias(ctx, r.pool, a)
+}
+
+// ImportModelAliases upserts aliases in one transaction, so either all of
+// them are saved or, on error, none are.
+func (r *PostgresRepository) ImportModelAliases(ctx context.Context, aliases []ModelAlias) error {
+	return r.withTx(ctx, func(tx pgx.Tx) error {
+		for _, a := range aliases {
+			if err := upsertModelAlias(ctx, tx, a); err != nil {
+				return fmt.Errorf("upsert alias %q: %w", a.Alias, err)
+			}
+		}
+		return nil
+	})
+}
+
+// modelAliasColumns is the column list read by scanModelAlias.
+const modelAliasColumns = "id, alias, target_model, provider_key_id, fallback_alias_id, use_light_model, light_model_threshold, light_model, max_temperature, fallback_on_statuses, weighted_targets, native_passthrough, cache_ttl_seconds, is_pattern, disabled, flagged_reason, response_format_fallback, max_messages, system_prompt_override"
+
+// rowScanner is satisfied by both pgx.Row and pgx.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanModelAlias(row rowScanner, a *ModelAlias) error {
+	return row.Scan(&a.ID, &a.Alias, &a.TargetModel, &a.ProviderKeyID, &a.FallbackAliasID, &a.UseLightModel, &a.LightModelThreshold, &a.LightModel, &a.MaxTemperature, &a.FallbackOnStatuses, &a.WeightedTargets, &a.NativePassthrough, &a.CacheTTLSeconds, &a.IsPattern, &a.Disabled, &a.FlaggedReason, &a.ResponseFormatFallback, &a.MaxMessages, &a.SystemPromptOverride)
+}
+
 func (r *PostgresRepository) GetModelAlias(ctx context.Context, userID int, alias string) (*ModelAlias, error) {
 	var a ModelAlias
-	err := r.pool.QueryRow(ctx,
-		"SELECT target_model, provider_key_id, fallback_alias_id, use_light_model, light_model_threshold, light_model FROM model_aliases WHERE user_id = $1 AND alias = $2",
-		userID, alias).Scan(&a.TargetModel, &a.ProviderKeyID, &a.FallbackAliasID, &a.UseLightModel, &a.LightModelThreshold, &a.LightModel)
+	err := scanModelAlias(r.pool.QueryRow(ctx,
+		"SELECT "+modelAliasColumns+" FROM model_aliases WHERE user_id = $1 AND alias = $2",
+		userID, alias), &a)
 	if err != nil {
 		return nil, err
 	}
 	a.UserID = userID
-	a.Alias = alias
 	return &a, nil
 }
 
+// MatchModelAlias returns the user's pattern alias that matches model, for
+// requests with no exact alias. Longer patterns are tried first so the most
+// specific one wins, ties going to the first by name. pgx.ErrNoRows is
+// returned when none match.
+func (r *PostgresRepository) MatchModelAlias(ctx context.Context, userID int, model string) (*ModelAlias, error) {
+	rows, err := r.pool.Query(ctx,
+		"SELECT "+modelAliasColumns+" FROM model_aliases WHERE user_id = $1 AND is_pattern ORDER BY length(alias) DESC, alias",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a ModelAlias
+		if err := scanModelAlias(rows, &a); err != nil {
+			return nil, err
+		}
+		if MatchAliasPattern(a.Alias, model) {
+			a.UserID = userID
+			return &a, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, pgx.ErrNoRows
+}
+
+// MatchAliasPattern reports whether model matches pattern, where each * matches
+// any run of characters, including none, and everything else is literal.
+func MatchAliasPattern(pattern, model string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == model
+	}
+	if !strings.HasPrefix(model, parts[0]) {
+		return false
+	}
+	model = model[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(model, p)
+		if i < 0 {
+			return false
+		}
+		model = model[i+len(p):]
+	}
+	return len(model) >= len(last) && strings.HasSuffix(model, last)
+}
+
+// AliasModelRef is the models an alias routes to, with the provider type of
+// its key, as checked against the provider model cache.
+type AliasModelRef struct {
+	ID            int
+	UserID        int
+	Alias         string
+	Provider      string
+	TargetModel   string
+	LightModel    *string
+	Disabled      bool
+	FlaggedReason *string
+}
+
+// ListAliasModelRefs returns every non-pattern alias with its provider type.
+func (r *PostgresRepository) ListAliasModelRefs(ctx context.Context) ([]AliasModelRef, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT a.id, a.user_id, a.alias, pk.provider, a.target_model, a.light_model, a.disabled, a.flagged_reason
+		 FROM model_aliases a JOIN provider_keys pk ON pk.id = a.provider_key_id
+		 WHERE NOT a.is_pattern`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []AliasModelRef
+	for rows.Next() {
+		var ref AliasModelRef
+		if err := rows.Scan(&ref.ID, &ref.UserID, &ref.Alias, &ref.Provider, &ref.TargetModel, &ref.LightModel, &ref.Disabled, &ref.FlaggedReason); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// SetAliasFlag records why an alias was flagged, or clears the flag when
+// reason is nil, and sets whether it is disabled.
+func (r *PostgresRepository) SetAliasFlag(ctx context.Context, aliasID int, reason *string, disable bool) error {
+	_, err := r.pool.Exec(ctx, "UPDATE model_aliases SET flagged_reason = $2, disabled = $3 WHERE id = $1", aliasID, reason, disable)
+	return err
+}
+
 func (r *PostgresRepository) GetModelAliasByID(ctx context.Context, id int) (string, error) {
 	var alias string
 	err := r.pool.QueryRow(ctx, "SELECT alias FROM model_aliases WHERE id = $1", id).Scan(&alias)
 	return alias, err
 }
 
-func (r *PostgresRepository) ListModelAliases(ctx context.Context, userID int) ([]ModelAlias, error) {
-	rows, err := r.pool.Query(ctx, "SELECT id, alias, target_model, provider_key_id, fallback_alias_id, use_light_model, light_model_threshold, light_model FROM model_aliases WHERE user_id = $1", userID)
+// GetUserModelAliasByID returns the name of the user's alias with the given
+// id, or pgx.ErrNoRows when the user has no such alias.
+func (r *PostgresRepository) GetUserModelAliasByID(ctx context.Context, userID, id int) (string, error) {
+	var alias string
+	err := r.pool.QueryRow(ctx, "SELECT alias FROM model_aliases WHERE id = $1 AND user_id = $2", id, userID).Scan(&alias)
+	return alias, err
+}
+
+// ErrInvalidSort is returned by list methods when asked to sort by an unknown field.
+var ErrInvalidSort = errors.New("invalid sort field")
+
+// aliasSortOrders maps the accepted sort fields for aliases to ORDER BY clauses.
+// The empty string is the default. Each ends in a unique column for a stable order.
+var aliasSortOrders = map[string]string{
+	"":           "alias",
+	"alias":      "alias",
+	"created_at": "created_at, alias",
+}
+
+// providerKeySortOrders maps the accepted sort fields for provider keys to ORDER BY clauses.
+var providerKeySortOrders = map[string]string{
+	"":           "created_at, id",
+	"created_at": "created_at, id",
+	"label":      "label, id",
+	"provider":   "provider, id",
+}
+
+func (r *PostgresRepository) ListModelAliases(ctx context.Context, userID int, sort string) ([]ModelAlias, error) {
+	orderBy, ok := aliasSortOrders[sort]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+	rows, err := r.pool.Query(ctx, "SELECT "+modelAliasColumns+" FROM model_aliases WHERE user_id = $1 ORDER BY "+orderBy, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -158,8 +728,7 @@ func (r *PostgresRepository) ListModelAliases(ctx context.Context, userID int) (
 	var aliases []ModelAlias
 	for rows.Next() {
 		var a ModelAlias
-		err := rows.Scan(&a.ID, &a.Alias, &a.TargetModel, &a.ProviderKeyID, &a.FallbackAliasID, &a.UseLightModel, &a.LightModelThreshold, &a.LightModel)
-		if err != nil {
+		if err := scanModelAlias(rows, &a); err != nil {
 			return nil, err
 		}
 		a.UserID = userID
@@ -170,12 +739,21 @@ func (r *PostgresRepository) ListModelAliases(ctx context.Context, userID int) (
 
 // allowedPatchColumns is the whitelist of columns that can be updated via PATCH.
 var allowedPatchColumns = map[string]bool{
-	"target_model":          true,
-	"provider_key_id":       true,
-	"fallback_alias_id":     true,
-	"use_light_model":       true,
-	"light_model_threshold": true,
-	"light_model":           true,
+	"target_model":             true,
+	"provider_key_id":          true,
+	"fallback_alias_id":        true,
+	"use_light_model":          true,
+	"light_model_threshold":    true,
+	"light_model":              true,
+	"max_temperature":          true,
+	"fallback_on_statuses":     true,
+	"weighted_targets":         true,
+	"native_passthrough":       true,
+	"cache_ttl_seconds":        true,
+	"disabled":                 true,
+	"response_format_fallback": true,
+	"max_messages":             true,
+	"system_prompt_override":   true,
 }
 
 func (r *PostgresRepository) PatchModelAlias(ctx context.Context, userID int, alias string, updates map[string]interface{}) error {
@@ -195,23 +773,130 @@ func (r *PostgresRepository) PatchModelAlias(ctx context.Context, userID int, al
 	}
 	sqlStr = sqlStr[:len(sqlStr)-2] + " WHERE user_id = $1 AND alias = $2"
 
-	_, err := r.pool.Exec(ctx, sqlStr, args...)
-	return err
+	tag, err := r.pool.Exec(ctx, sqlStr, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
 }
 
-func (r *PostgresRepository) CreateProviderKey(ctx context.Context, userID int, provider, encryptedKey, label string) error {
-	_, err := r.pool.Exec(ctx, "INSERT INTO provider_keys (user_id, provider, encrypted_key, label) VALUES ($1, $2, $3, $4)", userID, provider, encryptedKey, label)
+func (r *PostgresRepository) CreateProviderKey(ctx context.Context, userID int, provider, encryptedKey, label string, baseURL *string) error {
+	_, err := r.pool.Exec(ctx, "INSERT INTO provider_keys (user_id, provider, encrypted_key, label, base_url) VALUES ($1, $2, $3, $4, $5)", userID, provider, encryptedKey, label, baseURL)
 	return err
 }
 
+// ReencryptProviderKeys replaces every provider key's encrypted_key with
+// reencrypt's result, in one transaction, so a failure leaves all of them
+// as they were. It returns how many keys were updated.
+func (r *PostgresRepository) ReencryptProviderKeys(ctx context.Context, reencrypt func(encryptedKey string) (string, error)) (int, error) {
+	updated := 0
+	err := r.withTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT id, encrypted_key FROM provider_keys ORDER BY id FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id           int
+			encryptedKey string
+		}
+		var keys []row
+		for rows.Next() {
+			var k row
+			if err := rows.Scan(&k.id, &k.encryptedKey); err != nil {
+				rows.Close()
+				return err
+			}
+			keys = append(keys, k)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			encrypted, err := reencrypt(k.encryptedKey)
+			if err != nil {
+				return fmt.Errorf("provider key %d: %w", k.id, err)
+			}
+			if _, err := tx.Exec(ctx, "UPDATE provider_keys SET encrypted_key = $1 WHERE id = $2", encrypted, k.id); err != nil {
+				return fmt.Errorf("provider key %d: %w", k.id, err)
+			}
+		}
+		updated = len(keys)
+		return nil
+	})
+	return updated, err
+}
+
 func (r *PostgresRepository) GetProviderKey(ctx context.Context, keyID int, userID int) (string, string, error) {
 	var providerType, encryptedKey string
 	err := r.pool.QueryRow(ctx, "SELECT provider, encrypted_key FROM provider_keys WHERE id = $1 AND user_id = $2", keyID, userID).Scan(&providerType, &encryptedKey)
 	return providerType, encryptedKey, err
 }
 
-func (r *PostgresRepository) ListProviderKeys(ctx context.Context, userID int) ([]ProviderKey, error) {
-	rows, err := r.pool.Query(ctx, "SELECT id, provider, label, created_at FROM provider_keys WHERE user_id = $1", userID)
+// GetProviderKeyBaseURL returns the key's endpoint, or "" if it has none.
+func (r *PostgresRepository) GetProviderKeyBaseURL(ctx context.Context, keyID int, userID int) (string, error) {
+	var baseURL string
+	err := r.pool.QueryRow(ctx, "SELECT COALESCE(base_url, '') FROM provider_keys WHERE id = $1 AND user_id = $2", keyID, userID).Scan(&baseURL)
+	return baseURL, err
+}
+
+// ProviderKeyInUseError is returned by DeleteProviderKey when aliases still
+// route to the key.
+type ProviderKeyInUseError struct {
+	Aliases []string
+}
+
+func (e *ProviderKeyInUseError) Error() string {
+	return fmt.Sprintf("provider key is used by aliases: %s", strings.Join(e.Aliases, ", "))
+}
+
+// DeleteProviderKey deletes one of the user's provider keys. It returns
+// pgx.ErrNoRows if the user has no such key, and a *ProviderKeyInUseError if
+// any alias still references it. The check and the delete run in one
+// transaction with the key locked, so an alias can't be pointed at the key
+// in between.
+func (r *PostgresRepository) DeleteProviderKey(ctx context.Context, keyID int, userID int) error {
+	return r.withTx(ctx, func(tx pgx.Tx) error {
+		var id int
+		if err := tx.QueryRow(ctx, "SELECT id FROM provider_keys WHERE id = $1 AND user_id = $2 FOR UPDATE", keyID, userID).Scan(&id); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, "SELECT alias FROM model_aliases WHERE provider_key_id = $1 ORDER BY alias", keyID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var aliases []string
+		for rows.Next() {
+			var a string
+			if err := rows.Scan(&a); err != nil {
+				return err
+			}
+			aliases = append(aliases, a)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(aliases) > 0 {
+			return &ProviderKeyInUseError{Aliases: aliases}
+		}
+
+		_, err = tx.Exec(ctx, "DELETE FROM provider_keys WHERE id = $1 AND user_id = $2", keyID, userID)
+		return err
+	})
+}
+
+func (r *PostgresRepository) ListProviderKeys(ctx context.Context, userID int, sort string) ([]ProviderKey, error) {
+	orderBy, ok := providerKeySortOrders[sort]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+	rows, err := r.pool.Query(ctx, "SELECT id, provider, label, base_url, created_at FROM provider_keys WHERE user_id = $1 ORDER BY "+orderBy, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -220,7 +905,7 @@ func (r *PostgresRepository) ListProviderKeys(ctx context.Context, userID int) (
 	var keys []ProviderKey
 	for rows.Next() {
 		var k ProviderKey
-		err := rows.Scan(&k.ID, &k.Provider, &k.Label, &k.CreatedAt)
+		err := rows.Scan(&k.ID, &k.Provider, &k.Label, &k.BaseURL, &k.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -249,13 +934,101 @@ func (r *PostgresRepository) ListUniqueProviderKeysPerProvider(ctx context.Conte
 	return keys, nil
 }
 
+// FindProviderKeysForModel returns the user's provider keys whose provider type
+// has modelID in the cached provider_models list.
+func (r *PostgresRepository) FindProviderKeysForModel(ctx context.Context, userID int, modelID string) ([]ProviderKey, error) {
+	sql := `SELECT pk.id, pk.provider, pk.label, pk.created_at
+	        FROM provider_keys pk
+			JOIN provider_models pm ON pm.provider = pk.provider
+			WHERE pk.user_id = $1 AND pm.model_id = $2`
+
+	rows, err := r.pool.Query(ctx, sql, userID, modelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []ProviderKey
+	for rows.Next() {
+		var k ProviderKey
+		if err := rows.Scan(&k.ID, &k.Provider, &k.Label, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		k.UserID = userID
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// InsertProviderModel records that provider lists modelID, refreshing its
+// last_seen_at if it is already known.
 func (r *PostgresRepository) InsertProviderModel(ctx context.Context, provider, modelID string) error {
-	_, err := r.pool.Exec(ctx, "INSERT INTO provider_models (provider, model_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", provider, modelID)
+	_, err := r.pool.Exec(ctx,
+		"INSERT INTO provider_models (provider, model_id) VALUES ($1, $2) ON CONFLICT (provider, model_id) DO UPDATE SET last_seen_at = CURRENT_TIMESTAMP",
+		provider, modelID)
+	return err
+}
+
+// SeedProviderModels adds models to provider's cache in one statement. Models
+// already cached are left untouched, so seeding never refreshes last_seen_at
+// and can't keep a model the provider stopped listing from being pruned.
+func (r *PostgresRepository) SeedProviderModels(ctx context.Context, provider string, modelIDs []string) error {
+	_, err := r.pool.Exec(ctx,
+		"INSERT INTO provider_models (provider, model_id) SELECT $1, unnest($2::text[]) ON CONFLICT (provider, model_id) DO NOTHING",
+		provider, modelIDs)
 	return err
 }
 
-func (r *PostgresRepository) ListProviderModelsByType(ctx context.Context, providerType string) ([]string, error) {
-	rows, err := r.pool.Query(ctx, "SELECT model_id FROM provider_models WHERE provider = $1", providerType)
+// PruneProviderModels deletes provider's models that no poll has listed since
+// seenBefore, returning how many were removed.
+func (r *PostgresRepository) PruneProviderModels(ctx context.Context, provider string, seenBefore time.Time) (int64, error) {
+	tag, err := r.pool.Exec(ctx, "DELETE FROM provider_models WHERE provider = $1 AND last_seen_at < $2", provider, seenBefore)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ModelFilter narrows a provider model listing. The zero value lists every model.
+type ModelFilter struct {
+	Query  string // case-insensitive substring of the model id
+	Order  string // "", "asc" or "desc" by model id
+	Limit  int    // 0 = no limit
+	Offset int
+}
+
+// likeEscaper escapes LIKE wildcards so a query matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (r *PostgresRepository) ListProviderModelsByType(ctx context.Context, providerType string, filter ModelFilter) ([]string, error) {
+	sql := "SELECT model_id FROM provider_models WHERE provider = $1"
+	args := []interface{}{providerType}
+	if filter.Query != "" {
+		args = append(args, "%"+likeEscaper.Replace(filter.Query)+"%")
+		sql += fmt.Sprintf(" AND model_id ILIKE $%d", len(args))
+	}
+	switch filter.Order {
+	case "":
+	case "asc":
+		sql += " ORDER BY model_id"
+	case "desc":
+		sql += " ORDER BY model_id DESC"
+	default:
+		return nil, ErrInvalidSort
+	}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		sql += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset > 0 {
+		args = append(args, filter.Offset)
+		sql += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := r.pool.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -292,13 +1065,18 @@ func (r *PostgresRepository) ListAllProviderModels(ctx context.Context) (map[str
 
 func (r *PostgresRepository) InsertRequestLog(ctx context.Context, log RequestLog) error {
 	_, err := r.pool.Exec(ctx,
-		"INSERT INTO request_logs (user_id, alias_used, provider_used, model_used, input_tokens, output_tokens, status_code) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		log.UserID, log.AliasUsed, log.ProviderUsed, log.ModelUsed, log.InputTokens, log.OutputTokens, log.StatusCode)
+		"INSERT INTO request_logs (user_id, alias_used, provider_used, model_used, input_tokens, output_tokens, status_code, estimated_input_tokens, endpoint, estimated_cost, response_id, upstream_response_id, latency_ms, error, cache_hit, usage_estimated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, ''), $13, NULLIF($14, ''), $15, $16)",
+		log.UserID, log.AliasUsed, log.ProviderUsed, log.ModelUsed, log.InputTokens, log.OutputTokens, log.StatusCode, log.EstimatedInputTokens, log.Endpoint, log.EstimatedCost, log.ResponseID, log.UpstreamResponseID, log.LatencyMS, log.Error, log.CacheHit, log.UsageEstimated)
 	return err
 }
 
 func (r *PostgresRepository) GetUsageStats(ctx context.Context, userID int) ([]UsageStats, error) {
-	sql := `SELECT provider_used, alias_used, SUM(input_tokens) as input, SUM(output_tokens) as output, COUNT(*) as reqs 
+	sql := `SELECT provider_used, alias_used, SUM(input_tokens) as input, SUM(output_tokens) as output, COUNT(*) as reqs,
+	               COALESCE(SUM(estimated_cost), 0)::float8 as cost,
+	               COALESCE(ARRAY_AGG(DISTINCT model_used) FILTER (WHERE estimated_cost IS NULL AND status_code < 400), '{}') as unpriced_models,
+	               AVG(latency_ms)::float8 as avg_latency_ms,
+	               PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY latency_ms) as p95_latency_ms,
+	               COUNT(*) FILTER (WHERE status_code < 400) as successes
 	        FROM request_logs 
 			WHERE user_id = $1 
 			GROUP BY provider_used, alias_used`
@@ -312,10 +1090,184 @@ func (r *PostgresRepository) GetUsageStats(ctx context.Context, userID int) ([]U
 	var stats []UsageStats
 	for rows.Next() {
 		var s UsageStats
-		if err := rows.Scan(&s.Provider, &s.Alias, &s.Input, &s.Output, &s.Reqs); err != nil {
+		if err := rows.Scan(&s.Provider, &s.Alias, &s.Input, &s.Output, &s.Reqs, &s.Cost, &s.UnpricedModels, &s.AvgLatencyMS, &s.P95LatencyMS, &s.Successes); err != nil {
 			return nil, err
 		}
 		stats = append(stats, s)
 	}
 	return stats, nil
 }
+
+func (r *PostgresRepository) GetUsageTotals(ctx context.Context, userID int, from, to time.Time) (UsageTotals, error) {
+	var t UsageTotals
+	err := r.pool.QueryRow(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0) FROM request_logs WHERE user_id = $1 AND created_at >= $2 AND created_at < $3",
+		userID, from, to).Scan(&t.Reqs, &t.Input, &t.Output)
+	return t, err
+}
+
+// GetUsageTimeSeries returns the user's usage in hour, day or week buckets,
+// oldest first, up to and including the current one. Buckets without
+// requests are included with zero counts.
+func (r *PostgresRepository) GetUsageTimeSeries(ctx context.Context, userID int, granularity string) ([]UsageBucket, error) {
+	n, ok := timeSeriesBuckets[granularity]
+	if !ok {
+		return nil, ErrInvalidGranularity
+	}
+	sql := `SELECT b.start, COUNT(l.id), COALESCE(SUM(l.input_tokens), 0), COALESCE(SUM(l.output_tokens), 0)
+	        FROM generate_series(date_trunc($2, NOW()) - ($3::int - 1) * ('1 ' || $2)::interval, date_trunc($2, NOW()), ('1 ' || $2)::interval) AS b(start)
+			LEFT JOIN request_logs l ON l.user_id = $1 AND date_trunc($2, l.created_at) = b.start
+			GROUP BY b.start
+			ORDER BY b.start`
+
+	rows, err := r.pool.Query(ctx, sql, userID, granularity, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []UsageBucket
+	for rows.Next() {
+		var b UsageBucket
+		if err := rows.Scan(&b.Start, &b.Reqs, &b.Input, &b.Output); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// GetTopAliases returns the aliases with the highest estimated spend in the
+// period. Aliases with the same spend, such as unpriced ones, are ranked by
+// total tokens.
+func (r *PostgresRepository) GetTopAliases(ctx context.Context, userID int, from, to time.Time, limit int) ([]UsageStats, error) {
+	sql := `SELECT provider_used, alias_used, SUM(input_tokens) as input, SUM(output_tokens) as output, COUNT(*) as reqs,
+	               COALESCE(SUM(estimated_cost), 0)::float8 as cost
+	        FROM request_logs
+			WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+			GROUP BY provider_used, alias_used
+			ORDER BY COALESCE(SUM(estimated_cost), 0) DESC, SUM(input_tokens) + SUM(output_tokens) DESC
+			LIMIT $4`
+
+	rows, err := r.pool.Query(ctx, sql, userID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []UsageStats
+	for rows.Next() {
+		var s UsageStats
+		if err := rows.Scan(&s.Provider, &s.Alias, &s.Input, &s.Output, &s.Reqs, &s.Cost); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+func (r *PostgresRepository) GetProviderErrorRates(ctx context.Context, userID int, from, to time.Time) ([]ProviderErrorRate, error) {
+	sql := `SELECT provider_used, COUNT(*) as reqs, COUNT(*) FILTER (WHERE status_code >= 400) as errors
+	        FROM request_logs
+			WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+			GROUP BY provider_used`
+
+	rows, err := r.pool.Query(ctx, sql, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []ProviderErrorRate
+	for rows.Next() {
+		var e ProviderErrorRate
+		if err := rows.Scan(&e.Provider, &e.Reqs, &e.Errors); err != nil {
+			return nil, err
+		}
+		rates = append(rates, e)
+	}
+	return rates, nil
+}
+
+func (r *PostgresRepository) InsertFailedRequest(ctx context.Context, f FailedRequest) error {
+	_, err := r.pool.Exec(ctx,
+		"INSERT INTO failed_requests (user_id, requested_model, attempted_aliases, status_code, error, request_body) VALUES ($1, $2, $3, $4, $5, $6)",
+		f.UserID, f.RequestedModel, f.AttemptedAliases, f.StatusCode, f.Error, f.RequestBody)
+	return err
+}
+
+func (r *PostgresRepository) ListFailedRequests(ctx context.Context, userID, limit int) ([]FailedRequest, error) {
+	sql := `SELECT id, requested_model, attempted_aliases, status_code, error, request_body, created_at
+	        FROM failed_requests
+			WHERE user_id = $1
+			ORDER BY created_at DESC
+			LIMIT $2`
+
+	rows, err := r.pool.Query(ctx, sql, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []FailedRequest
+	for rows.Next() {
+		var f FailedRequest
+		if err := rows.Scan(&f.ID, &f.RequestedModel, &f.AttemptedAliases, &f.StatusCode, &f.Error, &f.RequestBody, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		f.UserID = userID
+		failures = append(failures, f)
+	}
+	return failures, nil
+}
+
+func (r *PostgresRepository) InsertAuditEntry(ctx context.Context, e AuditEntry) error {
+	_, err := r.pool.Exec(ctx,
+		"INSERT INTO audit_log (user_id, action, target, status_code, source_ip, details) VALUES ($1, $2, $3, $4, $5, $6)",
+		e.UserID, e.Action, e.Target, e.StatusCode, e.SourceIP, e.Details)
+	return err
+}
+
+// ListAuditEntries returns the most recent audit log entries, newest first.
+func (r *PostgresRepository) ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	rows, err := r.pool.Query(ctx,
+		"SELECT id, user_id, action, target, status_code, source_ip, details, created_at FROM audit_log ORDER BY created_at DESC, id DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.Target, &e.StatusCode, &e.SourceIP, &e.Details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (r *PostgresRepository) InsertStoredResponse(ctx context.Context, sr StoredResponse) error {
+	metadata := sr.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	_, err := r.pool.Exec(ctx,
+		"INSERT INTO stored_responses (id, user_id, model, metadata, response) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id, id) DO NOTHING",
+		sr.ID, sr.UserID, sr.Model, metadata, string(sr.Response))
+	return err
+}
+
+func (r *PostgresRepository) GetStoredResponse(ctx context.Context, userID int, id string) (*StoredResponse, error) {
+	sr := StoredResponse{ID: id, UserID: userID}
+	var response string
+	err := r.pool.QueryRow(ctx,
+		"SELECT model, metadata, response::text, created_at FROM stored_responses WHERE user_id = $1 AND id = $2",
+		userID, id).Scan(&sr.Model, &sr.Metadata, &response, &sr.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	sr.Response = []byte(response)
+	return &sr, nil
+}
@@ -0,0 +1,442 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestImportModelAliases_RollsBack(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := NewPostgresRepository(mock)
+
+	// The second row fails, so the first must not be committed
+	failed := errors.New("constraint violation")
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO model_aliases").WithArgs(anyArgs(17)...).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec("INSERT INTO model_aliases").WithArgs(anyArgs(17)...).
+		WillReturnError(failed)
+	mock.ExpectRollback()
+
+	err = repo.ImportModelAliases(context.Background(), []ModelAlias{
+		{UserID: 1, Alias: "fast", TargetModel: "gpt-4o-mini", ProviderKeyID: 4},
+		{UserID: 1, Alias: "smart", TargetModel: "gpt-4o", ProviderKeyID: 4},
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("Expected the insert error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteModelAlias(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted int64
+		wantErr error
+	}{
+		{name: "deleted", deleted: 1},
+		// Clearing fallbacks is rolled back when there was nothing to delete
+		{name: "missing", deleted: 0, wantErr: pgx.ErrNoRows},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := NewPostgresRepository(mock)
+
+			mock.ExpectBegin()
+			mock.ExpectExec("UPDATE model_aliases SET fallback_alias_id = NULL").WithArgs(1, "fast").
+				WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+			mock.ExpectExec("DELETE FROM model_aliases").WithArgs(1, "fast").
+				WillReturnResult(pgxmock.NewResult("DELETE", tt.deleted))
+			if tt.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err = repo.DeleteModelAlias(context.Background(), 1, "fast")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func anyArgs(n int) []any {
+	args := make([]any, n)
+	for i := range args {
+		args[i] = pgxmock.AnyArg()
+	}
+	return args
+}
+
+func TestReencryptProviderKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		failOn      string
+		wantUpdated int
+	}{
+		{name: "all rotated", wantUpdated: 2},
+		// One undecryptable key leaves every key as it was
+		{name: "rolls back", failOn: "enc-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := NewPostgresRepository(mock)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT id, encrypted_key FROM provider_keys ORDER BY id FOR UPDATE").
+				WillReturnRows(mock.NewRows([]string{"id", "encrypted_key"}).AddRow(1, "enc-1").AddRow(2, "enc-2"))
+			mock.ExpectExec("UPDATE provider_keys SET encrypted_key").WithArgs("new-enc-1", 1).
+				WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			if tt.failOn == "" {
+				mock.ExpectExec("UPDATE provider_keys SET encrypted_key").WithArgs("new-enc-2", 2).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			failed := errors.New("decrypt: message authentication failed")
+			updated, err := repo.ReencryptProviderKeys(context.Background(), func(enc string) (string, error) {
+				if enc == tt.failOn {
+					return "", failed
+				}
+				return "new-" + enc, nil
+			})
+			if tt.failOn != "" && !errors.Is(err, failed) {
+				t.Errorf("Expected the reencrypt error, got %v", err)
+			}
+			if tt.failOn == "" && err != nil {
+				t.Errorf("ReencryptProviderKeys: %v", err)
+			}
+			if updated != tt.wantUpdated {
+				t.Errorf("Expected %d keys updated, got %d", tt.wantUpdated, updated)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestInsertStoredResponse_DefaultsMetadata(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := NewPostgresRepository(mock)
+
+	// A nil map would be stored as JSON null rather than an empty object
+	mock.ExpectExec("INSERT INTO stored_responses").
+		WithArgs("resp_1", 1, "gpt-4o", map[string]string{}, `{"id":"resp_1"}`).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	err = repo.InsertStoredResponse(context.Background(), StoredResponse{
+		ID: "resp_1", UserID: 1, Model: "gpt-4o", Response: []byte(`{"id":"resp_1"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetStoredResponse(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := NewPostgresRepository(mock)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT model, metadata, response::text, created_at FROM stored_responses").
+		WithArgs(1, "resp_1").
+		WillReturnRows(mock.NewRows([]string{"model", "metadata", "response", "created_at"}).
+			AddRow("gpt-4o", map[string]string{"run": "7"}, `{"id":"resp_1"}`, created))
+	// Lookups are scoped to the user, so another user's ID finds nothing
+	mock.ExpectQuery("SELECT model, metadata, response::text, created_at FROM stored_responses").
+		WithArgs(2, "resp_1").
+		WillReturnError(pgx.ErrNoRows)
+
+	sr, err := repo.GetStoredResponse(context.Background(), 1, "resp_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StoredResponse{ID: "resp_1", UserID: 1, Model: "gpt-4o", Metadata: map[string]string{"run": "7"}, Response: []byte(`{"id":"resp_1"}`), CreatedAt: created}
+	if !reflect.DeepEqual(*sr, want) {
+		t.Errorf("Expected %+v, got %+v", want, *sr)
+	}
+
+	if _, err := repo.GetStoredResponse(context.Background(), 2, "resp_1"); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("Expected pgx.ErrNoRows for another user, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetUserRateLimits(t *testing.T) {
+	grace := time.Now().Add(time.Hour)
+	tests := []struct {
+		name       string
+		graceUntil *time.Time
+	}{
+		{name: "immediate"},
+		{name: "with grace", graceUntil: &grace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := NewPostgresRepository(mock)
+
+			// A grace period still running keeps the previous limits from
+			// before it rather than the limits it is replacing
+			mock.ExpectExec(`WHEN rate_limit_grace_until > NOW\(\) THEN COALESCE\(previous_rate_limit_minute, rate_limit_minute\)(.|\n)+`+
+				`WHEN rate_limit_grace_until > NOW\(\) THEN COALESCE\(previous_rate_limit_daily, rate_limit_daily\)`).
+				WithArgs(1, 5, 50, tt.graceUntil).
+				WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+			if err := repo.SetUserRateLimits(context.Background(), 1, 5, 50, tt.graceUntil); err != nil {
+				t.Fatal(err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestDeleteProviderKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		owned   bool
+		aliases []string
+		wantErr error
+	}{
+		{name: "deleted", owned: true},
+		{name: "missing", wantErr: pgx.ErrNoRows},
+		{name: "in use", owned: true, aliases: []string{"fast", "smart"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := NewPostgresRepository(mock)
+
+			// The key is locked for the check, so no alias can start using
+			// it before it's deleted
+			mock.ExpectBegin()
+			q := mock.ExpectQuery("SELECT id FROM provider_keys WHERE id = \\$1 AND user_id = \\$2 FOR UPDATE").WithArgs(7, 1)
+			if !tt.owned {
+				q.WillReturnError(pgx.ErrNoRows)
+				mock.ExpectRollback()
+			} else {
+				q.WillReturnRows(mock.NewRows([]string{"id"}).AddRow(7))
+				rows := mock.NewRows([]string{"alias"})
+				for _, a := range tt.aliases {
+					rows.AddRow(a)
+				}
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(7).WillReturnRows(rows)
+				if len(tt.aliases) > 0 {
+					mock.ExpectRollback()
+				} else {
+					mock.ExpectExec("DELETE FROM provider_keys").WithArgs(7, 1).
+						WillReturnResult(pgxmock.NewResult("DELETE", 1))
+					mock.ExpectCommit()
+				}
+			}
+
+			err = repo.DeleteProviderKey(context.Background(), 7, 1)
+			var inUse *ProviderKeyInUseError
+			switch {
+			case len(tt.aliases) > 0:
+				if !errors.As(err, &inUse) || !reflect.DeepEqual(inUse.Aliases, tt.aliases) {
+					t.Errorf("Expected the key in use by %v, got %v", tt.aliases, err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestFindProviderKeysForModel(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := NewPostgresRepository(mock)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("FROM provider_keys pk").WithArgs(1, "gpt-4o").
+		WillReturnRows(mock.NewRows([]string{"id", "provider", "label", "created_at"}).
+			AddRow(4, "openai", "work", created))
+	// An error ending the rows early must not be mistaken for fewer keys
+	failed := errors.New("connection reset")
+	mock.ExpectQuery("FROM provider_keys pk").WithArgs(1, "gpt-4o").
+		WillReturnRows(mock.NewRows([]string{"id", "provider", "label", "created_at"}).
+			AddRow(4, "openai", "work", created).
+			AddRow(5, "openai", "home", created).
+			CloseError(failed))
+
+	keys, err := repo.FindProviderKeysForModel(context.Background(), 1, "gpt-4o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProviderKey{{ID: 4, UserID: 1, Provider: "openai", Label: "work", CreatedAt: created}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected %+v, got %+v", want, keys)
+	}
+
+	if _, err := repo.FindProviderKeysForModel(context.Background(), 1, "gpt-4o"); !errors.Is(err, failed) {
+		t.Errorf("Expected the rows error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListSortOrders(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    func(r *PostgresRepository, sort string) error
+		sort    string
+		orderBy string
+	}{
+		{name: "aliases by default", list: listAliases, orderBy: "ORDER BY alias$"},
+		{name: "aliases by creation", list: listAliases, sort: "created_at", orderBy: "ORDER BY created_at, alias$"},
+		{name: "provider keys by default", list: listProviderKeys, orderBy: "ORDER BY created_at, id$"},
+		{name: "provider keys by label", list: listProviderKeys, sort: "label", orderBy: "ORDER BY label, id$"},
+		{name: "provider keys by provider", list: listProviderKeys, sort: "provider", orderBy: "ORDER BY provider, id$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := NewPostgresRepository(mock)
+
+			mock.ExpectQuery(tt.orderBy).WithArgs(1).WillReturnError(pgx.ErrNoRows)
+			if err := tt.list(repo, tt.sort); !errors.Is(err, pgx.ErrNoRows) {
+				t.Errorf("Expected the query to run, got %v", err)
+			}
+			// Unknown sort fields are rejected without querying
+			if err := tt.list(repo, "id; DROP TABLE users"); !errors.Is(err, ErrInvalidSort) {
+				t.Errorf("Expected ErrInvalidSort, got %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func listAliases(r *PostgresRepository, sort string) error {
+	_, err := r.ListModelAliases(context.Background(), 1, sort)
+	return err
+}
+
+func listProviderKeys(r *PostgresRepository, sort string) error {
+	_, err := r.ListProviderKeys(context.Background(), 1, sort)
+	return err
+}
+
+func TestListProviderModelsByType(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter ModelFilter
+		sql    string
+		args   []any
+	}{
+		{name: "unfiltered", sql: `provider = \$1$`, args: []any{"openai"}},
+		{
+			name:   "filtered, ordered and paginated",
+			filter: ModelFilter{Query: "gpt-4o", Order: "desc", Limit: 10, Offset: 20},
+			sql:    `provider = \$1 AND model_id ILIKE \$2 ORDER BY model_id DESC LIMIT \$3 OFFSET \$4$`,
+			args:   []any{"openai", "%gpt-4o%", 10, 20},
+		},
+		{
+			// LIKE wildcards in the query match literally
+			name:   "escaped query",
+			filter: ModelFilter{Query: "4o_mini%"},
+			sql:    `model_id ILIKE \$2$`,
+			args:   []any{"openai", `%4o\_mini\%%`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := NewPostgresRepository(mock)
+
+			mock.ExpectQuery(tt.sql).WithArgs(tt.args...).
+				WillReturnRows(mock.NewRows([]string{"model_id"}).AddRow("gpt-4o-mini"))
+
+			models, err := repo.ListProviderModelsByType(context.Background(), "openai", tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(models, []string{"gpt-4o-mini"}) {
+				t.Errorf("Unexpected models %v", models)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+
+	repo := NewPostgresRepository(nil)
+	if _, err := repo.ListProviderModelsByType(context.Background(), "openai", ModelFilter{Order: "random"}); !errors.Is(err, ErrInvalidSort) {
+		t.Errorf("Expected ErrInvalidSort for an unknown order, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+// Package denylist rejects requests whose content matches operator-configured
+// patterns before they are forwarded upstream.
+package denylist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	patterns []*regexp.Regexp
+	mu       sync.RWMutex
+)
+
+// Init loads the denylist from the file named by DENYLIST_FILE, if set.
+func Init() error {
+	path := os.Getenv("DENYLIST_FILE")
+	if path == "" {
+		return nil
+	}
+	return Load(path)
+}
+
+// Load compiles the patterns in path, one regular expression per line. Blank
+// lines and lines starting with # are ignored. Use (?i) for case-insensitive
+// matching and regexp.QuoteMeta-style escaping for literal substrings.
+func Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open denylist: %w", err)
+	}
+	defer f.Close()
+
+	var compiled []*regexp.Regexp
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return fmt.Errorf("denylist line %d: %w", line, err)
+		}
+		compiled = append(compiled, re)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read denylist: %w", err)
+	}
+
+	Set(compiled)
+	return nil
+}
+
+// Set replaces the active patterns.
+func Set(res []*regexp.Regexp) {
+	mu.Lock()
+	patterns = res
+	mu.Unlock()
+}
+
+// Enabled reports whether any patterns are loaded.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(patterns) > 0
+}
+
+// Match returns the first pattern that matches text.
+func Match(text string) (pattern string, ok bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, re := range patterns {
+		if re.MatchString(text) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
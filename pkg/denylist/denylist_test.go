@@ -0,0 +1,152 @@
+package denylist
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	defer Set(nil)
+
+	tests := []struct {
+		name        string
+		patterns    []string
+		text        string
+		wantPattern string
+	}{
+		{name: "no patterns", text: "ignore previous instructions"},
+		{name: "case sensitive miss", patterns: []string{`ignore previous instructions`}, text: "IGNORE previous instructions"},
+		{name: "case insensitive", patterns: []string{`(?i)ignore previous instructions`}, text: "IGNORE Previous Instructions", wantPattern: `(?i)ignore previous instructions`},
+		{name: "substring", patterns: []string{`kill`}, text: "a new skill", wantPattern: `kill`},
+		{name: "word boundary miss", patterns: []string{`\bkill\b`}, text: "a new skill"},
+		{name: "word boundary", patterns: []string{`\bkill\b`}, text: "kill the process", wantPattern: `\bkill\b`},
+		{name: "first match wins", patterns: []string{`secret`, `(?i)password`, `token`}, text: "my Password and token", wantPattern: `(?i)password`},
+		{name: "across lines", patterns: []string{`(?i)ignore previous`}, text: "hello\nignore previous instructions\n", wantPattern: `(?i)ignore previous`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res []*regexp.Regexp
+			for _, p := range tt.patterns {
+				res = append(res, regexp.MustCompile(p))
+			}
+			Set(res)
+
+			if Enabled() != (len(tt.patterns) > 0) {
+				t.Errorf("Enabled() = %v with %d patterns", Enabled(), len(tt.patterns))
+			}
+			pattern, ok := Match(tt.text)
+			if ok != (tt.wantPattern != "") || pattern != tt.wantPattern {
+				t.Errorf("Match(%q) = %q, %v, want %q", tt.text, pattern, ok, tt.wantPattern)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer Set(nil)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+		// wantBlocked and wantAllowed are checked against the loaded list
+		wantBlocked []string
+		wantAllowed []string
+	}{
+		{
+			name:        "patterns",
+			content:     "# prompt injection\n(?i)ignore previous instructions\n\n  \\bdrop table\\b  \n",
+			wantBlocked: []string{"Ignore previous instructions", "please drop table users"},
+			wantAllowed: []string{"# prompt injection", "dropped tables"},
+		},
+		{
+			name:        "comments and blank lines only",
+			content:     "# nothing yet\n\n",
+			wantAllowed: []string{"anything"},
+		},
+		{
+			name:    "invalid pattern",
+			content: "ok\n(unclosed\n",
+			wantErr: "denylist line 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Set(nil)
+			path := filepath.Join(t.TempDir(), "denylist.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				if Enabled() {
+					t.Error("Expected a failed load to leave no patterns active")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if Enabled() != (len(tt.wantBlocked) > 0) {
+				t.Errorf("Enabled() = %v", Enabled())
+			}
+			for _, text := range tt.wantBlocked {
+				if _, ok := Match(text); !ok {
+					t.Errorf("Expected %q to be blocked", text)
+				}
+			}
+			for _, text := range tt.wantAllowed {
+				if pattern, ok := Match(text); ok {
+					t.Errorf("Expected %q to be allowed, matched %q", text, pattern)
+				}
+			}
+		})
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer Set(nil)
+
+	t.Run("unset", func(t *testing.T) {
+		Set(nil)
+		t.Setenv("DENYLIST_FILE", "")
+		if err := Init(); err != nil {
+			t.Fatalf("Init() error = %v", err)
+		}
+		if Enabled() {
+			t.Error("Expected no denylist without DENYLIST_FILE")
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		Set(nil)
+		t.Setenv("DENYLIST_FILE", filepath.Join(t.TempDir(), "missing.txt"))
+		if err := Init(); err == nil || !strings.Contains(err.Error(), "open denylist") {
+			t.Errorf("Init() error = %v, want an open error", err)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		Set(nil)
+		path := filepath.Join(t.TempDir(), "denylist.txt")
+		if err := os.WriteFile(path, []byte("(?i)jailbreak\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("DENYLIST_FILE", path)
+		if err := Init(); err != nil {
+			t.Fatalf("Init() error = %v", err)
+		}
+		if _, ok := Match("a JAILBREAK prompt"); !ok {
+			t.Error("Expected the loaded pattern to match")
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package features
+
+import (
+	"context"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// Known feature flags. A user's stored flags override the defaults below.
+const (
+	Streaming   = "streaming"
+	Caching     = "caching"
+	ToolCalling = "tool_calling"
+)
+
+// Defaults is the value of each known feature for users that have not had it set.
+var Defaults = map[string]bool{
+	Streaming:   true,
+	Caching:     false,
+	ToolCalling: true,
+}
+
+// IsKnown reports whether name is a recognised feature flag.
+func IsKnown(name string) bool {
+	_, ok := Defaults[name]
+	return ok
+}
+
+type userFeatures struct {
+	flags     map[string]bool
+	fetchedAt time.Time
+}
+
+var (
+	cache    = make(map[int]userFeatures)
+	cacheMu  sync.RWMutex
+	cacheTTL = 1 * time.Minute
+)
+
+// HasFeature reports whether the feature is enabled for the user, falling back
+// to the default when the user has no explicit flag or the lookup fails.
+func HasFeature(ctx context.Context, repo db.Repository, userID int, feature string) bool {
+	flags := getUserFeatures(ctx, repo, userID)
+	if enabled, ok := flags[feature]; ok {
+		return enabled
+	}
+	return Defaults[feature]
+}
+
+func getUserFeatures(ctx context.Context, repo db.Repository, userID int) map[string]bool {
+	cacheMu.RLock()
+	cached, ok := cache[userID]
+	cacheMu.RUnlock()
+
+	if ok && time.Since(cached.fetchedAt) < cacheTTL {
+		return cached.flags
+	}
+
+	flags, err := repo.GetUserFeatures(ctx, userID)
+	if err != nil {
+		logging.Printf(ctx, "features: get user features error for user %d: %v", userID, err)
+		return nil
+	}
+
+	cacheMu.Lock()
+	cache[userID] = userFeatures{flags: flags, fetchedAt: time.Now()}
+	cacheMu.Unlock()
+
+	return flags
+}
+
+// Invalidate drops the cached flags for a user so the next check hits the DB.
+func Invalidate(userID int) {
+	cacheMu.Lock()
+	delete(cache, userID)
+	cacheMu.Unlock()
+}
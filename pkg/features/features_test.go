@@ -0,0 +1,123 @@
+package features
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestHasFeature(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  map[string]bool
+		err     error
+		feature string
+		want    bool
+	}{
+		{name: "default on", stored: map[string]bool{}, feature: Streaming, want: true},
+		{name: "default off", stored: map[string]bool{}, feature: Caching, want: false},
+		{name: "enabled override", stored: map[string]bool{Caching: true}, feature: Caching, want: true},
+		{name: "disabled override", stored: map[string]bool{ToolCalling: false}, feature: ToolCalling, want: false},
+		// An override for one flag leaves the others at their defaults
+		{name: "unrelated override", stored: map[string]bool{Streaming: false}, feature: ToolCalling, want: true},
+		{name: "lookup error", err: errors.New("connection refused"), feature: Streaming, want: true},
+		{name: "lookup error default off", err: errors.New("connection refused"), feature: Caching, want: false},
+		{name: "unknown feature", stored: map[string]bool{}, feature: "telepathy", want: false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := db.NewPostgresRepository(mock)
+
+			userID := 7100 + i
+			defer Invalidate(userID)
+			q := mock.ExpectQuery("SELECT features FROM users").WithArgs(userID)
+			if tt.err != nil {
+				q.WillReturnError(tt.err)
+			} else {
+				q.WillReturnRows(mock.NewRows([]string{"features"}).AddRow(tt.stored))
+			}
+
+			if got := HasFeature(context.Background(), repo, userID, tt.feature); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestHasFeature_CachesUntilInvalidated(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := db.NewPostgresRepository(mock)
+
+	userID := 7200
+	defer Invalidate(userID)
+	mock.ExpectQuery("SELECT features FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool{Caching: true}))
+	mock.ExpectQuery("SELECT features FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool{Caching: false}))
+
+	ctx := context.Background()
+	// The second check is served from the cache
+	if !HasFeature(ctx, repo, userID, Caching) || !HasFeature(ctx, repo, userID, Caching) {
+		t.Fatal("Expected caching enabled")
+	}
+	Invalidate(userID)
+	if HasFeature(ctx, repo, userID, Caching) {
+		t.Error("Expected the new flags to be read after Invalidate")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHasFeature_ErrorNotCached(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := db.NewPostgresRepository(mock)
+
+	userID := 7300
+	defer Invalidate(userID)
+	mock.ExpectQuery("SELECT features FROM users").WithArgs(userID).WillReturnError(errors.New("connection refused"))
+	mock.ExpectQuery("SELECT features FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"features"}).AddRow(map[string]bool{Caching: true}))
+
+	ctx := context.Background()
+	if HasFeature(ctx, repo, userID, Caching) {
+		t.Error("Expected the default when the lookup fails")
+	}
+	if !HasFeature(ctx, repo, userID, Caching) {
+		t.Error("Expected the stored flag once the lookup recovers")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIsKnown(t *testing.T) {
+	for _, name := range []string{Streaming, Caching, ToolCalling} {
+		if !IsKnown(name) {
+			t.Errorf("Expected %q to be known", name)
+		}
+	}
+	if IsKnown("telepathy") {
+		t.Error("Expected an unknown flag not to be known")
+	}
+}
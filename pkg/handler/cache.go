@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/types"
+)
+
+// Deterministic requests that repeat verbatim are answered from an
+// in-memory cache for the alias's cache_ttl_seconds, or RESPONSE_CACHE_TTL
+// when it has none, instead of being paid for again. Only requests that
+// could be coalesced are cached: non-streaming, with temperature 0, for users
+// with the caching feature enabled.
+var (
+	responseCacheTTL = config.Duration("RESPONSE_CACHE_TTL", 0)
+	responses        = newResponseCache(maxCachedResponses)
+
+	cacheHits = expvar.NewInt("response_cache_hits")
+)
+
+// maxCachedResponses bounds the cache; the least recently used entries are
+// evicted past it.
+const maxCachedResponses = 10000
+
+type cachedResponse struct {
+	key          string
+	resp         *types.OpenAIResponse
+	providerType string
+	model        string // upstream model that produced the response
+	alias        string // alias that served it, after any fallback
+	expires      time.Time
+}
+
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element // of cachedResponse, in order
+	order   *list.List               // most recently used first
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{max: max, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// writeCached answers a request from the cache and logs it as a cache hit,
+// with no tokens used or cost, since nothing was sent upstream.
+func (s *ProxyServer) writeCached(ctx context.Context, w http.ResponseWriter, userID int, req types.OpenAIRequest, entry cachedResponse) {
+	cacheHits.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Cache", "hit")
+	if err := json.NewEncoder(w).Encode(entry.resp); err != nil {
+		logging.Printf(ctx, "proxy handler: encode cached response error: %v", err)
+	}
+
+	estimated := s.Tokens.CountTokens(entry.model, req.Messages)
+	logs.enqueue(ctx, func(ctx context.Context) {
+		free := 0.0
+		if err := s.Repo.InsertRequestLog(ctx, db.RequestLog{
+			UserID:               userID,
+			AliasUsed:            entry.alias,
+			ProviderUsed:         entry.providerType,
+			ModelUsed:            entry.model,
+			EstimatedInputTokens: &estimated,
+			StatusCode:           http.StatusOK,
+			Endpoint:             db.EndpointChatCompletions,
+			EstimatedCost:        &free,
+			ResponseID:           entry.resp.ID,
+			CacheHit:             true,
+		}); err != nil {
+			logging.Printf(ctx, "proxy handler: insert request log error: %v", err)
+		}
+	})
+}
+
+// cacheKey identifies a client request by hashing the user and the request
+// as sent, alias name included, so it can be looked up before resolving.
+func cacheKey(userID int, req types.OpenAIRequest) string {
+	return requestKey(userID, 0, req)
+}
+
+// cacheTTL is how long alias's responses may be served from the cache.
+func cacheTTL(alias *db.ModelAlias) time.Duration {
+	if alias.CacheTTLSeconds != nil {
+		return time.Duration(*alias.CacheTTLSeconds) * time.Second
+	}
+	return responseCacheTTL
+}
+
+// get returns a copy of the unexpired response cached under key.
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	entry := el.Value.(cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return cachedResponse{}, false
+	}
+	c.order.MoveToFront(el)
+	copied := *entry.resp
+	entry.resp = &copied
+	return entry, true
+}
+
+// put caches resp under key for ttl, evicting the least recently used
+// entries when the cache is full.
+func (c *responseCache) put(key string, resp *types.OpenAIResponse, providerType, model, alias string, ttl time.Duration) {
+	copied := *resp
+	entry := cachedResponse{key: key, resp: &copied, providerType: providerType, model: model, alias: alias, expires: time.Now().Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry; the caller must hold c.mu.
+func (c *responseCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(cachedResponse).key)
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/types"
+)
+
+func TestResponseCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(3)
+	for i := range 3 {
+		c.put(fmt.Sprint(i), &types.OpenAIResponse{ID: fmt.Sprint(i)}, "openai", "gpt-4o", "fast", time.Minute)
+	}
+	// Reading 0 makes 1 the least recently used
+	if _, ok := c.get("0"); !ok {
+		t.Fatal("Expected 0 to be cached")
+	}
+	c.put("3", &types.OpenAIResponse{ID: "3"}, "openai", "gpt-4o", "fast", time.Minute)
+
+	if len(c.entries) != 3 || c.order.Len() != 3 {
+		t.Errorf("Expected the cache held at 3 entries, got %d (%d in order)", len(c.entries), c.order.Len())
+	}
+	if _, ok := c.get("1"); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"0", "2", "3"} {
+		if entry, ok := c.get(key); !ok || entry.resp.ID != key {
+			t.Errorf("Expected %s to be cached, got %+v, %v", key, entry, ok)
+		}
+	}
+}
+
+func TestResponseCache_PutReplaces(t *testing.T) {
+	c := newResponseCache(2)
+	c.put("a", &types.OpenAIResponse{ID: "old"}, "openai", "gpt-4o", "fast", time.Minute)
+	c.put("b", &types.OpenAIResponse{ID: "b"}, "openai", "gpt-4o", "fast", time.Minute)
+	c.put("a", &types.OpenAIResponse{ID: "new"}, "openai", "gpt-4o", "fast", time.Minute)
+	c.put("c", &types.OpenAIResponse{ID: "c"}, "openai", "gpt-4o", "fast", time.Minute)
+
+	// Replacing a counts as a use, so b is evicted instead
+	if entry, ok := c.get("a"); !ok || entry.resp.ID != "new" {
+		t.Errorf("Expected the replaced response, got %+v, %v", entry, ok)
+	}
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+}
+
+func TestResponseCache_Expiry(t *testing.T) {
+	c := newResponseCache(2)
+	c.put("a", &types.OpenAIResponse{ID: "a"}, "openai", "gpt-4o", "fast", -time.Second)
+	if _, ok := c.get("a"); ok {
+		t.Error("Expected an expired entry to be missed")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Error("Expected the expired entry to be dropped on read")
+	}
+}
+
+func TestResponseCache_Copies(t *testing.T) {
+	c := newResponseCache(2)
+	resp := &types.OpenAIResponse{ID: "a"}
+	c.put("a", resp, "openai", "gpt-4o", "fast", time.Minute)
+	resp.ID = "changed"
+
+	entry, _ := c.get("a")
+	entry.resp.ID = "changed again"
+	if entry, _ := c.get("a"); entry.resp.ID != "a" {
+		t.Errorf("Expected the cached response unaffected by callers, got %q", entry.resp.ID)
+	}
+}
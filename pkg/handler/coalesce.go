@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"tokentracer-proxy/pkg/types"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Identical concurrent requests share one upstream call, so a burst of
+// duplicates (e.g. many clients retrying at once) is only paid for once.
+var (
+	inFlight singleflight.Group
+
+	coalescedRequests = expvar.NewInt("coalesced_requests")
+)
+
+// coalescable reports whether req may share another request's response.
+// Only non-streaming requests with temperature 0 qualify, since any other
+// request is expected to get its own sample.
+func coalescable(req types.OpenAIRequest) bool {
+	return !req.Stream && req.Temperature != nil && *req.Temperature == 0
+}
+
+// requestKey identifies a request to a provider key by hashing the user, the
+// key and the upstream request body.
+func requestKey(userID, providerKeyID int, req types.OpenAIRequest) string {
+	body, _ := json.Marshal(struct {
+		UserID        int                 `json:"user_id"`
+		ProviderKeyID int                 `json:"provider_key_id"`
+		Request       types.OpenAIRequest `json:"request"`
+	}{userID, providerKeyID, req})
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// coalesce runs send, unless an identical request is already in flight, in
+// which case it waits for and returns that request's result instead.
+func coalesce(key string, send func() (*types.OpenAIResponse, error)) (*types.OpenAIResponse, error) {
+	leader := false
+	v, err, shared := inFlight.Do(key, func() (interface{}, error) {
+		leader = true
+		resp, err := send()
+		if resp == nil {
+			return nil, err
+		}
+		// Shared by value, so every caller, the leader included, gets its own
+		// copy to fill in usage and an ID on
+		return *resp, err
+	})
+	resp, ok := v.(types.OpenAIResponse)
+	if !ok {
+		return nil, err
+	}
+	if shared && !leader {
+		coalescedRequests.Add(1)
+	}
+	return &resp, err
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/types"
+)
+
+func TestCoalesce_SharesConcurrentDuplicates(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	send := func() (*types.OpenAIResponse, error) {
+		calls.Add(1)
+		<-release
+		return &types.OpenAIResponse{ID: "chatcmpl-shared"}, nil
+	}
+
+	before := coalescedRequests.Value()
+	key := requestKey(1, 2, types.OpenAIRequest{Model: "gpt-4o"})
+
+	var wg sync.WaitGroup
+	resps := make([]*types.OpenAIResponse, 5)
+	for i := range resps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], _ = coalesce(key, send)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected one upstream call, got %d", n)
+	}
+	if got := coalescedRequests.Value() - before; got != 4 {
+		t.Errorf("Expected 4 coalesced requests, got %d", got)
+	}
+	for i, resp := range resps {
+		if resp == nil || resp.ID != "chatcmpl-shared" {
+			t.Fatalf("Expected caller %d to get the shared response, got %+v", i, resp)
+		}
+		for _, other := range resps[:i] {
+			if other == resp {
+				t.Errorf("Expected each caller to get its own copy")
+			}
+		}
+	}
+}
+
+// TestCoalesce_CallersMutateIndependently fills in each caller's response the
+// way writeSuccess does, while the others read theirs. Run with -race.
+func TestCoalesce_CallersMutateIndependently(t *testing.T) {
+	release := make(chan struct{})
+	send := func() (*types.OpenAIResponse, error) {
+		<-release
+		return &types.OpenAIResponse{Choices: []types.OpenAIChoice{{Index: 0}}}, nil
+	}
+	key := requestKey(1, 3, types.OpenAIRequest{Model: "gpt-4o"})
+
+	var wg sync.WaitGroup
+	ids := make([]string, 8)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := coalesce(key, send)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			estimateUsage(resp, 10+i)
+			if resp.ID == "" {
+				resp.ID = newResponseID()
+			}
+			ids[i] = resp.ID
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			t.Errorf("Expected every caller to get its own response ID, got %v", ids)
+			break
+		}
+		seen[id] = true
+	}
+}
+
+func TestCoalesce_Error(t *testing.T) {
+	failed := errors.New("upstream error")
+	resp, err := coalesce(requestKey(1, 4, types.OpenAIRequest{}), func() (*types.OpenAIResponse, error) {
+		return nil, failed
+	})
+	if resp != nil || !errors.Is(err, failed) {
+		t.Errorf("Expected the send error and no response, got %+v, %v", resp, err)
+	}
+}
+
+func TestCoalescable(t *testing.T) {
+	zero, warm := 0.0, 0.7
+	tests := []struct {
+		name string
+		req  types.OpenAIRequest
+		want bool
+	}{
+		{name: "temperature 0", req: types.OpenAIRequest{Temperature: &zero}, want: true},
+		{name: "no temperature", req: types.OpenAIRequest{}, want: false},
+		{name: "sampled", req: types.OpenAIRequest{Temperature: &warm}, want: false},
+		{name: "streaming", req: types.OpenAIRequest{Temperature: &zero, Stream: true}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coalescable(tt.req); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	req := types.OpenAIRequest{Model: "gpt-4o", Temperature: &zero}
+	if requestKey(1, 2, req) == requestKey(3, 2, req) {
+		t.Error("Expected different users' requests never to be coalesced")
+	}
+}
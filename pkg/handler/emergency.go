@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/ratelimit"
+	"tokentracer-proxy/pkg/types"
+)
+
+// The emergency route is an operator-owned alias tried after a user's own
+// aliases and fallbacks have all failed. It is opt-in: both the owning user id
+// and the alias name must be set.
+var (
+	emergencyOwner = config.Int("EMERGENCY_ALIAS_OWNER", 0)
+	emergencyAlias = config.String("EMERGENCY_ALIAS", "")
+
+	emergencyUses = expvar.NewInt("emergency_fallbacks")
+)
+
+// tryEmergency routes req to the emergency alias when one is configured and
+// cause is the kind of error a fallback could fix. It reports whether a
+// response was written.
+func (s *ProxyServer) tryEmergency(ctx context.Context, w http.ResponseWriter, userID int, req types.OpenAIRequest, cause error, mode fallbackMode) bool {
+	// Streaming requests aren't routed to the emergency alias
+	if emergencyOwner == 0 || emergencyAlias == "" || req.Stream || !shouldFallback(&db.ModelAlias{}, cause, mode) {
+		return false
+	}
+	if !ratelimit.SpendAttempt(ctx) {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: attempt budget exhausted for user %d, not routing to emergency alias", userID)
+		return false
+	}
+
+	alias, err := s.Repo.GetModelAlias(ctx, emergencyOwner, emergencyAlias)
+	if err != nil {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: get emergency alias %q error: %v", emergencyAlias, err)
+		return false
+	}
+	if alias.Disabled {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: emergency alias %q is disabled", emergencyAlias)
+		return false
+	}
+	if alias.MaxMessages != nil && len(req.Messages) > *alias.MaxMessages {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: emergency alias %q cannot serve the request for user %d: %d messages exceeds limit of %d", emergencyAlias, userID, len(req.Messages), *alias.MaxMessages)
+		return false
+	}
+	providerType, _, err := s.Repo.GetProviderKey(ctx, alias.ProviderKeyID, emergencyOwner)
+	if err != nil {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: get provider key for emergency alias %q error: %v", emergencyAlias, err)
+		return false
+	}
+	prov, ok := newProvider(providerType, s.Repo, alias.ProviderKeyID, emergencyOwner)
+	if !ok {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: unsupported provider type %q for emergency alias %q", providerType, emergencyAlias)
+		return false
+	}
+
+	reqCopy := req
+	reqCopy.Model = alias.TargetModel
+	clampTemperature(ctx, &reqCopy, alias)
+	applySystemPrompt(&reqCopy, alias)
+	if err := provider.ApplyParamPolicy(ctx, s.Repo, userID, providerType, &reqCopy); err != nil {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: emergency alias %q cannot serve the request for user %d: %v", emergencyAlias, userID, err)
+		return false
+	}
+	if validateModels && !s.modelAvailable(ctx, providerType, reqCopy.Model) {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: model %q for emergency alias %q not in cached %s model list", reqCopy.Model, emergencyAlias, providerType)
+		return false
+	}
+	emergencyUses.Add(1)
+	logging.Printf(ctx, "EMERGENCY FALLBACK: all aliases failed for user %d (requested %q, last error: %v); routing to emergency alias %q (%s %s)",
+		userID, req.Model, cause, emergencyAlias, providerType, reqCopy.Model)
+
+	var resp *types.OpenAIResponse
+	var latency time.Duration
+	release, err := provider.AcquireSlot(ctx, providerType, alias.ProviderKeyID)
+	if err == nil {
+		start := time.Now()
+		resp, err = prov.Send(ctx, reqCopy)
+		latency = time.Since(start)
+		release()
+	}
+	if err != nil {
+		logging.Printf(ctx, "EMERGENCY FALLBACK: emergency alias %q failed for user %d: %v", emergencyAlias, userID, err)
+		return false
+	}
+
+	s.writeSuccess(ctx, w, userID, req, resp, providerType, reqCopy.Model, emergencyAlias, latency)
+	return true
+}
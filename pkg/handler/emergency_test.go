@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/db/dbtest"
+	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/ratelimit"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// recordingProvider records the request it was sent.
+type recordingProvider struct {
+	sent *types.OpenAIRequest
+}
+
+func (p *recordingProvider) Send(ctx context.Context, req types.OpenAIRequest) (*types.OpenAIResponse, error) {
+	p.sent = &req
+	return &types.OpenAIResponse{ID: "emergency-id", Usage: types.OpenAIUsage{PromptTokens: 4, CompletionTokens: 2}}, nil
+}
+
+func (p *recordingProvider) ListModels(ctx context.Context) ([]string, error) { return nil, nil }
+
+// attemptBudgetCtx returns a request context carrying an attempt budget of
+// limit, with the request's first attempt already spent, as
+// RateLimitMiddleware leaves it.
+func attemptBudgetCtx(t *testing.T, mock pgxmock.PgxPoolIface, userID, limit int) context.Context {
+	t.Helper()
+	orig := db.Pool
+	db.Pool = mock
+	defer func() { db.Pool = orig }()
+
+	mock.ExpectQuery("SELECT rate_limit_minute, rate_limit_daily").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"minute", "daily", "attempts", "tokens", "prev_minute", "prev_daily", "grace_until"}).
+			AddRow(0, 0, limit, 0, nil, nil, nil))
+	var ctx context.Context
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+	ratelimit.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if ctx == nil {
+		t.Fatal("Expected the rate limit middleware to pass the request on")
+	}
+	return ctx
+}
+
+func TestTryEmergency(t *testing.T) {
+	defer func(owner int, alias string) { emergencyOwner, emergencyAlias = owner, alias }(emergencyOwner, emergencyAlias)
+	defer func(v bool) { validateModels = v }(validateModels)
+
+	hot, capped, maxMessages := 1.5, 0.7, 1
+	preamble := "Be brief."
+	cause := &provider.ProviderError{StatusCode: http.StatusServiceUnavailable}
+	emergency := db.ModelAlias{ID: 9, UserID: 1, Alias: "emergency", TargetModel: "gpt-4o-mini", ProviderKeyID: 8, MaxTemperature: &capped}
+
+	tests := []struct {
+		name      string
+		owner     int
+		validate  bool
+		req       types.OpenAIRequest
+		budget    int
+		alias     *db.ModelAlias
+		models    []string
+		wantRoute bool
+		wantTemp  float64
+		// wantSystem is the system message expected ahead of the client's
+		wantSystem string
+	}{
+		{
+			name:  "routed",
+			owner: 1, alias: &emergency, validate: true, models: []string{"gpt-4o-mini"},
+			req:       types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}}, Temperature: &hot},
+			wantRoute: true, wantTemp: capped,
+		},
+		{
+			name:  "system prompt override",
+			owner: 1, alias: &db.ModelAlias{ID: 9, UserID: 1, Alias: "emergency", TargetModel: "gpt-4o-mini", ProviderKeyID: 8, MaxTemperature: &capped, SystemPromptOverride: &preamble},
+			req:       types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}}, Temperature: &hot},
+			wantRoute: true, wantTemp: capped, wantSystem: preamble,
+		},
+		{
+			name: "not configured",
+			req:  types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}}},
+		},
+		{
+			name:  "attempt budget exhausted",
+			owner: 1, budget: 1,
+			req: types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}}},
+		},
+		{
+			name:  "alias disabled",
+			owner: 1, alias: &db.ModelAlias{ID: 9, UserID: 1, Alias: "emergency", TargetModel: "gpt-4o-mini", ProviderKeyID: 8, Disabled: true},
+			req: types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}}},
+		},
+		{
+			name:  "too many messages",
+			owner: 1, alias: &db.ModelAlias{ID: 9, UserID: 1, Alias: "emergency", TargetModel: "gpt-4o-mini", ProviderKeyID: 8, MaxMessages: &maxMessages},
+			req: types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}, {Role: "user", Content: "Again"}}},
+		},
+		{
+			name:  "model unavailable",
+			owner: 1, alias: &emergency, validate: true, models: []string{"gpt-4o"},
+			req: types.OpenAIRequest{Model: "mine", Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}}},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			s := NewProxyServer(db.NewPostgresRepository(mockDB))
+			emergencyOwner, emergencyAlias = tt.owner, "emergency"
+			validateModels = tt.validate
+
+			prov := &recordingProvider{}
+			defer SetProviderFactory("openai", func(r db.Repository, k, u int) provider.Provider { return prov })()
+
+			userID := 8801 + i
+			ctx := context.Background()
+			if tt.budget > 0 {
+				ctx = attemptBudgetCtx(t, mockDB, userID, tt.budget)
+			}
+			if tt.alias != nil {
+				mockDB.ExpectQuery("SELECT (.+) FROM model_aliases").WithArgs(1, "emergency").
+					WillReturnRows(dbtest.AliasRows(mockDB, *tt.alias))
+			}
+			if tt.alias != nil && !tt.alias.Disabled && tt.alias.MaxMessages == nil {
+				mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(8, 1).
+					WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "fake-key"))
+			}
+			if tt.models != nil {
+				rows := mockDB.NewRows([]string{"model_id"})
+				for _, m := range tt.models {
+					rows.AddRow(m)
+				}
+				mockDB.ExpectQuery("SELECT model_id FROM provider_models").WithArgs("openai").WillReturnRows(rows)
+			}
+			if tt.wantRoute {
+				mockDB.ExpectExec("INSERT INTO request_logs").
+					WithArgs(userID, "emergency", "openai", "gpt-4o-mini", 4, 2, 200, pgxmock.AnyArg(), db.EndpointChatCompletions, pgxmock.AnyArg(), "emergency-id", "", pgxmock.AnyArg(), pgxmock.AnyArg(), false, false).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			}
+
+			w := httptest.NewRecorder()
+			if got := s.tryEmergency(ctx, w, userID, tt.req, cause, fallbackDefault); got != tt.wantRoute {
+				t.Errorf("Expected routed: %v, got %v", tt.wantRoute, got)
+			}
+			if (prov.sent != nil) != tt.wantRoute {
+				t.Fatalf("Expected sent to the emergency alias: %v, got %+v", tt.wantRoute, prov.sent)
+			}
+			if tt.wantRoute {
+				if prov.sent.Model != "gpt-4o-mini" || prov.sent.Temperature == nil || *prov.sent.Temperature != tt.wantTemp {
+					t.Errorf("Expected gpt-4o-mini at temperature %g, got %+v", tt.wantTemp, prov.sent)
+				}
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected status 200, got %d", w.Code)
+				}
+				if tt.wantSystem != "" {
+					if len(prov.sent.Messages) != 2 || prov.sent.Messages[0].Role != "system" || prov.sent.Messages[0].Content != tt.wantSystem {
+						t.Errorf("Expected the system prompt override ahead of the request's messages, got %+v", prov.sent.Messages)
+					}
+				} else if len(prov.sent.Messages) != len(tt.req.Messages) {
+					t.Errorf("Expected the request's messages unchanged, got %+v", prov.sent.Messages)
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			if err := mockDB.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
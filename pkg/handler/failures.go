@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/types"
+)
+
+// logRequestBodies controls whether request bodies are persisted alongside
+// failed requests. Off by default since message content may be sensitive.
+var logRequestBodies = config.Bool("LOG_REQUEST_BODIES", false)
+
+// logFailure asynchronously records a request that failed after all fallbacks
+// in the failed_requests dead-letter table, and in the request log against
+// the last alias attempted. providerType is that alias's provider.
+func (s *ProxyServer) logFailure(ctx context.Context, userID int, req types.OpenAIRequest, attempted []string, providerType string, status int, cause error) {
+	f := db.FailedRequest{
+		UserID:           userID,
+		RequestedModel:   req.Model,
+		AttemptedAliases: attempted,
+		StatusCode:       status,
+	}
+	if cause != nil {
+		f.Error = cause.Error()
+	}
+	if logRequestBodies {
+		if body, err := json.Marshal(req); err == nil {
+			b := string(body)
+			f.RequestBody = &b
+		}
+	}
+
+	var aliasUsed string
+	if len(attempted) > 0 {
+		aliasUsed = attempted[len(attempted)-1]
+	}
+	entry := failedRequestLog(userID, providerType, aliasUsed, status, cause)
+
+	logs.enqueue(ctx, func(ctx context.Context) {
+		if err := s.Repo.InsertFailedRequest(ctx, f); err != nil {
+			logging.Printf(ctx, "proxy handler: insert failed request error: %v", err)
+		}
+		if err := s.Repo.InsertRequestLog(ctx, entry); err != nil {
+			logging.Printf(ctx, "proxy handler: insert request log error: %v", err)
+		}
+	})
+}
+
+// logRejected asynchronously records a request rejected before it reached a
+// provider, e.g. for an unknown alias, in the request log.
+func (s *ProxyServer) logRejected(ctx context.Context, userID int, aliasUsed string, status int, cause error) {
+	entry := failedRequestLog(userID, "", aliasUsed, status, cause)
+	logs.enqueue(ctx, func(ctx context.Context) {
+		if err := s.Repo.InsertRequestLog(ctx, entry); err != nil {
+			logging.Printf(ctx, "proxy handler: insert request log error: %v", err)
+		}
+	})
+}
+
+// failedRequestLog is the request log entry for a failed chat completion,
+// with no tokens and the error as the message.
+func failedRequestLog(userID int, providerType, aliasUsed string, status int, cause error) db.RequestLog {
+	entry := db.RequestLog{
+		UserID:       userID,
+		AliasUsed:    aliasUsed,
+		ProviderUsed: providerType,
+		StatusCode:   status,
+		Endpoint:     db.EndpointChatCompletions,
+	}
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+	return entry
+}
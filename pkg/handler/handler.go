@@ -3,167 +3,615 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/config"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/denylist"
+	"tokentracer-proxy/pkg/features"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/pricing"
 	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/ratelimit"
+	"tokentracer-proxy/pkg/timing"
 	"tokentracer-proxy/pkg/types"
+
+	"github.com/jackc/pgx/v5"
 )
 
-// Provider factories for testing
+// ProviderCreator builds a provider for a user's provider key.
 type ProviderCreator func(repository db.Repository, providerKeyID, userID int) provider.Provider
 
+// providerFactories holds overrides of the built-in provider constructors,
+// keyed by provider type. Tests use SetProviderFactory to inject mocks.
 var (
-	AnthropicProviderFactory ProviderCreator = func(r db.Repository, k, u int) provider.Provider {
-		return provider.NewAnthropicProvider(r, k, u)
-	}
-	OpenAIProviderFactory ProviderCreator = func(r db.Repository, k, u int) provider.Provider {
-		return provider.NewOpenAIProvider(r, k, u)
+	providerFactories   = make(map[string]ProviderCreator)
+	providerFactoriesMu sync.RWMutex
+)
+
+// SetProviderFactory overrides the constructor used for providerType and
+// returns a function that restores the previous one:
+//
+//	defer handler.SetProviderFactory("anthropic", mockFactory)()
+func SetProviderFactory(providerType string, factory ProviderCreator) (restore func()) {
+	providerFactoriesMu.Lock()
+	prev, hadPrev := providerFactories[providerType]
+	providerFactories[providerType] = factory
+	providerFactoriesMu.Unlock()
+
+	return func() {
+		providerFactoriesMu.Lock()
+		defer providerFactoriesMu.Unlock()
+		if hadPrev {
+			providerFactories[providerType] = prev
+		} else {
+			delete(providerFactories, providerType)
+		}
 	}
-	GeminiProviderFactory ProviderCreator = func(r db.Repository, k, u int) provider.Provider {
-		return provider.NewGeminiProvider(r, k, u)
+}
+
+// newProvider resolves the provider for providerType, preferring overrides.
+func newProvider(providerType string, repo db.Repository, providerKeyID, userID int) (provider.Provider, bool) {
+	providerFactoriesMu.RLock()
+	factory, ok := providerFactories[providerType]
+	providerFactoriesMu.RUnlock()
+	if ok {
+		return factory(repo, providerKeyID, userID), true
 	}
-)
+	return provider.New(providerType, repo, providerKeyID, userID)
+}
 
 type ProxyServer struct {
-	Repo db.Repository
+	Repo   db.Repository
+	Tokens TokenCounter
 }
 
 func NewProxyServer(repo db.Repository) *ProxyServer {
-	return &ProxyServer{Repo: repo}
+	return &ProxyServer{Repo: repo, Tokens: defaultTokenCounter}
 }
 
 func (s *ProxyServer) ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	// 0. Get User from Context (set by AuthMiddleware)
 	userID, ok := r.Context().Value(auth.KeyUser).(int)
 	if !ok {
-		log.Printf("proxy handler: missing user context")
+		logging.Printf(r.Context(), "proxy handler: missing user context")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	// Sampled latency breakdown, logged once the request completes
+	var timings *timing.Recorder
+	if timing.Sample() {
+		timings = timing.New()
+		r = r.WithContext(timing.NewContext(r.Context(), timings))
+	}
+
 	// 1. Decode OpenAI Request
 	var openAIReq types.OpenAIRequest
 	if err := json.NewDecoder(r.Body).Decode(&openAIReq); err != nil {
-		log.Printf("proxy handler: decode request body error: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		logging.Printf(r.Context(), "proxy handler: decode request body error: %v", err)
+		httperr.BadBody(w, err, "Invalid request body")
+		return
+	}
+
+	if timings != nil {
+		defer func() { logging.Printf(r.Context(), "timing: user=%d model=%q %s", userID, openAIReq.Model, timings) }()
+	}
+
+	if openAIReq.Stream && !features.HasFeature(r.Context(), s.Repo, userID, features.Streaming) {
+		http.Error(w, "Streaming is not enabled for this account", http.StatusForbidden)
+		return
+	}
+	if len(openAIReq.Tools) > 0 && !features.HasFeature(r.Context(), s.Repo, userID, features.ToolCalling) {
+		http.Error(w, "Tool calling is not enabled for this account", http.StatusForbidden)
+		return
+	}
+
+	if denylist.Enabled() {
+		if pattern, blocked := denylist.Match(messageText(openAIReq.Messages)); blocked {
+			logging.Printf(r.Context(), "proxy handler: blocked request from user %d for model %q: matched denylist pattern %q", userID, openAIReq.Model, pattern)
+			http.Error(w, "Request blocked by content policy", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cacheable := coalescable(openAIReq) && features.HasFeature(r.Context(), s.Repo, userID, features.Caching)
+	if cacheable {
+		if entry, ok := responses.get(cacheKey(userID, openAIReq)); ok {
+			s.writeCached(r.Context(), w, userID, openAIReq, entry)
+			return
+		}
+	}
+
+	if err := ratelimit.CheckTokenBudget(r.Context(), s.Tokens.CountTokens(openAIReq.Model, openAIReq.Messages)); err != nil {
+		var budgetErr *ratelimit.TokenBudgetError
+		if errors.As(err, &budgetErr) {
+			http.Error(w, "Daily token limit exceeded: "+budgetErr.Error(), http.StatusTooManyRequests)
+			return
+		}
+		logging.Printf(r.Context(), "proxy handler: token budget check error for user %d: %v", userID, err)
+		http.Error(w, "Rate limit check failed", http.StatusInternalServerError)
+		return
+	}
+
+	mode, ok := parseFallbackMode(r.Header.Get("X-Fallback"))
+	if !ok {
+		http.Error(w, "X-Fallback must be one of off, default, max", http.StatusBadRequest)
 		return
 	}
 
 	// 2. Resolve Alias and Handle Request (with fallback)
 	currentModel := openAIReq.Model
-	maxDepth := 2 // Prevent infinite loops
-	var lastErr error
+	maxDepth := fallbackDepth
+	if mode == fallbackMax {
+		maxDepth = max(fallbackDepth, maxFallbackDepth)
+	}
+	var lastErr, firstErr error
+	var attempted []string
+	var failures []string   // "alias: error" for each alias that failed, in order
+	var lastProvider string // provider of the last alias attempted
+	// IDs of the aliases tried so far, to break fallback cycles
+	visited := make(map[int]bool)
 
 	for i := 0; i < maxDepth; i++ {
 		// Lookup Model Alias
+		logging.SetAlias(r.Context(), currentModel)
+		resolveStart := time.Now()
 		alias, err := s.Repo.GetModelAlias(r.Context(), userID, currentModel)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// No exact alias; exact matches always win over patterns
+			alias, err = s.Repo.MatchModelAlias(r.Context(), userID, currentModel)
+			if err == nil {
+				logging.Printf(r.Context(), "proxy handler: model %q (user %d) matched pattern alias %q", currentModel, userID, alias.Alias)
+				currentModel = alias.Alias
+			}
+		}
+		if err == nil && alias.IsPattern {
+			alias.TargetModel = strings.ReplaceAll(alias.TargetModel, db.ModelPlaceholder, openAIReq.Model)
+		}
 
 		if err != nil {
-			log.Printf("proxy handler: get model alias %q error: %v", currentModel, err)
+			logging.Printf(r.Context(), "proxy handler: get model alias %q error: %v", currentModel, err)
+			s.logRejected(r.Context(), userID, currentModel, http.StatusNotFound, fmt.Errorf("unknown model alias %q", currentModel))
 			http.Error(w, "Unknown model alias: "+currentModel, http.StatusNotFound)
 			return
 		}
 
+		if visited[alias.ID] {
+			// Only reachable through a fallback, so lastErr is set
+			cycle := strings.Join(append(attempted, currentModel), " -> ")
+			logging.Printf(r.Context(), "proxy handler: fallback cycle for user %d: %s: %v", userID, cycle, lastErr)
+			if s.tryEmergency(r.Context(), w, userID, openAIReq, lastErr, mode) {
+				return
+			}
+			setFallbackChain(w.Header(), attempted)
+			s.logFailure(r.Context(), userID, openAIReq, attempted, lastProvider, http.StatusLoopDetected, fmt.Errorf("fallback cycle %s: %w", cycle, lastErr))
+			http.Error(w, "Fallback cycle detected: "+cycle, http.StatusLoopDetected)
+			return
+		}
+		visited[alias.ID] = true
+
+		if alias.Disabled {
+			reason := "disabled"
+			if alias.FlaggedReason != nil {
+				reason += ": " + *alias.FlaggedReason
+			}
+			logging.Printf(r.Context(), "proxy handler: alias %q (user %d) is %s", currentModel, userID, reason)
+			if alias.FallbackAliasID != nil && mode != fallbackOff {
+				if fallbackAliasName, errFB := s.Repo.GetModelAliasByID(r.Context(), *alias.FallbackAliasID); errFB == nil {
+					attempted = append(attempted, currentModel)
+					lastErr = fmt.Errorf("alias %q is %s", currentModel, reason)
+					failures = append(failures, fmt.Sprintf("%s: %v", currentModel, lastErr))
+					currentModel = fallbackAliasName
+					continue
+				}
+			}
+			http.Error(w, fmt.Sprintf("Alias '%s' is %s", currentModel, reason), http.StatusFailedDependency)
+			return
+		}
+
+		if alias.MaxMessages != nil && len(openAIReq.Messages) > *alias.MaxMessages {
+			logging.Printf(r.Context(), "proxy handler: rejected request from user %d for alias %q: %d messages exceeds limit of %d", userID, currentModel, len(openAIReq.Messages), *alias.MaxMessages)
+			http.Error(w, fmt.Sprintf("Conversation has %d messages; alias '%s' allows at most %d", len(openAIReq.Messages), currentModel, *alias.MaxMessages), http.StatusBadRequest)
+			return
+		}
+
 		// Fetch Provider Type
 		providerType, _, err := s.Repo.GetProviderKey(r.Context(), alias.ProviderKeyID, userID)
+		timings.Since(timing.ResolveAlias, resolveStart)
 
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The alias's provider key was deleted; use the fallback if there is one
+			logging.Printf(r.Context(), "proxy handler: alias %q (user %d) references deleted provider key %d", currentModel, userID, alias.ProviderKeyID)
+			if alias.FallbackAliasID != nil && mode != fallbackOff {
+				if fallbackAliasName, errFB := s.Repo.GetModelAliasByID(r.Context(), *alias.FallbackAliasID); errFB == nil {
+					attempted = append(attempted, currentModel)
+					lastErr = fmt.Errorf("alias %q references a deleted provider key", currentModel)
+					failures = append(failures, fmt.Sprintf("%s: %v", currentModel, lastErr))
+					currentModel = fallbackAliasName
+					continue
+				}
+			}
+			http.Error(w, fmt.Sprintf("Alias '%s' references a deleted provider key. Point it at an existing key with PATCH /manage/aliases/%s.", currentModel, currentModel), http.StatusFailedDependency)
+			return
+		}
 		if err != nil {
-			log.Printf("proxy handler: get provider key for alias %q error: %v", currentModel, err)
+			logging.Printf(r.Context(), "proxy handler: get provider key for alias %q error: %v", currentModel, err)
 			http.Error(w, "Provider configuration not found", http.StatusInternalServerError)
 			return
 		}
 
 		// Instantiate Provider Strategy
-		var prov provider.Provider
-		switch providerType {
-		case "anthropic":
-			prov = AnthropicProviderFactory(s.Repo, alias.ProviderKeyID, userID)
-		case "openai":
-			prov = OpenAIProviderFactory(s.Repo, alias.ProviderKeyID, userID)
-		case "gemini":
-			prov = GeminiProviderFactory(s.Repo, alias.ProviderKeyID, userID)
-		default:
-			log.Printf("proxy handler: unsupported provider type %q for alias %q", providerType, currentModel)
+		prov, ok := newProvider(providerType, s.Repo, alias.ProviderKeyID, userID)
+		if !ok {
+			logging.Printf(r.Context(), "proxy handler: unsupported provider type %q for alias %q", providerType, currentModel)
 			http.Error(w, "Unsupported provider: "+providerType, http.StatusBadRequest)
 			return
 		}
+		streamer, canStream := prov.(provider.StreamSender)
+		if openAIReq.Stream && !canStream {
+			http.Error(w, "Streaming is not supported for provider: "+providerType, http.StatusBadRequest)
+			return
+		}
 
 		// Send Request
 		reqCopy := openAIReq
 		reqCopy.Model = alias.TargetModel
+		if len(alias.WeightedTargets) > 0 {
+			reqCopy.Model = pickWeightedTarget(alias.WeightedTargets)
+			logging.Printf(r.Context(), "proxy handler: alias %q (user %d) routed to weighted target %q", currentModel, userID, reqCopy.Model)
+		}
 
 		// Check for light model optimization
 		if alias.UseLightModel && alias.LightModel != nil && *alias.LightModel != "" {
-			tokens := estimateTokens(openAIReq.Messages)
+			tokens := s.Tokens.CountTokens(reqCopy.Model, openAIReq.Messages)
 			if tokens < alias.LightModelThreshold {
 				reqCopy.Model = *alias.LightModel
 			}
 		}
 
-		openAIResp, err := prov.Send(r.Context(), reqCopy)
+		clampTemperature(r.Context(), &reqCopy, alias)
+		applySystemPrompt(&reqCopy, alias)
+
+		if alias.ResponseFormatFallback && reqCopy.ResponseFormat != nil && !provider.SupportsParam(providerType, "response_format") {
+			logging.Printf(r.Context(), "proxy handler: downgrading response_format for alias %q (user %d): not supported by %s", currentModel, userID, providerType)
+			downgradeResponseFormat(&reqCopy)
+		}
+
+		if err := provider.ApplyParamPolicy(r.Context(), s.Repo, userID, providerType, &reqCopy); err != nil {
+			logging.Printf(r.Context(), "proxy handler: alias %q (user %d): %v", currentModel, userID, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if validateModels && !s.modelAvailable(r.Context(), providerType, reqCopy.Model) {
+			logging.Printf(r.Context(), "proxy handler: model %q for alias %q not in cached %s model list", reqCopy.Model, currentModel, providerType)
+			http.Error(w, "model not available: "+reqCopy.Model, http.StatusBadRequest)
+			return
+		}
+
+		attempted = append(attempted, currentModel)
+		lastProvider = providerType
+		var openAIResp *types.OpenAIResponse
+		var usage types.OpenAIUsage
+		var sse *sseWriter
+		var latency time.Duration
+		sendCtx, upstreamLimit := provider.WithRateLimitCapture(r.Context())
+		sendOnce := func() (*types.OpenAIResponse, error) {
+			release, err := provider.AcquireSlot(r.Context(), providerType, alias.ProviderKeyID)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			defer timings.Since(timing.Upstream, time.Now())
+			if openAIReq.Stream {
+				sse = newSSEWriter(r.Context(), w)
+				sse.upstreamLimit = upstreamLimit
+				usage, err = streamer.SendStream(sendCtx, reqCopy, sse.emit)
+				return nil, err
+			}
+			return prov.Send(sendCtx, reqCopy)
+		}
+		send := func() error {
+			start := time.Now()
+			defer func() { latency = time.Since(start) }()
+			if coalescable(reqCopy) {
+				openAIResp, err = coalesce(requestKey(userID, alias.ProviderKeyID, reqCopy), sendOnce)
+			} else {
+				openAIResp, err = sendOnce()
+			}
+			return err
+		}
+		err = send()
+		if err != nil && alias.ResponseFormatFallback && reqCopy.ResponseFormat != nil &&
+			(sse == nil || !sse.started) && isResponseFormatRejection(err) {
+			logging.Printf(r.Context(), "proxy handler: %s rejected response_format for alias %q (user %d), retrying without it: %v", reqCopy.Model, currentModel, userID, err)
+			downgradeResponseFormat(&reqCopy)
+			err = send()
+		}
+		if err != nil && sse != nil && sse.started {
+			// Part of the response is already with the client, so there is no
+			// falling back; ending without [DONE] tells it the stream was cut.
+			sse.close()
+			logging.Printf(r.Context(), "proxy handler: stream failed for alias %q (user %d): %v", currentModel, userID, err)
+			s.logFailure(r.Context(), userID, openAIReq, attempted, providerType, http.StatusBadGateway, err)
+			return
+		}
 		if err != nil {
-			if alias.FallbackAliasID != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			wantsFallback := alias.FallbackAliasID != nil && shouldFallback(alias, err, mode)
+			if wantsFallback && !ratelimit.SpendAttempt(r.Context()) {
+				// Attempt budget used up; don't pile more load on a failing provider
+				logging.Printf(r.Context(), "proxy handler: attempt budget exhausted for user %d, not falling back from alias %q: %v", userID, currentModel, err)
+				setFallbackChain(w.Header(), attempted)
+				s.logFailure(r.Context(), userID, openAIReq, attempted, providerType, failureStatus(firstErr), firstErr)
+				writeProviderFailure(r.Context(), w, firstErr, "Provider request failed")
+				return
+			}
+			if wantsFallback {
 				// Get fallback alias name
 				fallbackAliasName, errFB := s.Repo.GetModelAliasByID(r.Context(), *alias.FallbackAliasID)
 				if errFB == nil {
-					log.Printf("proxy handler: provider request failed for alias %q (user %d), trying fallback: %v", currentModel, userID, err)
+					logging.Printf(r.Context(), "proxy handler: provider request failed for alias %q (user %d), trying fallback: %v", currentModel, userID, err)
+					failures = append(failures, fmt.Sprintf("%s: %v", currentModel, err))
 					currentModel = fallbackAliasName
 					lastErr = err
 					continue // Try again with fallback alias
 				}
 			}
-			log.Printf("proxy handler: provider request failed for alias %q (user %d): %v", currentModel, userID, err)
-			http.Error(w, "Provider request failed", http.StatusBadGateway)
+			logging.Printf(r.Context(), "proxy handler: provider request failed for alias %q (user %d): %v", currentModel, userID, err)
+			if s.tryEmergency(r.Context(), w, userID, openAIReq, err, mode) {
+				return
+			}
+			setFallbackChain(w.Header(), attempted)
+			if errors.Is(err, provider.ErrConcurrencyLimit) {
+				s.logFailure(r.Context(), userID, openAIReq, attempted, providerType, http.StatusTooManyRequests, err)
+				http.Error(w, "Provider concurrency limit reached", http.StatusTooManyRequests)
+				return
+			}
+			s.logFailure(r.Context(), userID, openAIReq, attempted, providerType, failureStatus(err), err)
+			writeProviderFailure(r.Context(), w, err, "Provider request failed")
 			return
 		}
 
 		// Success!
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(openAIResp); err != nil {
-			log.Printf("proxy handler: encode response error: %v", err)
-		}
-
-		// Async Logging
-		go func(uid int, provType, model, aliasUsed string, in, out int) {
-			if err := s.Repo.InsertRequestLog(context.Background(), db.RequestLog{
-				UserID:       uid,
-				AliasUsed:    aliasUsed,
-				ProviderUsed: provType,
-				ModelUsed:    model,
-				InputTokens:  in,
-				OutputTokens: out,
-				StatusCode:   http.StatusOK,
-			}); err != nil {
-				log.Printf("proxy handler: insert request log error: %v", err)
-			}
-		}(userID, providerType, reqCopy.Model, currentModel, openAIResp.Usage.PromptTokens, openAIResp.Usage.CompletionTokens)
-
+		if sse != nil {
+			sse.done()
+			sse.close()
+			s.logUsage(r.Context(), userID, providerType, reqCopy.Model, currentModel, usage, false, s.Tokens.CountTokens(reqCopy.Model, openAIReq.Messages), sse.responseID, "", latency)
+			return
+		}
+		if ttl := cacheTTL(alias); cacheable && ttl > 0 {
+			responses.put(cacheKey(userID, openAIReq), openAIResp, providerType, reqCopy.Model, currentModel, ttl)
+		}
+		setUpstreamRateLimitHeaders(w.Header(), upstreamLimit)
+		s.writeSuccess(r.Context(), w, userID, openAIReq, openAIResp, providerType, reqCopy.Model, currentModel, latency)
 		return
 	}
 
 	if lastErr != nil {
-		log.Printf("proxy handler: all fallbacks failed for user %d: %v", userID, lastErr)
-		http.Error(w, "All fallbacks failed", http.StatusBadGateway)
+		logging.Printf(r.Context(), "proxy handler: all fallbacks failed for user %d: %s", userID, strings.Join(failures, "; "))
+		if s.tryEmergency(r.Context(), w, userID, openAIReq, lastErr, mode) {
+			return
+		}
+		setFallbackChain(w.Header(), attempted)
+		s.logFailure(r.Context(), userID, openAIReq, attempted, lastProvider, failureStatus(lastErr), lastErr)
+		writeProviderFailure(r.Context(), w, lastErr, "All fallbacks failed: "+strings.Join(failures, "; "))
 	} else {
-		log.Printf("proxy handler: max fallback depth reached for user %d", userID)
+		logging.Printf(r.Context(), "proxy handler: max fallback depth reached for user %d", userID)
 		http.Error(w, "Max fallback depth reached", http.StatusLoopDetected)
 	}
 }
 
-func estimateTokens(messages []types.OpenAIMessage) int {
-	totalChars := 0
-	for _, m := range messages {
-		totalChars += len(m.Content)
+// writeSuccess returns a completion to the client and logs the request asynchronously.
+func (s *ProxyServer) writeSuccess(ctx context.Context, w http.ResponseWriter, userID int, req types.OpenAIRequest, resp *types.OpenAIResponse, providerType, model, aliasUsed string, latency time.Duration) {
+	estimated := s.Tokens.CountTokens(model, req.Messages)
+	usageEstimated := estimateUsage(resp, estimated)
+	if usageEstimated {
+		w.Header().Set("X-Usage-Estimated", "true")
 	}
-	// Simple heuristic: 4 characters per token
-	if totalChars == 0 {
-		return 0
+	if shouldStore(req) {
+		s.storeResponse(ctx, userID, req, resp)
 	}
-	tokens := totalChars / 4
-	if tokens == 0 {
-		return 1
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Printf(ctx, "proxy handler: encode response error: %v", err)
+	}
+
+	s.logUsage(ctx, userID, providerType, model, aliasUsed, resp.Usage, usageEstimated, estimated, resp.ID, resp.UpstreamID, latency)
+}
+
+// logUsage records a successful completion's token usage and upstream
+// latency asynchronously. usageEstimated marks usage as the proxy's estimate
+// rather than the provider's count. upstreamID is the provider's response id
+// when it differs from responseID.
+func (s *ProxyServer) logUsage(ctx context.Context, userID int, providerType, model, aliasUsed string, usage types.OpenAIUsage, usageEstimated bool, estimated int, responseID, upstreamID string, latency time.Duration) {
+	latencyMS := int(latency.Milliseconds())
+	logs.enqueue(ctx, func(ctx context.Context) {
+		if err := s.Repo.InsertRequestLog(ctx, db.RequestLog{
+			UserID:               userID,
+			AliasUsed:            aliasUsed,
+			ProviderUsed:         providerType,
+			ModelUsed:            model,
+			InputTokens:          usage.PromptTokens,
+			OutputTokens:         usage.CompletionTokens,
+			EstimatedInputTokens: &estimated,
+			StatusCode:           http.StatusOK,
+			Endpoint:             db.EndpointChatCompletions,
+			EstimatedCost:        pricing.Cost(model, usage.PromptTokens, usage.CompletionTokens),
+			ResponseID:           responseID,
+			UpstreamResponseID:   upstreamID,
+			LatencyMS:            &latencyMS,
+			UsageEstimated:       usageEstimated,
+		}); err != nil {
+			logging.Printf(ctx, "proxy handler: insert request log error: %v", err)
+		}
+	})
+}
+
+// failureStatus is the status a failed upstream call is answered with: the
+// upstream's own for errors the caller can act on, otherwise 502.
+func failureStatus(err error) int {
+	var perr *provider.ProviderError
+	if errors.As(err, &perr) {
+		return perr.ClientStatus()
+	}
+	return http.StatusBadGateway
+}
+
+// writeProviderFailure responds to a failed upstream call with failureStatus.
+// Upstream error bodies are normalized into the OpenAI error envelope so
+// clients see the same shape whichever provider failed; other errors get the
+// plain message.
+func writeProviderFailure(ctx context.Context, w http.ResponseWriter, err error, message string) {
+	var perr *provider.ProviderError
+	if !errors.As(err, &perr) {
+		http.Error(w, message, http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(perr.ClientStatus())
+	if err := json.NewEncoder(w).Encode(perr.OpenAIError()); err != nil {
+		logging.Printf(ctx, "proxy handler: encode error response error: %v", err)
+	}
+}
+
+// setFallbackChain lists the aliases a failed request tried, in order, in the
+// X-Fallback-Chain header, once it has fallen back at least once.
+func setFallbackChain(h http.Header, attempted []string) {
+	if len(attempted) > 1 {
+		h.Set("X-Fallback-Chain", strings.Join(attempted, " -> "))
+	}
+}
+
+// fallbackMode is the per-request fallback behavior chosen with the X-Fallback header.
+type fallbackMode int
+
+const (
+	fallbackDefault fallbackMode = iota // the alias's configured behavior
+	fallbackOff                         // fail fast on the first error
+	fallbackMax                         // fall back on any error, up to maxFallbackDepth
+)
+
+// fallbackDepth is the number of aliases tried per request: by default the
+// requested alias plus two tiers of fallback.
+var fallbackDepth = config.Int("MAX_FALLBACK_DEPTH", 3)
+
+// maxFallbackDepth is the number of aliases tried with X-Fallback: max, unless
+// MAX_FALLBACK_DEPTH is higher.
+const maxFallbackDepth = 5
+
+func parseFallbackMode(header string) (fallbackMode, bool) {
+	switch strings.ToLower(strings.TrimSpace(header)) {
+	case "", "default":
+		return fallbackDefault, true
+	case "off":
+		return fallbackOff, true
+	case "max":
+		return fallbackMax, true
+	}
+	return fallbackDefault, false
+}
+
+// shouldFallback decides whether a failed Send should move on to the alias's
+// fallback. Transport errors always do; upstream statuses are checked against
+// the alias's fallback_on_statuses, or the default classification when unset.
+// X-Fallback: off never falls back and max falls back on any error.
+func shouldFallback(alias *db.ModelAlias, err error, mode fallbackMode) bool {
+	switch mode {
+	case fallbackOff:
+		return false
+	case fallbackMax:
+		return true
+	}
+
+	var perr *provider.ProviderError
+	if !errors.As(err, &perr) {
+		return true
+	}
+	if alias.FallbackOnStatuses != nil {
+		return slices.Contains(alias.FallbackOnStatuses, perr.StatusCode)
+	}
+	return provider.FallbackEligible(perr.StatusCode)
+}
+
+// pickWeightedTarget chooses one of the targets with probability proportional to its weight.
+func pickWeightedTarget(targets []db.WeightedTarget) string {
+	total := 0
+	for _, t := range targets {
+		total += t.Weight
+	}
+	if total <= 0 {
+		return targets[0].Model
+	}
+
+	n := rand.IntN(total) //nolint:gosec // canary routing doesn't need a CSPRNG
+	for _, t := range targets {
+		if n < t.Weight {
+			return t.Model
+		}
+		n -= t.Weight
+	}
+	return targets[len(targets)-1].Model
+}
+
+// defaultMaxTemperature caps request temperature for aliases without their own
+// max_temperature. Unset (the default) means no cap.
+var defaultMaxTemperature *float64
+
+func init() {
+	if v, ok := config.Float("MAX_TEMPERATURE"); ok {
+		defaultMaxTemperature = &v
+	}
+}
+
+// clampTemperature lowers req.Temperature to the alias (or server) cap if it exceeds it.
+func clampTemperature(ctx context.Context, req *types.OpenAIRequest, alias *db.ModelAlias) {
+	maxTemp := alias.MaxTemperature
+	if maxTemp == nil {
+		maxTemp = defaultMaxTemperature
+	}
+	if maxTemp == nil || req.Temperature == nil || *req.Temperature <= *maxTemp {
+		return
+	}
+
+	logging.Printf(ctx, "proxy handler: clamping temperature %g to %g for alias %q (user %d)", *req.Temperature, *maxTemp, alias.Alias, alias.UserID)
+	clamped := *maxTemp
+	req.Temperature = &clamped
+}
+
+// applySystemPrompt puts the alias's system prompt override ahead of the
+// client's messages. Providers without a system role, such as Anthropic,
+// combine it with the client's own system messages.
+func applySystemPrompt(req *types.OpenAIRequest, alias *db.ModelAlias) {
+	if alias.SystemPromptOverride == nil || *alias.SystemPromptOverride == "" {
+		return
+	}
+
+	// Copy rather than prepend in place; the slice is shared with the
+	// original request, which later fallbacks start from.
+	messages := make([]types.OpenAIMessage, 0, len(req.Messages)+1)
+	messages = append(messages, types.OpenAIMessage{Role: "system", Content: *alias.SystemPromptOverride})
+	req.Messages = append(messages, req.Messages...)
+}
+
+// messageText concatenates the text content of all messages, one per line.
+func messageText(messages []types.OpenAIMessage) string {
+	var b strings.Builder
+	for _, m := range messages {
+		b.WriteString(m.Content)
+		b.WriteByte('\n')
 	}
-	return tokens
+	return b.String()
 }
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// Request log writes go through a bounded queue drained by a fixed pool of
+// workers, so a burst of traffic can't spawn unbounded goroutines and queued
+// writes can be flushed on shutdown. With LOG_WORKERS=0 writes happen
+// synchronously, before the handler returns.
+var (
+	logs = newLogQueue(config.Int("LOG_QUEUE_SIZE", 1000), config.Int("LOG_WORKERS", 4))
+
+	droppedLogWrites = expvar.NewInt("dropped_log_writes")
+)
+
+// logWrite is one queued DB write; it logs its own errors.
+type logWrite func(ctx context.Context)
+
+type logQueue struct {
+	jobs    chan logWrite
+	workers sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newLogQueue(size, workers int) *logQueue {
+	q := &logQueue{}
+	if workers <= 0 {
+		return q
+	}
+	q.jobs = make(chan logWrite, size)
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for job := range q.jobs {
+				job(context.Background())
+			}
+		}()
+	}
+	return q
+}
+
+// enqueue queues job for a worker. It runs job inline when the queue is
+// synchronous or already flushed, and drops it with a warning rather than
+// block the request when the queue is full. job gets ctx's values, for its
+// log lines, but not its cancellation, since it outlives the request.
+func (q *logQueue) enqueue(ctx context.Context, job logWrite) {
+	ctx = context.WithoutCancel(ctx)
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.jobs == nil || q.closed {
+		job(ctx)
+		return
+	}
+	select {
+	case q.jobs <- func(context.Context) { job(ctx) }:
+	default:
+		droppedLogWrites.Add(1)
+		logging.Printf(ctx, "log queue: queue full (%d pending), dropping log write", cap(q.jobs))
+	}
+}
+
+// pending returns the number of queued writes not yet picked up by a worker.
+func (q *logQueue) pending() int {
+	return len(q.jobs)
+}
+
+// flush stops accepting queued writes and waits for the workers to finish
+// the ones already queued, or for ctx to be done.
+func (q *logQueue) flush(ctx context.Context) error {
+	q.mu.Lock()
+	if q.jobs != nil && !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PendingLogWrites returns the number of request log writes waiting for a
+// worker.
+func PendingLogWrites() int {
+	return logs.pending()
+}
+
+// FlushLogs writes out the queued request logs, for use on shutdown. Later
+// writes are made synchronously.
+func FlushLogs(ctx context.Context) error {
+	return logs.flush(ctx)
+}
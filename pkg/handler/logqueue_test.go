@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogQueue(t *testing.T) {
+	q := newLogQueue(1, 1)
+
+	var written atomic.Int32
+	write := func(ctx context.Context) { written.Add(1) }
+
+	// Hold the only worker so later writes have to queue
+	started, release := make(chan struct{}), make(chan struct{})
+	q.enqueue(context.Background(), func(ctx context.Context) {
+		close(started)
+		<-release
+		written.Add(1)
+	})
+	<-started
+
+	q.enqueue(context.Background(), write)
+	if got := q.pending(); got != 1 {
+		t.Fatalf("Expected 1 pending write, got %d", got)
+	}
+
+	dropped := droppedLogWrites.Value()
+	q.enqueue(context.Background(), write)
+	if got := droppedLogWrites.Value() - dropped; got != 1 {
+		t.Errorf("Expected a write to a full queue to be dropped, got %d drops", got)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := written.Load(); got != 2 {
+		t.Errorf("Expected the 2 queued writes to be flushed, got %d", got)
+	}
+
+	// Once flushed, writes happen inline
+	q.enqueue(context.Background(), write)
+	if got := written.Load(); got != 3 {
+		t.Errorf("Expected a write after flush to run synchronously, got %d writes", got)
+	}
+}
+
+func TestLogQueue_Synchronous(t *testing.T) {
+	q := newLogQueue(10, 0)
+	ran := false
+	q.enqueue(context.Background(), func(ctx context.Context) { ran = true })
+	if !ran {
+		t.Errorf("Expected a queue without workers to write synchronously")
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"context"
+	"slices"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// validateModels enables rejecting requests whose resolved model is missing from
+// the cached provider_models list. Off by default since the cache can lag
+// behind newly released models.
+var validateModels = config.Bool("VALIDATE_MODELS", false)
+
+// modelAvailable reports whether model is in the provider's cached model list.
+// An empty cache or a lookup error counts as available so a cron that hasn't
+// run yet doesn't block every request.
+func (s *ProxyServer) modelAvailable(ctx context.Context, providerType, model string) bool {
+	models, err := s.Repo.ListProviderModelsByType(ctx, providerType, db.ModelFilter{})
+	if err != nil {
+		logging.Printf(ctx, "proxy handler: list %s models error: %v", providerType, err)
+		return true
+	}
+	if len(models) == 0 {
+		return true
+	}
+	return slices.Contains(models, model)
+}
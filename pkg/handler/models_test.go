@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/db/dbtest"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestModelAvailable(t *testing.T) {
+	tests := []struct {
+		name   string
+		models []string
+		err    error
+		want   bool
+	}{
+		{name: "listed", models: []string{"gpt-4o", "gpt-4o-mini"}, want: true},
+		{name: "not listed", models: []string{"gpt-4o-mini"}, want: false},
+		// The poll hasn't filled the cache yet, or it can't be read
+		{name: "empty cache", want: true},
+		{name: "lookup error", err: errors.New("connection refused"), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			s := NewProxyServer(db.NewPostgresRepository(mockDB))
+
+			q := mockDB.ExpectQuery("SELECT model_id FROM provider_models").WithArgs("openai")
+			if tt.err != nil {
+				q.WillReturnError(tt.err)
+			} else {
+				rows := mockDB.NewRows([]string{"model_id"})
+				for _, m := range tt.models {
+					rows.AddRow(m)
+				}
+				q.WillReturnRows(rows)
+			}
+
+			if got := s.modelAvailable(context.Background(), "openai", "gpt-4o"); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+			if err := mockDB.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestProxyHandler_RejectsUnavailableModel(t *testing.T) {
+	defer func(v bool) { validateModels = v }(validateModels)
+	validateModels = true
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	s := NewProxyServer(db.NewPostgresRepository(mockDB))
+
+	userID := 31
+	mockDB.ExpectQuery("SELECT (.+) FROM model_aliases").
+		WithArgs(userID, "typo").
+		WillReturnRows(dbtest.AliasRows(mockDB, db.ModelAlias{ID: 1, Alias: "typo", TargetModel: "gpt-4o-mnii", ProviderKeyID: 4}))
+	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+		WithArgs(4, userID).
+		WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "fake-key"))
+	mockDB.ExpectQuery("SELECT model_id FROM provider_models").WithArgs("openai").
+		WillReturnRows(mockDB.NewRows([]string{"model_id"}).AddRow("gpt-4o").AddRow("gpt-4o-mini"))
+
+	req := httptest.NewRequest("POST", "/chat/completions", strings.NewReader(`{"model":"typo","messages":[{"role":"user","content":"Hi"}]}`))
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+	w := httptest.NewRecorder()
+	s.ProxyHandler(w, req)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "model not available: gpt-4o-mnii") {
+		t.Errorf("Expected 400 model not available, got %d: %s", w.Code, w.Body.String())
+	}
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
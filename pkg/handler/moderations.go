@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/types"
+)
+
+// moderationAlias is the alias used for moderation requests that don't name
+// a model. Unset means model is required.
+var moderationAlias = config.String("MODERATION_ALIAS", "")
+
+// ModerationsHandler serves the OpenAI /v1/moderations endpoint, routing the
+// request through the caller's alias to a provider that supports moderation.
+func (s *ProxyServer) ModerationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.KeyUser).(int)
+	if !ok {
+		logging.Printf(r.Context(), "moderations handler: missing user context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req types.ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logging.Printf(r.Context(), "moderations handler: decode request body error: %v", err)
+		httperr.BadBody(w, err, "Invalid request body")
+		return
+	}
+	if len(req.Input) == 0 {
+		http.Error(w, "input is required", http.StatusBadRequest)
+		return
+	}
+	aliasName := req.Model
+	if aliasName == "" {
+		aliasName = moderationAlias
+	}
+	if aliasName == "" {
+		http.Error(w, "model is required", http.StatusBadRequest)
+		return
+	}
+
+	logging.SetAlias(r.Context(), aliasName)
+	alias, err := s.Repo.GetModelAlias(r.Context(), userID, aliasName)
+	if err != nil {
+		logging.Printf(r.Context(), "moderations handler: get model alias %q error: %v", aliasName, err)
+		http.Error(w, "Unknown model alias: "+aliasName, http.StatusNotFound)
+		return
+	}
+	providerType, _, err := s.Repo.GetProviderKey(r.Context(), alias.ProviderKeyID, userID)
+	if err != nil {
+		logging.Printf(r.Context(), "moderations handler: get provider key for alias %q error: %v", aliasName, err)
+		http.Error(w, "Provider configuration not found", http.StatusInternalServerError)
+		return
+	}
+	prov, ok := newProvider(providerType, s.Repo, alias.ProviderKeyID, userID)
+	if !ok {
+		http.Error(w, "Unsupported provider: "+providerType, http.StatusBadRequest)
+		return
+	}
+	moderator, ok := prov.(provider.Moderator)
+	if !ok {
+		http.Error(w, "Moderation is not supported for provider: "+providerType, http.StatusBadRequest)
+		return
+	}
+
+	release, err := provider.AcquireSlot(r.Context(), providerType, alias.ProviderKeyID)
+	if err != nil {
+		if errors.Is(err, provider.ErrConcurrencyLimit) {
+			http.Error(w, "Provider concurrency limit reached", http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "Provider request failed", http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	req.Model = alias.TargetModel
+	resp, err := moderator.Moderate(r.Context(), req)
+	if err != nil {
+		logging.Printf(r.Context(), "moderations handler: provider request failed for alias %q (user %d): %v", aliasName, userID, err)
+		writeProviderFailure(r.Context(), w, err, "Provider request failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Printf(r.Context(), "moderations handler: encode response error: %v", err)
+	}
+
+	logs.enqueue(r.Context(), func(ctx context.Context) {
+		// Moderations are free, so they never need a price
+		free := 0.0
+		if err := s.Repo.InsertRequestLog(ctx, db.RequestLog{
+			UserID:        userID,
+			AliasUsed:     aliasName,
+			ProviderUsed:  providerType,
+			ModelUsed:     alias.TargetModel,
+			StatusCode:    http.StatusOK,
+			Endpoint:      db.EndpointModerations,
+			EstimatedCost: &free,
+		}); err != nil {
+			logging.Printf(r.Context(), "moderations handler: insert request log error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/denylist"
+	"tokentracer-proxy/pkg/features"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/pricing"
+	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/ratelimit"
+	"tokentracer-proxy/pkg/status"
+	"tokentracer-proxy/pkg/types"
+)
+
+// MessagesHandler serves the native Anthropic Messages API for aliases with
+// native_passthrough. The body is forwarded with only the model rewritten to
+// the alias's target, and the upstream response is returned unchanged.
+func (s *ProxyServer) MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.KeyUser).(int)
+	if !ok {
+		logging.Printf(r.Context(), "messages handler: missing user context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httperr.BadBody(w, err, "Invalid request body")
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		logging.Printf(r.Context(), "messages handler: decode request body error: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var aliasName string
+	if err := json.Unmarshal(fields["model"], &aliasName); err != nil || aliasName == "" {
+		http.Error(w, "model is required", http.StatusBadRequest)
+		return
+	}
+	var stream bool
+	if raw, ok := fields["stream"]; ok {
+		_ = json.Unmarshal(raw, &stream)
+	}
+
+	if stream && !features.HasFeature(r.Context(), s.Repo, userID, features.Streaming) {
+		http.Error(w, "Streaming is not enabled for this account", http.StatusForbidden)
+		return
+	}
+	text := nativeMessageText(fields)
+	if denylist.Enabled() {
+		if pattern, blocked := denylist.Match(text); blocked {
+			logging.Printf(r.Context(), "messages handler: blocked request from user %d for model %q: matched denylist pattern %q", userID, aliasName, pattern)
+			http.Error(w, "Request blocked by content policy", http.StatusBadRequest)
+			return
+		}
+	}
+
+	estimated := s.Tokens.CountTokens(aliasName, []types.OpenAIMessage{{Role: "user", Content: text}})
+	if err := ratelimit.CheckTokenBudget(r.Context(), estimated); err != nil {
+		var budgetErr *ratelimit.TokenBudgetError
+		if errors.As(err, &budgetErr) {
+			http.Error(w, "Daily token limit exceeded: "+budgetErr.Error(), http.StatusTooManyRequests)
+			return
+		}
+		logging.Printf(r.Context(), "messages handler: token budget check error for user %d: %v", userID, err)
+		http.Error(w, "Rate limit check failed", http.StatusInternalServerError)
+		return
+	}
+
+	logging.SetAlias(r.Context(), aliasName)
+	alias, err := s.Repo.GetModelAlias(r.Context(), userID, aliasName)
+	if err != nil {
+		logging.Printf(r.Context(), "messages handler: get model alias %q error: %v", aliasName, err)
+		http.Error(w, "Unknown model alias: "+aliasName, http.StatusNotFound)
+		return
+	}
+	if !alias.NativePassthrough {
+		http.Error(w, fmt.Sprintf("Alias %q does not have native_passthrough enabled", aliasName), http.StatusBadRequest)
+		return
+	}
+
+	providerType, _, err := s.Repo.GetProviderKey(r.Context(), alias.ProviderKeyID, userID)
+	if err != nil {
+		logging.Printf(r.Context(), "messages handler: get provider key for alias %q error: %v", aliasName, err)
+		http.Error(w, "Provider configuration not found", http.StatusInternalServerError)
+		return
+	}
+	prov, ok := newProvider(providerType, s.Repo, alias.ProviderKeyID, userID)
+	if !ok {
+		http.Error(w, "Unsupported provider: "+providerType, http.StatusBadRequest)
+		return
+	}
+	native, ok := prov.(provider.NativeSender)
+	if !ok {
+		http.Error(w, "Native passthrough is not supported for provider: "+providerType, http.StatusBadRequest)
+		return
+	}
+
+	fields["model"], _ = json.Marshal(alias.TargetModel)
+	body, _ = json.Marshal(fields)
+
+	release, err := provider.AcquireSlot(r.Context(), providerType, alias.ProviderKeyID)
+	if err != nil {
+		if errors.Is(err, provider.ErrConcurrencyLimit) {
+			http.Error(w, "Provider concurrency limit reached", http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "Provider request failed", http.StatusBadGateway)
+		return
+	}
+	defer release()
+
+	resp, err := native.SendNative(r.Context(), body, r.Header)
+	if err != nil {
+		logging.Printf(r.Context(), "messages handler: provider request failed for alias %q (user %d): %v", aliasName, userID, err)
+		http.Error(w, "Provider request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Request-Id"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	streaming := stream && resp.StatusCode == http.StatusOK
+	if streaming {
+		status.StreamStarted()
+		defer status.StreamEnded()
+		// Streams may outlive the server's write timeout
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logging.Printf(r.Context(), "messages handler: clear write deadline error: %v", err)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var usage types.AnthropicUsage
+	if streaming {
+		copyNativeStream(r.Context(), w, resp.Body, &usage)
+	} else {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			logging.Printf(r.Context(), "messages handler: read upstream response error: %v", err)
+		}
+		if _, err := w.Write(respBody); err != nil {
+			logging.Printf(r.Context(), "messages handler: write response error: %v", err)
+		}
+		var parsed struct {
+			Usage types.AnthropicUsage `json:"usage"`
+		}
+		if json.Unmarshal(respBody, &parsed) == nil {
+			usage = parsed.Usage
+		}
+	}
+
+	code := resp.StatusCode
+	logs.enqueue(r.Context(), func(ctx context.Context) {
+		if err := s.Repo.InsertRequestLog(ctx, db.RequestLog{
+			UserID:        userID,
+			AliasUsed:     aliasName,
+			ProviderUsed:  providerType,
+			ModelUsed:     alias.TargetModel,
+			InputTokens:   usage.InputTokens,
+			OutputTokens:  usage.OutputTokens,
+			StatusCode:    code,
+			Endpoint:      db.EndpointMessages,
+			EstimatedCost: pricing.Cost(alias.TargetModel, usage.InputTokens, usage.OutputTokens),
+		}); err != nil {
+			logging.Printf(r.Context(), "messages handler: insert request log error: %v", err)
+		}
+	})
+}
+
+// nativeMessageText returns the text of a Messages API request's system
+// prompt and messages, for matching against the denylist. Both may be a plain
+// string or an array of content blocks.
+func nativeMessageText(fields map[string]json.RawMessage) string {
+	var b strings.Builder
+	var system string
+	if json.Unmarshal(fields["system"], &system) == nil {
+		b.WriteString(system)
+		b.WriteByte('\n')
+	} else {
+		var blocks []types.AnthropicBlock
+		if json.Unmarshal(fields["system"], &blocks) == nil {
+			writeBlockText(&b, blocks)
+		}
+	}
+
+	var messages []types.AnthropicMessage
+	if json.Unmarshal(fields["messages"], &messages) == nil {
+		for _, m := range messages {
+			if m.Blocks != nil {
+				writeBlockText(&b, m.Blocks)
+				continue
+			}
+			b.WriteString(m.Content)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// writeBlockText writes the text of each block, and of the blocks nested in
+// tool results, one per line.
+func writeBlockText(b *strings.Builder, blocks []types.AnthropicBlock) {
+	for _, block := range blocks {
+		if block.Text != "" {
+			b.WriteString(block.Text)
+			b.WriteByte('\n')
+		}
+		writeBlockText(b, block.Content)
+	}
+}
+
+// copyNativeStream relays an Anthropic SSE stream line by line, flushing after
+// each event, and picks the token usage out of the message_start and
+// message_delta events.
+func copyNativeStream(ctx context.Context, w http.ResponseWriter, body io.Reader, usage *types.AnthropicUsage) {
+	flusher, _ := w.(http.Flusher)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if data, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+			var event struct {
+				Type    string `json:"type"`
+				Message struct {
+					Usage types.AnthropicUsage `json:"usage"`
+				} `json:"message"`
+				Usage types.AnthropicUsage `json:"usage"`
+			}
+			if json.Unmarshal(data, &event) == nil {
+				switch event.Type {
+				case "message_start":
+					usage.InputTokens = event.Message.Usage.InputTokens
+				case "message_delta":
+					usage.OutputTokens = event.Usage.OutputTokens
+				}
+			}
+		}
+
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			logging.Printf(ctx, "messages handler: write stream error: %v", err)
+			return
+		}
+		if len(line) == 0 && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logging.Printf(ctx, "messages handler: read upstream stream error: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/types"
+)
+
+// isResponseFormatRejection reports whether err is an upstream 400 caused by
+// the request's response_format, e.g. JSON mode on a model without it.
+func isResponseFormatRejection(err error) bool {
+	var perr *provider.ProviderError
+	if !errors.As(err, &perr) || perr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	if oe := perr.OpenAIError().Error; oe.Param != nil && *oe.Param == "response_format" {
+		return true
+	}
+	return strings.Contains(string(perr.Body), "response_format")
+}
+
+// downgradeResponseFormat replaces req.ResponseFormat with a system message
+// asking for the same output, for models that can't enforce it themselves.
+func downgradeResponseFormat(req *types.OpenAIRequest) {
+	format := req.ResponseFormat
+	req.ResponseFormat = nil
+	if format == nil || format.Type == "text" {
+		return
+	}
+
+	instruction := "Respond only with a single valid JSON object and no other text."
+	if format.Type == "json_schema" && len(format.JSONSchema) > 0 {
+		schema := format.JSONSchema
+		var spec struct {
+			Schema json.RawMessage `json:"schema"`
+		}
+		if err := json.Unmarshal(format.JSONSchema, &spec); err == nil && len(spec.Schema) > 0 {
+			schema = spec.Schema
+		}
+		instruction = "Respond only with a single valid JSON object matching this JSON schema, and no other text:\n" + string(schema)
+	}
+
+	// Copy rather than prepend in place; the slice is shared with the
+	// original request, which later fallbacks start from.
+	messages := make([]types.OpenAIMessage, 0, len(req.Messages)+1)
+	messages = append(messages, types.OpenAIMessage{Role: "system", Content: instruction})
+	req.Messages = append(messages, req.Messages...)
+}
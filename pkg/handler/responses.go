@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// shouldStore reports whether the response to req is persisted for later
+// retrieval. Like failed request bodies, this requires LOG_REQUEST_BODIES.
+func shouldStore(req types.OpenAIRequest) bool {
+	return logRequestBodies && req.Store != nil && *req.Store
+}
+
+// storeResponse asynchronously persists a completion under its ID, assigning
+// one first if the provider didn't return any.
+func (s *ProxyServer) storeResponse(ctx context.Context, userID int, req types.OpenAIRequest, resp *types.OpenAIResponse) {
+	if resp.ID == "" {
+		resp.ID = newResponseID()
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		logging.Printf(ctx, "proxy handler: marshal stored response error: %v", err)
+		return
+	}
+
+	sr := db.StoredResponse{ID: resp.ID, UserID: userID, Model: resp.Model, Metadata: req.Metadata, Response: body}
+	logs.enqueue(ctx, func(ctx context.Context) {
+		if err := s.Repo.InsertStoredResponse(ctx, sr); err != nil {
+			logging.Printf(ctx, "proxy handler: insert stored response error: %v", err)
+		}
+	})
+}
+
+func newResponseID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "resp_" + hex.EncodeToString(b)
+}
+
+// GetResponseHandler returns a response stored with store: true
+func (s *ProxyServer) GetResponseHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.KeyUser).(int)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sr, err := s.Repo.GetStoredResponse(r.Context(), userID, chi.URLParam(r, "id"))
+	if err != nil {
+		httperr.Lookup(w, r, err, "Response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         sr.ID,
+		"model":      sr.Model,
+		"metadata":   sr.Metadata,
+		"created_at": sr.CreatedAt.Format(time.RFC3339),
+		"response":   json.RawMessage(sr.Response),
+	}); err != nil {
+		logging.Printf(r.Context(), "get stored response: encode response error: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/handler"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestGetResponseHandler(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		userID   int
+		found    bool
+		wantCode int
+	}{
+		{name: "found", userID: 1, found: true, wantCode: http.StatusOK},
+		{name: "not found", userID: 1, wantCode: http.StatusNotFound},
+		// The lookup is scoped to the caller, so another user's response is
+		// indistinguishable from a missing one
+		{name: "other user", userID: 2, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockDB.Close()
+			ps := handler.NewProxyServer(db.NewPostgresRepository(mockDB))
+
+			q := mockDB.ExpectQuery("SELECT model, metadata, response::text, created_at FROM stored_responses").
+				WithArgs(tt.userID, "resp_1")
+			if tt.found {
+				q.WillReturnRows(mockDB.NewRows([]string{"model", "metadata", "response", "created_at"}).
+					AddRow("gpt-4o", map[string]string{"run": "7"}, `{"id":"resp_1","object":"chat.completion"}`, created))
+			} else {
+				q.WillReturnError(pgx.ErrNoRows)
+			}
+
+			r := chi.NewRouter()
+			r.Get("/v1/responses/{id}", ps.GetResponseHandler)
+			req := httptest.NewRequest("GET", "/v1/responses/resp_1", nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, tt.userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if tt.found {
+				var body struct {
+					ID        string            `json:"id"`
+					Model     string            `json:"model"`
+					Metadata  map[string]string `json:"metadata"`
+					CreatedAt string            `json:"created_at"`
+					Response  struct {
+						ID string `json:"id"`
+					} `json:"response"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+				if body.ID != "resp_1" || body.Model != "gpt-4o" || body.Metadata["run"] != "7" ||
+					body.CreatedAt != "2024-01-02T03:04:05Z" || body.Response.ID != "resp_1" {
+					t.Errorf("Unexpected stored response %+v", body)
+				}
+			}
+			if err := mockDB.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetResponseHandler_Unauthorized(t *testing.T) {
+	ps := handler.NewProxyServer(nil)
+	w := httptest.NewRecorder()
+	ps.GetResponseHandler(w, httptest.NewRequest("GET", "/v1/responses/resp_1", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", w.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/status"
+)
+
+// sseWriter writes a streaming response to the client as server-sent events,
+// flushing after each one. Headers are only sent with the first event, so a
+// stream that fails before producing anything can still fall back.
+type sseWriter struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+	// upstreamLimit is relayed in the response headers when set
+	upstreamLimit *provider.UpstreamRateLimit
+	// responseID is the id of the first chunk, for the request log
+	responseID string
+}
+
+func newSSEWriter(ctx context.Context, w http.ResponseWriter) *sseWriter {
+	flusher, _ := w.(http.Flusher)
+	return &sseWriter{ctx: ctx, w: w, flusher: flusher}
+}
+
+func (s *sseWriter) emit(event []byte) error {
+	if !s.started {
+		s.started = true
+		status.StreamStarted()
+		// Streams may outlive the server's write timeout
+		if err := http.NewResponseController(s.w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logging.Printf(s.ctx, "proxy handler: clear write deadline error: %v", err)
+		}
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.Header().Set("Connection", "keep-alive")
+		setUpstreamRateLimitHeaders(s.w.Header(), s.upstreamLimit)
+		s.w.WriteHeader(http.StatusOK)
+	}
+	if s.responseID == "" {
+		s.responseID = chunkID(event)
+	}
+	if _, err := s.w.Write(event); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// chunkID returns the id of the chat.completion.chunk in an SSE event, or ""
+// if it has none.
+func chunkID(event []byte) string {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(event), []byte("data: "))
+	if !ok {
+		return ""
+	}
+	var chunk struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return ""
+	}
+	return chunk.ID
+}
+
+// done terminates a successful stream with the [DONE] sentinel.
+func (s *sseWriter) done() {
+	if err := s.emit([]byte("data: [DONE]\n\n")); err != nil {
+		logging.Printf(s.ctx, "proxy handler: write stream error: %v", err)
+	}
+}
+
+// close marks the stream finished for the active stream count.
+func (s *sseWriter) close() {
+	if s.started {
+		status.StreamEnded()
+	}
+}
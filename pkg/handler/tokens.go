@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"os"
+	"strings"
+	"tokentracer-proxy/pkg/tokenizer"
+	"tokentracer-proxy/pkg/types"
+)
+
+const (
+	// tokensPerMessage is the framing around each chat message: its role
+	// and the separators between messages.
+	tokensPerMessage = 4
+	// tokensPerReply primes the assistant's reply after the last message.
+	tokensPerReply = 3
+	// charsPerToken is the average token length of English text.
+	charsPerToken = 4
+)
+
+// TokenCounter counts the prompt tokens of a request to model. The proxy
+// uses it for light-model routing, the daily token budget and the estimate
+// logged alongside the provider's usage.
+type TokenCounter interface {
+	CountTokens(model string, messages []types.OpenAIMessage) int
+}
+
+// HeuristicCounter estimates tokens from message lengths for any model.
+type HeuristicCounter struct{}
+
+func (HeuristicCounter) CountTokens(model string, messages []types.OpenAIMessage) int {
+	return estimateTokens(messages)
+}
+
+// BPECounter counts OpenAI models' tokens with their BPE vocabulary, and
+// falls back to the heuristic for other models.
+type BPECounter struct {
+	Encoding *tokenizer.Encoding
+}
+
+func (c BPECounter) CountTokens(model string, messages []types.OpenAIMessage) int {
+	if !isOpenAIModel(model) {
+		return estimateTokens(messages)
+	}
+	if len(messages) == 0 {
+		return 0
+	}
+	tokens := tokensPerReply
+	for _, m := range messages {
+		tokens += tokensPerMessage + c.Encoding.Count(m.Content)
+	}
+	return tokens
+}
+
+// isOpenAIModel reports whether model is tokenized with OpenAI's BPE.
+func isOpenAIModel(model string) bool {
+	for _, prefix := range []string{"gpt-", "chatgpt-", "o1", "o3", "o4", "text-embedding-"} {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTokenCounter is the counter new ProxyServers start with.
+var defaultTokenCounter TokenCounter = HeuristicCounter{}
+
+// InitTokenizer loads the tiktoken rank file named by TOKENIZER_FILE, e.g.
+// o200k_base.tiktoken, and counts OpenAI models' tokens with it from then
+// on. Without it, tokens are estimated from message lengths.
+func InitTokenizer() error {
+	path := os.Getenv("TOKENIZER_FILE")
+	if path == "" {
+		return nil
+	}
+	enc, err := tokenizer.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	defaultTokenCounter = BPECounter{Encoding: enc}
+	return nil
+}
+
+// estimateTokens approximates the prompt tokens of messages the way
+// OpenAI's counting guide does: a fixed overhead per message plus its
+// content, at about 4 characters per token, plus the reply priming.
+func estimateTokens(messages []types.OpenAIMessage) int {
+	if len(messages) == 0 {
+		return 0
+	}
+	tokens := tokensPerReply
+	for _, m := range messages {
+		tokens += tokensPerMessage + contentTokens(m.Content)
+	}
+	return tokens
+}
+
+// contentTokens approximates the tokens of text at about 4 characters each.
+func contentTokens(text string) int {
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
+
+// estimateUsage fills in resp's usage when the upstream reported none, as
+// some Gemini responses do, from the prompt estimate and the returned
+// content. Usage with a prompt or completion count but no total is kept as
+// reported. It reports whether the usage is an estimate.
+func estimateUsage(resp *types.OpenAIResponse, promptTokens int) bool {
+	if resp.Usage != (types.OpenAIUsage{}) {
+		return false
+	}
+	completion := 0
+	for _, c := range resp.Choices {
+		completion += contentTokens(c.Message.Content)
+	}
+	resp.Usage = types.OpenAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completion,
+		TotalTokens:      promptTokens + completion,
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/tokenizer"
+	"tokentracer-proxy/pkg/types"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	many := make([]types.OpenAIMessage, 20)
+	for i := range many {
+		many[i] = types.OpenAIMessage{Role: "user", Content: "ok"}
+	}
+
+	tests := []struct {
+		name     string
+		messages []types.OpenAIMessage
+		want     int
+	}{
+		{name: "no messages", want: 0},
+		{name: "empty content", messages: []types.OpenAIMessage{{Role: "user"}}, want: 7},
+		{name: "short message", messages: []types.OpenAIMessage{{Role: "user", Content: "Hello"}}, want: 9},
+		// The framing outweighs the content, which the old sum ignored
+		{name: "many small messages", messages: many, want: 20*(4+1) + 3},
+		{name: "one large message", messages: []types.OpenAIMessage{{Role: "user", Content: strings.Repeat("a", 4000)}}, want: 1000 + 4 + 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateTokens(tt.messages); got != tt.want {
+				t.Errorf("Expected %d tokens, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBPECounter(t *testing.T) {
+	enc, err := tokenizer.Parse(strings.NewReader("aGVsbG8= 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := BPECounter{Encoding: enc}
+	messages := []types.OpenAIMessage{{Role: "user", Content: "hello"}}
+
+	// "hello" is a single token in the vocabulary
+	if got := counter.CountTokens("gpt-4o", messages); got != 1+tokensPerMessage+tokensPerReply {
+		t.Errorf("Expected the BPE count for an OpenAI model, got %d", got)
+	}
+	if got, want := counter.CountTokens("claude-sonnet-4", messages), estimateTokens(messages); got != want {
+		t.Errorf("Expected the heuristic %d for other models, got %d", want, got)
+	}
+}
+
+func TestEstimateUsage(t *testing.T) {
+	reply := types.OpenAIResponse{Choices: []types.OpenAIChoice{{Message: types.OpenAIMessage{Role: "assistant", Content: "Hello there!"}}}}
+
+	resp := reply
+	if !estimateUsage(&resp, 9) {
+		t.Fatal("Expected missing usage to be estimated")
+	}
+	if want := (types.OpenAIUsage{PromptTokens: 9, CompletionTokens: 3, TotalTokens: 12}); resp.Usage != want {
+		t.Errorf("Expected usage %+v, got %+v", want, resp.Usage)
+	}
+
+	// Reported counts are kept even without a total
+	metered := reply
+	metered.Usage = types.OpenAIUsage{PromptTokens: 10, CompletionTokens: 20}
+	if estimateUsage(&metered, 9) {
+		t.Error("Expected reported usage to be kept")
+	}
+	if metered.Usage.PromptTokens != 10 || metered.Usage.CompletionTokens != 20 {
+		t.Errorf("Expected reported usage to be unchanged, got %+v", metered.Usage)
+	}
+}
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/provider"
+)
+
+// relayUpstreamRateLimits passes the upstream's remaining rate-limit budget on
+// to clients, so they can back off before the provider starts refusing.
+var relayUpstreamRateLimits = config.Bool("RELAY_UPSTREAM_RATE_LIMITS", false)
+
+// setUpstreamRateLimitHeaders sets X-Upstream-RateLimit-Remaining (tokens) and
+// X-Upstream-RateLimit-Remaining-Requests from what the upstream reported.
+func setUpstreamRateLimitHeaders(h http.Header, l *provider.UpstreamRateLimit) {
+	if !relayUpstreamRateLimits || l == nil {
+		return
+	}
+	if l.RemainingTokens >= 0 {
+		h.Set("X-Upstream-RateLimit-Remaining", strconv.Itoa(l.RemainingTokens))
+	}
+	if l.RemainingRequests >= 0 {
+		h.Set("X-Upstream-RateLimit-Remaining-Requests", strconv.Itoa(l.RemainingRequests))
+	}
+}
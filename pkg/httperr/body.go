@@ -0,0 +1,47 @@
+package httperr
+
+import (
+	"errors"
+	"net/http"
+	"tokentracer-proxy/pkg/config"
+)
+
+// maxRequestBytes caps request bodies so a single oversized request can't
+// exhaust the process's memory while it's decoded.
+var maxRequestBytes = int64(config.Int("MAX_REQUEST_BYTES", 4<<20))
+
+// LimitBody rejects requests whose declared length exceeds MAX_REQUEST_BYTES
+// with 413, and caps the body of the rest, so reading past the limit fails
+// with *http.MaxBytesError. See BadBody.
+func LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxRequestBytes {
+			tooLarge(w)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BadBody responds to a request body that couldn't be read or decoded: 413
+// when it exceeded the size limit, otherwise 400 with message.
+func BadBody(w http.ResponseWriter, err error, message string) {
+	if isTooLarge(err) {
+		tooLarge(w)
+		return
+	}
+	http.Error(w, message, http.StatusBadRequest)
+}
+
+// isTooLarge reports whether err came from reading past the body size limit.
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+func tooLarge(w http.ResponseWriter) {
+	http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,50 @@
+package httperr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	defer func(n int64) { maxRequestBytes = n }(maxRequestBytes)
+	maxRequestBytes = 16
+
+	h := LimitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			BadBody(w, err, "Invalid request body")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name     string
+		body     string
+		chunked  bool
+		wantCode int
+	}{
+		{name: "within the limit", body: `{"a": 1}`, wantCode: http.StatusNoContent},
+		{name: "invalid", body: `{"a":`, wantCode: http.StatusBadRequest},
+		{name: "declared too large", body: `{"a": "0123456789abcdef"}`, wantCode: http.StatusRequestEntityTooLarge},
+		// Without a Content-Length the limit is hit while decoding
+		{name: "streamed too large", body: `{"a": "0123456789abcdef"}`, chunked: true, wantCode: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d", tt.wantCode, w.Code)
+			}
+		})
+	}
+}
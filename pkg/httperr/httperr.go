@@ -0,0 +1,24 @@
+// Package httperr holds response helpers shared by the API handlers.
+package httperr
+
+import (
+	"errors"
+	"net/http"
+	"tokentracer-proxy/pkg/logging"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Lookup responds to a failed lookup of a single resource. Lookups are always
+// scoped to the caller, so a resource that doesn't exist and one owned by
+// another user are indistinguishable: both get 404 "<resource> not found",
+// which avoids revealing which ids exist. Any other error is logged and
+// answered with 500.
+func Lookup(w http.ResponseWriter, r *http.Request, err error, resource string) {
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, resource+" not found", http.StatusNotFound)
+		return
+	}
+	logging.Printf(r.Context(), "%s lookup error: %v", resource, err)
+	http.Error(w, "DB Error", http.StatusInternalServerError)
+}
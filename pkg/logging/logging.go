@@ -0,0 +1,151 @@
+// Package logging writes JSON logs through slog and carries per-request
+// fields, the request ID, user and alias, so every line logged while serving
+// a request can be correlated across packages.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestIDHeader carries the request ID in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits the client-supplied IDs that are kept, so arbitrary
+// header content doesn't end up in the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Init makes slog's default logger, which the log package also writes
+// through, emit JSON to stdout with the request fields of each line's context.
+func Init() {
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, nil)}))
+}
+
+// fields are the request's log fields. They are filled in as the request
+// is served, e.g. the user once it is authenticated, so they are shared by
+// pointer through the context.
+type fields struct {
+	mu        sync.Mutex
+	requestID string
+	userID    int
+	alias     string
+}
+
+type ctxKey struct{}
+
+func fromContext(ctx context.Context) *fields {
+	f, _ := ctx.Value(ctxKey{}).(*fields)
+	return f
+}
+
+func (f *fields) attrs() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs := []slog.Attr{slog.String("request_id", f.requestID)}
+	if f.userID != 0 {
+		attrs = append(attrs, slog.Int("user_id", f.userID))
+	}
+	if f.alias != "" {
+		attrs = append(attrs, slog.String("alias", f.alias))
+	}
+	return attrs
+}
+
+// contextHandler adds the request fields from the context to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if f := fromContext(ctx); f != nil {
+		r.AddAttrs(f.attrs()...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestID gives each request an ID, the client's X-Request-ID when it
+// sends a valid one, and returns it in the X-Request-ID response header.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), ctxKey{}, &fields{requestID: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs one line per request with its status, size and duration.
+// It must run after RequestID.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", ww.Status(),
+			"bytes", ww.BytesWritten(),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// SetUser records the authenticated user in the request's log fields.
+func SetUser(ctx context.Context, userID int) {
+	if f := fromContext(ctx); f != nil {
+		f.mu.Lock()
+		f.userID = userID
+		f.mu.Unlock()
+	}
+}
+
+// SetAlias records the alias being served in the request's log fields.
+func SetAlias(ctx context.Context, alias string) {
+	if f := fromContext(ctx); f != nil {
+		f.mu.Lock()
+		f.alias = alias
+		f.mu.Unlock()
+	}
+}
+
+// RequestIDFromContext returns the request's ID, or "" outside a request.
+func RequestIDFromContext(ctx context.Context) string {
+	if f := fromContext(ctx); f != nil {
+		return f.requestID
+	}
+	return ""
+}
+
+// Printf logs a formatted message at info level with the request fields
+// from ctx.
+func Printf(ctx context.Context, format string, args ...any) {
+	slog.InfoContext(ctx, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "client id", header: "abc-123", want: "abc-123"},
+		{name: "no id"},
+		{name: "invalid id", header: "bad id\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestIDFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			got := w.Header().Get(RequestIDHeader)
+			if got != seen {
+				t.Errorf("Expected response header %q to match context id %q", got, seen)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("Expected request id %q, got %q", tt.want, got)
+			}
+			if tt.want == "" && (got == "" || got == tt.header) {
+				t.Errorf("Expected a generated request id, got %q", got)
+			}
+		})
+	}
+}
+
+func TestPrintf_RequestFields(t *testing.T) {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}))
+	defer slog.SetDefault(orig)
+
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUser(r.Context(), 7)
+		SetAlias(r.Context(), "fast")
+		Printf(r.Context(), "served %d", 1)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a JSON log line, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{"msg": "served 1", "request_id": "req-1", "user_id": float64(7), "alias": "fast"}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, record[k])
+		}
+	}
+}
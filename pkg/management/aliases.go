@@ -3,24 +3,100 @@ package management
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"tokentracer-proxy/pkg/auth"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 )
 
 type ModelAliasRequest struct {
-	ID                  int     `json:"id"`
-	Alias               string  `json:"alias"`
-	TargetModel         string  `json:"target_model"`
-	ProviderKeyID       int     `json:"provider_key_id"`
-	FallbackAliasID     *int    `json:"fallback_alias_id"`
-	UseLightModel       bool    `json:"use_light_model"`
-	LightModelThreshold int     `json:"light_model_threshold"`
-	LightModel          *string `json:"light_model"`
+	ID                  int                 `json:"id"`
+	Alias               string              `json:"alias"`
+	TargetModel         string              `json:"target_model"`
+	ProviderKeyID       int                 `json:"provider_key_id"`
+	FallbackAliasID     *int                `json:"fallback_alias_id"`
+	UseLightModel       bool                `json:"use_light_model"`
+	LightModelThreshold int                 `json:"light_model_threshold"`
+	LightModel          *string             `json:"light_model"`
+	MaxTemperature      *float64            `json:"max_temperature"`
+	FallbackOnStatuses  []int               `json:"fallback_on_statuses"`
+	WeightedTargets     []db.WeightedTarget `json:"weighted_targets"`
+	NativePassthrough   bool                `json:"native_passthrough"`
+	CacheTTLSeconds     *int                `json:"cache_ttl_seconds"`
+	IsPattern           bool                `json:"is_pattern"`
+	// ResponseFormatFallback downgrades response_format to a prompt
+	// instruction instead of failing when the target model rejects it
+	ResponseFormatFallback bool `json:"response_format_fallback"`
+	// MaxMessages rejects conversations with more messages; nil means no limit
+	MaxMessages *int `json:"max_messages"`
+	// SystemPromptOverride is sent as a system message ahead of the client's
+	// messages; nil means none
+	SystemPromptOverride *string `json:"system_prompt_override"`
+
+	// Changed with PATCH or by the model poll, not on create/update
+	Disabled      bool    `json:"disabled"`
+	FlaggedReason *string `json:"flagged_reason"`
+
+	// Read-only, set by ListAliases with ?expand=fallback
+	FallbackAlias string   `json:"fallback_alias,omitempty"`
+	FallbackChain []string `json:"fallback_chain,omitempty"`
+	FallbackCycle bool     `json:"fallback_cycle,omitempty"`
+}
+
+func aliasResponse(a db.ModelAlias) ModelAliasRequest {
+	return ModelAliasRequest{
+		ID:                     a.ID,
+		Alias:                  a.Alias,
+		TargetModel:            a.TargetModel,
+		ProviderKeyID:          a.ProviderKeyID,
+		FallbackAliasID:        a.FallbackAliasID,
+		UseLightModel:          a.UseLightModel,
+		LightModelThreshold:    a.LightModelThreshold,
+		LightModel:             a.LightModel,
+		MaxTemperature:         a.MaxTemperature,
+		FallbackOnStatuses:     a.FallbackOnStatuses,
+		WeightedTargets:        a.WeightedTargets,
+		NativePassthrough:      a.NativePassthrough,
+		CacheTTLSeconds:        a.CacheTTLSeconds,
+		IsPattern:              a.IsPattern,
+		ResponseFormatFallback: a.ResponseFormatFallback,
+		MaxMessages:            a.MaxMessages,
+		SystemPromptOverride:   a.SystemPromptOverride,
+		Disabled:               a.Disabled,
+		FlaggedReason:          a.FlaggedReason,
+	}
+}
+
+func (req ModelAliasRequest) toModelAlias(userID int) db.ModelAlias {
+	return db.ModelAlias{
+		UserID:                 userID,
+		Alias:                  req.Alias,
+		TargetModel:            req.TargetModel,
+		ProviderKeyID:          req.ProviderKeyID,
+		FallbackAliasID:        req.FallbackAliasID,
+		UseLightModel:          req.UseLightModel,
+		LightModelThreshold:    req.LightModelThreshold,
+		LightModel:             req.LightModel,
+		MaxTemperature:         req.MaxTemperature,
+		FallbackOnStatuses:     req.FallbackOnStatuses,
+		WeightedTargets:        req.WeightedTargets,
+		NativePassthrough:      req.NativePassthrough,
+		CacheTTLSeconds:        req.CacheTTLSeconds,
+		IsPattern:              req.IsPattern,
+		ResponseFormatFallback: req.ResponseFormatFallback,
+		MaxMessages:            req.MaxMessages,
+		SystemPromptOverride:   req.SystemPromptOverride,
+	}
 }
 
 // UpsertModelAlias creates or updates a routing rule
@@ -29,21 +105,49 @@ func UpsertModelAlias(w http.ResponseWriter, r *http.Request) {
 
 	var req ModelAliasRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		httperr.BadBody(w, err, "Invalid request body")
 		return
 	}
 
-	if req.Alias == "" {
-		http.Error(w, "Alias name is required", http.StatusBadRequest)
+	if status, msg := req.validate(r.Context(), userID); status != http.StatusOK {
+		http.Error(w, msg, status)
 		return
 	}
-	if req.TargetModel == "" {
-		http.Error(w, "Target model is required", http.StatusBadRequest)
+
+	err := db.Repo.UpsertModelAlias(context.Background(), req.toModelAlias(userID))
+	if err != nil {
+		logging.Printf(r.Context(), "upsert model alias error: %v", err)
+		http.Error(w, "Failed to save model alias", http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validate checks an alias before it is saved, normalizing optional fields
+// and inferring the provider key when none is given. It returns a non-200
+// status and message when the alias can't be saved.
+func (req *ModelAliasRequest) validate(ctx context.Context, userID int) (int, string) {
+	if req.Alias == "" {
+		return http.StatusBadRequest, "Alias name is required"
+	}
+	if req.TargetModel == "" {
+		return http.StatusBadRequest, "Target model is required"
+	}
+	if err := validatePattern(req.Alias, req.TargetModel, req.IsPattern); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
 	if req.ProviderKeyID <= 0 {
-		http.Error(w, "A valid provider key is required", http.StatusBadRequest)
-		return
+		// Infer the provider key from the cached model list
+		keyID, status, msg := inferProviderKey(ctx, userID, req.TargetModel)
+		if status != http.StatusOK {
+			return status, msg
+		}
+		req.ProviderKeyID = keyID
+	} else if _, _, err := db.Repo.GetProviderKey(ctx, req.ProviderKeyID, userID); errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusNotFound, "Provider key not found"
+	} else if err != nil {
+		logging.Printf(ctx, "validate alias: get provider key %d error for user %d: %v", req.ProviderKeyID, userID, err)
+		return http.StatusInternalServerError, "DB Error"
 	}
 
 	// Normalize optional fields: treat zero as null
@@ -53,14 +157,148 @@ func UpsertModelAlias(w http.ResponseWriter, r *http.Request) {
 	if req.LightModel != nil && *req.LightModel == "" {
 		req.LightModel = nil
 	}
+	if req.SystemPromptOverride != nil && *req.SystemPromptOverride == "" {
+		req.SystemPromptOverride = nil
+	}
+	if req.FallbackAliasID != nil {
+		if status, msg := validateFallback(ctx, userID, req.Alias, *req.FallbackAliasID); status != http.StatusOK {
+			return status, msg
+		}
+	}
+
+	if req.MaxTemperature != nil && *req.MaxTemperature < 0 {
+		return http.StatusBadRequest, "max_temperature must be non-negative"
+	}
+	if req.CacheTTLSeconds != nil && *req.CacheTTLSeconds < 0 {
+		return http.StatusBadRequest, "cache_ttl_seconds must be non-negative"
+	}
+	if req.MaxMessages != nil && *req.MaxMessages <= 0 {
+		return http.StatusBadRequest, "max_messages must be positive"
+	}
+	if err := validateStatuses(req.FallbackOnStatuses); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	if err := validateWeightedTargets(req.WeightedTargets); err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusOK, ""
+}
 
-	err := db.Repo.UpsertModelAlias(context.Background(), userID, req.Alias, req.TargetModel, req.ProviderKeyID, req.FallbackAliasID, req.UseLightModel, req.LightModelThreshold, req.LightModel)
+// inferProviderKey picks the user's provider key for targetModel by looking the
+// model up in the provider_models cache. It returns a non-200 status and message
+// when no key, or more than one key, could serve the model.
+func inferProviderKey(ctx context.Context, userID int, targetModel string) (int, int, string) {
+	keys, err := db.Repo.FindProviderKeysForModel(ctx, userID, targetModel)
 	if err != nil {
-		log.Printf("upsert model alias error: %v", err)
-		http.Error(w, "Failed to save model alias", http.StatusInternalServerError)
-		return
+		logging.Printf(ctx, "infer provider key: find keys for model %q error for user %d: %v", targetModel, userID, err)
+		return 0, http.StatusInternalServerError, "Failed to infer provider key"
+	}
+
+	switch len(keys) {
+	case 0:
+		return 0, http.StatusBadRequest, "A valid provider key is required (could not infer one for model " + targetModel + ")"
+	case 1:
+		return keys[0].ID, http.StatusOK, ""
+	default:
+		return 0, http.StatusConflict, fmt.Sprintf("Model %s matches %d of your provider keys; specify provider_key_id", targetModel, len(keys))
 	}
-	w.WriteHeader(http.StatusOK)
+}
+
+// validateFallback checks fallbackID is another of the user's aliases. Like
+// inferProviderKey, it returns a non-200 status and message when it isn't.
+func validateFallback(ctx context.Context, userID int, alias string, fallbackID int) (int, string) {
+	name, err := db.Repo.GetUserModelAliasByID(ctx, userID, fallbackID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusBadRequest, fmt.Sprintf("fallback_alias_id %d is not one of your aliases", fallbackID)
+	}
+	if err != nil {
+		logging.Printf(ctx, "validate fallback: get alias %d error for user %d: %v", fallbackID, userID, err)
+		return http.StatusInternalServerError, "Failed to check fallback alias"
+	}
+	if name == alias {
+		return http.StatusBadRequest, fmt.Sprintf("Alias %s cannot fall back to itself", alias)
+	}
+	return http.StatusOK, ""
+}
+
+// validatePattern checks a pattern alias has a wildcard, and that only
+// pattern aliases use the requested-model placeholder in their target.
+func validatePattern(alias, targetModel string, isPattern bool) error {
+	if !isPattern {
+		if strings.Contains(targetModel, db.ModelPlaceholder) {
+			return fmt.Errorf("target_model may only use %s on pattern aliases", db.ModelPlaceholder)
+		}
+		return nil
+	}
+	if !strings.Contains(alias, "*") {
+		return fmt.Errorf("pattern alias %q must contain a * wildcard", alias)
+	}
+	return nil
+}
+
+// validateStatuses checks every entry is a valid HTTP status code.
+func validateStatuses(statuses []int) error {
+	for _, st := range statuses {
+		if st < 100 || st > 599 {
+			return fmt.Errorf("invalid HTTP status in fallback_on_statuses: %d", st)
+		}
+	}
+	return nil
+}
+
+// maxFallbackChainDepth bounds how far expandFallbackChains follows fallbacks.
+const maxFallbackChainDepth = 10
+
+// expandFallbackChains fills in each alias's fallback name and the chain of
+// alias names reached by following fallbacks, resolved from the listed aliases
+// themselves. Expansion stops at a repeated alias and flags the cycle.
+func expandFallbackChains(aliases []ModelAliasRequest) {
+	byID := make(map[int]*ModelAliasRequest, len(aliases))
+	for i := range aliases {
+		byID[aliases[i].ID] = &aliases[i]
+	}
+
+	for i := range aliases {
+		a := &aliases[i]
+		seen := map[int]bool{a.ID: true}
+		next := a.FallbackAliasID
+		for depth := 0; next != nil && depth < maxFallbackChainDepth; depth++ {
+			fb, ok := byID[*next]
+			if !ok {
+				break
+			}
+			if seen[fb.ID] {
+				a.FallbackCycle = true
+				break
+			}
+			seen[fb.ID] = true
+			a.FallbackChain = append(a.FallbackChain, fb.Alias)
+			next = fb.FallbackAliasID
+		}
+		if len(a.FallbackChain) > 0 {
+			a.FallbackAlias = a.FallbackChain[0]
+		}
+	}
+}
+
+// maxWeightedTargets bounds how many canary targets one alias may define.
+const maxWeightedTargets = 10
+
+// validateWeightedTargets checks every canary target names a model and has a
+// positive weight. Weights are relative, so they need not sum to 100.
+func validateWeightedTargets(targets []db.WeightedTarget) error {
+	if len(targets) > maxWeightedTargets {
+		return fmt.Errorf("at most %d weighted_targets are allowed", maxWeightedTargets)
+	}
+	for _, t := range targets {
+		if t.Model == "" {
+			return fmt.Errorf("every weighted target needs a model")
+		}
+		if t.Weight <= 0 {
+			return fmt.Errorf("weighted target %s must have a positive weight", t.Model)
+		}
+	}
+	return nil
 }
 
 // PatchModelAlias updates specific fields of a routing rule
@@ -70,49 +308,269 @@ func PatchModelAlias(w http.ResponseWriter, r *http.Request) {
 
 	var req map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		httperr.BadBody(w, err, "Invalid request")
+		return
+	}
+
+	if raw, ok := req["fallback_on_statuses"].([]interface{}); ok {
+		statuses := make([]int, 0, len(raw))
+		for _, v := range raw {
+			n, ok := v.(float64)
+			if !ok {
+				http.Error(w, "fallback_on_statuses must be a list of HTTP status codes", http.StatusBadRequest)
+				return
+			}
+			statuses = append(statuses, int(n))
+		}
+		if err := validateStatuses(statuses); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req["fallback_on_statuses"] = statuses
+	}
+
+	if raw, ok := req["weighted_targets"]; ok && raw != nil {
+		var targets []db.WeightedTarget
+		encoded, _ := json.Marshal(raw)
+		if err := json.Unmarshal(encoded, &targets); err != nil {
+			http.Error(w, "weighted_targets must be a list of {model, weight}", http.StatusBadRequest)
+			return
+		}
+		if err := validateWeightedTargets(targets); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req["weighted_targets"] = targets
+	}
+
+	if raw, ok := req["cache_ttl_seconds"]; ok && raw != nil {
+		n, ok := raw.(float64)
+		if !ok || n < 0 || n != float64(int(n)) {
+			http.Error(w, "cache_ttl_seconds must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		req["cache_ttl_seconds"] = int(n)
+	}
+
+	if raw, ok := req["max_messages"]; ok && raw != nil {
+		n, ok := raw.(float64)
+		if !ok || n <= 0 || n != float64(int(n)) {
+			http.Error(w, "max_messages must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		req["max_messages"] = int(n)
+	}
+
+	if raw, ok := req["system_prompt_override"]; ok && raw != nil {
+		prompt, ok := raw.(string)
+		if !ok {
+			http.Error(w, "system_prompt_override must be a string", http.StatusBadRequest)
+			return
+		}
+		if prompt == "" {
+			req["system_prompt_override"] = nil
+		}
+	}
+
+	if raw, ok := req["fallback_alias_id"]; ok && raw != nil {
+		n, ok := raw.(float64)
+		if !ok || n <= 0 || n != float64(int(n)) {
+			http.Error(w, "fallback_alias_id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		req["fallback_alias_id"] = int(n)
+	}
+
+	for _, name := range []string{"disabled", "response_format_fallback"} {
+		if raw, ok := req[name]; ok {
+			if _, ok := raw.(bool); !ok {
+				http.Error(w, name+" must be a boolean", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// The patched alias must pass the same checks as on create, including
+	// that its provider key and fallback are the user's own
+	current, err := db.Repo.GetModelAlias(r.Context(), userID, aliasName)
+	if err != nil {
+		httperr.Lookup(w, r, err, "Model alias")
+		return
+	}
+	merged := aliasResponse(*current)
+	patch, _ := json.Marshal(req)
+	if err := json.Unmarshal(patch, &merged); err != nil {
+		httperr.BadBody(w, err, "Invalid request")
 		return
 	}
+	// Only the patchable columns change
+	merged.ID, merged.Alias, merged.IsPattern, merged.FlaggedReason = current.ID, current.Alias, current.IsPattern, current.FlaggedReason
+	if status, msg := merged.validate(r.Context(), userID); status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	if _, ok := req["provider_key_id"]; ok {
+		// validate infers the key when the patch clears it
+		req["provider_key_id"] = merged.ProviderKeyID
+	}
 
-	err := db.Repo.PatchModelAlias(context.Background(), userID, aliasName, req)
+	err = db.Repo.PatchModelAlias(r.Context(), userID, aliasName, req)
+	if errors.Is(err, pgx.ErrNoRows) {
+		httperr.Lookup(w, r, err, "Model alias")
+		return
+	}
 	if err != nil {
-		log.Printf("patch model alias error: %v", err)
+		logging.Printf(r.Context(), "patch model alias error: %v", err)
 		http.Error(w, "Failed to update model alias", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// DeleteModelAlias removes a routing rule. Aliases that fell back to it are
+// left without a fallback.
+func DeleteModelAlias(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+	aliasName := chi.URLParam(r, "alias")
+
+	if err := db.Repo.DeleteModelAlias(r.Context(), userID, aliasName); err != nil {
+		httperr.Lookup(w, r, err, "Model alias")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListFlaggedAliases returns the aliases the model poll flagged because their
+// models are no longer listed by the provider.
+func ListFlaggedAliases(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	results, err := db.Repo.ListModelAliases(r.Context(), userID, "")
+	if err != nil {
+		logging.Printf(r.Context(), "list flagged aliases error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	aliases := make([]ModelAliasRequest, 0)
+	for _, a := range results {
+		if a.FlaggedReason != nil {
+			aliases = append(aliases, aliasResponse(a))
+		}
+	}
+	writeList(w, r, aliases, "list flagged aliases")
+}
+
 // ListAliases returns all routing rules
 func ListAliases(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(auth.KeyUser).(int)
 
-	results, err := db.Repo.ListModelAliases(context.Background(), userID)
+	expand := r.URL.Query().Get("expand")
+	if expand != "" && expand != "fallback" {
+		http.Error(w, "expand must be fallback", http.StatusBadRequest)
+		return
+	}
+
+	results, err := db.Repo.ListModelAliases(context.Background(), userID, r.URL.Query().Get("sort"))
+	if errors.Is(err, db.ErrInvalidSort) {
+		http.Error(w, "sort must be one of alias, created_at", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "list aliases error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	aliases := make([]ModelAliasRequest, 0, len(results))
+	for _, a := range results {
+		aliases = append(aliases, aliasResponse(a))
+	}
+	if expand == "fallback" {
+		expandFallbackChains(aliases)
+	}
+	writeList(w, r, aliases, "list aliases")
+}
+
+// ExportAliases returns all of the user's aliases as a JSON array in the
+// shape POST /aliases and /aliases/import accept.
+func ExportAliases(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	results, err := db.Repo.ListModelAliases(r.Context(), userID, "alias")
 	if err != nil {
-		log.Printf("list aliases error for user %d: %v", userID, err)
+		logging.Printf(r.Context(), "export aliases error for user %d: %v", userID, err)
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
 	}
 
-	var aliases []ModelAliasRequest
+	aliases := make([]ModelAliasRequest, 0, len(results))
 	for _, a := range results {
-		aliases = append(aliases, ModelAliasRequest{
-			ID:                  a.ID,
-			Alias:               a.Alias,
-			TargetModel:         a.TargetModel,
-			ProviderKeyID:       a.ProviderKeyID,
-			FallbackAliasID:     a.FallbackAliasID,
-			UseLightModel:       a.UseLightModel,
-			LightModelThreshold: a.LightModelThreshold,
-			LightModel:          a.LightModel,
-		})
+		aliases = append(aliases, aliasResponse(a))
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="aliases.json"`)
 	if err := json.NewEncoder(w).Encode(aliases); err != nil {
-		log.Printf("list aliases: encode response error: %v", err)
+		logging.Printf(r.Context(), "export aliases: encode response error: %v", err)
 	}
 }
 
+// AliasImportResult is the outcome of one row of an alias import.
+type AliasImportResult struct {
+	Alias    string `json:"alias"`
+	Imported bool   `json:"imported"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportAliases upserts a JSON array of aliases. Each row is validated as
+// POST /aliases would; rows that fail are reported and skipped, and the rest
+// are saved in one transaction. The response lists the outcome of each row.
+func ImportAliases(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	var reqs []ModelAliasRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		httperr.BadBody(w, err, "Invalid request body: expected an array of aliases")
+		return
+	}
+
+	results := make([]AliasImportResult, len(reqs))
+	valid := make([]db.ModelAlias, 0, len(reqs))
+	validRows := make([]int, 0, len(reqs))
+	seen := make(map[string]bool)
+	for i := range reqs {
+		req := &reqs[i]
+		results[i].Alias = req.Alias
+		if seen[req.Alias] {
+			results[i].Error = "Alias " + req.Alias + " appears more than once"
+			continue
+		}
+		seen[req.Alias] = true
+		if status, msg := req.validate(r.Context(), userID); status != http.StatusOK {
+			if status == http.StatusInternalServerError {
+				http.Error(w, "Failed to import aliases", http.StatusInternalServerError)
+				return
+			}
+			results[i].Error = msg
+			continue
+		}
+		valid = append(valid, req.toModelAlias(userID))
+		validRows = append(validRows, i)
+	}
+
+	if len(valid) > 0 {
+		if err := db.Repo.ImportModelAliases(r.Context(), valid); err != nil {
+			logging.Printf(r.Context(), "import aliases error for user %d: %v", userID, err)
+			http.Error(w, "Failed to import aliases", http.StatusInternalServerError)
+			return
+		}
+		for _, i := range validRows {
+			results[i].Imported = true
+		}
+	}
+	writeList(w, r, results, "import aliases")
+}
+
 // ListProviderModels returns cached models for a given provider key
 func ListProviderModels(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(auth.KeyUser).(int)
@@ -124,35 +582,62 @@ func ListProviderModels(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	q := r.URL.Query()
+	filter := db.ModelFilter{Query: q.Get("q"), Order: q.Get("order")}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = n
+	}
+
 	providerName, _, err := db.Repo.GetProviderKey(context.Background(), keyIDInt, userID)
 	if err != nil {
-		log.Printf("list provider models: get provider key %d error for user %d: %v", keyIDInt, userID, err)
-		http.Error(w, "Unauthorized or not found", http.StatusUnauthorized)
+		httperr.Lookup(w, r, err, "Provider key")
 		return
 	}
 
-	models, err := db.Repo.ListProviderModelsByType(context.Background(), providerName)
+	models, err := db.Repo.ListProviderModelsByType(context.Background(), providerName, filter)
+	if errors.Is(err, db.ErrInvalidSort) {
+		http.Error(w, "order must be one of asc, desc", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Printf("list provider models: list models error for provider %q: %v", providerName, err)
+		logging.Printf(r.Context(), "list provider models: list models error for provider %q: %v", providerName, err)
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(models); err != nil {
-		log.Printf("list provider models: encode response error: %v", err)
-	}
+	writeList(w, r, models, "list provider models")
+}
+
+// ProviderModels is the cached models of one provider type
+type ProviderModels struct {
+	Provider string   `json:"provider"`
+	Models   []string `json:"models"`
 }
 
-// ListAllModels returns all cached models for all providers
+// ListAllModels returns all cached models, one entry per provider type in
+// provider order
 func ListAllModels(w http.ResponseWriter, r *http.Request) {
-	models, err := db.Repo.ListAllProviderModels(context.Background())
+	models, err := db.Repo.ListAllProviderModels(r.Context())
 	if err != nil {
-		log.Printf("list all models error: %v", err)
+		logging.Printf(r.Context(), "list all models error: %v", err)
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(models); err != nil {
-		log.Printf("list all models: encode response error: %v", err)
+	var list []ProviderModels
+	for _, p := range slices.Sorted(maps.Keys(models)) {
+		list = append(list, ProviderModels{Provider: p, Models: models[p]})
 	}
+	writeList(w, r, list, "list all models")
 }
@@ -0,0 +1,46 @@
+package management
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandFallbackChains(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	aliases := []ModelAliasRequest{
+		{ID: 1, Alias: "a", FallbackAliasID: intPtr(2)},
+		{ID: 2, Alias: "b", FallbackAliasID: intPtr(3)},
+		{ID: 3, Alias: "c"},
+		{ID: 4, Alias: "loop1", FallbackAliasID: intPtr(5)},
+		{ID: 5, Alias: "loop2", FallbackAliasID: intPtr(4)},
+		{ID: 6, Alias: "dangling", FallbackAliasID: intPtr(42)},
+	}
+	// A chain longer than the bound is cut off rather than followed
+	for i := 0; i <= maxFallbackChainDepth+1; i++ {
+		aliases = append(aliases, ModelAliasRequest{ID: 100 + i, Alias: "long", FallbackAliasID: intPtr(101 + i)})
+	}
+	expandFallbackChains(aliases)
+
+	tests := []struct {
+		alias    int
+		fallback string
+		chain    []string
+		cycle    bool
+	}{
+		{alias: 0, fallback: "b", chain: []string{"b", "c"}},
+		{alias: 2},
+		{alias: 3, fallback: "loop2", chain: []string{"loop2"}, cycle: true},
+		{alias: 5},
+	}
+	for _, tt := range tests {
+		a := aliases[tt.alias]
+		if a.FallbackAlias != tt.fallback || !reflect.DeepEqual(a.FallbackChain, tt.chain) || a.FallbackCycle != tt.cycle {
+			t.Errorf("%s: expected fallback %q, chain %v, cycle %v; got %q, %v, %v",
+				a.Alias, tt.fallback, tt.chain, tt.cycle, a.FallbackAlias, a.FallbackChain, a.FallbackCycle)
+		}
+	}
+	if n := len(aliases[6].FallbackChain); n != maxFallbackChainDepth {
+		t.Errorf("Expected the chain cut off at %d aliases, got %d", maxFallbackChainDepth, n)
+	}
+}
@@ -3,13 +3,48 @@ package management
 import (
 	"context"
 	"fmt"
+	"slices"
 	"time"
+	"tokentracer-proxy/pkg/config"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
 	"tokentracer-proxy/pkg/provider"
+	"tokentracer-proxy/pkg/status"
 )
 
-// StartModelPolling starts a background goroutine that polls providers for models every 12 hours
+// disableVanishedAliases makes the model poll disable, not just flag, aliases
+// whose models are no longer listed. Off by default since the cache can lag.
+var disableVanishedAliases = config.Bool("DISABLE_VANISHED_ALIASES", false)
+
+// modelPollEnabled turns off the upstream model poll, e.g. in CI without
+// outbound access. The seeded common models are still available.
+var modelPollEnabled = config.Bool("MODEL_POLL_ENABLED", true)
+
+// commonModels are seeded into the model cache so aliases can be set up
+// before a provider has been polled, or when polling is disabled.
+var commonModels = map[string][]string{
+	"openai":    {"gpt-5", "gpt-5.2-thinking", "gpt-5.2-pro", "gpt-4o", "gpt-4o-mini", "o3-pro", "o4-mini"},
+	"anthropic": {"claude-4.5-opus", "claude-4.5-sonnet", "claude-4.5-haiku", "claude-4-sonnet", "claude-4-opus"},
+	"gemini":    {"gemini-3-pro", "gemini-3-flash", "gemini-2.5-pro", "gemini-2.5-flash"},
+	"mistral":   {"mistral-large-latest", "mistral-medium-latest", "mistral-small-latest", "codestral-latest", "ministral-8b-latest"},
+}
+
+// SeedModels adds the common models for every supported provider type to the
+// model cache. It makes no upstream calls and is safe to run on every start.
+func SeedModels(ctx context.Context) {
+	for _, p := range provider.SupportedProviders() {
+		seedCommonModels(ctx, p)
+	}
+}
+
+// StartModelPolling starts a background goroutine that polls providers for
+// models every 12 hours. It does nothing when MODEL_POLL_ENABLED is false.
 func StartModelPolling(ctx context.Context) {
+	if !modelPollEnabled {
+		logging.Printf(ctx, "Model polling disabled")
+		return
+	}
+
 	// 1. Initial run on startup
 	pollModels(ctx)
 
@@ -29,61 +64,109 @@ func StartModelPolling(ctx context.Context) {
 }
 
 func pollModels(ctx context.Context) {
-	fmt.Println("Polling providers for models...")
-
-	// 1. Seed all known providers first so we have defaults even with no keys
-	for _, p := range provider.SupportedProviders() {
-		seedCommonModels(ctx, p)
-	}
+	logging.Printf(ctx, "Polling providers for models")
+	pollStart := time.Now()
 
-	// 2. Poll using one key per provider type
+	// Poll using one key per provider type
 	results, err := db.Repo.ListUniqueProviderKeysPerProvider(ctx)
 	if err != nil {
-		fmt.Printf("Failed to query provider keys for polling: %v\n", err)
+		logging.Printf(ctx, "Failed to query provider keys for polling: %v", err)
 		return
 	}
 
+	var polled []string
 	for _, k := range results {
-		fmt.Printf("Polling real-time models for %s using key ID %d...\n", k.Provider, k.ID)
-		var prov provider.Provider
-		switch k.Provider {
-		case "openai":
-			prov = provider.NewOpenAIProvider(db.Repo, k.ID, k.UserID)
-		case "anthropic":
-			prov = provider.NewAnthropicProvider(db.Repo, k.ID, k.UserID)
-		case "gemini":
-			prov = provider.NewGeminiProvider(db.Repo, k.ID, k.UserID)
-		}
-
-		if prov != nil {
+		logging.Printf(ctx, "Polling real-time models for %s using key ID %d", k.Provider, k.ID)
+		prov, ok := provider.New(k.Provider, db.Repo, k.ID, k.UserID)
+		if ok {
 			models, err := prov.ListModels(ctx)
 			if err == nil {
 				for _, m := range models {
 					if err := db.Repo.InsertProviderModel(ctx, k.Provider, m); err != nil {
-						fmt.Printf("Failed to insert model %s for provider %s: %v\n", m, k.Provider, err)
+						logging.Printf(ctx, "Failed to insert model %s for provider %s: %v", m, k.Provider, err)
 					}
 				}
+				// Only a successful listing says what the provider no longer has
+				if pruned, err := db.Repo.PruneProviderModels(ctx, k.Provider, pollStart); err != nil {
+					logging.Printf(ctx, "Failed to prune stale models for provider %s: %v", k.Provider, err)
+				} else if pruned > 0 {
+					logging.Printf(ctx, "Pruned %d stale models for provider %s", pruned, k.Provider)
+				}
+				polled = append(polled, k.Provider)
 			} else {
-				fmt.Printf("Failed to list models for provider %s: %v\n", k.Provider, err)
+				logging.Printf(ctx, "Failed to list models for provider %s: %v", k.Provider, err)
 			}
 		}
 	}
-	fmt.Println("Model polling complete.")
+	reconcileAliases(ctx, polled)
+	// A poll in which every listing failed refreshed nothing
+	if len(polled) > 0 {
+		status.RecordModelPoll(time.Now())
+	}
+	logging.Printf(ctx, "Model polling complete")
 }
 
-func seedCommonModels(ctx context.Context, providerType string) {
-	var commonModels []string
-	switch providerType {
-	case "openai":
-		commonModels = []string{"gpt-5", "gpt-5.2-thinking", "gpt-5.2-pro", "gpt-4o", "gpt-4o-mini", "o3-pro", "o4-mini"}
-	case "anthropic":
-		commonModels = []string{"claude-4.5-opus", "claude-4.5-sonnet", "claude-4.5-haiku", "claude-4-sonnet", "claude-4-opus"}
-	case "gemini":
-		commonModels = []string{"gemini-3-pro", "gemini-3-flash", "gemini-2.5-pro", "gemini-2.5-flash"}
+// reconcileAliases flags aliases on the polled provider types whose target or
+// light model is no longer in the model cache, and clears the flag once the
+// model is back. With DISABLE_VANISHED_ALIASES the flagged aliases are also
+// disabled, and re-enabled when cleared.
+func reconcileAliases(ctx context.Context, polled []string) {
+	if len(polled) == 0 {
+		return
+	}
+	refs, err := db.Repo.ListAliasModelRefs(ctx)
+	if err != nil {
+		logging.Printf(ctx, "Failed to list aliases for reconciliation: %v", err)
+		return
+	}
+	models, err := db.Repo.ListAllProviderModels(ctx)
+	if err != nil {
+		logging.Printf(ctx, "Failed to list provider models for reconciliation: %v", err)
+		return
 	}
-	for _, m := range commonModels {
-		if err := db.Repo.InsertProviderModel(ctx, providerType, m); err != nil {
-			fmt.Printf("Failed to seed model %s for provider %s: %v\n", m, providerType, err)
+
+	for _, ref := range refs {
+		if !slices.Contains(polled, ref.Provider) {
+			continue
+		}
+		reason := vanishedModelReason(ref, models[ref.Provider])
+		switch {
+		case reason != nil && (ref.FlaggedReason == nil || *ref.FlaggedReason != *reason || ref.Disabled != disableVanishedAliases):
+			logging.Printf(ctx, "Flagging alias %q (user %d): %s", ref.Alias, ref.UserID, *reason)
+			if err := db.Repo.SetAliasFlag(ctx, ref.ID, reason, disableVanishedAliases); err != nil {
+				logging.Printf(ctx, "Failed to flag alias %q (user %d): %v", ref.Alias, ref.UserID, err)
+			}
+		case reason == nil && ref.FlaggedReason != nil:
+			// Aliases disabled by hand, without a flag, are left alone
+			logging.Printf(ctx, "Clearing flag on alias %q (user %d)", ref.Alias, ref.UserID)
+			if err := db.Repo.SetAliasFlag(ctx, ref.ID, nil, false); err != nil {
+				logging.Printf(ctx, "Failed to clear flag on alias %q (user %d): %v", ref.Alias, ref.UserID, err)
+			}
 		}
 	}
 }
+
+// vanishedModelReason returns why ref should be flagged given its provider's
+// cached models, or nil if its models are all listed.
+func vanishedModelReason(ref db.AliasModelRef, models []string) *string {
+	var reason string
+	switch {
+	case !slices.Contains(models, ref.TargetModel):
+		reason = fmt.Sprintf("target_model %s is no longer listed by %s", ref.TargetModel, ref.Provider)
+	case ref.LightModel != nil && *ref.LightModel != "" && !slices.Contains(models, *ref.LightModel):
+		reason = fmt.Sprintf("light_model %s is no longer listed by %s", *ref.LightModel, ref.Provider)
+	default:
+		return nil
+	}
+	return &reason
+}
+
+func seedCommonModels(ctx context.Context, providerType string) {
+	models := commonModels[providerType]
+	if len(models) == 0 {
+		return
+	}
+	if err := db.Repo.SeedProviderModels(ctx, providerType, models); err != nil {
+		logging.Printf(ctx, "Failed to seed models for provider %s: %v", providerType, err)
+	}
+}
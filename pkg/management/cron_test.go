@@ -0,0 +1,153 @@
+package management
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/status"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestReconcileAliases(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Repo
+	db.Repo = db.NewPostgresRepository(mock)
+	defer func() { db.Repo = orig }()
+
+	oldReason := "target_model gpt-4-32k is no longer listed by openai"
+	light := "gpt-3.5-turbo-0301"
+	mock.ExpectQuery("SELECT (.+) FROM model_aliases a JOIN provider_keys").
+		WillReturnRows(mock.NewRows([]string{"id", "user_id", "alias", "provider", "target_model", "light_model", "disabled", "flagged_reason"}).
+			AddRow(1, 7, "healthy", "openai", "gpt-4o", nil, false, nil).
+			AddRow(2, 7, "vanished", "openai", "gpt-4-32k", nil, false, nil).
+			AddRow(3, 7, "light", "openai", "gpt-4o", &light, false, nil).
+			AddRow(4, 7, "back", "openai", "gpt-4o", nil, false, &oldReason).
+			AddRow(5, 7, "unpolled", "anthropic", "claude-2", nil, false, nil))
+	mock.ExpectQuery("SELECT provider, model_id FROM provider_models").
+		WillReturnRows(mock.NewRows([]string{"provider", "model_id"}).
+			AddRow("openai", "gpt-4o").
+			AddRow("anthropic", "claude-sonnet-4-5"))
+	mock.ExpectExec("UPDATE model_aliases SET flagged_reason").
+		WithArgs(2, pgxmock.AnyArg(), false).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec("UPDATE model_aliases SET flagged_reason").
+		WithArgs(3, pgxmock.AnyArg(), false).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec("UPDATE model_aliases SET flagged_reason").
+		WithArgs(4, (*string)(nil), false).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	reconcileAliases(context.Background(), []string{"openai"})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPollModels_RecordsOnlySuccessfulPolls(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Repo
+	db.Repo = db.NewPostgresRepository(mock)
+	defer func() { db.Repo = orig }()
+
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	enc, err := crypto.Encrypt("sk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"id":"gpt-4o"}]}`))
+	}))
+	defer upstream.Close()
+	t.Setenv("OPENAI_BASE_URL", upstream.URL)
+
+	expectKeys := func() {
+		mock.ExpectQuery("SELECT DISTINCT ON \\(provider\\) id, user_id, provider FROM provider_keys").
+			WillReturnRows(mock.NewRows([]string{"id", "user_id", "provider"}).AddRow(1, 7, "openai"))
+	}
+
+	// The only listing fails, so nothing was refreshed
+	before := status.Current().LastModelPoll
+	expectKeys()
+	mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(1, 7).
+		WillReturnError(errors.New("connection refused"))
+	pollModels(context.Background())
+	if after := status.Current().LastModelPoll; !equalTimes(before, after) {
+		t.Errorf("Expected a failed poll not to be recorded, got %v", after)
+	}
+
+	expectKeys()
+	mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(1, 7).
+		WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", enc))
+	mock.ExpectExec("INSERT INTO provider_models").WithArgs("openai", "gpt-4o").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec("DELETE FROM provider_models").WithArgs("openai", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectQuery("SELECT (.+) FROM model_aliases a JOIN provider_keys").
+		WillReturnRows(mock.NewRows([]string{"id", "user_id", "alias", "provider", "target_model", "light_model", "disabled", "flagged_reason"}))
+	mock.ExpectQuery("SELECT provider, model_id FROM provider_models").
+		WillReturnRows(mock.NewRows([]string{"provider", "model_id"}).AddRow("openai", "gpt-4o"))
+	pollModels(context.Background())
+	if after := status.Current().LastModelPoll; after == nil || equalTimes(before, after) {
+		t.Errorf("Expected a successful poll to be recorded, got %v", after)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func equalTimes(a, b *time.Time) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Equal(*b))
+}
+
+func TestVanishedModelReason(t *testing.T) {
+	light := "gpt-4o-mini"
+	ref := db.AliasModelRef{Provider: "openai", TargetModel: "gpt-4o", LightModel: &light}
+	if got := vanishedModelReason(ref, []string{"gpt-4o", "gpt-4o-mini"}); got != nil {
+		t.Errorf("Expected no reason, got %q", *got)
+	}
+	got := vanishedModelReason(ref, []string{"gpt-4o"})
+	if want := "light_model gpt-4o-mini is no longer listed by openai"; got == nil || *got != want {
+		t.Errorf("Expected %q, got %v", want, got)
+	}
+}
+
+func TestSeedModels(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Repo
+	db.Repo = db.NewPostgresRepository(mock)
+	defer func() { db.Repo = orig }()
+
+	// One statement per provider type with common models; the rest are skipped
+	for _, p := range []string{"openai", "anthropic", "gemini"} {
+		mock.ExpectExec("INSERT INTO provider_models (.+) ON CONFLICT (.+) DO NOTHING").
+			WithArgs(p, commonModels[p]).
+			WillReturnResult(pgxmock.NewResult("INSERT", 0))
+	}
+
+	SeedModels(context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
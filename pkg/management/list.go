@@ -0,0 +1,31 @@
+package management
+
+import (
+	"encoding/json"
+	"net/http"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// listEnvelope wraps list responses for clients that ask for ?envelope=true,
+// giving them the item count alongside the items.
+type listEnvelope[T any] struct {
+	Data  []T `json:"data"`
+	Count int `json:"count"`
+}
+
+// writeList encodes items as a list response. Bare arrays stay the default so
+// existing clients keep working; ?envelope=true wraps them in {data, count}.
+// An empty list is always encoded as [], never null.
+func writeList[T any](w http.ResponseWriter, r *http.Request, items []T, handler string) {
+	if items == nil {
+		items = []T{}
+	}
+	var body any = items
+	if r.URL.Query().Get("envelope") == "true" {
+		body = listEnvelope[T]{Data: items, Count: len(items)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logging.Printf(r.Context(), "%s: encode response error: %v", handler, err)
+	}
+}
@@ -2,11 +2,11 @@ package management
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"net/http"
+	"strconv"
 	"tokentracer-proxy/pkg/auth"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -19,32 +19,83 @@ func GetUsageStats(w http.ResponseWriter, r *http.Request) {
 
 	results, err := db.Repo.GetUsageStats(context.Background(), userID)
 	if err != nil {
-		log.Printf("get usage stats error: %v", err)
+		logging.Printf(r.Context(), "get usage stats error: %v", err)
 		http.Error(w, "Failed to retrieve usage stats", http.StatusInternalServerError)
 		return
 	}
 
-	var stats []map[string]interface{}
+	stats := make([]map[string]interface{}, 0, len(results))
 	for _, s := range results {
 		stats = append(stats, map[string]interface{}{
 			"provider": s.Provider, "alias": s.Alias, "input_tokens": s.Input, "output_tokens": s.Output, "requests": s.Reqs,
+			"cost": s.Cost, "unpriced_models": s.UnpricedModels,
+			"avg_latency_ms": s.AvgLatencyMS, "p95_latency_ms": s.P95LatencyMS,
+			"successes": s.Successes, "success_rate": successRate(s.Successes, s.Reqs),
 		})
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(stats); err != nil {
-		log.Printf("dashboard stats: encode response error: %v", err)
+	writeList(w, r, stats, "dashboard stats")
+}
+
+// successRate is the share of requests that succeeded, 0 when there are none.
+func successRate(successes, reqs int) float64 {
+	if reqs == 0 {
+		return 0
+	}
+	return float64(successes) / float64(reqs)
+}
+
+// ListFailures returns the user's most recent permanently failed requests
+func ListFailures(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	results, err := db.Repo.ListFailedRequests(r.Context(), userID, limit)
+	if err != nil {
+		logging.Printf(r.Context(), "list failures error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	failures := make([]map[string]interface{}, 0, len(results))
+	for _, f := range results {
+		failures = append(failures, map[string]interface{}{
+			"id": f.ID, "requested_model": f.RequestedModel, "attempted_aliases": f.AttemptedAliases,
+			"status_code": f.StatusCode, "error": f.Error, "request_body": f.RequestBody, "created_at": f.CreatedAt,
+		})
 	}
+	writeList(w, r, failures, "list failures")
 }
 
 func RegisterRoutes(r chi.Router) {
+	r.Get("/provider-types", ListProviderTypes)
 	r.Post("/providers", CreateProviderKey)
 	r.Get("/providers", ListProviderKeys)
+	r.Delete("/providers/{keyID}", DeleteProviderKey)
 	r.Get("/providers/{keyID}/models", ListProviderModels)
 	r.Get("/models", ListAllModels)
 
 	r.Post("/aliases", UpsertModelAlias)
 	r.Get("/aliases", ListAliases)
+	r.Get("/aliases/flagged", ListFlaggedAliases)
+	r.Get("/aliases/validate", ValidateAliases)
+	r.Get("/aliases/export", ExportAliases)
+	r.Post("/aliases/import", ImportAliases)
 	r.Patch("/aliases/{alias}", PatchModelAlias)
+	r.Delete("/aliases/{alias}", DeleteModelAlias)
 
 	r.Get("/usage", GetUsageStats)
+	r.Get("/usage/summary", GetUsageSummary)
+	r.Get("/usage/timeseries", GetUsageTimeSeries)
+	r.Get("/failures", ListFailures)
+	r.Get("/param-policy", GetParamPolicy)
+	r.Put("/param-policy", SetParamPolicy)
 }
@@ -0,0 +1,821 @@
+package management_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/db/dbtest"
+	"tokentracer-proxy/pkg/management"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// TestListHandlers_EmptyIsArray checks list endpoints encode no rows as [],
+// not null, both bare and in the envelope.
+func TestListHandlers_EmptyIsArray(t *testing.T) {
+	userID := 42
+	tests := []struct {
+		name   string
+		path   string
+		expect func(mock pgxmock.PgxPoolIface)
+	}{
+		{
+			name: "aliases",
+			path: "/aliases",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT (.+) FROM model_aliases").WithArgs(userID).
+					WillReturnRows(dbtest.AliasRows(mock))
+			},
+		},
+		{
+			name: "flagged aliases",
+			path: "/aliases/flagged",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT (.+) FROM model_aliases").WithArgs(userID).
+					WillReturnRows(dbtest.AliasRows(mock))
+			},
+		},
+		{
+			name: "provider keys",
+			path: "/providers",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT id, provider, label, base_url, created_at FROM provider_keys").WithArgs(userID).
+					WillReturnRows(mock.NewRows([]string{"id", "provider", "label", "base_url", "created_at"}))
+			},
+		},
+		{
+			name: "provider models",
+			path: "/providers/7/models",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(7, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				mock.ExpectQuery("SELECT model_id FROM provider_models").WithArgs("openai").
+					WillReturnRows(mock.NewRows([]string{"model_id"}))
+			},
+		},
+		{
+			name: "all models",
+			path: "/models",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, model_id FROM provider_models").
+					WillReturnRows(mock.NewRows([]string{"provider", "model_id"}))
+			},
+		},
+		{
+			name: "usage",
+			path: "/usage",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider_used, alias_used").WithArgs(userID).
+					WillReturnRows(mock.NewRows([]string{"provider_used", "alias_used", "input", "output", "reqs", "cost", "unpriced_models", "avg_latency_ms", "p95_latency_ms", "successes"}))
+			},
+		},
+		{
+			name: "failures",
+			path: "/failures",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT id, requested_model").WithArgs(userID, 50).
+					WillReturnRows(mock.NewRows([]string{"id", "requested_model", "attempted_aliases", "status_code", "error", "request_body", "created_at"}))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, envelope := range []bool{false, true} {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+
+			path, want := tt.path, "[]"
+			if envelope {
+				path, want = path+"?envelope=true", `{"data":[],"count":0}`
+			}
+			req := httptest.NewRequest("GET", path, nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("%s (envelope=%v): expected 200, got %d: %s", tt.name, envelope, w.Code, w.Body.String())
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != want {
+				t.Errorf("%s (envelope=%v): expected %s, got %s", tt.name, envelope, want, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("%s: there were unfulfilled expectations: %s", tt.name, err)
+			}
+			mock.Close()
+		}
+	}
+}
+
+func TestListAllModels(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+	mock.ExpectQuery("SELECT provider, model_id FROM provider_models").
+		WillReturnRows(mock.NewRows([]string{"provider", "model_id"}).
+			AddRow("openai", "gpt-4o").AddRow("anthropic", "claude-4.5-opus").AddRow("openai", "gpt-5"))
+
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	req := httptest.NewRequest("GET", "/models?envelope=true", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, 42))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	want := `{"data":[{"provider":"anthropic","models":["claude-4.5-opus"]},{"provider":"openai","models":["gpt-4o","gpt-5"]}],"count":2}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListHandlers_InvalidSort(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	for _, path := range []string{"/aliases?sort=target_model", "/providers?sort=encrypted_key"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, 42))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, w.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListAliases_ExpandFallback(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 42
+	backup := 2
+	mock.ExpectQuery("SELECT (.+) FROM model_aliases").WithArgs(userID).
+		WillReturnRows(dbtest.AliasRows(mock,
+			db.ModelAlias{ID: 1, Alias: "fast", TargetModel: "gpt-4o-mini", ProviderKeyID: 4, FallbackAliasID: &backup},
+			db.ModelAlias{ID: 2, Alias: "backup", TargetModel: "gpt-4o", ProviderKeyID: 4}))
+
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/aliases"+query, nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("?expand=fallback")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var aliases []struct {
+		Alias         string   `json:"alias"`
+		FallbackAlias string   `json:"fallback_alias"`
+		FallbackChain []string `json:"fallback_chain"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &aliases); err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 || aliases[0].FallbackAlias != "backup" || len(aliases[0].FallbackChain) != 1 || aliases[1].FallbackChain != nil {
+		t.Errorf("Unexpected expansion %+v", aliases)
+	}
+
+	if w := do("?expand=provider"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown expansion, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListProviderModels_Filter(t *testing.T) {
+	userID := 42
+	tests := []struct {
+		name     string
+		query    string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+	}{
+		{
+			name:  "filtered",
+			query: "?q=sonnet&order=asc&limit=5&offset=10",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(7, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("anthropic", "enc"))
+				mock.ExpectQuery("ILIKE (.+) ORDER BY model_id LIMIT").WithArgs("anthropic", "%sonnet%", 5, 10).
+					WillReturnRows(mock.NewRows([]string{"model_id"}).AddRow("claude-sonnet-4-5"))
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:  "unknown order",
+			query: "?order=newest",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(7, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("anthropic", "enc"))
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{name: "limit too large", query: "?limit=5000", expect: func(pgxmock.PgxPoolIface) {}, wantCode: http.StatusBadRequest},
+		{name: "negative offset", query: "?offset=-1", expect: func(pgxmock.PgxPoolIface) {}, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest("GET", "/providers/7/models"+tt.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetUsageStats_Latency(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 42
+	avg, p95 := 812.5, 1900.0
+	mock.ExpectQuery("SELECT provider_used, alias_used").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"provider_used", "alias_used", "input", "output", "reqs", "cost", "unpriced_models", "avg_latency_ms", "p95_latency_ms", "successes"}).
+			AddRow("openai", "fast", 10, 5, 4, 0.01, []string{}, &avg, &p95, 3).
+			AddRow("anthropic", "old", 3, 1, 1, 0.0, []string{}, nil, nil, 1))
+
+	req := httptest.NewRequest("GET", "/usage", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+	w := httptest.NewRecorder()
+	management.GetUsageStats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"avg_latency_ms":812.5`) || !strings.Contains(body, `"p95_latency_ms":1900`) {
+		t.Errorf("Expected the latency percentiles in %s", body)
+	}
+	if !strings.Contains(body, `"avg_latency_ms":null`) {
+		t.Errorf("Expected null latency for requests logged without one in %s", body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUsageTimeSeries(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 42
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("FROM generate_series").WithArgs(userID, "week", 12).
+		WillReturnRows(mock.NewRows([]string{"start", "count", "input", "output"}).
+			AddRow(day, 0, 0, 0).
+			AddRow(day.AddDate(0, 0, 7), 3, 30, 12))
+
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	do := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/usage/timeseries"+query, nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("?granularity=week")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	want := `[{"start":"2025-03-01T00:00:00Z","requests":0,"input_tokens":0,"output_tokens":0,"total_tokens":0},{"start":"2025-03-08T00:00:00Z","requests":3,"input_tokens":30,"output_tokens":12,"total_tokens":42}]`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	if w := do("?granularity=month"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown granularity, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUsageSummary(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 42
+	mock.ExpectQuery("SELECT COUNT").WithArgs(userID, pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"count", "input", "output"}).AddRow(12, 1200, 300))
+	mock.ExpectQuery("SELECT COUNT").WithArgs(userID, pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"count", "input", "output"}).AddRow(8, 800, 200))
+	// The top aliases are ranked by spend, so a cheap alias with more tokens
+	// comes after an expensive one
+	mock.ExpectQuery(`ORDER BY COALESCE\(SUM\(estimated_cost\), 0\) DESC`).WithArgs(userID, pgxmock.AnyArg(), pgxmock.AnyArg(), 5).
+		WillReturnRows(mock.NewRows([]string{"provider_used", "alias_used", "input", "output", "reqs", "cost"}).
+			AddRow("anthropic", "smart", 100, 50, 2, 0.75).
+			AddRow("openai", "fast", 1000, 200, 10, 0.02))
+	mock.ExpectQuery("SELECT provider_used, COUNT").WithArgs(userID, pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"provider_used", "reqs", "errors"}).
+			AddRow("openai", 10, 1).
+			AddRow("anthropic", 2, 1))
+
+	req := httptest.NewRequest("GET", "/usage/summary", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+	w := httptest.NewRecorder()
+	management.GetUsageSummary(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var summary struct {
+		CurrentPeriod struct {
+			Requests int `json:"requests"`
+		} `json:"current_period"`
+		TopAliases []struct {
+			Alias string  `json:"alias"`
+			Cost  float64 `json:"cost"`
+		} `json:"top_aliases"`
+		MostErrorProneProvider struct {
+			Provider string `json:"provider"`
+		} `json:"most_error_prone_provider"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.CurrentPeriod.Requests != 12 {
+		t.Errorf("Expected 12 requests this period, got %d", summary.CurrentPeriod.Requests)
+	}
+	if len(summary.TopAliases) != 2 || summary.TopAliases[0].Alias != "smart" || summary.TopAliases[0].Cost != 0.75 {
+		t.Errorf("Expected smart to lead the top aliases by spend, got %+v", summary.TopAliases)
+	}
+	if summary.MostErrorProneProvider.Provider != "anthropic" {
+		t.Errorf("Expected anthropic as the most error-prone provider, got %q", summary.MostErrorProneProvider.Provider)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpsertAlias_InfersProviderKey(t *testing.T) {
+	userID := 42
+	created := time.Now()
+	tests := []struct {
+		name     string
+		keys     []int
+		wantCode int
+	}{
+		{name: "one key", keys: []int{4}, wantCode: http.StatusOK},
+		{name: "no key", wantCode: http.StatusBadRequest},
+		{name: "ambiguous", keys: []int{4, 5}, wantCode: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+
+			rows := mock.NewRows([]string{"id", "provider", "label", "created_at"})
+			for _, id := range tt.keys {
+				rows.AddRow(id, "anthropic", "", created)
+			}
+			mock.ExpectQuery("FROM provider_keys pk").WithArgs(userID, "claude-sonnet-4-5").WillReturnRows(rows)
+			if tt.wantCode == http.StatusOK {
+				// The inferred key is saved with the alias
+				mock.ExpectExec("INSERT INTO model_aliases").
+					WithArgs(append([]any{userID, "smart", "claude-sonnet-4-5", 4}, anyArgs(13)...)...).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			}
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest("POST", "/aliases", strings.NewReader(`{"alias": "smart", "target_model": "claude-sonnet-4-5"}`))
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func anyArgs(n int) []any {
+	args := make([]any, n)
+	for i := range args {
+		args[i] = pgxmock.AnyArg()
+	}
+	return args
+}
+
+func TestAliasFallbackValidation(t *testing.T) {
+	userID := 42
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+	}{
+		{
+			name:   "upsert with own fallback",
+			method: "POST",
+			path:   "/aliases",
+			body:   `{"alias": "fast", "target_model": "gpt-4o", "provider_key_id": 4, "fallback_alias_id": 7}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(7, userID).
+					WillReturnRows(mock.NewRows([]string{"alias"}).AddRow("backup"))
+				fallback := 7
+				mock.ExpectExec("INSERT INTO model_aliases").
+					WithArgs(userID, "fast", "gpt-4o", 4, &fallback, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:   "upsert with unknown or another user's fallback",
+			method: "POST",
+			path:   "/aliases",
+			body:   `{"alias": "fast", "target_model": "gpt-4o", "provider_key_id": 4, "fallback_alias_id": 8}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(8, userID).
+					WillReturnError(pgx.ErrNoRows)
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "upsert falling back to itself",
+			method: "POST",
+			path:   "/aliases",
+			body:   `{"alias": "fast", "target_model": "gpt-4o", "provider_key_id": 4, "fallback_alias_id": 3}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(3, userID).
+					WillReturnRows(mock.NewRows([]string{"alias"}).AddRow("fast"))
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "patch falling back to itself",
+			method: "PATCH",
+			path:   "/aliases/fast",
+			body:   `{"fallback_alias_id": 3}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT (.+) FROM model_aliases WHERE user_id = \\$1 AND alias = \\$2").WithArgs(userID, "fast").
+					WillReturnRows(dbtest.AliasRows(mock, db.ModelAlias{ID: 3, Alias: "fast", TargetModel: "gpt-4o", ProviderKeyID: 4}))
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(3, userID).
+					WillReturnRows(mock.NewRows([]string{"alias"}).AddRow("fast"))
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "patch clearing the fallback",
+			method: "PATCH",
+			path:   "/aliases/fast",
+			body:   `{"fallback_alias_id": null}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				fallback := 7
+				mock.ExpectQuery("SELECT (.+) FROM model_aliases WHERE user_id = \\$1 AND alias = \\$2").WithArgs(userID, "fast").
+					WillReturnRows(dbtest.AliasRows(mock, db.ModelAlias{ID: 3, Alias: "fast", TargetModel: "gpt-4o", ProviderKeyID: 4, FallbackAliasID: &fallback}))
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				mock.ExpectExec("UPDATE model_aliases SET fallback_alias_id").WithArgs(userID, "fast", nil).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+// TestPatchModelAlias_Validation checks a patched alias gets the same checks
+// as a new one.
+func TestPatchModelAlias_Validation(t *testing.T) {
+	userID := 42
+	current := db.ModelAlias{ID: 3, Alias: "fast", TargetModel: "gpt-4o", ProviderKeyID: 4}
+	tests := []struct {
+		name     string
+		body     string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "own provider key",
+			body: `{"provider_key_id": 5, "max_temperature": 0.5}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(5, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+				// Column order follows the patch map, so the values aren't matched
+				mock.ExpectExec("UPDATE model_aliases SET").WithArgs(userID, "fast", pgxmock.AnyArg(), pgxmock.AnyArg()).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "another user's provider key",
+			body: `{"provider_key_id": 9}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(9, userID).
+					WillReturnError(pgx.ErrNoRows)
+			},
+			wantCode: http.StatusNotFound,
+			wantBody: "Provider key not found",
+		},
+		{
+			name: "negative max_temperature",
+			body: `{"max_temperature": -1}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+					WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+			},
+			wantCode: http.StatusBadRequest,
+			wantBody: "max_temperature must be non-negative",
+		},
+		{
+			name:     "placeholder on a plain alias",
+			body:     `{"target_model": "openai/{model}"}`,
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+			wantBody: "target_model may only use {model} on pattern aliases",
+		},
+		{
+			name:     "empty target model",
+			body:     `{"target_model": ""}`,
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+			wantBody: "Target model is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			mock.ExpectQuery("SELECT (.+) FROM model_aliases WHERE user_id = \\$1 AND alias = \\$2").WithArgs(userID, "fast").
+				WillReturnRows(dbtest.AliasRows(mock, current))
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest("PATCH", "/aliases/fast", strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("Expected %q in the body, got %q", tt.wantBody, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestPatchModelAlias_NotFound(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+	mock.ExpectQuery("SELECT (.+) FROM model_aliases WHERE user_id = \\$1 AND alias = \\$2").WithArgs(42, "missing").
+		WillReturnError(pgx.ErrNoRows)
+
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	req := httptest.NewRequest("PATCH", "/aliases/missing", strings.NewReader(`{"disabled": true}`))
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, 42))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteModelAlias(t *testing.T) {
+	userID := 42
+	tests := []struct {
+		name     string
+		deleted  int64
+		wantCode int
+	}{
+		{name: "deleted", deleted: 1, wantCode: http.StatusNoContent},
+		// Another user's alias is indistinguishable from a missing one
+		{name: "missing", deleted: 0, wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+
+			mock.ExpectBegin()
+			mock.ExpectExec("UPDATE model_aliases SET fallback_alias_id = NULL").WithArgs(userID, "fast").
+				WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			mock.ExpectExec("DELETE FROM model_aliases").WithArgs(userID, "fast").
+				WillReturnResult(pgxmock.NewResult("DELETE", tt.deleted))
+			if tt.deleted > 0 {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest("DELETE", "/aliases/fast", nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestExportImportAliases(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 42
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM model_aliases").WithArgs(userID).
+		WillReturnRows(dbtest.AliasRows(mock, db.ModelAlias{ID: 1, Alias: "fast", TargetModel: "gpt-4o-mini", ProviderKeyID: 4}))
+	w := do("GET", "/aliases/export", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected export status 200, got %d", w.Code)
+	}
+	var exported []management.ModelAliasRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &exported); err != nil || len(exported) != 1 || exported[0].Alias != "fast" {
+		t.Fatalf("Expected the exported alias, got %s (%v)", w.Body.String(), err)
+	}
+
+	// The valid row is written in a transaction; the others are reported
+	mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(4, userID).
+		WillReturnRows(mock.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", "enc"))
+	mock.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").WithArgs(9, userID).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO model_aliases").
+		WithArgs(userID, "fast", "gpt-4o-mini", 4, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+
+	w = do("POST", "/aliases/import", `[
+		{"alias": "fast", "target_model": "gpt-4o-mini", "provider_key_id": 4},
+		{"alias": "other", "target_model": "gpt-4o", "provider_key_id": 9},
+		{"alias": "fast", "target_model": "gpt-4o", "provider_key_id": 4}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected import status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var results []management.AliasImportResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || !results[0].Imported || results[1].Imported || results[1].Error == "" || results[2].Imported {
+		t.Errorf("Expected only the first row imported, got %+v", results)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
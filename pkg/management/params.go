@@ -0,0 +1,65 @@
+package management
+
+import (
+	"encoding/json"
+	"net/http"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/provider"
+)
+
+// ParamPolicyRequest chooses how request parameters a provider has no
+// equivalent for are handled. A null policy returns to the server default.
+type ParamPolicyRequest struct {
+	Policy *string `json:"policy"`
+}
+
+// GetParamPolicy returns the user's unsupported parameter policy and the
+// policy in effect for them
+func GetParamPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	policy, err := db.Repo.GetUserParamPolicy(r.Context(), userID)
+	if err != nil {
+		logging.Printf(r.Context(), "get param policy error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	writeParamPolicy(w, r, policy)
+}
+
+// SetParamPolicy sets or clears the user's unsupported parameter policy
+func SetParamPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	var req ParamPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httperr.BadBody(w, err, "Invalid request body")
+		return
+	}
+	if req.Policy != nil && !provider.ValidParamPolicy(*req.Policy) {
+		http.Error(w, "policy must be drop, reject or null", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Repo.SetUserParamPolicy(r.Context(), userID, req.Policy); err != nil {
+		logging.Printf(r.Context(), "set param policy error for user %d: %v", userID, err)
+		http.Error(w, "Failed to update policy", http.StatusInternalServerError)
+		return
+	}
+	provider.InvalidateParamPolicy(userID)
+	writeParamPolicy(w, r, req.Policy)
+}
+
+func writeParamPolicy(w http.ResponseWriter, r *http.Request, policy *string) {
+	effective := provider.DefaultParamPolicy()
+	if policy != nil {
+		effective = *policy
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"policy": policy, "effective": effective}); err != nil {
+		logging.Printf(r.Context(), "param policy: encode response error: %v", err)
+	}
+}
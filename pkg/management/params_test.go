@@ -0,0 +1,150 @@
+package management_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/management"
+	"tokentracer-proxy/pkg/provider"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestParamPolicy(t *testing.T) {
+	userID := 42
+	reject := provider.ParamPolicyReject
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:   "get default",
+			method: "GET",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID).
+					WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow((*string)(nil)))
+			},
+			wantCode: http.StatusOK,
+			wantBody: `{"effective":"` + provider.DefaultParamPolicy() + `","policy":null}`,
+		},
+		{
+			name:   "get set",
+			method: "GET",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID).
+					WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow(&reject))
+			},
+			wantCode: http.StatusOK,
+			wantBody: `{"effective":"reject","policy":"reject"}`,
+		},
+		{
+			name:   "set",
+			method: "PUT",
+			body:   `{"policy":"reject"}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectExec("UPDATE users SET unsupported_param_policy").WithArgs(userID, &reject).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+			wantCode: http.StatusOK,
+			wantBody: `{"effective":"reject","policy":"reject"}`,
+		},
+		{
+			name:   "clear",
+			method: "PUT",
+			body:   `{"policy":null}`,
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectExec("UPDATE users SET unsupported_param_policy").WithArgs(userID, (*string)(nil)).
+					WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+			},
+			wantCode: http.StatusOK,
+			wantBody: `"policy":null`,
+		},
+		{
+			name:     "unknown policy",
+			method:   "PUT",
+			body:     `{"policy":"warn"}`,
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+			wantBody: "policy must be drop, reject or null",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest(tt.method, "/param-policy", strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("Expected %s in the body, got %s", tt.wantBody, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+// TestSetParamPolicy_Invalidates checks a new policy applies to the next
+// request rather than after the cached one expires.
+func TestSetParamPolicy_Invalidates(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+
+	userID := 43
+	defer provider.InvalidateParamPolicy(userID)
+	drop, reject := provider.ParamPolicyDrop, provider.ParamPolicyReject
+	mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow(&drop))
+	if got := provider.UserParamPolicy(context.Background(), db.Repo, userID); got != drop {
+		t.Fatalf("Expected drop, got %q", got)
+	}
+
+	mock.ExpectExec("UPDATE users SET unsupported_param_policy").WithArgs(userID, &reject).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	req := httptest.NewRequest("PUT", "/param-policy", strings.NewReader(`{"policy":"reject"}`))
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow(&reject))
+	if got := provider.UserParamPolicy(context.Background(), db.Repo, userID); got != reject {
+		t.Errorf("Expected reject straight after the change, got %q", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -3,17 +3,29 @@ package management
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"tokentracer-proxy/pkg/auth"
 	"tokentracer-proxy/pkg/crypto"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/httperr"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/provider"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type ProviderKeyRequest struct {
 	Provider     string `json:"provider"`
 	EncryptedKey string `json:"api_key"`
 	Label        string `json:"label"`
+	// BaseURL is required for provider types with requires_base_url, e.g.
+	// the resource endpoint for Azure OpenAI
+	BaseURL *string `json:"base_url"`
 }
 
 // CreateProviderKey stores a downstream provider's key (e.g. OpenAI)
@@ -22,45 +34,90 @@ func CreateProviderKey(w http.ResponseWriter, r *http.Request) {
 
 	var req ProviderKeyRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		httperr.BadBody(w, err, "Invalid request")
+		return
+	}
+	if info, ok := provider.LookupType(req.Provider); ok && info.RequiresBaseURL && (req.BaseURL == nil || *req.BaseURL == "") {
+		http.Error(w, "base_url is required for provider "+req.Provider, http.StatusBadRequest)
+		return
+	}
+	if req.BaseURL != nil && *req.BaseURL != "" && !validBaseURL(*req.BaseURL) {
+		http.Error(w, "base_url must be an absolute http or https URL", http.StatusBadRequest)
 		return
 	}
 
 	encrypted, err := crypto.Encrypt(req.EncryptedKey)
 	if err != nil {
-		log.Printf("encrypt provider key error: %v", err)
+		logging.Printf(r.Context(), "encrypt provider key error: %v", err)
 		http.Error(w, "Failed to create provider key", http.StatusInternalServerError)
 		return
 	}
 
-	err = db.Repo.CreateProviderKey(context.Background(), userID, req.Provider, encrypted, req.Label)
+	err = db.Repo.CreateProviderKey(context.Background(), userID, req.Provider, encrypted, req.Label, req.BaseURL)
 	if err != nil {
-		log.Printf("create provider key error: %v", err)
+		logging.Printf(r.Context(), "create provider key error: %v", err)
 		http.Error(w, "Failed to create provider key", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// validBaseURL reports whether s is an absolute http or https URL with a
+// host, which is all the providers can send requests to.
+func validBaseURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// DeleteProviderKey removes one of the user's provider keys. Keys still used
+// by aliases are kept, and the aliases are listed in the 409 response.
+func DeleteProviderKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		http.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+
+	err = db.Repo.DeleteProviderKey(r.Context(), keyID, userID)
+	var inUse *db.ProviderKeyInUseError
+	if errors.As(err, &inUse) {
+		http.Error(w, fmt.Sprintf("Provider key is still used by aliases: %s. Point them at another key or delete them first.", strings.Join(inUse.Aliases, ", ")), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		httperr.Lookup(w, r, err, "Provider key")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // ListProviderKeys returns all keys for the user
 func ListProviderKeys(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(auth.KeyUser).(int)
 
-	results, err := db.Repo.ListProviderKeys(context.Background(), userID)
+	results, err := db.Repo.ListProviderKeys(context.Background(), userID, r.URL.Query().Get("sort"))
+	if errors.Is(err, db.ErrInvalidSort) {
+		http.Error(w, "sort must be one of created_at, label, provider", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Printf("list provider keys error for user %d: %v", userID, err)
+		logging.Printf(r.Context(), "list provider keys error for user %d: %v", userID, err)
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
 	}
 
-	var keys []map[string]interface{}
+	keys := make([]map[string]interface{}, 0, len(results))
 	for _, k := range results {
 		keys = append(keys, map[string]interface{}{
-			"id": k.ID, "provider": k.Provider, "label": k.Label, "created_at": k.CreatedAt,
+			"id": k.ID, "provider": k.Provider, "label": k.Label, "base_url": k.BaseURL, "created_at": k.CreatedAt,
 		})
 	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(keys); err != nil {
-		log.Printf("list provider keys: encode response error: %v", err)
-	}
+	writeList(w, r, keys, "list provider keys")
+}
+
+// ListProviderTypes returns the supported provider types and their requirements
+func ListProviderTypes(w http.ResponseWriter, r *http.Request) {
+	writeList(w, r, provider.Types(), "list provider types")
 }
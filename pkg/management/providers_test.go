@@ -0,0 +1,185 @@
+package management_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/management"
+	"tokentracer-proxy/pkg/provider"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestCreateProviderKey_BaseURL(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{name: "https", body: `{"provider":"azure","api_key":"k","base_url":"https://res.openai.azure.com"}`, wantCode: http.StatusCreated},
+		{name: "http with port", body: `{"provider":"ollama","api_key":"k","base_url":"http://localhost:11434"}`, wantCode: http.StatusCreated},
+		{name: "omitted", body: `{"provider":"openai","api_key":"k"}`, wantCode: http.StatusCreated},
+		{name: "required but omitted", body: `{"provider":"azure","api_key":"k"}`, wantCode: http.StatusBadRequest},
+		{name: "relative", body: `{"provider":"ollama","api_key":"k","base_url":"/v1"}`, wantCode: http.StatusBadRequest},
+		{name: "no scheme", body: `{"provider":"ollama","api_key":"k","base_url":"localhost:11434"}`, wantCode: http.StatusBadRequest},
+		{name: "other scheme", body: `{"provider":"ollama","api_key":"k","base_url":"ftp://example.com"}`, wantCode: http.StatusBadRequest},
+		{name: "no host", body: `{"provider":"ollama","api_key":"k","base_url":"https://"}`, wantCode: http.StatusBadRequest},
+		{name: "unparseable", body: `{"provider":"ollama","api_key":"k","base_url":"http://[::1"}`, wantCode: http.StatusBadRequest},
+	}
+
+	userID := 42
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+
+			if tt.wantCode == http.StatusCreated {
+				mock.ExpectExec("INSERT INTO provider_keys").WithArgs(userID, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			}
+
+			req := httptest.NewRequest("POST", "/providers", strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			management.CreateProviderKey(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestListProviderTypes(t *testing.T) {
+	r := chi.NewRouter()
+	management.RegisterRoutes(r)
+	req := httptest.NewRequest("GET", "/provider-types", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, 42))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var types []struct {
+		Name            string `json:"name"`
+		DisplayName     string `json:"display_name"`
+		RequiresBaseURL bool   `json:"requires_base_url"`
+		AuthStyle       string `json:"auth_style"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &types); err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != len(provider.Types()) {
+		t.Fatalf("Expected every provider type, got %d", len(types))
+	}
+	for _, ty := range types {
+		if ty.Name == "azure" && (!ty.RequiresBaseURL || ty.DisplayName != "Azure OpenAI" || ty.AuthStyle == "") {
+			t.Errorf("Unexpected azure metadata %+v", ty)
+		}
+	}
+}
+
+func TestDeleteProviderKey(t *testing.T) {
+	userID := 42
+	tests := []struct {
+		name     string
+		path     string
+		expect   func(mock pgxmock.PgxPoolIface)
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "deleted",
+			path: "/providers/7",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM provider_keys").WithArgs(7, userID).
+					WillReturnRows(mock.NewRows([]string{"id"}).AddRow(7))
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(7).
+					WillReturnRows(mock.NewRows([]string{"alias"}))
+				mock.ExpectExec("DELETE FROM provider_keys").WithArgs(7, userID).
+					WillReturnResult(pgxmock.NewResult("DELETE", 1))
+				mock.ExpectCommit()
+			},
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name: "in use",
+			path: "/providers/7",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM provider_keys").WithArgs(7, userID).
+					WillReturnRows(mock.NewRows([]string{"id"}).AddRow(7))
+				mock.ExpectQuery("SELECT alias FROM model_aliases").WithArgs(7).
+					WillReturnRows(mock.NewRows([]string{"alias"}).AddRow("fast").AddRow("smart"))
+				mock.ExpectRollback()
+			},
+			wantCode: http.StatusConflict,
+			wantBody: "fast, smart",
+		},
+		{
+			name: "other user's key",
+			path: "/providers/7",
+			expect: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM provider_keys").WithArgs(7, userID).WillReturnError(pgx.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "invalid ID",
+			path:     "/providers/abc",
+			expect:   func(mock pgxmock.PgxPoolIface) {},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+			tt.expect(mock)
+
+			r := chi.NewRouter()
+			management.RegisterRoutes(r)
+			req := httptest.NewRequest("DELETE", tt.path, nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d. Body: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("Expected %q in the body, got %q", tt.wantBody, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
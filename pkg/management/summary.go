@@ -0,0 +1,147 @@
+package management
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// summaryTopAliases is how many aliases the usage summary ranks.
+const summaryTopAliases = 5
+
+type periodTotals struct {
+	Start        time.Time `json:"start"`
+	Requests     int       `json:"requests"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	TotalTokens  int       `json:"total_tokens"`
+}
+
+type aliasUsage struct {
+	Alias        string `json:"alias"`
+	Provider     string `json:"provider"`
+	Requests     int    `json:"requests"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	TotalTokens  int    `json:"total_tokens"`
+	// Cost is the estimated spend in US dollars.
+	Cost float64 `json:"cost"`
+}
+
+type providerErrors struct {
+	Provider  string  `json:"provider"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+type usageSummary struct {
+	CurrentPeriod          periodTotals    `json:"current_period"`
+	PreviousPeriod         periodTotals    `json:"previous_period"`
+	TopAliases             []aliasUsage    `json:"top_aliases"`
+	MostErrorProneProvider *providerErrors `json:"most_error_prone_provider"`
+}
+
+// GetUsageSummary returns month-to-date totals, the previous month for
+// comparison, the top aliases by spend, and the provider with the highest error rate
+func GetUsageSummary(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+	ctx := r.Context()
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	prevStart := monthStart.AddDate(0, -1, 0)
+
+	current, err := db.Repo.GetUsageTotals(ctx, userID, monthStart, now)
+	if err != nil {
+		logging.Printf(ctx, "usage summary: current totals error for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve usage summary", http.StatusInternalServerError)
+		return
+	}
+	previous, err := db.Repo.GetUsageTotals(ctx, userID, prevStart, monthStart)
+	if err != nil {
+		logging.Printf(ctx, "usage summary: previous totals error for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve usage summary", http.StatusInternalServerError)
+		return
+	}
+	top, err := db.Repo.GetTopAliases(ctx, userID, monthStart, now, summaryTopAliases)
+	if err != nil {
+		logging.Printf(ctx, "usage summary: top aliases error for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve usage summary", http.StatusInternalServerError)
+		return
+	}
+	rates, err := db.Repo.GetProviderErrorRates(ctx, userID, monthStart, now)
+	if err != nil {
+		logging.Printf(ctx, "usage summary: provider error rates error for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve usage summary", http.StatusInternalServerError)
+		return
+	}
+
+	summary := usageSummary{
+		CurrentPeriod:  toPeriodTotals(monthStart, current),
+		PreviousPeriod: toPeriodTotals(prevStart, previous),
+		TopAliases:     make([]aliasUsage, 0, len(top)),
+	}
+	for _, s := range top {
+		summary.TopAliases = append(summary.TopAliases, aliasUsage{
+			Alias: s.Alias, Provider: s.Provider, Requests: s.Reqs,
+			InputTokens: s.Input, OutputTokens: s.Output, TotalTokens: s.Input + s.Output,
+			Cost: s.Cost,
+		})
+	}
+	for _, e := range rates {
+		if e.Reqs == 0 || e.Errors == 0 {
+			continue
+		}
+		rate := float64(e.Errors) / float64(e.Reqs)
+		if summary.MostErrorProneProvider == nil || rate > summary.MostErrorProneProvider.ErrorRate {
+			summary.MostErrorProneProvider = &providerErrors{Provider: e.Provider, Requests: e.Reqs, Errors: e.Errors, ErrorRate: rate}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		logging.Printf(ctx, "usage summary: encode response error: %v", err)
+	}
+}
+
+// GetUsageTimeSeries returns the user's usage per hour, day (the default) or
+// week, for charting. Periods without requests are included as zeros.
+func GetUsageTimeSeries(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+	results, err := db.Repo.GetUsageTimeSeries(r.Context(), userID, granularity)
+	if errors.Is(err, db.ErrInvalidGranularity) {
+		http.Error(w, "granularity must be one of hour, day, week", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logging.Printf(r.Context(), "usage time series error for user %d: %v", userID, err)
+		http.Error(w, "Failed to retrieve usage time series", http.StatusInternalServerError)
+		return
+	}
+
+	buckets := make([]periodTotals, 0, len(results))
+	for _, b := range results {
+		buckets = append(buckets, toPeriodTotals(b.Start, b.UsageTotals))
+	}
+	writeList(w, r, buckets, "usage time series")
+}
+
+func toPeriodTotals(start time.Time, t db.UsageTotals) periodTotals {
+	return periodTotals{
+		Start:        start,
+		Requests:     t.Reqs,
+		InputTokens:  t.Input,
+		OutputTokens: t.Output,
+		TotalTokens:  t.Input + t.Output,
+	}
+}
@@ -0,0 +1,178 @@
+package management
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/provider"
+)
+
+// Problem severities. Errors break routing for the alias; warnings mean it
+// may not route the way its owner expects.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// AliasProblem is one broken invariant in a user's alias configuration.
+type AliasProblem struct {
+	Severity string   `json:"severity"`
+	Code     string   `json:"code"`
+	Aliases  []string `json:"aliases"`
+	Message  string   `json:"message"`
+}
+
+// ValidateAliases checks the user's aliases against each other and their
+// provider keys, returning every problem found. An empty list means the
+// configuration is consistent.
+func ValidateAliases(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(auth.KeyUser).(int)
+
+	aliases, err := db.Repo.ListModelAliases(r.Context(), userID, "")
+	if err != nil {
+		logging.Printf(r.Context(), "validate aliases: list aliases error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	keys, err := db.Repo.ListProviderKeys(r.Context(), userID, "")
+	if err != nil {
+		logging.Printf(r.Context(), "validate aliases: list provider keys error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Known models per provider type, loaded on first use. A type with no
+	// cached models hasn't been polled, so its models can't be checked.
+	models := map[string]map[string]bool{}
+	knownModels := func(providerType string) (map[string]bool, error) {
+		if m, ok := models[providerType]; ok {
+			return m, nil
+		}
+		ids, err := db.Repo.ListProviderModelsByType(r.Context(), providerType, db.ModelFilter{})
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			m[id] = true
+		}
+		models[providerType] = m
+		return m, nil
+	}
+
+	problems, err := aliasProblems(aliases, keys, knownModels)
+	if err != nil {
+		logging.Printf(r.Context(), "validate aliases: list provider models error for user %d: %v", userID, err)
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	writeList(w, r, problems, "validate aliases")
+}
+
+// aliasProblems checks each alias's fallback, provider key and models.
+// knownModels returns the cached model IDs for a provider type.
+func aliasProblems(aliases []db.ModelAlias, keys []db.ProviderKey, knownModels func(string) (map[string]bool, error)) ([]AliasProblem, error) {
+	byID := make(map[int]db.ModelAlias, len(aliases))
+	for _, a := range aliases {
+		byID[a.ID] = a
+	}
+	keysByID := make(map[int]db.ProviderKey, len(keys))
+	for _, k := range keys {
+		keysByID[k.ID] = k
+	}
+
+	var problems []AliasProblem
+	add := func(severity, code, message string, aliases ...string) {
+		problems = append(problems, AliasProblem{Severity: severity, Code: code, Aliases: aliases, Message: message})
+	}
+
+	// Each cycle is reported once, from the alias with the lowest ID on it
+	reported := map[int]bool{}
+	for _, a := range aliases {
+		if cycle := fallbackCycle(a, byID); cycle != nil && !reported[cycle[0].ID] {
+			names := make([]string, len(cycle))
+			for i, c := range cycle {
+				reported[c.ID] = true
+				names[i] = c.Alias
+			}
+			add(severityError, "fallback_cycle", fmt.Sprintf("Fallbacks loop: %s -> %s", strings.Join(names, " -> "), names[0]), names...)
+		}
+	}
+
+	for _, a := range aliases {
+		if a.FallbackAliasID != nil {
+			fb, ok := byID[*a.FallbackAliasID]
+			switch {
+			case !ok:
+				add(severityError, "fallback_missing", fmt.Sprintf("Fallback alias %d does not exist", *a.FallbackAliasID), a.Alias)
+			case fb.Disabled:
+				add(severityWarning, "fallback_disabled", fmt.Sprintf("Falls back to '%s', which is disabled", fb.Alias), a.Alias, fb.Alias)
+			case fb.FlaggedReason != nil:
+				add(severityWarning, "fallback_flagged", fmt.Sprintf("Falls back to '%s', which is flagged: %s", fb.Alias, *fb.FlaggedReason), a.Alias, fb.Alias)
+			}
+		}
+
+		if a.UseLightModel && (a.LightModel == nil || *a.LightModel == "") {
+			add(severityError, "light_model_missing", "use_light_model is set but light_model is empty", a.Alias)
+		}
+
+		key, ok := keysByID[a.ProviderKeyID]
+		if !ok {
+			add(severityError, "provider_key_missing", fmt.Sprintf("Provider key %d does not exist", a.ProviderKeyID), a.Alias)
+			continue
+		}
+		if _, ok := provider.LookupType(key.Provider); !ok {
+			add(severityError, "provider_unsupported", fmt.Sprintf("Provider key %d is for unsupported provider '%s'", key.ID, key.Provider), a.Alias)
+			continue
+		}
+
+		known, err := knownModels(key.Provider)
+		if err != nil {
+			return nil, err
+		}
+		if len(known) == 0 {
+			continue
+		}
+		if !a.IsPattern && !known[a.TargetModel] {
+			add(severityWarning, "target_model_unknown", fmt.Sprintf("Target model '%s' is not listed by %s", a.TargetModel, key.Provider), a.Alias)
+		}
+		if a.UseLightModel && a.LightModel != nil && *a.LightModel != "" && !known[*a.LightModel] {
+			add(severityWarning, "light_model_unknown", fmt.Sprintf("Light model '%s' is not listed by %s", *a.LightModel, key.Provider), a.Alias)
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Severity == severityError && problems[j].Severity != severityError
+	})
+	return problems, nil
+}
+
+// fallbackCycle returns the aliases on the fallback cycle a's chain runs
+// into, starting from the one with the lowest ID, or nil if there is none.
+func fallbackCycle(a db.ModelAlias, byID map[int]db.ModelAlias) []db.ModelAlias {
+	var chain []db.ModelAlias
+	pos := map[int]int{}
+	for cur, ok := a, true; ok; {
+		if start, seen := pos[cur.ID]; seen {
+			cycle := chain[start:]
+			first := 0
+			for i, c := range cycle {
+				if c.ID < cycle[first].ID {
+					first = i
+				}
+			}
+			return append(append([]db.ModelAlias{}, cycle[first:]...), cycle[:first]...)
+		}
+		pos[cur.ID] = len(chain)
+		chain = append(chain, cur)
+		if cur.FallbackAliasID == nil {
+			return nil
+		}
+		cur, ok = byID[*cur.FallbackAliasID]
+	}
+	return nil
+}
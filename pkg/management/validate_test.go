@@ -0,0 +1,58 @@
+package management
+
+import (
+	"reflect"
+	"testing"
+	"tokentracer-proxy/pkg/db"
+)
+
+func TestAliasProblems(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	strPtr := func(s string) *string { return &s }
+
+	aliases := []db.ModelAlias{
+		{ID: 1, Alias: "a", TargetModel: "gpt-4o", ProviderKeyID: 7, FallbackAliasID: intPtr(2)},
+		{ID: 2, Alias: "b", TargetModel: "gpt-4o", ProviderKeyID: 7, FallbackAliasID: intPtr(3)},
+		{ID: 3, Alias: "c", TargetModel: "gpt-4o", ProviderKeyID: 7, FallbackAliasID: intPtr(2)},
+		{ID: 4, Alias: "gone", TargetModel: "gpt-4o", ProviderKeyID: 99, FallbackAliasID: intPtr(42)},
+		{ID: 5, Alias: "off", TargetModel: "gpt-4o", ProviderKeyID: 7, Disabled: true},
+		{ID: 6, Alias: "light", TargetModel: "gpt-5", ProviderKeyID: 7, FallbackAliasID: intPtr(5), UseLightModel: true, LightModel: strPtr("gpt-4o-nano")},
+		{ID: 7, Alias: "nolight", TargetModel: "gpt-4o", ProviderKeyID: 8, UseLightModel: true},
+	}
+	keys := []db.ProviderKey{{ID: 7, Provider: "openai"}, {ID: 8, Provider: "bogus"}}
+	lookups := 0
+	knownModels := func(providerType string) (map[string]bool, error) {
+		lookups++
+		return map[string]bool{"gpt-4o": true}, nil
+	}
+
+	problems, err := aliasProblems(aliases, keys, knownModels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type problem struct {
+		severity, code string
+		aliases        []string
+	}
+	var got []problem
+	for _, p := range problems {
+		got = append(got, problem{p.Severity, p.Code, p.Aliases})
+	}
+	want := []problem{
+		{"error", "fallback_cycle", []string{"b", "c"}},
+		{"error", "fallback_missing", []string{"gone"}},
+		{"error", "provider_key_missing", []string{"gone"}},
+		{"error", "light_model_missing", []string{"nolight"}},
+		{"error", "provider_unsupported", []string{"nolight"}},
+		{"warning", "fallback_disabled", []string{"light", "off"}},
+		{"warning", "target_model_unknown", []string{"light"}},
+		{"warning", "light_model_unknown", []string{"light"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected problems\n%+v\ngot\n%+v", want, got)
+	}
+	if lookups != 5 {
+		t.Errorf("Expected a model lookup per alias with a valid key, got %d", lookups)
+	}
+}
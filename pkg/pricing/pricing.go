@@ -0,0 +1,72 @@
+// Package pricing estimates the cost of requests from a per-model price table.
+package pricing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ModelPrice is what a model costs, in US dollars per 1K tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+var (
+	prices map[string]ModelPrice
+	mu     sync.RWMutex
+)
+
+// Init loads the price table from the JSON file named by MODEL_PRICES_FILE,
+// or else from the MODEL_PRICES variable itself. Both hold an object keyed by
+// model, e.g. {"gpt-4o": {"input": 0.0025, "output": 0.01}}.
+func Init() error {
+	if path := os.Getenv("MODEL_PRICES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read model prices: %w", err)
+		}
+		return Load(data)
+	}
+	if raw := os.Getenv("MODEL_PRICES"); raw != "" {
+		return Load([]byte(raw))
+	}
+	return nil
+}
+
+// Load parses a JSON price table and makes it the active one.
+func Load(data []byte) error {
+	var table map[string]ModelPrice
+	if err := json.Unmarshal(data, &table); err != nil {
+		return fmt.Errorf("parse model prices: %w", err)
+	}
+	for model, p := range table {
+		if p.Input < 0 || p.Output < 0 {
+			return fmt.Errorf("model prices: negative price for %s", model)
+		}
+	}
+	Set(table)
+	return nil
+}
+
+// Set replaces the active price table.
+func Set(table map[string]ModelPrice) {
+	mu.Lock()
+	prices = table
+	mu.Unlock()
+}
+
+// Cost returns the estimated cost in US dollars of a request to model, or nil
+// when the model has no price.
+func Cost(model string, inputTokens, outputTokens int) *float64 {
+	mu.RLock()
+	p, ok := prices[model]
+	mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	cost := float64(inputTokens)/1000*p.Input + float64(outputTokens)/1000*p.Output
+	return &cost
+}
@@ -0,0 +1,21 @@
+package pricing
+
+import "testing"
+
+func TestCost(t *testing.T) {
+	if err := Load([]byte(`{"gpt-4o": {"input": 0.0025, "output": 0.01}}`)); err != nil {
+		t.Fatal(err)
+	}
+	defer Set(nil)
+
+	cost := Cost("gpt-4o", 2000, 500)
+	if cost == nil || *cost != 0.01 {
+		t.Errorf("Expected 2K input + 0.5K output to cost 0.01, got %v", cost)
+	}
+	if cost := Cost("gpt-5", 2000, 500); cost != nil {
+		t.Errorf("Expected no cost for an unpriced model, got %v", *cost)
+	}
+	if err := Load([]byte(`{"gpt-4o": {"input": -1}}`)); err == nil {
+		t.Errorf("Expected negative prices to be rejected")
+	}
+}
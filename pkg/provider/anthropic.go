@@ -9,6 +9,7 @@ import (
 	"os"
 	"tokentracer-proxy/pkg/crypto"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
 	"tokentracer-proxy/pkg/translator"
 	"tokentracer-proxy/pkg/types"
 )
@@ -49,12 +50,12 @@ func (p *AnthropicProvider) Send(ctx context.Context, req types.OpenAIRequest) (
 	reqBody, _ := json.Marshal(anthropicReq)
 
 	// 3. Send Request
-	upstreamReq, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/v1/messages", bytes.NewBuffer(reqBody))
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/v1/messages", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upstream request: %w", err)
 	}
 
-	apiKey, err := crypto.Decrypt(encryptedKey)
+	apiKey, err := decryptKey(ctx, encryptedKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
 	}
@@ -63,7 +64,7 @@ func (p *AnthropicProvider) Send(ctx context.Context, req types.OpenAIRequest) (
 	upstreamReq.Header.Set("anthropic-version", "2023-06-01")
 	upstreamReq.Header.Set("content-type", "application/json")
 
-	client := &http.Client{}
+	client := anthropicClient
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
 		return nil, fmt.Errorf("upstream request failed: %w", err)
@@ -71,7 +72,7 @@ func (p *AnthropicProvider) Send(ctx context.Context, req types.OpenAIRequest) (
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("upstream error: status %d", resp.StatusCode)
+		return nil, newProviderError(resp)
 	}
 
 	// 4. Handle Response
@@ -80,13 +81,118 @@ func (p *AnthropicProvider) Send(ctx context.Context, req types.OpenAIRequest) (
 		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
 	}
 
-	openAIResp, err := translator.AnthropicToOpenAIResponse(anthropicResp)
+	openAIResp, err := translator.AnthropicToOpenAIResponse(ctx, anthropicResp)
 	if err != nil {
 		return nil, fmt.Errorf("response translation error: %w", err)
 	}
 
 	return &openAIResp, nil
 }
+
+// SendStream streams a chat completion, translating Anthropic's message
+// events into OpenAI chat.completion.chunk events.
+func (p *AnthropicProvider) SendStream(ctx context.Context, req types.OpenAIRequest, emit func([]byte) error) (types.OpenAIUsage, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	req.Stream = true
+	anthropicReq, err := translator.OpenAIToAnthropicRequest(req)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("translation error: %w", err)
+	}
+	reqBody, _ := json.Marshal(anthropicReq)
+
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/v1/messages", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("x-api-key", apiKey)
+	upstreamReq.Header.Set("anthropic-version", "2023-06-01")
+	upstreamReq.Header.Set("content-type", "application/json")
+	upstreamReq.Header.Set("accept", "text/event-stream")
+
+	resp, err := anthropicStreamClient.Do(upstreamReq)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return types.OpenAIUsage{}, newProviderError(resp)
+	}
+
+	var t translator.AnthropicStreamTranslator
+	err = readEvents(resp.Body, func(raw, data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		var ev types.AnthropicStreamEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return fmt.Errorf("decode stream event: %w", err)
+		}
+		if ev.Type == "error" && ev.Error != nil {
+			return fmt.Errorf("%s: %s", ev.Error.Type, ev.Error.Message)
+		}
+		chunk := t.Translate(ctx, ev)
+		if chunk == nil {
+			return nil
+		}
+		event, err := sseEvent(chunk)
+		if err != nil {
+			return err
+		}
+		return emit(event)
+	})
+	if err != nil {
+		return t.Usage, fmt.Errorf("upstream stream failed: %w", err)
+	}
+	return t.Usage, nil
+}
+
+// SendNative forwards an Anthropic Messages API body unchanged. The caller
+// owns the returned response, whatever its status, and must close its body.
+// Only the anthropic-version and anthropic-beta headers are taken from header.
+func (p *AnthropicProvider) SendNative(ctx context.Context, body []byte, header http.Header) (*http.Response, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return nil, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+
+	version := header.Get("anthropic-version")
+	if version == "" {
+		version = "2023-06-01"
+	}
+	upstreamReq.Header.Set("x-api-key", apiKey)
+	upstreamReq.Header.Set("anthropic-version", version)
+	if beta := header.Get("anthropic-beta"); beta != "" {
+		upstreamReq.Header.Set("anthropic-beta", beta)
+	}
+	upstreamReq.Header.Set("content-type", "application/json")
+
+	resp, err := anthropicStreamClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	return resp, nil
+}
+
 func (p *AnthropicProvider) ListModels(ctx context.Context) ([]string, error) {
 	// Anthropic recently added a models API: https://docs.anthropic.com/en/api/models-list
 	// 1. Fetch Key
@@ -109,7 +215,7 @@ func (p *AnthropicProvider) ListModels(ctx context.Context) ([]string, error) {
 	upstreamReq.Header.Set("x-api-key", apiKey)
 	upstreamReq.Header.Set("anthropic-version", "2023-06-01")
 
-	client := &http.Client{}
+	client := anthropicClient
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
 		return nil, fmt.Errorf("upstream request failed: %w", err)
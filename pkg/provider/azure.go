@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/translator"
+	"tokentracer-proxy/pkg/types"
+)
+
+// azureAPIVersion is the api-version sent with Azure OpenAI chat completions.
+var azureAPIVersion = config.String("AZURE_OPENAI_API_VERSION", "2024-10-21")
+
+// azureDeploymentsAPIVersion is the last api-version with the deployments
+// listing endpoint; newer versions dropped it from the data plane.
+const azureDeploymentsAPIVersion = "2022-12-01"
+
+// AzureOpenAIProvider sends requests to an Azure OpenAI resource. The
+// resource endpoint is the provider key's base URL and the model is the
+// deployment name, so an alias's target model names the deployment.
+type AzureOpenAIProvider struct {
+	repo          db.Repository
+	providerKeyID int
+	userID        int
+}
+
+func NewAzureOpenAIProvider(repository db.Repository, providerKeyID, userID int) *AzureOpenAIProvider {
+	return &AzureOpenAIProvider{
+		repo:          repository,
+		providerKeyID: providerKeyID,
+		userID:        userID,
+	}
+}
+
+// credentials returns the resource endpoint and the encrypted API key.
+func (p *AzureOpenAIProvider) credentials(ctx context.Context) (string, string, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return "", "", fmt.Errorf("provider configuration not found: %w", err)
+	}
+	endpoint, err := p.repo.GetProviderKeyBaseURL(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return "", "", fmt.Errorf("provider configuration not found: %w", err)
+	}
+	if endpoint == "" {
+		return "", "", fmt.Errorf("azure provider key %d has no endpoint", p.providerKeyID)
+	}
+	return strings.TrimRight(endpoint, "/"), encryptedKey, nil
+}
+
+func azureChatURL(endpoint, deployment string) string {
+	return endpoint + "/openai/deployments/" + url.PathEscape(deployment) + "/chat/completions?api-version=" + url.QueryEscape(azureAPIVersion)
+}
+
+func (p *AzureOpenAIProvider) Send(ctx context.Context, req types.OpenAIRequest) (*types.OpenAIResponse, error) {
+	endpoint, encryptedKey, err := p.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", azureChatURL(endpoint, req.Model), bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("api-key", apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := azureClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newProviderError(resp)
+	}
+
+	var openAIResp types.OpenAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+	translator.CitationsFromAnnotations(&openAIResp)
+
+	return &openAIResp, nil
+}
+
+// SendStream streams a chat completion, relaying the upstream's chunks as-is.
+func (p *AzureOpenAIProvider) SendStream(ctx context.Context, req types.OpenAIRequest, emit func([]byte) error) (types.OpenAIUsage, error) {
+	endpoint, encryptedKey, err := p.credentials(ctx)
+	if err != nil {
+		return types.OpenAIUsage{}, err
+	}
+
+	req, hideUsage := withStreamUsage(req)
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", azureChatURL(endpoint, req.Model), bytes.NewBuffer(reqBody))
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("api-key", apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := azureStreamClient.Do(upstreamReq)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return streamOpenAICompatible(resp, hideUsage, emit)
+}
+
+// ListModels returns the resource's deployment names, which are what aliases
+// target.
+func (p *AzureOpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
+	endpoint, encryptedKey, err := p.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/openai/deployments?api-version="+azureDeploymentsAPIVersion, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := crypto.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("api-key", apiKey)
+
+	resp, err := azureClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream error: status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+
+	var models []string
+	for _, m := range data.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
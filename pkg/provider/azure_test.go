@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestAzureOpenAIProvider_Send(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	encrypted, err := crypto.Encrypt("azure-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPath, gotVersion, gotKey, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotVersion = r.URL.Query().Get("api-version")
+		gotKey = r.Header.Get("api-key")
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.OpenAIResponse{ID: "chatcmpl-azure"})
+	}))
+	defer upstream.Close()
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+		WithArgs(3, 7).
+		WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("azure", encrypted))
+	mockDB.ExpectQuery("SELECT COALESCE\\(base_url, ''\\) FROM provider_keys").
+		WithArgs(3, 7).
+		WillReturnRows(mockDB.NewRows([]string{"base_url"}).AddRow(upstream.URL + "/"))
+
+	p := NewAzureOpenAIProvider(db.NewPostgresRepository(mockDB), 3, 7)
+	resp, err := p.Send(context.Background(), types.OpenAIRequest{
+		Model:    "my-gpt4o",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp.ID != "chatcmpl-azure" {
+		t.Errorf("Expected the upstream response, got %+v", resp)
+	}
+	if gotPath != "/openai/deployments/my-gpt4o/chat/completions" {
+		t.Errorf("Expected the deployment URL, got %q", gotPath)
+	}
+	if gotVersion != azureAPIVersion {
+		t.Errorf("Expected api-version %q, got %q", azureAPIVersion, gotVersion)
+	}
+	if gotKey != "azure-secret" || gotAuth != "" {
+		t.Errorf("Expected the key in api-key and no Authorization, got api-key=%q Authorization=%q", gotKey, gotAuth)
+	}
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
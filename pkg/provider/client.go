@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/version"
+)
+
+// defaultProviderTimeout bounds an upstream call when neither
+// <PROVIDER>_TIMEOUT nor PROVIDER_TIMEOUT is set, and the provider type has
+// no default of its own.
+const defaultProviderTimeout = 30 * time.Second
+
+// Shared upstream clients, one per provider type so each can carry its own
+// User-Agent and timeout. The stream clients are for responses read
+// incrementally, which may legitimately outlast the timeout.
+var (
+	openAIClient    = NewHTTPClient("openai")
+	anthropicClient = NewHTTPClient("anthropic")
+	geminiClient    = NewHTTPClient("gemini")
+	azureClient     = NewHTTPClient("azure")
+	ollamaClient    = NewHTTPClient("ollama")
+	mistralClient   = NewHTTPClient("mistral")
+
+	openAIStreamClient    = newStreamClient("openai")
+	anthropicStreamClient = newStreamClient("anthropic")
+	geminiStreamClient    = newStreamClient("gemini")
+	azureStreamClient     = newStreamClient("azure")
+	ollamaStreamClient    = newStreamClient("ollama")
+	mistralStreamClient   = newStreamClient("mistral")
+)
+
+// NewHTTPClient returns a client for calls to providerType. Whole requests,
+// including reading the body, are limited to the provider's timeout:
+// <PROVIDER>_TIMEOUT, then the type's own default, then PROVIDER_TIMEOUT,
+// then 30s. Requests carry the configured User-Agent: <PROVIDER>_USER_AGENT,
+// then UPSTREAM_USER_AGENT, then tokentracer-proxy/<version>. Transient
+// failures are retried (see retryTransport) within the timeout, up to
+// <PROVIDER>_MAX_RETRIES, then PROVIDER_MAX_RETRIES, times. Response bodies
+// are capped at MAX_RESPONSE_BYTES. Cancelling a request's context, e.g. when
+// the client disconnects, aborts the upstream call.
+func NewHTTPClient(providerType string) *http.Client {
+	return &http.Client{
+		Transport: limitTransport{newHeaderTransport(providerType, newRetryTransport(providerType, http.DefaultTransport))},
+		Timeout:   providerTimeout(providerType),
+	}
+}
+
+// newStreamClient returns a client without an overall timeout; only the wait
+// for the upstream's response headers is bounded by the provider's timeout.
+func newStreamClient(providerType string) *http.Client {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ResponseHeaderTimeout = providerTimeout(providerType)
+	return &http.Client{Transport: newHeaderTransport(providerType, newRetryTransport(providerType, base))}
+}
+
+func providerTimeout(providerType string) time.Duration {
+	timeout := config.Duration("PROVIDER_TIMEOUT", defaultProviderTimeout)
+	if info, ok := LookupType(providerType); ok && info.defaultTimeout > 0 {
+		timeout = info.defaultTimeout
+	}
+	return config.Duration(strings.ToUpper(providerType)+"_TIMEOUT", timeout)
+}
+
+func providerMaxRetries(providerType string) int {
+	return config.Int(strings.ToUpper(providerType)+"_MAX_RETRIES", maxRetries)
+}
+
+func newHeaderTransport(providerType string, base http.RoundTripper) *headerTransport {
+	ua := config.String("UPSTREAM_USER_AGENT", "tokentracer-proxy/"+version.Version)
+	ua = config.String(strings.ToUpper(providerType)+"_USER_AGENT", ua)
+	return &headerTransport{
+		base:            base,
+		userAgent:       ua,
+		openRouterRef:   config.String("OPENROUTER_REFERER", ""),
+		openRouterTitle: config.String("OPENROUTER_TITLE", "tokentracer-proxy"),
+	}
+}
+
+// headerTransport sets identification headers on every upstream request.
+type headerTransport struct {
+	base            http.RoundTripper
+	userAgent       string
+	openRouterRef   string
+	openRouterTitle string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+
+	// OpenRouter attributes traffic to apps by these headers
+	if strings.HasSuffix(req.URL.Hostname(), "openrouter.ai") {
+		if t.openRouterRef != "" {
+			req.Header.Set("HTTP-Referer", t.openRouterRef)
+		}
+		if t.openRouterTitle != "" {
+			req.Header.Set("X-Title", t.openRouterTitle)
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		recordRateLimit(req.Context(), resp.Header)
+	}
+	return resp, err
+}
+
+// maxResponseBytes caps non-streaming upstream response bodies, so a hostile
+// or broken upstream can't exhaust memory while its response is decoded.
+var maxResponseBytes = int64(config.Int("MAX_RESPONSE_BYTES", 8<<20))
+
+// errResponseTooLarge is returned when reading past maxResponseBytes.
+var errResponseTooLarge = fmt.Errorf("upstream response exceeds %d bytes", maxResponseBytes)
+
+// limitTransport caps the bodies of the responses it returns.
+type limitTransport struct {
+	base http.RoundTripper
+}
+
+func (t limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: maxResponseBytes}
+	return resp, nil
+}
+
+// limitedBody fails with errResponseTooLarge once more than remaining bytes
+// have been read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the limit to tell a body that ends exactly at it
+	// from one that goes on
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = -1
+	return n, errResponseTooLarge
+}
+
+// decryptKey decrypts a provider API key, timing it for sampled requests.
+func decryptKey(ctx context.Context, encryptedKey string) (string, error) {
+	start := time.Now()
+	defer timing.FromContext(ctx).Since(timing.KeyDecrypt, start)
+	return crypto.Decrypt(encryptedKey)
+}
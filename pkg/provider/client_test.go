@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTypes_EffectiveTimeoutAndRetries(t *testing.T) {
+	t.Setenv("PROVIDER_TIMEOUT", "10s")
+	t.Setenv("GEMINI_TIMEOUT", "5s")
+	t.Setenv("OLLAMA_MAX_RETRIES", "0")
+
+	want := map[string]struct {
+		timeout float64
+		retries int
+	}{
+		"openai": {10, maxRetries},
+		"gemini": {5, maxRetries},
+		// Ollama's own default outranks PROVIDER_TIMEOUT
+		"ollama": {120, 0},
+	}
+	for _, info := range Types() {
+		w, ok := want[info.Name]
+		if !ok {
+			continue
+		}
+		if info.TimeoutSeconds != w.timeout || info.MaxRetries != w.retries {
+			t.Errorf("%s: expected timeout %vs and %d retries, got %vs and %d", info.Name, w.timeout, w.retries, info.TimeoutSeconds, info.MaxRetries)
+		}
+	}
+	if got := NewHTTPClient("ollama").Timeout; got != 2*time.Minute {
+		t.Errorf("Expected the ollama client to use its default timeout, got %s", got)
+	}
+}
+
+func TestNewHTTPClient_Timeout(t *testing.T) {
+	if got := NewHTTPClient("openai").Timeout; got != defaultProviderTimeout {
+		t.Errorf("Expected default timeout %s, got %s", defaultProviderTimeout, got)
+	}
+
+	t.Setenv("PROVIDER_TIMEOUT", "10s")
+	t.Setenv("ANTHROPIC_TIMEOUT", "50ms")
+	if got := NewHTTPClient("openai").Timeout; got != 10*time.Second {
+		t.Errorf("Expected PROVIDER_TIMEOUT to apply, got %s", got)
+	}
+
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hung)
+
+	start := time.Now()
+	resp, err := NewHTTPClient("anthropic").Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected the hung upstream to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected ANTHROPIC_TIMEOUT to cut the request short, took %s", elapsed)
+	}
+}
+
+func TestHeaderTransport_CapturesRateLimit(t *testing.T) {
+	tests := []struct {
+		name             string
+		headers          map[string]string
+		requests, tokens int
+	}{
+		{"openai", map[string]string{"x-ratelimit-remaining-requests": "59", "x-ratelimit-remaining-tokens": "149000"}, 59, 149000},
+		{"anthropic", map[string]string{"anthropic-ratelimit-requests-remaining": "49", "anthropic-ratelimit-tokens-remaining": "39000"}, 49, 39000},
+		{"none", nil, -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.headers {
+					w.Header().Set(k, v)
+				}
+			}))
+			defer srv.Close()
+
+			ctx, limit := WithRateLimitCapture(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+			resp, err := NewHTTPClient(tt.name).Do(req)
+			if err != nil {
+				t.Fatalf("request error: %v", err)
+			}
+			resp.Body.Close()
+
+			if limit.RemainingRequests != tt.requests || limit.RemainingTokens != tt.tokens {
+				t.Errorf("Expected %d requests / %d tokens remaining, got %+v", tt.requests, tt.tokens, *limit)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClient_ResponseLimit(t *testing.T) {
+	defer func(n int64) { maxResponseBytes = n }(maxResponseBytes)
+	maxResponseBytes = 8
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer srv.Close()
+
+	for body, wantErr := range map[string]bool{"12345678": false, "123456789": true} {
+		resp, err := NewHTTPClient("openai").Get(srv.URL + "?body=" + body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if wantErr != errors.Is(err, errResponseTooLarge) {
+			t.Errorf("%q: expected too large %v, got %v", body, wantErr, err)
+		}
+		if !wantErr && string(got) != body {
+			t.Errorf("Expected %q, got %q", body, got)
+		}
+	}
+}
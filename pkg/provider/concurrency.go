@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/config"
+)
+
+// ErrConcurrencyLimit is returned by AcquireSlot when a provider key is
+// already running its maximum number of concurrent requests.
+var ErrConcurrencyLimit = errors.New("provider key concurrency limit reached")
+
+var (
+	// defaultMaxConcurrency applies to every provider key unless overridden by
+	// <PROVIDER>_MAX_CONCURRENCY. 0 means unlimited.
+	defaultMaxConcurrency = config.Int("PROVIDER_MAX_CONCURRENCY", 0)
+	// concurrencyWait is how long a request waits for a free slot before giving up.
+	concurrencyWait = config.Duration("PROVIDER_CONCURRENCY_WAIT", 0)
+	// queueDepth bounds how many requests may wait for a slot on one provider
+	// key; further requests are rejected at once. 0 means unbounded.
+	queueDepth = config.Int("PROVIDER_QUEUE_DEPTH", 0)
+
+	semaphores   = make(map[int]chan struct{})
+	waiting      = make(map[int]int)
+	semaphoresMu sync.Mutex
+
+	// inFlight publishes the current number of in-flight requests per provider key ID.
+	inFlight = expvar.NewMap("provider_inflight")
+	// queued publishes the number of requests waiting for a slot per provider key ID.
+	queued = expvar.NewMap("provider_queue_depth")
+	// queueWaitMs accumulates time spent waiting for a slot per provider key
+	// ID; queueWaits counts the waits, so the mean wait is their ratio.
+	queueWaitMs = expvar.NewMap("provider_queue_wait_ms")
+	queueWaits  = expvar.NewMap("provider_queue_waits")
+	// queueRejected counts requests turned away by a full queue or an expired wait.
+	queueRejected = expvar.NewMap("provider_queue_rejected")
+)
+
+// maxConcurrency returns the per-key concurrency limit for a provider type.
+func maxConcurrency(providerType string) int {
+	return config.Int(strings.ToUpper(providerType)+"_MAX_CONCURRENCY", defaultMaxConcurrency)
+}
+
+func semaphoreFor(providerKeyID, limit int) chan struct{} {
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+	sem, ok := semaphores[providerKeyID]
+	if !ok || cap(sem) != limit {
+		sem = make(chan struct{}, limit)
+		semaphores[providerKeyID] = sem
+	}
+	return sem
+}
+
+// enqueue records a request waiting for a slot on a provider key, reporting
+// false if the key's queue is already full.
+func enqueue(providerKeyID int) bool {
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+	if queueDepth > 0 && waiting[providerKeyID] >= queueDepth {
+		return false
+	}
+	waiting[providerKeyID]++
+	return true
+}
+
+func dequeue(providerKeyID int) {
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+	if waiting[providerKeyID]--; waiting[providerKeyID] <= 0 {
+		delete(waiting, providerKeyID)
+	}
+}
+
+// AcquireSlot reserves one in-flight request slot for a provider key, waiting
+// up to PROVIDER_CONCURRENCY_WAIT for one to free up. At most
+// PROVIDER_QUEUE_DEPTH requests wait per key; beyond that requests are
+// rejected without waiting. The returned release
+// function must be called once the upstream call completes.
+func AcquireSlot(ctx context.Context, providerType string, providerKeyID int) (release func(), err error) {
+	limit := maxConcurrency(providerType)
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	key := strconv.Itoa(providerKeyID)
+	sem := semaphoreFor(providerKeyID, limit)
+	select {
+	case sem <- struct{}{}:
+	default:
+		if concurrencyWait <= 0 || !enqueue(providerKeyID) {
+			queueRejected.Add(key, 1)
+			return nil, ErrConcurrencyLimit
+		}
+		queued.Add(key, 1)
+		start := time.Now()
+		defer func() {
+			dequeue(providerKeyID)
+			queued.Add(key, -1)
+			queueWaits.Add(key, 1)
+			queueWaitMs.Add(key, time.Since(start).Milliseconds())
+		}()
+
+		timer := time.NewTimer(concurrencyWait)
+		defer timer.Stop()
+		select {
+		case sem <- struct{}{}:
+		case <-timer.C:
+			queueRejected.Add(key, 1)
+			return nil, ErrConcurrencyLimit
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	inFlight.Add(key, 1)
+	return func() {
+		inFlight.Add(key, -1)
+		<-sem
+	}, nil
+}
@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireSlot_BoundedQueue(t *testing.T) {
+	prevMax, prevWait, prevDepth := defaultMaxConcurrency, concurrencyWait, queueDepth
+	defaultMaxConcurrency, concurrencyWait, queueDepth = 1, time.Second, 1
+	defer func() { defaultMaxConcurrency, concurrencyWait, queueDepth = prevMax, prevWait, prevDepth }()
+
+	const keyID = 90210
+	ctx := context.Background()
+
+	release, err := AcquireSlot(ctx, "openai", keyID)
+	if err != nil {
+		t.Fatalf("first AcquireSlot() error = %v", err)
+	}
+
+	// The second request queues for the slot
+	acquired := make(chan error, 1)
+	go func() {
+		r, err := AcquireSlot(ctx, "openai", keyID)
+		if err == nil {
+			r()
+		}
+		acquired <- err
+	}()
+	for deadline := time.Now().Add(time.Second); ; {
+		semaphoresMu.Lock()
+		n := waiting[keyID]
+		semaphoresMu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second request never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so a third is rejected without waiting
+	start := time.Now()
+	if _, err := AcquireSlot(ctx, "openai", keyID); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Errorf("expected ErrConcurrencyLimit with a full queue, got %v", err)
+	}
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("expected an immediate rejection, waited %v", waited)
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("queued request should get the freed slot, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"tokentracer-proxy/pkg/types"
+)
+
+// maxErrorBodyBytes bounds how much of an upstream error body is kept.
+const maxErrorBodyBytes = 64 << 10
+
+// ProviderError is returned by Send when the upstream responds with a non-200 status.
+type ProviderError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("upstream error: status %d", e.StatusCode)
+}
+
+// newProviderError captures the status and (bounded) body of a failed upstream response.
+func newProviderError(resp *http.Response) *ProviderError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	return &ProviderError{StatusCode: resp.StatusCode, Body: body}
+}
+
+// ClientStatus is the status the proxy should answer with for this error.
+// Upstream client errors and rate limits are relayed so callers can see what
+// was wrong with their request. 401 and 403 concern the proxy's provider key,
+// not the caller's credentials, and upstream server errors are the gateway's
+// problem, so those become 502.
+func (e *ProviderError) ClientStatus() int {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized, e.StatusCode == http.StatusForbidden:
+		return http.StatusBadGateway
+	case e.StatusCode >= 400 && e.StatusCode < 500:
+		return e.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// FallbackEligible is the default classification of upstream statuses that
+// should trigger an alias's fallback. Errors caused by the request itself
+// (400, 413, 422) would fail on any provider, so they are returned as-is.
+func FallbackEligible(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return false
+	}
+	return status >= 400
+}
+
+// upstreamErrorBody covers the error shapes of the supported providers:
+// OpenAI {error:{message,type,code}}, Anthropic {type:"error",error:{type,message}}
+// and Gemini {error:{code,message,status}}.
+type upstreamErrorBody struct {
+	Error *struct {
+		Message string          `json:"message"`
+		Type    string          `json:"type"`
+		Param   *string         `json:"param"`
+		Code    json.RawMessage `json:"code"`
+		Status  string          `json:"status"`
+	} `json:"error"`
+}
+
+// anthropicErrorTypes maps Anthropic error types to the nearest OpenAI type.
+var anthropicErrorTypes = map[string]string{
+	"invalid_request_error": "invalid_request_error",
+	"authentication_error":  "authentication_error",
+	"permission_error":      "permission_error",
+	"not_found_error":       "invalid_request_error",
+	"request_too_large":     "invalid_request_error",
+	"rate_limit_error":      "rate_limit_exceeded",
+	"api_error":             "server_error",
+	"overloaded_error":      "server_error",
+}
+
+// geminiErrorTypes maps Gemini (Google RPC) statuses to the nearest OpenAI type.
+var geminiErrorTypes = map[string]string{
+	"INVALID_ARGUMENT":    "invalid_request_error",
+	"FAILED_PRECONDITION": "invalid_request_error",
+	"NOT_FOUND":           "invalid_request_error",
+	"UNAUTHENTICATED":     "authentication_error",
+	"PERMISSION_DENIED":   "permission_error",
+	"RESOURCE_EXHAUSTED":  "rate_limit_exceeded",
+	"INTERNAL":            "server_error",
+	"UNAVAILABLE":         "server_error",
+	"DEADLINE_EXCEEDED":   "server_error",
+}
+
+// OpenAIError normalizes the upstream error body into the OpenAI error
+// envelope, preserving the provider's message. Bodies that aren't a recognised
+// error shape get a generic message and a type derived from the status code.
+func (e *ProviderError) OpenAIError() types.OpenAIErrorResponse {
+	out := types.OpenAIError{Type: errorTypeForStatus(e.StatusCode)}
+
+	var body upstreamErrorBody
+	if err := json.Unmarshal(e.Body, &body); err != nil || body.Error == nil || body.Error.Message == "" {
+		out.Message = e.Error()
+		if text := strings.TrimSpace(string(e.Body)); text != "" && err != nil {
+			out.Message += ": " + text
+		}
+		return types.OpenAIErrorResponse{Error: out}
+	}
+
+	out.Message = body.Error.Message
+	out.Param = body.Error.Param
+	switch {
+	case body.Error.Status != "":
+		// Gemini: numeric code mirrors the HTTP status, so the RPC status is the useful code.
+		if t, ok := geminiErrorTypes[body.Error.Status]; ok {
+			out.Type = t
+		}
+		code := body.Error.Status
+		out.Code = &code
+	case body.Error.Type != "":
+		if t, ok := anthropicErrorTypes[body.Error.Type]; ok {
+			out.Type = t
+		} else {
+			out.Type = body.Error.Type
+		}
+		out.Code = rawCode(body.Error.Code)
+	default:
+		out.Code = rawCode(body.Error.Code)
+	}
+	return types.OpenAIErrorResponse{Error: out}
+}
+
+// rawCode converts an error code that may be a JSON string, number or null.
+func rawCode(raw json.RawMessage) *string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return &s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		s = n.String()
+		return &s
+	}
+	return nil
+}
+
+// errorTypeForStatus picks an OpenAI error type for a bare upstream status.
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	}
+	return "server_error"
+}
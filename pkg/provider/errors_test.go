@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProviderError_OpenAIError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantMsg  string
+		wantType string
+		wantCode string
+	}{
+		{
+			name:     "OpenAI",
+			status:   http.StatusNotFound,
+			body:     `{"error":{"message":"The model 'gpt-5o' does not exist","type":"invalid_request_error","param":null,"code":"model_not_found"}}`,
+			wantMsg:  "The model 'gpt-5o' does not exist",
+			wantType: "invalid_request_error",
+			wantCode: "model_not_found",
+		},
+		{
+			name:     "Anthropic rate limit",
+			status:   http.StatusTooManyRequests,
+			body:     `{"type":"error","error":{"type":"rate_limit_error","message":"Number of request tokens has exceeded your per-minute rate limit"}}`,
+			wantMsg:  "Number of request tokens has exceeded your per-minute rate limit",
+			wantType: "rate_limit_exceeded",
+		},
+		{
+			name:     "Anthropic overloaded",
+			status:   529,
+			body:     `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			wantMsg:  "Overloaded",
+			wantType: "server_error",
+		},
+		{
+			name:     "Gemini",
+			status:   http.StatusBadRequest,
+			body:     `{"error":{"code":400,"message":"API key not valid. Please pass a valid API key.","status":"INVALID_ARGUMENT"}}`,
+			wantMsg:  "API key not valid. Please pass a valid API key.",
+			wantType: "invalid_request_error",
+			wantCode: "INVALID_ARGUMENT",
+		},
+		{
+			name:     "Non-JSON body",
+			status:   http.StatusBadGateway,
+			body:     "<html>Bad Gateway</html>",
+			wantMsg:  "upstream error: status 502: <html>Bad Gateway</html>",
+			wantType: "server_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perr := &ProviderError{StatusCode: tt.status, Body: []byte(tt.body)}
+			got := perr.OpenAIError().Error
+
+			if got.Message != tt.wantMsg {
+				t.Errorf("Expected message %q, got %q", tt.wantMsg, got.Message)
+			}
+			if got.Type != tt.wantType {
+				t.Errorf("Expected type %q, got %q", tt.wantType, got.Type)
+			}
+			gotCode := ""
+			if got.Code != nil {
+				gotCode = *got.Code
+			}
+			if gotCode != tt.wantCode {
+				t.Errorf("Expected code %q, got %q", tt.wantCode, gotCode)
+			}
+		})
+	}
+}
+
+func TestProviderError_ClientStatus(t *testing.T) {
+	tests := []struct {
+		upstream, want int
+	}{
+		{http.StatusBadRequest, http.StatusBadRequest},
+		{http.StatusNotFound, http.StatusNotFound},
+		{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{http.StatusUnauthorized, http.StatusBadGateway},
+		{http.StatusForbidden, http.StatusBadGateway},
+		{http.StatusInternalServerError, http.StatusBadGateway},
+		{http.StatusServiceUnavailable, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		if got := (&ProviderError{StatusCode: tt.upstream}).ClientStatus(); got != tt.want {
+			t.Errorf("ClientStatus() for upstream %d = %d, want %d", tt.upstream, got, tt.want)
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os"
 	"tokentracer-proxy/pkg/crypto"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/translator"
 	"tokentracer-proxy/pkg/types"
 )
 
@@ -44,12 +46,12 @@ func (p *GeminiProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	reqBody, _ := json.Marshal(req)
 
 	// 3. Send Request
-	upstreamReq, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/chat/completions", bytes.NewBuffer(reqBody))
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/chat/completions", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upstream request: %w", err)
 	}
 
-	apiKey, err := crypto.Decrypt(encryptedKey)
+	apiKey, err := decryptKey(ctx, encryptedKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
 	}
@@ -57,7 +59,7 @@ func (p *GeminiProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
 	upstreamReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := geminiClient
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
 		return nil, fmt.Errorf("upstream request failed: %w", err)
@@ -65,7 +67,7 @@ func (p *GeminiProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("upstream error: status %d", resp.StatusCode)
+		return nil, newProviderError(resp)
 	}
 
 	// 4. Handle Response
@@ -73,10 +75,42 @@ func (p *GeminiProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
 		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
 	}
+	translator.CitationsFromAnnotations(&openAIResp)
 
 	return &openAIResp, nil
 }
 
+// SendStream streams a chat completion, relaying the upstream's chunks as-is.
+func (p *GeminiProvider) SendStream(ctx context.Context, req types.OpenAIRequest, emit func([]byte) error) (types.OpenAIUsage, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	req, hideUsage := withStreamUsage(req)
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/chat/completions", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := geminiStreamClient.Do(upstreamReq)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return streamOpenAICompatible(resp, hideUsage, emit)
+}
+
 func (p *GeminiProvider) ListModels(ctx context.Context) ([]string, error) {
 	// 1. Fetch Key
 	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
@@ -97,7 +131,7 @@ func (p *GeminiProvider) ListModels(ctx context.Context) ([]string, error) {
 
 	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{}
+	client := geminiClient
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
 		return nil, fmt.Errorf("upstream request failed: %w", err)
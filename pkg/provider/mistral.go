@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/types"
+)
+
+// MistralProvider sends requests to Mistral's La Plateforme API, which
+// accepts OpenAI-format chat completions as they are.
+type MistralProvider struct {
+	repo          db.Repository
+	providerKeyID int
+	userID        int
+	baseURL       string
+}
+
+func NewMistralProvider(repository db.Repository, providerKeyID, userID int) *MistralProvider {
+	baseURL := os.Getenv("MISTRAL_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.mistral.ai"
+	}
+
+	return &MistralProvider{
+		repo:          repository,
+		providerKeyID: providerKeyID,
+		userID:        userID,
+		baseURL:       baseURL,
+	}
+}
+
+// newRequest builds an authorized request to path on the Mistral API.
+func (p *MistralProvider) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return nil, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), method, p.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	if body != nil {
+		upstreamReq.Header.Set("Content-Type", "application/json")
+	}
+	return upstreamReq, nil
+}
+
+func (p *MistralProvider) Send(ctx context.Context, req types.OpenAIRequest) (*types.OpenAIResponse, error) {
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := p.newRequest(ctx, "POST", "/v1/chat/completions", reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := mistralClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newProviderError(resp)
+	}
+
+	var openAIResp types.OpenAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+	return &openAIResp, nil
+}
+
+// SendStream streams a chat completion, relaying the upstream's chunks as-is.
+// Mistral rejects stream_options but always reports usage on the final chunk,
+// alongside its choices, so there is nothing to hide from the client.
+func (p *MistralProvider) SendStream(ctx context.Context, req types.OpenAIRequest, emit func([]byte) error) (types.OpenAIUsage, error) {
+	req.Stream = true
+	req.StreamOptions = nil
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := p.newRequest(ctx, "POST", "/v1/chat/completions", reqBody)
+	if err != nil {
+		return types.OpenAIUsage{}, err
+	}
+	upstreamReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := mistralStreamClient.Do(upstreamReq)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return streamOpenAICompatible(resp, false, emit)
+}
+
+func (p *MistralProvider) ListModels(ctx context.Context) ([]string, error) {
+	upstreamReq, err := p.newRequest(ctx, "GET", "/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := mistralClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream error: status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+
+	var models []string
+	for _, m := range data.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
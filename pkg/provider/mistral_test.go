@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestMistralProvider(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	encrypted, err := crypto.Encrypt("mistral-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotAuth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/chat/completions":
+			w.Write([]byte(`{"id":"cmpl-1","object":"chat.completion","model":"mistral-large-latest","choices":[{"index":0,"message":{"role":"assistant","content":"Bonjour"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`))
+		case "/v1/models":
+			w.Write([]byte(`{"object":"list","data":[{"id":"mistral-large-latest"},{"id":"codestral-latest"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	t.Setenv("MISTRAL_BASE_URL", upstream.URL)
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	for range 2 {
+		mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+			WithArgs(3, 7).
+			WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("mistral", encrypted))
+	}
+
+	p, ok := New("mistral", db.NewPostgresRepository(mockDB), 3, 7)
+	if !ok {
+		t.Fatal("Expected mistral to be a registered provider type")
+	}
+
+	resp, err := p.Send(context.Background(), types.OpenAIRequest{Model: "mistral-large-latest", Messages: []types.OpenAIMessage{{Role: "user", Content: "Salut"}}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp.Choices[0].Message.Content != "Bonjour" || resp.Usage.TotalTokens != 7 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	models, err := p.ListModels(context.Background())
+	if err != nil {
+		t.Fatalf("ListModels: %v", err)
+	}
+	if want := []string{"mistral-large-latest", "codestral-latest"}; !reflect.DeepEqual(models, want) {
+		t.Errorf("Expected %v, got %v", want, models)
+	}
+
+	for _, auth := range gotAuth {
+		if auth != "Bearer mistral-key" {
+			t.Errorf("Expected the key as a bearer token, got %q", auth)
+		}
+	}
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
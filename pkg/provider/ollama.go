@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/types"
+)
+
+// OllamaProvider sends requests to a self-hosted OpenAI-compatible server,
+// such as Ollama, at the provider key's base URL. The API key is optional
+// and sent as a bearer token when set.
+type OllamaProvider struct {
+	repo          db.Repository
+	providerKeyID int
+	userID        int
+}
+
+func NewOllamaProvider(repository db.Repository, providerKeyID, userID int) *OllamaProvider {
+	return &OllamaProvider{
+		repo:          repository,
+		providerKeyID: providerKeyID,
+		userID:        userID,
+	}
+}
+
+// credentials returns the server's base URL, without a trailing /v1, and the
+// encrypted API key.
+func (p *OllamaProvider) credentials(ctx context.Context) (string, string, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return "", "", fmt.Errorf("provider configuration not found: %w", err)
+	}
+	baseURL, err := p.repo.GetProviderKeyBaseURL(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return "", "", fmt.Errorf("provider configuration not found: %w", err)
+	}
+	if baseURL == "" {
+		return "", "", fmt.Errorf("ollama provider key %d has no base URL", p.providerKeyID)
+	}
+	return strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/v1"), encryptedKey, nil
+}
+
+// authorize sets the bearer token, if the key has one.
+func authorize(req *http.Request, apiKey string) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
+
+func (p *OllamaProvider) Send(ctx context.Context, req types.OpenAIRequest) (*types.OpenAIResponse, error) {
+	baseURL, encryptedKey, err := p.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", baseURL+"/v1/chat/completions", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	authorize(upstreamReq, apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := ollamaClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newProviderError(resp)
+	}
+
+	var openAIResp types.OpenAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+	return &openAIResp, nil
+}
+
+// SendStream streams a chat completion, relaying the upstream's chunks as-is.
+func (p *OllamaProvider) SendStream(ctx context.Context, req types.OpenAIRequest, emit func([]byte) error) (types.OpenAIUsage, error) {
+	baseURL, encryptedKey, err := p.credentials(ctx)
+	if err != nil {
+		return types.OpenAIUsage{}, err
+	}
+
+	req, hideUsage := withStreamUsage(req)
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", baseURL+"/v1/chat/completions", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	authorize(upstreamReq, apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := ollamaStreamClient.Do(upstreamReq)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return streamOpenAICompatible(resp, hideUsage, emit)
+}
+
+// ListModels returns the models the server has pulled, from the
+// OpenAI-compatible /v1/models endpoint.
+func (p *OllamaProvider) ListModels(ctx context.Context) ([]string, error) {
+	baseURL, encryptedKey, err := p.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/v1/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := crypto.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	authorize(upstreamReq, apiKey)
+
+	resp, err := ollamaClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream error: status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+
+	var models []string
+	for _, m := range data.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
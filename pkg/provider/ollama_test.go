@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestOllamaProvider_ListModelsWithoutKey(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	encrypted, err := crypto.Encrypt("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPath, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","data":[{"id":"llama3.2:latest","object":"model"},{"id":"qwen2.5:7b","object":"model"}]}`))
+	}))
+	defer upstream.Close()
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+		WithArgs(2, 7).
+		WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("ollama", encrypted))
+	mockDB.ExpectQuery("SELECT COALESCE\\(base_url, ''\\) FROM provider_keys").
+		WithArgs(2, 7).
+		WillReturnRows(mockDB.NewRows([]string{"base_url"}).AddRow(upstream.URL + "/v1/"))
+
+	models, err := NewOllamaProvider(db.NewPostgresRepository(mockDB), 2, 7).ListModels(context.Background())
+	if err != nil {
+		t.Fatalf("ListModels: %v", err)
+	}
+	if want := []string{"llama3.2:latest", "qwen2.5:7b"}; !reflect.DeepEqual(models, want) {
+		t.Errorf("Expected %v, got %v", want, models)
+	}
+	if gotPath != "/v1/models" {
+		t.Errorf("Expected /v1/models once, got %q", gotPath)
+	}
+	if gotAuth != "" {
+		t.Errorf("Expected no Authorization header without a key, got %q", gotAuth)
+	}
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"tokentracer-proxy/pkg/crypto"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/translator"
 	"tokentracer-proxy/pkg/types"
 )
 
@@ -15,13 +18,20 @@ type OpenAIProvider struct {
 	repo          db.Repository
 	providerKeyID int
 	userID        int
+	baseURL       string
 }
 
 func NewOpenAIProvider(repository db.Repository, providerKeyID, userID int) *OpenAIProvider {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.openai.com"
+	}
+
 	return &OpenAIProvider{
 		repo:          repository,
 		providerKeyID: providerKeyID,
 		userID:        userID,
+		baseURL:       baseURL,
 	}
 }
 
@@ -36,12 +46,12 @@ func (p *OpenAIProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	reqBody, _ := json.Marshal(req)
 
 	// 3. Send Request
-	upstreamReq, err := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(reqBody))
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/v1/chat/completions", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upstream request: %w", err)
 	}
 
-	apiKey, err := crypto.Decrypt(encryptedKey)
+	apiKey, err := decryptKey(ctx, encryptedKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
 	}
@@ -49,7 +59,7 @@ func (p *OpenAIProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
 	upstreamReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := openAIClient
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
 		return nil, fmt.Errorf("upstream request failed: %w", err)
@@ -57,7 +67,7 @@ func (p *OpenAIProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("upstream error: status %d", resp.StatusCode)
+		return nil, newProviderError(resp)
 	}
 
 	// 4. Handle Response
@@ -65,9 +75,79 @@ func (p *OpenAIProvider) Send(ctx context.Context, req types.OpenAIRequest) (*ty
 	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
 		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
 	}
+	translator.CitationsFromAnnotations(&openAIResp)
 
 	return &openAIResp, nil
 }
+
+// SendStream streams a chat completion, relaying the upstream's chunks as-is.
+func (p *OpenAIProvider) SendStream(ctx context.Context, req types.OpenAIRequest, emit func([]byte) error) (types.OpenAIUsage, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	req, hideUsage := withStreamUsage(req)
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/v1/chat/completions", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+	upstreamReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := openAIStreamClient.Do(upstreamReq)
+	if err != nil {
+		return types.OpenAIUsage{}, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return streamOpenAICompatible(resp, hideUsage, emit)
+}
+
+// Moderate classifies the input with the OpenAI moderations endpoint.
+func (p *OpenAIProvider) Moderate(ctx context.Context, req types.ModerationRequest) (*types.ModerationResponse, error) {
+	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
+	if err != nil {
+		return nil, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	reqBody, _ := json.Marshal(req)
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.baseURL+"/v1/moderations", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := openAIClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newProviderError(resp)
+	}
+
+	var modResp types.ModerationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&modResp); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+	return &modResp, nil
+}
+
 func (p *OpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
 	// 1. Fetch Key
 	_, encryptedKey, err := p.repo.GetProviderKey(ctx, p.providerKeyID, p.userID)
@@ -76,7 +156,7 @@ func (p *OpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
 	}
 
 	// 2. Send Request
-	upstreamReq, err := http.NewRequestWithContext(ctx, "GET", "https://api.openai.com/v1/models", nil)
+	upstreamReq, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/v1/models", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upstream request: %w", err)
 	}
@@ -88,7 +168,7 @@ func (p *OpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
 
 	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{}
+	client := openAIClient
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
 		return nil, fmt.Errorf("upstream request failed: %w", err)
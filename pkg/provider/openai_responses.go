@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/timing"
+	"tokentracer-proxy/pkg/translator"
+	"tokentracer-proxy/pkg/types"
+)
+
+// OpenAIResponsesProvider sends chat completions to OpenAI's Responses API
+// (/v1/responses), for models and features only available there. Requests
+// are stateless single calls; streaming is not supported.
+type OpenAIResponsesProvider struct {
+	openai *OpenAIProvider
+}
+
+func NewOpenAIResponsesProvider(repository db.Repository, providerKeyID, userID int) *OpenAIResponsesProvider {
+	return &OpenAIResponsesProvider{openai: NewOpenAIProvider(repository, providerKeyID, userID)}
+}
+
+func (p *OpenAIResponsesProvider) Send(ctx context.Context, req types.OpenAIRequest) (*types.OpenAIResponse, error) {
+	_, encryptedKey, err := p.openai.repo.GetProviderKey(ctx, p.openai.providerKeyID, p.openai.userID)
+	if err != nil {
+		return nil, fmt.Errorf("provider configuration not found: %w", err)
+	}
+
+	respReq, err := translator.OpenAIToResponsesRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to translate request: %w", err)
+	}
+	reqBody, _ := json.Marshal(respReq)
+
+	upstreamReq, err := http.NewRequestWithContext(timing.Trace(ctx), "POST", p.openai.baseURL+"/v1/responses", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+
+	apiKey, err := decryptKey(ctx, encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provider key: %w", err)
+	}
+	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	upstreamReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := openAIClient.Do(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newProviderError(resp)
+	}
+
+	var responsesResp types.ResponsesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responsesResp); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream response: %w", err)
+	}
+	openAIResp := translator.ResponsesToOpenAIResponse(ctx, responsesResp)
+	return &openAIResp, nil
+}
+
+// ListModels lists the key's models; they are the same as for chat completions.
+func (p *OpenAIResponsesProvider) ListModels(ctx context.Context) ([]string, error) {
+	return p.openai.ListModels(ctx)
+}
@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestOpenAIProvider_BaseURL(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	encrypted, err := crypto.Encrypt("sk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.OpenAIResponse{ID: "chatcmpl-gateway"})
+	}))
+	defer upstream.Close()
+	t.Setenv("OPENAI_BASE_URL", upstream.URL+"/api")
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+		WithArgs(1, 7).
+		WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai", encrypted))
+
+	resp, err := NewOpenAIProvider(db.NewPostgresRepository(mockDB), 1, 7).Send(context.Background(), types.OpenAIRequest{
+		Model:    "gpt-4o",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp.ID != "chatcmpl-gateway" {
+		t.Errorf("Expected the gateway's response, got %+v", resp)
+	}
+	if gotPath != "/api/v1/chat/completions" {
+		t.Errorf("Expected the request under OPENAI_BASE_URL, got %q", gotPath)
+	}
+}
+
+func TestOpenAIResponsesProvider_Send(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	encrypted, err := crypto.Encrypt("sk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPath string
+	var gotBody types.ResponsesRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"resp_abc","object":"response","model":"gpt-4.1","status":"completed",
+			"output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Hi there"}]}],
+			"usage":{"input_tokens":8,"output_tokens":3,"total_tokens":11}}`))
+	}))
+	defer upstream.Close()
+	t.Setenv("OPENAI_BASE_URL", upstream.URL)
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+		WithArgs(1, 7).
+		WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("openai_responses", encrypted))
+
+	resp, err := NewOpenAIResponsesProvider(db.NewPostgresRepository(mockDB), 1, 7).Send(context.Background(), types.OpenAIRequest{
+		Model:    "gpt-4.1",
+		Messages: []types.OpenAIMessage{{Role: "system", Content: "Be nice."}, {Role: "user", Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if gotPath != "/v1/responses" {
+		t.Errorf("Expected a request to /v1/responses, got %q", gotPath)
+	}
+	if gotBody.Instructions != "Be nice." || len(gotBody.Input) != 1 || gotBody.Store {
+		t.Errorf("Expected a stateless request with the system message as instructions, got %+v", gotBody)
+	}
+	if resp.Choices[0].Message.Content != "Hi there" || resp.Usage.TotalTokens != 11 {
+		t.Errorf("Expected the translated response, got %+v", resp)
+	}
+}
@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/types"
+)
+
+// Policies for request parameters a provider type has no equivalent for
+const (
+	// ParamPolicyDrop removes the parameter and logs a warning
+	ParamPolicyDrop = "drop"
+	// ParamPolicyReject fails the request with UnsupportedParamError
+	ParamPolicyReject = "reject"
+)
+
+// unsupportedParamPolicy is how requests carrying a parameter listed in the
+// provider type's UnsupportedParams are handled, for users that have not
+// chosen a policy of their own.
+var unsupportedParamPolicy = config.String("UNSUPPORTED_PARAM_POLICY", ParamPolicyDrop)
+
+// ValidParamPolicy reports whether policy is drop or reject.
+func ValidParamPolicy(policy string) bool {
+	return policy == ParamPolicyDrop || policy == ParamPolicyReject
+}
+
+// DefaultParamPolicy returns the server-wide policy.
+func DefaultParamPolicy() string {
+	return unsupportedParamPolicy
+}
+
+type userParamPolicy struct {
+	policy    *string
+	fetchedAt time.Time
+}
+
+var (
+	policyCache    = make(map[int]userParamPolicy)
+	policyCacheMu  sync.RWMutex
+	policyCacheTTL = 1 * time.Minute
+)
+
+// UserParamPolicy returns the user's policy, falling back to the server-wide
+// one when they have not set one or the lookup fails.
+func UserParamPolicy(ctx context.Context, repo db.Repository, userID int) string {
+	policyCacheMu.RLock()
+	cached, ok := policyCache[userID]
+	policyCacheMu.RUnlock()
+
+	if !ok || time.Since(cached.fetchedAt) >= policyCacheTTL {
+		policy, err := repo.GetUserParamPolicy(ctx, userID)
+		if err != nil {
+			logging.Printf(ctx, "provider: get param policy error for user %d: %v", userID, err)
+			return unsupportedParamPolicy
+		}
+		cached = userParamPolicy{policy: policy, fetchedAt: time.Now()}
+		policyCacheMu.Lock()
+		policyCache[userID] = cached
+		policyCacheMu.Unlock()
+	}
+
+	if cached.policy == nil || !ValidParamPolicy(*cached.policy) {
+		return unsupportedParamPolicy
+	}
+	return *cached.policy
+}
+
+// InvalidateParamPolicy drops the cached policy for a user so the next
+// check hits the DB.
+func InvalidateParamPolicy(userID int) {
+	policyCacheMu.Lock()
+	delete(policyCache, userID)
+	policyCacheMu.Unlock()
+}
+
+// optionalParam reads and clears one optional OpenAI request parameter.
+type optionalParam struct {
+	isSet func(*types.OpenAIRequest) bool
+	clear func(*types.OpenAIRequest)
+}
+
+// optionalParams holds the parameters that may appear in a TypeInfo's
+// UnsupportedParams, keyed by their JSON name.
+var optionalParams = map[string]optionalParam{
+	"frequency_penalty": {
+		isSet: func(r *types.OpenAIRequest) bool { return r.FrequencyPenalty != nil },
+		clear: func(r *types.OpenAIRequest) { r.FrequencyPenalty = nil },
+	},
+	"presence_penalty": {
+		isSet: func(r *types.OpenAIRequest) bool { return r.PresencePenalty != nil },
+		clear: func(r *types.OpenAIRequest) { r.PresencePenalty = nil },
+	},
+	"stop": {
+		isSet: func(r *types.OpenAIRequest) bool { return len(r.Stop) > 0 },
+		clear: func(r *types.OpenAIRequest) { r.Stop = nil },
+	},
+	"response_format": {
+		isSet: func(r *types.OpenAIRequest) bool { return r.ResponseFormat != nil },
+		clear: func(r *types.OpenAIRequest) { r.ResponseFormat = nil },
+	},
+}
+
+// SupportsParam reports whether providerType accepts the named OpenAI request
+// parameter. Unknown provider types are assumed to accept everything.
+func SupportsParam(providerType, name string) bool {
+	info, ok := LookupType(providerType)
+	if !ok {
+		return true
+	}
+	for _, p := range info.UnsupportedParams {
+		if p == name {
+			return false
+		}
+	}
+	return true
+}
+
+// UnsupportedParamError is returned by ApplyParamPolicy when the request uses
+// parameters the provider type does not support and the policy is reject.
+type UnsupportedParamError struct {
+	ProviderType string
+	Params       []string
+}
+
+func (e *UnsupportedParamError) Error() string {
+	return fmt.Sprintf("%s not supported by provider %s", strings.Join(e.Params, ", "), e.ProviderType)
+}
+
+// ApplyParamPolicy checks req against the parameters providerType does not
+// support, under userID's policy. Under the drop policy they are removed from
+// req with a logged warning; under reject an *UnsupportedParamError is
+// returned and req is left alone. The policy is only looked up when req uses
+// such a parameter.
+func ApplyParamPolicy(ctx context.Context, repo db.Repository, userID int, providerType string, req *types.OpenAIRequest) error {
+	info, ok := LookupType(providerType)
+	if !ok {
+		return nil
+	}
+
+	var used []string
+	for _, name := range info.UnsupportedParams {
+		if p, ok := optionalParams[name]; ok && p.isSet(req) {
+			used = append(used, name)
+		}
+	}
+	if len(used) == 0 {
+		return nil
+	}
+
+	if UserParamPolicy(ctx, repo, userID) == ParamPolicyReject {
+		return &UnsupportedParamError{ProviderType: providerType, Params: used}
+	}
+	for _, name := range used {
+		optionalParams[name].clear(req)
+	}
+	logging.Printf(ctx, "provider: dropping %s for %s model %q: not supported by the provider", strings.Join(used, ", "), providerType, req.Model)
+	return nil
+}
@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestApplyParamPolicy(t *testing.T) {
+	orig := unsupportedParamPolicy
+	defer func() { unsupportedParamPolicy = orig }()
+
+	penalty := 0.5
+	drop, reject := ParamPolicyDrop, ParamPolicyReject
+	tests := []struct {
+		name         string
+		provider     string
+		serverPolicy string
+		userPolicy   *string
+		lookupErr    error
+		wantReject   bool
+	}{
+		{name: "drop", provider: "anthropic", serverPolicy: ParamPolicyDrop},
+		{name: "reject", provider: "anthropic", serverPolicy: ParamPolicyReject, wantReject: true},
+		{name: "user rejects", provider: "anthropic", serverPolicy: ParamPolicyDrop, userPolicy: &reject, wantReject: true},
+		{name: "user drops", provider: "anthropic", serverPolicy: ParamPolicyReject, userPolicy: &drop},
+		{name: "lookup error", provider: "anthropic", serverPolicy: ParamPolicyReject, lookupErr: errors.New("connection refused"), wantReject: true},
+		// Nothing to decide, so the policy isn't looked up
+		{name: "supported provider", provider: "openai", serverPolicy: ParamPolicyReject},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			repo := db.NewPostgresRepository(mock)
+			unsupportedParamPolicy = tt.serverPolicy
+
+			userID := 6100 + i
+			defer InvalidateParamPolicy(userID)
+			if tt.provider == "anthropic" {
+				q := mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID)
+				if tt.lookupErr != nil {
+					q.WillReturnError(tt.lookupErr)
+				} else {
+					q.WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow(tt.userPolicy))
+				}
+			}
+
+			req := types.OpenAIRequest{Model: "claude-3", FrequencyPenalty: &penalty, PresencePenalty: &penalty}
+			err = ApplyParamPolicy(context.Background(), repo, userID, tt.provider, &req)
+			var perr *UnsupportedParamError
+			switch {
+			case tt.wantReject:
+				if !errors.As(err, &perr) {
+					t.Fatalf("expected UnsupportedParamError, got %v", err)
+				}
+				if len(perr.Params) != 2 || perr.Params[0] != "frequency_penalty" {
+					t.Errorf("Params = %v", perr.Params)
+				}
+				if req.FrequencyPenalty == nil {
+					t.Error("request should be left alone on reject")
+				}
+			case tt.provider == "openai":
+				if err != nil {
+					t.Fatalf("ApplyParamPolicy() error = %v", err)
+				}
+				if req.FrequencyPenalty == nil || req.PresencePenalty == nil {
+					t.Errorf("penalties should pass through to openai: %+v", req)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("ApplyParamPolicy() error = %v", err)
+				}
+				if req.FrequencyPenalty != nil || req.PresencePenalty != nil {
+					t.Errorf("penalties not dropped: %+v", req)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestUserParamPolicy_CachesUntilInvalidated(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	repo := db.NewPostgresRepository(mock)
+
+	userID := 6200
+	defer InvalidateParamPolicy(userID)
+	reject := ParamPolicyReject
+	mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow(&reject))
+	mock.ExpectQuery("SELECT unsupported_param_policy FROM users").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"unsupported_param_policy"}).AddRow((*string)(nil)))
+
+	ctx := context.Background()
+	// The second lookup is served from the cache
+	if UserParamPolicy(ctx, repo, userID) != ParamPolicyReject || UserParamPolicy(ctx, repo, userID) != ParamPolicyReject {
+		t.Fatal("Expected the user's reject policy")
+	}
+	InvalidateParamPolicy(userID)
+	if got := UserParamPolicy(ctx, repo, userID); got != unsupportedParamPolicy {
+		t.Errorf("Expected the server default once cleared, got %q", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -2,6 +2,9 @@ package provider
 
 import (
 	"context"
+	"net/http"
+	"time"
+	"tokentracer-proxy/pkg/db"
 	"tokentracer-proxy/pkg/types"
 )
 
@@ -16,6 +19,132 @@ type Provider interface {
 	ListModels(ctx context.Context) ([]string, error)
 }
 
+// NativeSender is implemented by providers that can forward requests in
+// their own API format, for aliases with native_passthrough.
+type NativeSender interface {
+	SendNative(ctx context.Context, body []byte, header http.Header) (*http.Response, error)
+}
+
+// StreamSender is implemented by providers that can stream completions.
+// SendStream calls emit with each server-sent event of the response, framed
+// and ready to write to the client, and returns the token usage once the
+// stream ends. The closing [DONE] sentinel is left to the caller. An error
+// returned before the first emit means nothing was sent and the request can
+// be retried elsewhere.
+type StreamSender interface {
+	SendStream(ctx context.Context, req types.OpenAIRequest, emit func(event []byte) error) (types.OpenAIUsage, error)
+}
+
+// Moderator is implemented by providers with a content moderation endpoint.
+type Moderator interface {
+	Moderate(ctx context.Context, req types.ModerationRequest) (*types.ModerationResponse, error)
+}
+
+// Auth styles used by upstream providers
+const (
+	AuthBearer  = "bearer"
+	AuthXAPIKey = "x-api-key"
+	AuthAPIKey  = "api-key"
+	// AuthOptionalBearer sends the key as a bearer token only if one is set
+	AuthOptionalBearer = "optional-bearer"
+)
+
+// TypeInfo describes a provider type and what a provider key for it needs.
+type TypeInfo struct {
+	Name                 string `json:"name"`
+	DisplayName          string `json:"display_name"`
+	RequiresBaseURL      bool   `json:"requires_base_url"`
+	RequiresRegion       bool   `json:"requires_region"`
+	AuthStyle            string `json:"auth_style"`
+	SupportsModelListing bool   `json:"supports_model_listing"`
+	// UnsupportedParams are OpenAI request parameters the provider has no
+	// equivalent for; see ApplyParamPolicy.
+	UnsupportedParams []string `json:"unsupported_params,omitempty"`
+	// TimeoutSeconds and MaxRetries are the effective settings for upstream
+	// calls, filled in by Types.
+	TimeoutSeconds float64 `json:"timeout_seconds"`
+	MaxRetries     int     `json:"max_retries"`
+
+	// defaultTimeout replaces the server-wide default timeout for the type
+	defaultTimeout time.Duration
+}
+
+var providerTypes = []TypeInfo{
+	{Name: "openai", DisplayName: "OpenAI", AuthStyle: AuthBearer, SupportsModelListing: true},
+	{Name: "anthropic", DisplayName: "Anthropic", AuthStyle: AuthXAPIKey, SupportsModelListing: true,
+		UnsupportedParams: []string{"frequency_penalty", "presence_penalty", "response_format"}},
+	{Name: "gemini", DisplayName: "Gemini", AuthStyle: AuthBearer, SupportsModelListing: true},
+	{Name: "azure", DisplayName: "Azure OpenAI", RequiresBaseURL: true, AuthStyle: AuthAPIKey, SupportsModelListing: true},
+	// Self-hosted models may need loading into memory before they answer
+	{Name: "ollama", DisplayName: "Ollama / OpenAI-compatible", RequiresBaseURL: true, AuthStyle: AuthOptionalBearer, SupportsModelListing: true,
+		defaultTimeout: 2 * time.Minute},
+	{Name: "openai_responses", DisplayName: "OpenAI (Responses API)", AuthStyle: AuthBearer, SupportsModelListing: true,
+		UnsupportedParams: []string{"frequency_penalty", "presence_penalty", "stop"}},
+	{Name: "mistral", DisplayName: "Mistral", AuthStyle: AuthBearer, SupportsModelListing: true},
+}
+
+// Types returns the metadata for every supported provider type.
+func Types() []TypeInfo {
+	out := make([]TypeInfo, len(providerTypes))
+	copy(out, providerTypes)
+	for i := range out {
+		out[i].TimeoutSeconds = providerTimeout(out[i].Name).Seconds()
+		out[i].MaxRetries = providerMaxRetries(out[i].Name)
+	}
+	return out
+}
+
+// LookupType returns the metadata for a provider type by name.
+func LookupType(name string) (TypeInfo, bool) {
+	for _, t := range providerTypes {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TypeInfo{}, false
+}
+
 func SupportedProviders() []string {
-	return []string{"openai", "anthropic", "gemini"}
+	names := make([]string, 0, len(providerTypes))
+	for _, t := range providerTypes {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// Constructor builds a provider bound to one of a user's provider keys.
+type Constructor func(repository db.Repository, providerKeyID, userID int) Provider
+
+var constructors = map[string]Constructor{
+	"openai": func(r db.Repository, k, u int) Provider {
+		return NewOpenAIProvider(r, k, u)
+	},
+	"anthropic": func(r db.Repository, k, u int) Provider {
+		return NewAnthropicProvider(r, k, u)
+	},
+	"gemini": func(r db.Repository, k, u int) Provider {
+		return NewGeminiProvider(r, k, u)
+	},
+	"azure": func(r db.Repository, k, u int) Provider {
+		return NewAzureOpenAIProvider(r, k, u)
+	},
+	"ollama": func(r db.Repository, k, u int) Provider {
+		return NewOllamaProvider(r, k, u)
+	},
+	"openai_responses": func(r db.Repository, k, u int) Provider {
+		return NewOpenAIResponsesProvider(r, k, u)
+	},
+	"mistral": func(r db.Repository, k, u int) Provider {
+		return NewMistralProvider(r, k, u)
+	},
+}
+
+// New instantiates the provider registered under providerType. The boolean is
+// false when the type is unknown.
+func New(providerType string, repository db.Repository, providerKeyID, userID int) (Provider, bool) {
+	c, ok := constructors[providerType]
+	if !ok {
+		return nil, false
+	}
+	return c(repository, providerKeyID, userID), true
 }
@@ -0,0 +1,37 @@
+package provider
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestTypes_MatchConstructors guards against a provider type being listed to
+// clients without a constructor to serve it, or the reverse.
+func TestTypes_MatchConstructors(t *testing.T) {
+	for _, info := range Types() {
+		if _, ok := constructors[info.Name]; !ok {
+			t.Errorf("Provider type %q has no constructor", info.Name)
+		}
+		if info.DisplayName == "" || info.AuthStyle == "" {
+			t.Errorf("Provider type %q is missing its display name or auth style", info.Name)
+		}
+	}
+	for name := range constructors {
+		if _, ok := LookupType(name); !ok {
+			t.Errorf("Constructor %q has no provider type metadata", name)
+		}
+	}
+	if !slices.Equal(SupportedProviders(), []string{"openai", "anthropic", "gemini", "azure", "ollama", "openai_responses", "mistral"}) {
+		t.Errorf("Unexpected supported providers %v", SupportedProviders())
+	}
+}
+
+func TestLookupType(t *testing.T) {
+	info, ok := LookupType("azure")
+	if !ok || !info.RequiresBaseURL || info.AuthStyle != AuthAPIKey {
+		t.Errorf("Expected azure to require a base URL with api-key auth, got %+v", info)
+	}
+	if _, ok := LookupType("bedrock"); ok {
+		t.Error("Expected an unknown provider type not to be found")
+	}
+}
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// UpstreamRateLimit is the remaining budget an upstream reported in its
+// response headers. Fields are -1 when the upstream didn't report them.
+type UpstreamRateLimit struct {
+	RemainingRequests int
+	RemainingTokens   int
+}
+
+// rateLimitHeaders are the remaining-budget headers of each provider, in the
+// order they are checked. Gemini's OpenAI-compatible API uses OpenAI's names.
+var rateLimitHeaders = struct {
+	requests, tokens []string
+}{
+	requests: []string{"x-ratelimit-remaining-requests", "anthropic-ratelimit-requests-remaining"},
+	tokens:   []string{"x-ratelimit-remaining-tokens", "anthropic-ratelimit-tokens-remaining"},
+}
+
+type rateLimitKey struct{}
+
+// WithRateLimitCapture returns a context under which upstream calls record the
+// provider's rate-limit headers into the returned UpstreamRateLimit. Each
+// response overwrites it, so it holds the state reported by the last call.
+func WithRateLimitCapture(ctx context.Context) (context.Context, *UpstreamRateLimit) {
+	l := &UpstreamRateLimit{RemainingRequests: -1, RemainingTokens: -1}
+	return context.WithValue(ctx, rateLimitKey{}, l), l
+}
+
+// recordRateLimit stores the rate-limit headers of resp in the capture
+// attached to ctx, if any.
+func recordRateLimit(ctx context.Context, header http.Header) {
+	l, ok := ctx.Value(rateLimitKey{}).(*UpstreamRateLimit)
+	if !ok {
+		return
+	}
+	l.RemainingRequests = firstIntHeader(header, rateLimitHeaders.requests)
+	l.RemainingTokens = firstIntHeader(header, rateLimitHeaders.tokens)
+}
+
+func firstIntHeader(header http.Header, names []string) int {
+	for _, name := range names {
+		if n, err := strconv.Atoi(header.Get(name)); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return -1
+}
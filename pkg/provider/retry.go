@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/ratelimit"
+)
+
+var (
+	// maxRetries is how many times a transient upstream failure is retried
+	// before it is returned to the caller (and any fallback), for provider
+	// types without <PROVIDER>_MAX_RETRIES. 0 disables retries.
+	maxRetries = config.Int("PROVIDER_MAX_RETRIES", 2)
+	// retryBaseDelay is the backoff before the first retry; it doubles for
+	// each retry after that, up to retryMaxDelay.
+	retryBaseDelay = config.Duration("PROVIDER_RETRY_BASE_DELAY", 500*time.Millisecond)
+	retryMaxDelay  = 10 * time.Second
+)
+
+// Retryable reports whether an upstream status is transient and worth
+// retrying against the same provider.
+func Retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryTransport retries requests that get a Retryable status, with
+// exponential backoff and full jitter, or the upstream's Retry-After when it
+// sends one. Each retry spends one of the user's upstream attempts.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+}
+
+func newRetryTransport(providerType string, base http.RoundTripper) *retryTransport {
+	return &retryTransport{base: base, maxRetries: providerMaxRetries(providerType)}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || !Retryable(resp.StatusCode) || attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		delay, ok := retryDelay(resp, attempt)
+		if !ok || (req.Body != nil && req.GetBody == nil) {
+			// Retry-After is beyond our patience, or the body can't be resent
+			return resp, nil
+		}
+		if !ratelimit.SpendAttempt(req.Context()) {
+			return resp, nil
+		}
+
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			next.Body = body
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodyBytes))
+		resp.Body.Close()
+
+		logging.Printf(req.Context(), "provider: %s %s returned %d, retrying in %s (retry %d of %d)", req.Method, req.URL.Host, resp.StatusCode, delay, attempt+1, t.maxRetries)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		req = next
+	}
+}
+
+// retryDelay returns how long to wait before retrying after resp. A
+// Retry-After header is honored when it is within retryMaxDelay; ok is false
+// when it asks for longer.
+func retryDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		var d time.Duration
+		if secs, err := strconv.Atoi(ra); err == nil {
+			d = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(ra); err == nil {
+			d = time.Until(at)
+		}
+		if d > retryMaxDelay {
+			return 0, false
+		}
+		if d > 0 {
+			return d, true
+		}
+	}
+
+	backoff := retryBaseDelay << attempt
+	if backoff <= 0 || backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+	return rand.N(backoff) + 1, true //nolint:gosec // jitter doesn't need a CSPRNG
+}
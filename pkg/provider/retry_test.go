@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	origDelay, origRetries := retryBaseDelay, maxRetries
+	retryBaseDelay, maxRetries = time.Millisecond, 2
+	defer func() { retryBaseDelay, maxRetries = origDelay, origRetries }()
+
+	tests := []struct {
+		name       string
+		statuses   []int
+		retryAfter string
+		wantStatus int
+		wantHits   int
+	}{
+		{"recovers after transient errors", []int{503, 429, 200}, "", 200, 3},
+		{"gives up after max retries", []int{502, 502, 502, 200}, "", 502, 3},
+		{"fails fast on client errors", []int{401, 200}, "", 401, 1},
+		{"honors a short Retry-After", []int{429, 200}, "0", 200, 2},
+		{"returns a long Retry-After at once", []int{429, 200}, "120", 429, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != `{"model":"gpt-4o"}` {
+					t.Errorf("attempt %d got body %q", hits+1, body)
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.statuses[hits])
+				hits++
+			}))
+			defer srv.Close()
+
+			req, _ := http.NewRequest("POST", srv.URL, bytes.NewBufferString(`{"model":"gpt-4o"}`))
+			resp, err := NewHTTPClient("openai").Do(req)
+			if err != nil {
+				t.Fatalf("request error: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus || hits != tt.wantHits {
+				t.Errorf("Expected status %d after %d hits, got %d after %d", tt.wantStatus, tt.wantHits, resp.StatusCode, hits)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"tokentracer-proxy/pkg/types"
+)
+
+// readEvents reads server-sent events from r, calling fn with the raw bytes
+// of each event (including its terminating blank line) and its data payload,
+// the data lines joined by newlines. Events are passed on exactly as received,
+// so multi-line events and multi-byte characters are never split.
+func readEvents(r io.Reader, fn func(raw, data []byte) error) error {
+	br := bufio.NewReader(r)
+	var raw, data []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			raw = append(raw, line...)
+			trimmed := bytes.TrimRight(line, "\r\n")
+			if len(trimmed) == 0 {
+				if len(bytes.TrimSpace(raw)) > 0 {
+					if ferr := fn(raw, data); ferr != nil {
+						return ferr
+					}
+				}
+				raw, data = nil, nil
+			} else if payload, ok := bytes.CutPrefix(trimmed, []byte("data:")); ok {
+				if data != nil {
+					data = append(data, '\n')
+				}
+				data = append(data, bytes.TrimPrefix(payload, []byte(" "))...)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			// A final event without its blank line is still delivered
+			if len(bytes.TrimSpace(raw)) > 0 {
+				return fn(raw, data)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// errStreamDone stops readEvents at the [DONE] sentinel.
+var errStreamDone = errors.New("stream done")
+
+// streamOpenAICompatible relays an OpenAI-format chat completion stream. When
+// hideUsage is set, the proxy asked for the usage chunk itself and it is read
+// but not passed on to the client.
+func streamOpenAICompatible(resp *http.Response, hideUsage bool, emit func([]byte) error) (types.OpenAIUsage, error) {
+	if resp.StatusCode != http.StatusOK {
+		return types.OpenAIUsage{}, newProviderError(resp)
+	}
+
+	var usage types.OpenAIUsage
+	err := readEvents(resp.Body, func(raw, data []byte) error {
+		if string(data) == "[DONE]" {
+			return errStreamDone
+		}
+		var chunk struct {
+			Choices []json.RawMessage  `json:"choices"`
+			Usage   *types.OpenAIUsage `json:"usage"`
+		}
+		if json.Unmarshal(data, &chunk) == nil && chunk.Usage != nil {
+			usage = *chunk.Usage
+			if hideUsage && len(chunk.Choices) == 0 {
+				return nil
+			}
+		}
+		return emit(raw)
+	})
+	if err != nil && !errors.Is(err, errStreamDone) {
+		return usage, fmt.Errorf("upstream stream failed: %w", err)
+	}
+	return usage, nil
+}
+
+// withStreamUsage returns a copy of req that asks the upstream to report usage
+// at the end of the stream, and whether the client didn't ask for it.
+func withStreamUsage(req types.OpenAIRequest) (types.OpenAIRequest, bool) {
+	hide := req.StreamOptions == nil || !req.StreamOptions.IncludeUsage
+	req.Stream = true
+	req.StreamOptions = &types.OpenAIStreamOptions{IncludeUsage: true}
+	return req, hide
+}
+
+// sseEvent frames v as a server-sent event.
+func sseEvent(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte("data: "), data...), '\n', '\n'), nil
+}
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/types"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestStreamOpenAICompatible(t *testing.T) {
+	upstream := "data: {\"id\":\"c1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+		": keep-alive\n\n" +
+		"data: {\"id\":\"c1\",\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":1,\"total_tokens\":4}}\n\n" +
+		"data: [DONE]\n\n"
+
+	run := func(hideUsage bool) (string, int) {
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(upstream))}
+		var out strings.Builder
+		usage, err := streamOpenAICompatible(resp, hideUsage, func(event []byte) error {
+			out.Write(event)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("streamOpenAICompatible() error = %v", err)
+		}
+		return out.String(), usage.TotalTokens
+	}
+
+	got, total := run(false)
+	if total != 4 {
+		t.Errorf("Expected total_tokens 4, got %d", total)
+	}
+	if want := strings.TrimSuffix(upstream, "data: [DONE]\n\n"); got != want {
+		t.Errorf("Expected events relayed unchanged without [DONE]\ngot:  %q\nwant: %q", got, want)
+	}
+
+	got, total = run(true)
+	if total != 4 {
+		t.Errorf("Expected total_tokens 4 with hidden usage, got %d", total)
+	}
+	if strings.Contains(got, "usage") {
+		t.Errorf("Expected the usage chunk to be hidden, got %q", got)
+	}
+}
+
+func TestStreamOpenAICompatible_UpstreamError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Body: io.NopCloser(strings.NewReader(`{"error":{"message":"slow down"}}`))}
+	_, err := streamOpenAICompatible(resp, false, func([]byte) error {
+		t.Error("emit should not be called for an error response")
+		return nil
+	})
+	perr, ok := err.(*ProviderError)
+	if !ok || perr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 ProviderError, got %v", err)
+	}
+}
+
+// toolCallStream is a recorded OpenAI tool-call stream. The arguments arrive as
+// partial JSON fragments, some with multi-byte characters, and one event
+// carries its data over two lines.
+var toolCallStream = []string{
+	"data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":null,\"tool_calls\":[{\"index\":0,\"id\":\"call_abc\",\"type\":\"function\",\"function\":{\"name\":\"get_weather\",\"arguments\":\"\"}}]},\"finish_reason\":null}]}\n\n",
+	"data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"ci\"}}]},\"finish_reason\":null}]}\n\n",
+	"data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"ty\\\": \\\"Zürich \"}}]},\"finish_reason\":null}]}\n\n",
+	"data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\n" +
+		"data: \"function\":{\"arguments\":\"東京\\\"}\"}}]},\"finish_reason\":null}]}\n\n",
+	"data: {\"id\":\"chatcmpl-9\",\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n",
+}
+
+func TestStreamOpenAICompatible_ToolCallsByteForByte(t *testing.T) {
+	upstream := strings.Join(toolCallStream, "") + "data: [DONE]\n\n"
+	// Deliver the body one byte at a time so every event and every multi-byte
+	// character straddles reads.
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(iotest.OneByteReader(strings.NewReader(upstream)))}
+
+	var frames []string
+	_, err := streamOpenAICompatible(resp, true, func(event []byte) error {
+		frames = append(frames, string(event))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamOpenAICompatible() error = %v", err)
+	}
+	if !reflect.DeepEqual(frames, toolCallStream) {
+		t.Errorf("Expected frames relayed identically\ngot:  %q\nwant: %q", frames, toolCallStream)
+	}
+}
+
+func TestAnthropicProvider_SendStream(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+	encrypted, err := crypto.Encrypt("sk-ant-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotStream bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		gotStream = body.Stream
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range []string{
+			`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-3","content":[],"usage":{"input_tokens":12,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" World"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+			`{"type":"message_stop"}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", ev)
+		}
+	}))
+	defer upstream.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", upstream.URL)
+
+	mockDB, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").
+		WithArgs(1, 7).
+		WillReturnRows(mockDB.NewRows([]string{"provider", "encrypted_key"}).AddRow("anthropic", encrypted))
+
+	var text strings.Builder
+	usage, err := NewAnthropicProvider(db.NewPostgresRepository(mockDB), 1, 7).SendStream(context.Background(), types.OpenAIRequest{
+		Model:    "claude-3",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "Hi"}},
+	}, func(event []byte) error {
+		var chunk types.OpenAIStreamChunk
+		data := strings.TrimSpace(strings.TrimPrefix(string(event), "data: "))
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Expected an OpenAI chunk event, got %q: %v", event, err)
+		}
+		for _, c := range chunk.Choices {
+			text.WriteString(c.Delta.Content)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("SendStream: %v", err)
+	}
+	if !gotStream {
+		t.Error("Expected the upstream request to ask for a stream")
+	}
+	if text.String() != "Hello World" {
+		t.Errorf("Expected the text deltas in order, got %q", text.String())
+	}
+	if usage.PromptTokens != 12 || usage.CompletionTokens != 5 {
+		t.Errorf("Expected usage 12/5, got %+v", usage)
+	}
+}
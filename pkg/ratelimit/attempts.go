@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream attempts (first tries, fallbacks and retries) are budgeted per user
+// per minute, separately from the request limit, so one client's aggressive
+// retries can't multiply load on a failing provider.
+var defaultAttemptLimit = getEnvInt("RATE_LIMIT_ATTEMPTS_MINUTE", 0)
+
+type attemptBudgetKey struct{}
+
+type attemptBudget struct {
+	userID int
+	limit  int
+}
+
+var (
+	attemptBuckets  = make(map[string]int)
+	attemptBucketMu sync.Mutex
+)
+
+// withAttemptBudget records the request's first upstream attempt and attaches
+// the user's attempt budget to ctx. A limit of 0 means unlimited.
+func withAttemptBudget(ctx context.Context, userID, limit int) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	b := &attemptBudget{userID: userID, limit: limit}
+	b.spend(true)
+	return context.WithValue(ctx, attemptBudgetKey{}, b)
+}
+
+// SpendAttempt takes one upstream attempt from the request's budget, reporting
+// false when the user has used their attempts for this minute. Requests
+// without a budget are unlimited.
+func SpendAttempt(ctx context.Context) bool {
+	b, ok := ctx.Value(attemptBudgetKey{}).(*attemptBudget)
+	if !ok {
+		return true
+	}
+	return b.spend(false)
+}
+
+// spend counts an attempt if it is within the limit, or unconditionally when
+// force is set.
+func (b *attemptBudget) spend(force bool) bool {
+	minute := time.Now().Format("2006-01-02 15:04")
+	key := fmt.Sprintf("%d:%s", b.userID, minute)
+
+	attemptBucketMu.Lock()
+	defer attemptBucketMu.Unlock()
+
+	count := attemptBuckets[key]
+	if count >= b.limit && !force {
+		return false
+	}
+	attemptBuckets[key] = count + 1
+
+	// Prune entries from previous minutes
+	if len(attemptBuckets) > 10000 {
+		for k := range attemptBuckets {
+			if !strings.HasSuffix(k, ":"+minute) {
+				delete(attemptBuckets, k)
+			}
+		}
+	}
+	return count < b.limit
+}
@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAttemptBudget(t *testing.T) {
+	// The first attempt is recorded when the budget is attached
+	ctx := withAttemptBudget(context.Background(), 9001, 3)
+
+	if !SpendAttempt(ctx) || !SpendAttempt(ctx) {
+		t.Fatal("expected attempts within the budget to be allowed")
+	}
+	if SpendAttempt(ctx) {
+		t.Error("expected the fourth attempt to exceed a budget of 3")
+	}
+
+	// A second request in the same minute shares the user's budget
+	ctx2 := withAttemptBudget(context.Background(), 9001, 3)
+	if SpendAttempt(ctx2) {
+		t.Error("expected the budget to be shared across requests")
+	}
+}
+
+func TestAttemptBudget_Unlimited(t *testing.T) {
+	ctx := withAttemptBudget(context.Background(), 9002, 0)
+	for i := 0; i < 100; i++ {
+		if !SpendAttempt(ctx) {
+			t.Fatal("expected no budget to mean unlimited attempts")
+		}
+	}
+	if !SpendAttempt(context.Background()) {
+		t.Error("expected requests without a budget to be unlimited")
+	}
+}
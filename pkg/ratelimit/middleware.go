@@ -3,7 +3,7 @@ package ratelimit
 import (
 	"context"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
@@ -12,6 +12,7 @@ import (
 	"time"
 	"tokentracer-proxy/pkg/auth"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
 )
 
 var (
@@ -37,42 +38,103 @@ func getEnvInt(key string, fallback int) int {
 }
 
 type userLimits struct {
-	minute    int
-	daily     int
-	fetchedAt time.Time
+	minute   int
+	daily    int
+	attempts int
+	tokens   int
+	// Set while a lowered limit is in its grace period; the previous limits
+	// stay enforced until graceUntil.
+	prevMinute *int
+	prevDaily  *int
+	graceUntil *time.Time
+	fetchedAt  time.Time
 }
 
 var (
-	limitsCache   = make(map[int]userLimits)
-	limitsCacheMu sync.RWMutex
+	limitsCache    = make(map[int]userLimits)
+	limitsCacheMu  sync.RWMutex
 	limitsCacheTTL = 1 * time.Minute
 )
 
-func getUserLimits(userID int) (minuteLimit, dailyLimit int) {
+// effectiveLimits are the limits enforced for a request. During a grace period
+// pendingMinute/pendingDaily hold the lowered limits that apply from pendingAt.
+type effectiveLimits struct {
+	minute        int
+	daily         int
+	attempts      int
+	tokens        int
+	pendingMinute int
+	pendingDaily  int
+	pendingAt     time.Time
+}
+
+func getUserLimits(userID int) effectiveLimits {
 	limitsCacheMu.RLock()
 	cached, ok := limitsCache[userID]
 	limitsCacheMu.RUnlock()
 
 	if ok && time.Since(cached.fetchedAt) < limitsCacheTTL {
-		return resolveLimit(cached.minute, defaultMinuteLimit), resolveLimit(cached.daily, defaultDailyLimit)
+		return cached.effective(time.Now())
 	}
 
 	// Fetch from DB
-	// TODO: cache
-	var dbMinute, dbDaily int
+	var dbLimits userLimits
 	err := db.Pool.QueryRow(context.Background(),
-		"SELECT rate_limit_minute, rate_limit_daily FROM users WHERE id = $1", userID).
-		Scan(&dbMinute, &dbDaily)
+		"SELECT rate_limit_minute, rate_limit_daily, rate_limit_attempts_minute, rate_limit_tokens_daily, previous_rate_limit_minute, previous_rate_limit_daily, rate_limit_grace_until FROM users WHERE id = $1", userID).
+		Scan(&dbLimits.minute, &dbLimits.daily, &dbLimits.attempts, &dbLimits.tokens, &dbLimits.prevMinute, &dbLimits.prevDaily, &dbLimits.graceUntil)
 	if err != nil {
 		// On error, use server defaults
-		return defaultMinuteLimit, defaultDailyLimit
+		return effectiveLimits{minute: defaultMinuteLimit, daily: defaultDailyLimit, attempts: defaultAttemptLimit, tokens: defaultDailyTokenLimit}
 	}
+	dbLimits.fetchedAt = time.Now()
 
 	limitsCacheMu.Lock()
-	limitsCache[userID] = userLimits{minute: dbMinute, daily: dbDaily, fetchedAt: time.Now()}
+	limitsCache[userID] = dbLimits
 	limitsCacheMu.Unlock()
 
-	return resolveLimit(dbMinute, defaultMinuteLimit), resolveLimit(dbDaily, defaultDailyLimit)
+	return dbLimits.effective(time.Now())
+}
+
+// effective resolves the limits to enforce at now. While a grace period is
+// running, the looser of the previous and new limits is enforced and any
+// stricter new limit is reported as pending.
+func (l userLimits) effective(now time.Time) effectiveLimits {
+	minute := resolveLimit(l.minute, defaultMinuteLimit)
+	daily := resolveLimit(l.daily, defaultDailyLimit)
+	attempts := resolveLimit(l.attempts, defaultAttemptLimit)
+	tokens := resolveLimit(l.tokens, defaultDailyTokenLimit)
+	if l.graceUntil == nil || !now.Before(*l.graceUntil) {
+		return effectiveLimits{minute: minute, daily: daily, attempts: attempts, tokens: tokens}
+	}
+
+	eff := effectiveLimits{minute: minute, daily: daily, attempts: attempts, tokens: tokens, pendingAt: *l.graceUntil}
+	if l.prevMinute != nil {
+		if prev := resolveLimit(*l.prevMinute, defaultMinuteLimit); looserLimit(prev, minute) != minute {
+			eff.minute, eff.pendingMinute = prev, minute
+		}
+	}
+	if l.prevDaily != nil {
+		if prev := resolveLimit(*l.prevDaily, defaultDailyLimit); looserLimit(prev, daily) != daily {
+			eff.daily, eff.pendingDaily = prev, daily
+		}
+	}
+	return eff
+}
+
+// looserLimit returns the more permissive of two resolved limits (0 = unlimited).
+func looserLimit(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// InvalidateUserLimits drops the cached limits for a user so a change made
+// through the admin API is picked up on the next request.
+func InvalidateUserLimits(userID int) {
+	limitsCacheMu.Lock()
+	delete(limitsCache, userID)
+	limitsCacheMu.Unlock()
 }
 
 // resolveLimit returns the effective limit. If the user value is 0, fall back to
@@ -88,43 +150,100 @@ func RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := r.Context().Value(auth.KeyUser).(int)
 		if !ok {
-			log.Printf("rate limit middleware: missing user context")
+			logging.Printf(r.Context(), "rate limit middleware: missing user context")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		minuteLimit, dailyLimit := getUserLimits(userID)
+		limits := getUserLimits(userID)
+		minuteLimit, dailyLimit := limits.minute, limits.daily
+
+		// Announce lowered limits that are still in their grace period
+		if limits.pendingMinute > 0 || limits.pendingDaily > 0 {
+			if limits.pendingMinute > 0 {
+				w.Header().Set("X-RateLimit-Pending-Limit-Minute", strconv.Itoa(limits.pendingMinute))
+			}
+			if limits.pendingDaily > 0 {
+				w.Header().Set("X-RateLimit-Pending-Limit-Daily", strconv.Itoa(limits.pendingDaily))
+			}
+			w.Header().Set("X-RateLimit-Pending-Effective-At", limits.pendingAt.UTC().Format(time.RFC3339))
+		}
+
+		// The headers describe whichever window has the fewest requests left
+		var reported *window
+		now := time.Now()
 
 		// 1. Check Daily Limit (0 = unlimited)
 		if dailyLimit > 0 {
 			dailyCount, err := getDailyCount(userID)
 			if err != nil {
-				log.Printf("rate limit middleware: daily count error for user %d: %v", userID, err)
+				logging.Printf(r.Context(), "rate limit middleware: daily count error for user %d: %v", userID, err)
 				http.Error(w, "Rate limit check failed", http.StatusInternalServerError)
 				return
 			}
+			day := &window{limit: dailyLimit, remaining: max(dailyLimit-dailyCount-1, 0), reset: nextDay(now)}
 			if dailyCount >= dailyLimit {
+				day.setHeaders(w.Header(), now, true)
 				http.Error(w, "Daily rate limit exceeded.", http.StatusTooManyRequests)
 				return
 			}
+			reported = day
 		}
 
 		// 2. Per-Minute Limit (0 = unlimited)
 		if minuteLimit > 0 {
-			if isMinuteLimitExceeded(userID, minuteLimit) {
+			count, exceeded := countMinuteRequest(r.Context(), userID, minuteLimit)
+			minute := &window{limit: minuteLimit, remaining: max(minuteLimit-count, 0), reset: now.Truncate(time.Minute).Add(time.Minute)}
+			if exceeded {
+				minute.setHeaders(w.Header(), now, true)
 				http.Error(w, "Per-minute rate limit exceeded.", http.StatusTooManyRequests)
 				return
 			}
+			if reported == nil || minute.remaining < reported.remaining {
+				reported = minute
+			}
+		}
+		if reported != nil {
+			reported.setHeaders(w.Header(), now, false)
 		}
 
-		next.ServeHTTP(w, r)
+		// The daily token budget needs the request body, so it is checked by
+		// the handler with CheckTokenBudget
+		ctx := withAttemptBudget(r.Context(), userID, limits.attempts)
+		ctx = withTokenBudget(ctx, userID, limits.tokens)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// window is one rate limit window as reported to the client.
+type window struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// setHeaders sets X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (Unix seconds), plus Retry-After on a rejected request.
+func (win *window) setHeaders(h http.Header, now time.Time, rejected bool) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(win.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(win.remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(win.reset.Unix(), 10))
+	if rejected {
+		retryAfter := int(math.Ceil(win.reset.Sub(now).Seconds()))
+		h.Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	}
+}
+
+// nextDay returns the next midnight, when the daily count starts over.
+func nextDay(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
 func getDailyCount(userID int) (int, error) {
 	var count int
 	err := db.Pool.QueryRow(context.Background(),
-		"SELECT count(*) FROM request_logs WHERE user_id = $1 AND created_at >= CURRENT_DATE",
+		"SELECT count(*) FROM request_logs WHERE user_id = $1 AND created_at >= CURRENT_DATE AND status_code < 400",
 		userID).Scan(&count)
 	return count, err
 }
@@ -134,8 +253,20 @@ var (
 	bucketMu      sync.Mutex
 )
 
-func isMinuteLimitExceeded(userID int, limit int) bool {
+// countMinuteRequest counts a request against the user's per-minute limit. It
+// returns the requests counted this minute, including this one unless the
+// limit was already reached, and whether it was.
+func countMinuteRequest(ctx context.Context, userID int, limit int) (int, bool) {
 	minute := time.Now().Format("2006-01-02 15:04")
+
+	if redisClient != nil {
+		count, err := redisCountMinuteRequest(userID, minute)
+		if err == nil {
+			return min(count, limit), count > limit
+		}
+		logging.Printf(ctx, "rate limit middleware: redis error for user %d, using in-memory minute bucket: %v", userID, err)
+	}
+
 	key := fmt.Sprintf("%d:%s", userID, minute)
 
 	bucketMu.Lock()
@@ -143,7 +274,7 @@ func isMinuteLimitExceeded(userID int, limit int) bool {
 
 	count := minuteBuckets[key]
 	if count >= limit {
-		return true
+		return count, true
 	}
 
 	minuteBuckets[key] = count + 1
@@ -159,5 +290,5 @@ func isMinuteLimitExceeded(userID int, limit int) bool {
 		}
 	}
 
-	return false
+	return count + 1, false
 }
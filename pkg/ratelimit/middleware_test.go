@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Pool
+	db.Pool = mock
+	defer func() { db.Pool = orig }()
+
+	userID := 9301
+	defer InvalidateUserLimits(userID)
+	mock.ExpectQuery("SELECT rate_limit_minute, rate_limit_daily").
+		WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"rate_limit_minute", "rate_limit_daily", "rate_limit_attempts_minute", "rate_limit_tokens_daily", "previous_rate_limit_minute", "previous_rate_limit_daily", "rate_limit_grace_until"}).
+			AddRow(2, 100, 0, 0, nil, nil, nil))
+
+	h := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func() *httptest.ResponseRecorder {
+		mock.ExpectQuery("SELECT count\\(\\*\\) FROM request_logs").
+			WithArgs(userID).
+			WillReturnRows(mock.NewRows([]string{"count"}).AddRow(10))
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// The minute window has fewer requests left than the day, so it is reported
+	w := do()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("Expected limit 2 with 1 remaining, got %q and %q", w.Header().Get("X-RateLimit-Limit"), w.Header().Get("X-RateLimit-Remaining"))
+	}
+	reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || reset <= time.Now().Unix()-1 || reset > time.Now().Add(time.Minute).Unix() {
+		t.Errorf("Expected the reset at the next minute, got %q", w.Header().Get("X-RateLimit-Reset"))
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Error("Expected no Retry-After on an allowed request")
+	}
+
+	do()
+	w = do()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Expected 0 remaining, got %q", w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 60 {
+		t.Errorf("Expected Retry-After within the minute, got %q", w.Header().Get("Retry-After"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserLimitsEffective(t *testing.T) {
+	defer func(m, d int) { defaultMinuteLimit, defaultDailyLimit = m, d }(defaultMinuteLimit, defaultDailyLimit)
+	defaultMinuteLimit, defaultDailyLimit = 0, 0
+
+	now := time.Now()
+	grace := now.Add(time.Hour)
+	expired := now.Add(-time.Hour)
+	ptr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name   string
+		limits userLimits
+		want   effectiveLimits
+	}{
+		{
+			name:   "no grace period",
+			limits: userLimits{minute: 10, daily: 100},
+			want:   effectiveLimits{minute: 10, daily: 100},
+		},
+		{
+			// The previous, looser limits apply until the grace period ends
+			name:   "tighten",
+			limits: userLimits{minute: 5, daily: 50, prevMinute: ptr(10), prevDaily: ptr(100), graceUntil: &grace},
+			want:   effectiveLimits{minute: 10, daily: 100, pendingMinute: 5, pendingDaily: 50, pendingAt: grace},
+		},
+		{
+			name:   "tighten from unlimited",
+			limits: userLimits{minute: 5, daily: 50, prevMinute: ptr(0), prevDaily: ptr(0), graceUntil: &grace},
+			want:   effectiveLimits{minute: 0, daily: 0, pendingMinute: 5, pendingDaily: 50, pendingAt: grace},
+		},
+		{
+			name:   "loosen",
+			limits: userLimits{minute: 20, daily: 200, prevMinute: ptr(10), prevDaily: ptr(100), graceUntil: &grace},
+			want:   effectiveLimits{minute: 20, daily: 200, pendingAt: grace},
+		},
+		{
+			name:   "loosen one, tighten the other",
+			limits: userLimits{minute: 20, daily: 50, prevMinute: ptr(10), prevDaily: ptr(100), graceUntil: &grace},
+			want:   effectiveLimits{minute: 20, daily: 100, pendingDaily: 50, pendingAt: grace},
+		},
+		{
+			// Set to 5 then 2 within the grace period: the limits from before
+			// the first change are still the previous ones
+			name:   "re-set within grace",
+			limits: userLimits{minute: 2, daily: 20, prevMinute: ptr(10), prevDaily: ptr(100), graceUntil: &grace},
+			want:   effectiveLimits{minute: 10, daily: 100, pendingMinute: 2, pendingDaily: 20, pendingAt: grace},
+		},
+		{
+			name:   "grace expired",
+			limits: userLimits{minute: 5, daily: 50, prevMinute: ptr(10), prevDaily: ptr(100), graceUntil: &expired},
+			want:   effectiveLimits{minute: 5, daily: 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.effective(now); got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// defaultMonthlyTokenQuota applies to users whose monthly_token_quota is 0.
+// A final value of 0 means unlimited.
+var defaultMonthlyTokenQuota = int64(getEnvInt("MONTHLY_TOKEN_QUOTA", 0))
+
+type quotaUsage struct {
+	quota     int64
+	used      int64
+	fetchedAt time.Time
+}
+
+var (
+	quotaCache    = make(map[int]quotaUsage)
+	quotaCacheMu  sync.RWMutex
+	quotaCacheTTL = 30 * time.Second
+)
+
+// getQuotaUsage returns the user's effective monthly token quota and the
+// tokens used so far this calendar month (UTC), cached briefly so the sum over
+// request_logs isn't run on every request.
+func getQuotaUsage(userID int) (quota, used int64, err error) {
+	quotaCacheMu.RLock()
+	cached, ok := quotaCache[userID]
+	quotaCacheMu.RUnlock()
+
+	if ok && time.Since(cached.fetchedAt) < quotaCacheTTL {
+		return cached.quota, cached.used, nil
+	}
+
+	err = db.Pool.QueryRow(context.Background(),
+		`SELECT COALESCE(u.monthly_token_quota, 0),
+		        (SELECT COALESCE(SUM(input_tokens + output_tokens), 0) FROM request_logs
+		          WHERE user_id = u.id AND created_at >= date_trunc('month', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC')
+		 FROM users u WHERE u.id = $1`, userID).
+		Scan(&quota, &used)
+	if err != nil {
+		return 0, 0, err
+	}
+	if quota == 0 {
+		quota = defaultMonthlyTokenQuota
+	}
+
+	quotaCacheMu.Lock()
+	quotaCache[userID] = quotaUsage{quota: quota, used: used, fetchedAt: time.Now()}
+	quotaCacheMu.Unlock()
+
+	return quota, used, nil
+}
+
+// TokenQuotaMiddleware rejects requests once the user has used their monthly
+// token quota, and reports what remains in X-Quota-Remaining-Tokens.
+func TokenQuotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(auth.KeyUser).(int)
+		if !ok {
+			logging.Printf(r.Context(), "token quota middleware: missing user context")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		quota, used, err := getQuotaUsage(userID)
+		if err != nil {
+			logging.Printf(r.Context(), "token quota middleware: quota lookup error for user %d: %v", userID, err)
+			http.Error(w, "Quota check failed", http.StatusInternalServerError)
+			return
+		}
+		if quota <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		remaining := max(quota-used, 0)
+		w.Header().Set("X-Quota-Limit-Tokens", strconv.FormatInt(quota, 10))
+		w.Header().Set("X-Quota-Remaining-Tokens", strconv.FormatInt(remaining, 10))
+		if remaining == 0 {
+			http.Error(w, "Monthly token quota exceeded.", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
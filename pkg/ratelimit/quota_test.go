@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestTokenQuotaMiddleware(t *testing.T) {
+	defer func(q int64) { defaultMonthlyTokenQuota = q }(defaultMonthlyTokenQuota)
+	defaultMonthlyTokenQuota = 5000
+
+	tests := []struct {
+		name          string
+		quota, used   int64
+		err           error
+		wantCode      int
+		wantLimit     string
+		wantRemaining string
+	}{
+		{name: "under quota", quota: 1000, used: 400, wantCode: http.StatusOK, wantLimit: "1000", wantRemaining: "600"},
+		{name: "exhausted", quota: 1000, used: 1000, wantCode: http.StatusTooManyRequests, wantLimit: "1000", wantRemaining: "0"},
+		// Tokens from the request that crossed the quota can take usage past it
+		{name: "overshot", quota: 1000, used: 1200, wantCode: http.StatusTooManyRequests, wantLimit: "1000", wantRemaining: "0"},
+		{name: "server default", used: 100, wantCode: http.StatusOK, wantLimit: "5000", wantRemaining: "4900"},
+		{name: "lookup error", err: errors.New("connection refused"), wantCode: http.StatusInternalServerError},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			orig := db.Pool
+			db.Pool = mock
+			defer func() { db.Pool = orig }()
+
+			userID := 9401 + i
+			defer func() {
+				quotaCacheMu.Lock()
+				delete(quotaCache, userID)
+				quotaCacheMu.Unlock()
+			}()
+			q := mock.ExpectQuery("SELECT COALESCE\\(u.monthly_token_quota, 0\\)").WithArgs(userID)
+			if tt.err != nil {
+				q.WillReturnError(tt.err)
+			} else {
+				q.WillReturnRows(mock.NewRows([]string{"quota", "used"}).AddRow(tt.quota, tt.used))
+			}
+
+			called := false
+			h := TokenQuotaMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d", tt.wantCode, w.Code)
+			}
+			if called != (tt.wantCode == http.StatusOK) {
+				t.Errorf("Expected the handler called: %v, got %v", tt.wantCode == http.StatusOK, called)
+			}
+			if got := w.Header().Get("X-Quota-Limit-Tokens"); got != tt.wantLimit {
+				t.Errorf("Expected X-Quota-Limit-Tokens %q, got %q", tt.wantLimit, got)
+			}
+			if got := w.Header().Get("X-Quota-Remaining-Tokens"); got != tt.wantRemaining {
+				t.Errorf("Expected X-Quota-Remaining-Tokens %q, got %q", tt.wantRemaining, got)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestTokenQuotaMiddleware_Unlimited(t *testing.T) {
+	defer func(q int64) { defaultMonthlyTokenQuota = q }(defaultMonthlyTokenQuota)
+	defaultMonthlyTokenQuota = 0
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Pool
+	db.Pool = mock
+	defer func() { db.Pool = orig }()
+
+	userID := 9450
+	defer func() {
+		quotaCacheMu.Lock()
+		delete(quotaCache, userID)
+		quotaCacheMu.Unlock()
+	}()
+	// The usage is cached, so only the first request queries it
+	mock.ExpectQuery("SELECT COALESCE\\(u.monthly_token_quota, 0\\)").WithArgs(userID).
+		WillReturnRows(mock.NewRows([]string{"quota", "used"}).AddRow(int64(0), int64(1<<30)))
+
+	h := TokenQuotaMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for range 2 {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.KeyUser, userID))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200 without a quota, got %d", w.Code)
+		}
+		if w.Header().Get("X-Quota-Limit-Tokens") != "" {
+			t.Error("Expected no quota headers without a quota")
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
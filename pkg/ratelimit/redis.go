@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisClient, when set, holds the per-minute request counts so that every
+// replica enforces the same limit. Without it each process counts on its own.
+var redisClient *redis.Client
+
+// redisTimeout bounds each limiter call, so a slow Redis can't stall requests.
+const redisTimeout = 500 * time.Millisecond
+
+// Init connects to the Redis server at REDIS_URL, if set, for the per-minute
+// limit. With REDIS_URL unset minute buckets stay in memory.
+func Init() error {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return nil
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return fmt.Errorf("connect to redis: %w", err)
+	}
+	redisClient = client
+	return nil
+}
+
+// redisCountMinuteRequest counts the request in Redis under
+// ratelimit:{user}:{minute}, which expires once the minute is over, and
+// returns the requests counted this minute.
+func redisCountMinuteRequest(userID int, minute string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	key := fmt.Sprintf("ratelimit:%d:%s", userID, minute)
+	var incr *redis.IntCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 2*time.Minute)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestInit_Redis(t *testing.T) {
+	t.Setenv("REDIS_URL", "")
+	if err := Init(); err != nil || redisClient != nil {
+		t.Fatalf("expected no Redis without REDIS_URL, got client %v, err %v", redisClient, err)
+	}
+
+	t.Setenv("REDIS_URL", "not-a-url")
+	if err := Init(); err == nil {
+		t.Error("expected an invalid REDIS_URL to fail")
+	}
+}
+
+func TestMinuteLimit_RedisDownFallsBackToMemory(t *testing.T) {
+	// Grab a free port and close it, so nothing is listening there
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	redisClient = redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer func() {
+		redisClient.Close()
+		redisClient = nil
+	}()
+
+	if _, exceeded := countMinuteRequest(context.Background(), 9201, 1); exceeded {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if _, exceeded := countMinuteRequest(context.Background(), 9201, 1); !exceeded {
+		t.Error("expected the in-memory bucket to enforce the limit while Redis is down")
+	}
+}
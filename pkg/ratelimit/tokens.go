@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/db"
+)
+
+// defaultDailyTokenLimit applies to users whose rate_limit_tokens_daily is 0.
+// A final value of 0 means unlimited.
+var defaultDailyTokenLimit = getEnvInt("RATE_LIMIT_TOKENS_DAILY", 0)
+
+type tokenBudgetKey struct{}
+
+type tokenBudget struct {
+	userID int
+	limit  int
+}
+
+// withTokenBudget attaches the user's daily token budget to ctx. A limit of 0
+// means unlimited.
+func withTokenBudget(ctx context.Context, userID, limit int) context.Context {
+	if limit <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tokenBudgetKey{}, &tokenBudget{userID: userID, limit: limit})
+}
+
+// TokenBudgetError reports a request that would take the user past their
+// daily token budget.
+type TokenBudgetError struct {
+	Limit int
+	Used  int
+}
+
+func (e *TokenBudgetError) Error() string {
+	return fmt.Sprintf("daily token limit of %d exceeded (%d used today)", e.Limit, e.Used)
+}
+
+// CheckTokenBudget reports a *TokenBudgetError when the tokens the user has
+// used today plus estimated would exceed their daily token budget. Requests
+// without a budget are unlimited.
+func CheckTokenBudget(ctx context.Context, estimated int) error {
+	b, ok := ctx.Value(tokenBudgetKey{}).(*tokenBudget)
+	if !ok {
+		return nil
+	}
+
+	used, err := getDailyTokens(ctx, b.userID)
+	if err != nil {
+		return fmt.Errorf("daily token count: %w", err)
+	}
+	if used+estimated > b.limit {
+		return &TokenBudgetError{Limit: b.limit, Used: used}
+	}
+	return nil
+}
+
+type dailyTokens struct {
+	used      int
+	day       time.Time // UTC day the sum is for
+	fetchedAt time.Time
+}
+
+var (
+	dailyTokensCache    = make(map[int]dailyTokens)
+	dailyTokensCacheMu  sync.RWMutex
+	dailyTokensCacheTTL = 30 * time.Second
+)
+
+// getDailyTokens returns the tokens the user has used so far today (UTC),
+// cached briefly so the sum over request_logs isn't run on every request.
+func getDailyTokens(ctx context.Context, userID int) (int, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	dailyTokensCacheMu.RLock()
+	cached, ok := dailyTokensCache[userID]
+	dailyTokensCacheMu.RUnlock()
+
+	if ok && cached.day.Equal(today) && time.Since(cached.fetchedAt) < dailyTokensCacheTTL {
+		return cached.used, nil
+	}
+
+	var used int
+	err := db.Pool.QueryRow(ctx,
+		`SELECT COALESCE(SUM(input_tokens + output_tokens), 0) FROM request_logs
+		  WHERE user_id = $1 AND created_at >= $2`,
+		userID, today).Scan(&used)
+	if err != nil {
+		return 0, err
+	}
+
+	dailyTokensCacheMu.Lock()
+	dailyTokensCache[userID] = dailyTokens{used: used, day: today, fetchedAt: time.Now()}
+	dailyTokensCacheMu.Unlock()
+
+	return used, nil
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestCheckTokenBudget(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Pool
+	db.Pool = mock
+	defer func() { db.Pool = orig }()
+
+	ctx := withTokenBudget(context.Background(), 9101, 1000)
+	defer clearDailyTokens(9101)
+
+	// The sum is cached, so only the first check queries it
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(input_tokens \\+ output_tokens\\), 0\\) FROM request_logs").
+		WithArgs(9101, today).
+		WillReturnRows(mock.NewRows([]string{"sum"}).AddRow(900))
+	if err := CheckTokenBudget(ctx, 100); err != nil {
+		t.Errorf("expected a request reaching the budget exactly to pass, got %v", err)
+	}
+
+	err = CheckTokenBudget(ctx, 101)
+	var budgetErr *TokenBudgetError
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != 1000 || budgetErr.Used != 900 {
+		t.Errorf("expected a TokenBudgetError for 1000 with 900 used, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetDailyTokens_Refetch(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Pool
+	db.Pool = mock
+	defer func() { db.Pool = orig }()
+
+	userID := 9103
+	defer clearDailyTokens(userID)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	tests := []struct {
+		name  string
+		stale dailyTokens
+	}{
+		// Yesterday's sum is dropped at midnight UTC, however recently fetched
+		{name: "new day", stale: dailyTokens{used: 5000, day: today.AddDate(0, 0, -1), fetchedAt: time.Now()}},
+		{name: "expired", stale: dailyTokens{used: 5000, day: today, fetchedAt: time.Now().Add(-time.Minute)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dailyTokensCacheMu.Lock()
+			dailyTokensCache[userID] = tt.stale
+			dailyTokensCacheMu.Unlock()
+
+			mock.ExpectQuery("SELECT COALESCE\\(SUM\\(input_tokens \\+ output_tokens\\), 0\\) FROM request_logs").
+				WithArgs(userID, today).
+				WillReturnRows(mock.NewRows([]string{"sum"}).AddRow(40))
+			if used, err := getDailyTokens(context.Background(), userID); err != nil || used != 40 {
+				t.Errorf("Expected the sum refetched as 40, got %d, %v", used, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestGetDailyTokens_ErrorNotCached(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	orig := db.Pool
+	db.Pool = mock
+	defer func() { db.Pool = orig }()
+
+	userID := 9104
+	defer clearDailyTokens(userID)
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(input_tokens \\+ output_tokens\\), 0\\) FROM request_logs").
+		WithArgs(userID, pgxmock.AnyArg()).
+		WillReturnError(errors.New("connection refused"))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(input_tokens \\+ output_tokens\\), 0\\) FROM request_logs").
+		WithArgs(userID, pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"sum"}).AddRow(10))
+
+	if _, err := getDailyTokens(context.Background(), userID); err == nil {
+		t.Error("Expected the lookup error")
+	}
+	if used, err := getDailyTokens(context.Background(), userID); err != nil || used != 10 {
+		t.Errorf("Expected the sum once the lookup recovers, got %d, %v", used, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func clearDailyTokens(userID int) {
+	dailyTokensCacheMu.Lock()
+	delete(dailyTokensCache, userID)
+	dailyTokensCacheMu.Unlock()
+}
+
+func TestCheckTokenBudget_Unlimited(t *testing.T) {
+	// No budget means no query at all
+	if err := CheckTokenBudget(withTokenBudget(context.Background(), 9102, 0), 1<<20); err != nil {
+		t.Errorf("expected no budget to mean unlimited tokens, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// healthTimeout bounds the DB ping, so a hung database fails the check
+// rather than hanging it.
+const healthTimeout = 2 * time.Second
+
+// pingDB pings the database within healthTimeout.
+func pingDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	return db.Repo.Ping(ctx)
+}
+
+// HealthHandler answers 200 OK while the database responds to a ping, and
+// 503 with {"db":"down"} when it doesn't, so orchestrators restart the pod.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := pingDB(r.Context()); err != nil {
+		logging.Printf(r.Context(), "health check: db ping error: %v", err)
+		writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"db": "down"}, "health check")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("OK")); err != nil {
+		logging.Printf(r.Context(), "health check: write response error: %v", err)
+	}
+}
+
+// LivezHandler answers 200 whenever the process can serve requests at all.
+// It checks no dependencies, so a database outage doesn't restart the pod.
+func LivezHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("OK")); err != nil {
+		logging.Printf(r.Context(), "liveness check: write response error: %v", err)
+	}
+}
+
+// Readiness is the /readyz body: "ok" or the failure for each dependency.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// ReadyzHandler answers 200 when the database answers a ping and the auth
+// and crypto keys are set up, and 503 otherwise, with the result of each
+// check in the body.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := Readiness{Ready: true, Checks: map[string]string{"db": "ok", "auth": "ok", "crypto": "ok"}}
+	if err := pingDB(r.Context()); err != nil {
+		logging.Printf(r.Context(), "readiness check: db ping error: %v", err)
+		resp.Ready, resp.Checks["db"] = false, "down"
+	}
+	if !auth.Initialized() {
+		resp.Ready, resp.Checks["auth"] = false, "not initialized"
+	}
+	if !crypto.Initialized() {
+		resp.Ready, resp.Checks["crypto"] = false, "not initialized"
+	}
+
+	code := http.StatusOK
+	if !resp.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, code, resp, "readiness check")
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, body any, handler string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logging.Printf(r.Context(), "%s: encode response error: %v", handler, err)
+	}
+}
@@ -0,0 +1,85 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tokentracer-proxy/pkg/auth"
+	"tokentracer-proxy/pkg/crypto"
+	"tokentracer-proxy/pkg/db"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		pingErr  error
+		wantCode int
+		wantBody string
+	}{
+		{name: "db up", wantCode: http.StatusOK, wantBody: "OK"},
+		{name: "db down", pingErr: errors.New("connection refused"), wantCode: http.StatusServiceUnavailable, wantBody: `{"db":"down"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			db.Repo = db.NewPostgresRepository(mock)
+
+			ping := mock.ExpectQuery("SELECT 1")
+			if tt.pingErr != nil {
+				ping.WillReturnError(tt.pingErr)
+			} else {
+				ping.WillReturnRows(mock.NewRows([]string{"?column?"}).AddRow(1))
+			}
+
+			w := httptest.NewRecorder()
+			HealthHandler(w, httptest.NewRequest("GET", "/health", nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantBody {
+				t.Errorf("Expected body %s, got %s", tt.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	db.Repo = db.NewPostgresRepository(mock)
+	t.Setenv("ENCRYPTION_KEY", "test-key")
+	crypto.Init()
+
+	mock.ExpectQuery("SELECT 1").WillReturnError(errors.New("connection refused"))
+
+	w := httptest.NewRecorder()
+	ReadyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 with the db down, got %d", w.Code)
+	}
+	var got Readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Ready || got.Checks["db"] != "down" || got.Checks["crypto"] != "ok" {
+		t.Errorf("Expected the db check to fail and crypto to pass, got %+v", got)
+	}
+	if wantAuth := auth.Initialized(); (got.Checks["auth"] == "ok") != wantAuth {
+		t.Errorf("Expected the auth check to match auth.Initialized() = %v, got %q", wantAuth, got.Checks["auth"])
+	}
+}
@@ -0,0 +1,63 @@
+// Package status tracks process-wide operational counters and serves them as
+// a JSON snapshot on /status.
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"tokentracer-proxy/pkg/logging"
+	"tokentracer-proxy/pkg/version"
+)
+
+var (
+	startedAt     = time.Now()
+	activeStreams atomic.Int64
+	lastModelPoll atomic.Int64 // unix nanoseconds, 0 if never
+)
+
+// StreamStarted marks a streaming response as in flight. Call StreamEnded
+// when it finishes.
+func StreamStarted() { activeStreams.Add(1) }
+
+// StreamEnded marks a streaming response as finished.
+func StreamEnded() { activeStreams.Add(-1) }
+
+// RecordModelPoll records a successful run of the model poller.
+func RecordModelPoll(t time.Time) { lastModelPoll.Store(t.UnixNano()) }
+
+type Snapshot struct {
+	Version       string     `json:"version"`
+	StartedAt     time.Time  `json:"started_at"`
+	UptimeSeconds int64      `json:"uptime_seconds"`
+	ActiveStreams int64      `json:"active_streams"`
+	Goroutines    int        `json:"goroutines"`
+	LastModelPoll *time.Time `json:"last_model_poll"`
+}
+
+// Current returns the current snapshot.
+func Current() Snapshot {
+	s := Snapshot{
+		Version:       version.Version,
+		StartedAt:     startedAt.UTC(),
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		ActiveStreams: activeStreams.Load(),
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	if ns := lastModelPoll.Load(); ns != 0 {
+		t := time.Unix(0, ns).UTC()
+		s.LastModelPoll = &t
+	}
+	return s
+}
+
+// Handler serves the snapshot. It holds no user or provider data, so it is
+// safe to expose unauthenticated.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Current()); err != nil {
+		logging.Printf(r.Context(), "status: encode response error: %v", err)
+	}
+}
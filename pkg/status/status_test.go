@@ -0,0 +1,55 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tokentracer-proxy/pkg/version"
+)
+
+func TestStreams(t *testing.T) {
+	base := Current().ActiveStreams
+	StreamStarted()
+	StreamStarted()
+	if got := Current().ActiveStreams; got != base+2 {
+		t.Errorf("Expected %d active streams, got %d", base+2, got)
+	}
+	StreamEnded()
+	StreamEnded()
+	if got := Current().ActiveStreams; got != base {
+		t.Errorf("Expected %d active streams once they end, got %d", base, got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	defer func(ns int64) { lastModelPoll.Store(ns) }(lastModelPoll.Load())
+
+	lastModelPoll.Store(0)
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/status", nil))
+	var s Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.LastModelPoll != nil {
+		t.Errorf("Expected no model poll yet, got %v", s.LastModelPoll)
+	}
+	if s.Version != version.Version || s.Goroutines <= 0 || s.StartedAt.After(time.Now()) || s.UptimeSeconds < 0 {
+		t.Errorf("Unexpected snapshot %+v", s)
+	}
+
+	polled := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	RecordModelPoll(polled)
+	w = httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/status", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.LastModelPoll == nil || !s.LastModelPoll.Equal(polled) {
+		t.Errorf("Expected the last model poll at %v, got %v", polled, s.LastModelPoll)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected a JSON response, got %q", ct)
+	}
+}
@@ -0,0 +1,131 @@
+// Package timing records a per-request breakdown of where proxy latency is
+// spent, for a sampled fraction of requests.
+package timing
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+	"tokentracer-proxy/pkg/config"
+)
+
+// Phase names one measured part of a request.
+type Phase string
+
+const (
+	ResolveAlias      Phase = "resolve_alias"       // alias and provider key lookups
+	KeyDecrypt        Phase = "key_decrypt"         // provider key decryption
+	UpstreamConnect   Phase = "upstream_connect"    // obtaining a connection, incl. DNS and TLS
+	UpstreamFirstByte Phase = "upstream_first_byte" // request written to first response byte
+	Upstream          Phase = "upstream"            // the whole provider call, incl. reading the body
+)
+
+// phaseOrder fixes the order phases are reported in.
+var phaseOrder = []Phase{ResolveAlias, KeyDecrypt, UpstreamConnect, UpstreamFirstByte, Upstream}
+
+// sampleRate is the fraction of requests timed, from TIMING_SAMPLE_RATE.
+var sampleRate, _ = config.Float("TIMING_SAMPLE_RATE")
+
+// Sample reports whether the current request should be timed.
+func Sample() bool {
+	return sampleRate > 0 && rand.Float64() < sampleRate //nolint:gosec // sampling doesn't need a CSPRNG
+}
+
+// Recorder accumulates phase durations for one request. A nil *Recorder is
+// valid and records nothing, so callers don't need to check for sampling.
+type Recorder struct {
+	mu        sync.Mutex
+	start     time.Time
+	durations map[Phase]time.Duration
+}
+
+func New() *Recorder {
+	return &Recorder{start: time.Now(), durations: make(map[Phase]time.Duration)}
+}
+
+// Add adds d to the phase; phases hit more than once (e.g. on fallback) sum.
+func (r *Recorder) Add(p Phase, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.durations[p] += d
+	r.mu.Unlock()
+}
+
+// Since adds the time elapsed since start to the phase.
+func (r *Recorder) Since(p Phase, start time.Time) {
+	r.Add(p, time.Since(start))
+}
+
+// String formats the breakdown as key=value log fields, in milliseconds.
+func (r *Recorder) String() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, p := range phaseOrder {
+		if d, ok := r.durations[p]; ok {
+			fmt.Fprintf(&b, "%s_ms=%.3f ", p, float64(d)/float64(time.Millisecond))
+		}
+	}
+	fmt.Fprintf(&b, "total_ms=%.3f", float64(time.Since(r.start))/float64(time.Millisecond))
+	return b.String()
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying r.
+func NewContext(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// FromContext returns the request's Recorder, or nil when it isn't sampled.
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(ctxKey{}).(*Recorder)
+	return r
+}
+
+// Trace attaches an httptrace that records the connect and first-byte phases
+// of upstream requests made with the returned context. Unsampled contexts are
+// returned unchanged.
+func Trace(ctx context.Context) context.Context {
+	r := FromContext(ctx)
+	if r == nil {
+		return ctx
+	}
+
+	// The transport calls the hooks from different goroutines, e.g.
+	// WroteRequest from its write loop and GotFirstResponseByte from its
+	// read loop, so the timestamps are shared under mu.
+	var (
+		mu               sync.Mutex
+		connStart, wrote time.Time
+	)
+	set := func(t *time.Time) {
+		mu.Lock()
+		*t = time.Now()
+		mu.Unlock()
+	}
+	since := func(p Phase, t *time.Time) {
+		mu.Lock()
+		start := *t
+		mu.Unlock()
+		if !start.IsZero() {
+			r.Since(p, start)
+		}
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:              func(string) { set(&connStart) },
+		GotConn:              func(httptrace.GotConnInfo) { since(UpstreamConnect, &connStart) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { set(&wrote) },
+		GotFirstResponseByte: func() { since(UpstreamFirstByte, &wrote) },
+	})
+}
@@ -0,0 +1,109 @@
+package timing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSample(t *testing.T) {
+	defer func(r float64) { sampleRate = r }(sampleRate)
+
+	sampleRate = 0
+	if Sample() {
+		t.Error("Expected no sampling at rate 0")
+	}
+	sampleRate = 1
+	if !Sample() {
+		t.Error("Expected every request sampled at rate 1")
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var nilRec *Recorder
+	nilRec.Add(Upstream, time.Second)
+	if s := nilRec.String(); s != "" {
+		t.Errorf("Expected a nil recorder to format as empty, got %q", s)
+	}
+
+	r := New()
+	r.Add(Upstream, 2*time.Millisecond)
+	r.Add(ResolveAlias, time.Millisecond)
+	// Phases hit more than once, e.g. on fallback, sum
+	r.Add(Upstream, 3*time.Millisecond)
+
+	got := r.String()
+	if !regexp.MustCompile(`^resolve_alias_ms=1\.000 upstream_ms=5\.000 total_ms=\d+\.\d{3}$`).MatchString(got) {
+		t.Errorf("Unexpected breakdown %q", got)
+	}
+}
+
+func TestRecorder_Concurrent(t *testing.T) {
+	r := New()
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Add(Upstream, time.Millisecond)
+			_ = r.String()
+		}()
+	}
+	wg.Wait()
+	if d := r.durations[Upstream]; d != 10*time.Millisecond {
+		t.Errorf("Expected 10ms in total, got %v", d)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if FromContext(ctx) != nil {
+		t.Error("Expected no recorder on a bare context")
+	}
+	// Unsampled requests get no trace
+	if Trace(ctx) != ctx {
+		t.Error("Expected an unsampled context to be returned unchanged")
+	}
+
+	r := New()
+	if FromContext(NewContext(ctx, r)) != r {
+		t.Error("Expected the recorder back from the context")
+	}
+}
+
+// TestTrace makes real requests so the transport calls the trace hooks from
+// its own goroutines; run with -race.
+func TestTrace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	r := New()
+	ctx := Trace(NewContext(context.Background(), r))
+	for range 3 {
+		req, err := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.durations[UpstreamConnect]; !ok {
+		t.Error("Expected the connect phase to be recorded")
+	}
+	if d := r.durations[UpstreamFirstByte]; d < 3*time.Millisecond {
+		t.Errorf("Expected at least 3ms to first byte over three requests, got %v", d)
+	}
+}
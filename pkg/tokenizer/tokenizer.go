@@ -0,0 +1,105 @@
+// Package tokenizer counts tokens with byte pair encoding, using the
+// tiktoken rank files OpenAI publishes for its models (e.g. cl100k_base,
+// o200k_base).
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pretokenize splits text into the pieces BPE runs on, as tiktoken's
+// cl100k_base pattern does. Go's regexp has no lookahead, so trailing
+// whitespace before a word isn't split off; counts differ by at most a
+// token per run of spaces.
+var pretokenize = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Encoding is a BPE vocabulary: each token's bytes and its merge rank.
+type Encoding struct {
+	ranks map[string]int
+}
+
+// LoadFile reads a tiktoken rank file.
+func LoadFile(path string) (*Encoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open tokenizer: %w", err)
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse reads the tiktoken rank format: one token per line, base64-encoded,
+// followed by a space and its rank.
+func Parse(r io.Reader) (*Encoding, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("parse tokenizer: line %d: expected a token and a rank", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("parse tokenizer: line %d: %w", line, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("parse tokenizer: line %d: %w", line, err)
+		}
+		ranks[string(b)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read tokenizer: %w", err)
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("parse tokenizer: no tokens")
+	}
+	return &Encoding{ranks: ranks}, nil
+}
+
+// Count returns the number of tokens text encodes to.
+func (e *Encoding) Count(text string) int {
+	n := 0
+	for _, piece := range pretokenize.FindAllString(text, -1) {
+		n += e.countPiece(piece)
+	}
+	return n
+}
+
+// countPiece merges the piece's bytes pairwise, lowest rank first, until no
+// adjacent pair is a token, and returns the number of parts left.
+func (e *Encoding) countPiece(piece string) int {
+	if _, ok := e.ranks[piece]; ok {
+		return 1
+	}
+	// bounds[i] is where the i-th part starts
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := e.ranks[piece[bounds[i]:bounds[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	return len(bounds) - 1
+}
@@ -0,0 +1,51 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// ranksFile builds a tiktoken rank file for tokens, ranked in order.
+func ranksFile(tokens ...string) string {
+	var b strings.Builder
+	for i, tok := range tokens {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), i)
+	}
+	return b.String()
+}
+
+func TestCount(t *testing.T) {
+	enc, err := Parse(strings.NewReader(ranksFile("a", "b", "c", " ", "!", "ab", "bc", "abc", " abc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "abc", want: 1},
+		{text: "abc abc", want: 2},
+		// "ab" outranks "bc", so abcc merges to ab|c|c, then abc|c
+		{text: "abcc", want: 2},
+		{text: "cab", want: 2},
+		{text: "abc!", want: 2},
+	}
+
+	for _, tt := range tests {
+		if got := enc.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q): expected %d, got %d", tt.text, tt.want, got)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, in := range []string{"", "YQ==", "not-base64! 1", "YQ== one"} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("Parse(%q): expected an error", in)
+		}
+	}
+}
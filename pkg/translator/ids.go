@@ -0,0 +1,39 @@
+package translator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"tokentracer-proxy/pkg/config"
+	"tokentracer-proxy/pkg/logging"
+)
+
+// completionIDPrefix starts every OpenAI chat completion id.
+const completionIDPrefix = "chatcmpl-"
+
+// strictResponseIDs rewrites the ids of translated responses, such as
+// Anthropic's msg_..., into the chatcmpl-... format clients may validate.
+var strictResponseIDs = config.Bool("STRICT_RESPONSE_IDS", false)
+
+// NewCompletionID returns a random id in OpenAI's chat completion format.
+func NewCompletionID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return completionIDPrefix + hex.EncodeToString(b)
+}
+
+// responseID returns the id to send a translated response with. Unless
+// STRICT_RESPONSE_IDS is set, or the upstream id already has the OpenAI
+// format, that is the upstream id itself; otherwise a new id is generated
+// and its mapping to the upstream id logged for support.
+func responseID(ctx context.Context, upstreamID string) string {
+	if !strictResponseIDs || strings.HasPrefix(upstreamID, completionIDPrefix) {
+		return upstreamID
+	}
+	id := NewCompletionID()
+	logging.Printf(ctx, "translator: response id %s rewritten from upstream id %s", id, upstreamID)
+	return id
+}
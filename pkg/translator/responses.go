@@ -0,0 +1,208 @@
+package translator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"tokentracer-proxy/pkg/types"
+)
+
+// OpenAIToResponsesRequest maps a chat completion request onto the Responses
+// API. System messages become the instructions, and the rest of the
+// conversation, including earlier tool calls and their results, is sent as
+// input items. The request is stateless unless the client set store.
+func OpenAIToResponsesRequest(req types.OpenAIRequest) (types.ResponsesRequest, error) {
+	respReq := types.ResponsesRequest{
+		Model:           req.Model,
+		MaxOutputTokens: req.MaxTokens,
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		Metadata:        req.Metadata,
+	}
+	if req.Store != nil {
+		respReq.Store = *req.Store
+	}
+
+	var instructions []string
+	for _, msg := range req.Messages {
+		switch {
+		case msg.Role == "system" || msg.Role == "developer":
+			instructions = append(instructions, msg.Content)
+		case msg.Role == "tool":
+			respReq.Input = append(respReq.Input, types.ResponsesInputItem{
+				Type:   "function_call_output",
+				CallID: msg.ToolCallID,
+				Output: msg.Content,
+			})
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			if msg.Content != "" {
+				respReq.Input = append(respReq.Input, types.ResponsesInputItem{Role: msg.Role, Content: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				respReq.Input = append(respReq.Input, types.ResponsesInputItem{
+					Type:      "function_call",
+					CallID:    call.ID,
+					Name:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+				})
+			}
+		case msg.Parts != nil:
+			content, err := responsesContent(msg.Parts)
+			if err != nil {
+				return respReq, err
+			}
+			respReq.Input = append(respReq.Input, types.ResponsesInputItem{Role: msg.Role, Content: content})
+		default:
+			respReq.Input = append(respReq.Input, types.ResponsesInputItem{Role: msg.Role, Content: msg.Content})
+		}
+	}
+	respReq.Instructions = strings.Join(instructions, "\n")
+
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			return respReq, fmt.Errorf("unsupported tool type %q", tool.Type)
+		}
+		respReq.Tools = append(respReq.Tools, types.ResponsesTool{
+			Type:        "function",
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+	if len(req.ToolChoice) > 0 {
+		choice, err := responsesToolChoice(req.ToolChoice)
+		if err != nil {
+			return respReq, err
+		}
+		respReq.ToolChoice = choice
+	}
+
+	if req.ResponseFormat != nil {
+		format, err := responsesFormat(*req.ResponseFormat)
+		if err != nil {
+			return respReq, err
+		}
+		respReq.Text = &types.ResponsesText{Format: format}
+	}
+
+	return respReq, nil
+}
+
+// responsesContent maps OpenAI content parts to Responses input content.
+func responsesContent(parts []types.OpenAIContentPart) ([]types.ResponsesInputContent, error) {
+	content := make([]types.ResponsesInputContent, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			content = append(content, types.ResponsesInputContent{Type: "input_text", Text: p.Text})
+		case "image_url":
+			if p.ImageURL == nil || p.ImageURL.URL == "" {
+				return nil, fmt.Errorf("image_url content part is missing its url")
+			}
+			content = append(content, types.ResponsesInputContent{Type: "input_image", ImageURL: p.ImageURL.URL, Detail: p.ImageURL.Detail})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	return content, nil
+}
+
+// responsesToolChoice maps an OpenAI tool_choice to the Responses form, where
+// a named function is {"type": "function", "name": ...}.
+func responsesToolChoice(raw json.RawMessage) (json.RawMessage, error) {
+	if raw[0] == '"' {
+		return raw, nil
+	}
+	var named types.OpenAIToolChoice
+	if err := json.Unmarshal(raw, &named); err != nil || named.Type != "function" || named.Function.Name == "" {
+		return nil, fmt.Errorf("invalid tool_choice")
+	}
+	return json.Marshal(map[string]string{"type": "function", "name": named.Function.Name})
+}
+
+// responsesFormat maps response_format to the Responses text.format, where the
+// json_schema fields sit beside the type rather than nested under it.
+func responsesFormat(rf types.OpenAIResponseFormat) (json.RawMessage, error) {
+	format := map[string]interface{}{}
+	if rf.Type == "json_schema" && len(rf.JSONSchema) > 0 {
+		if err := json.Unmarshal(rf.JSONSchema, &format); err != nil {
+			return nil, fmt.Errorf("invalid response_format json_schema: %w", err)
+		}
+	}
+	format["type"] = rf.Type
+	return json.Marshal(format)
+}
+
+// ResponsesToOpenAIResponse maps a Responses API response back to a chat
+// completion.
+func ResponsesToOpenAIResponse(ctx context.Context, resp types.ResponsesResponse) types.OpenAIResponse {
+	openAIResp := types.OpenAIResponse{
+		ID:      responseID(ctx, resp.ID),
+		Object:  "chat.completion",
+		Created: resp.CreatedAt,
+		Model:   resp.Model,
+	}
+	if openAIResp.ID != resp.ID {
+		openAIResp.UpstreamID = resp.ID
+	}
+
+	content := ""
+	var toolCalls []types.OpenAIToolCall
+	for _, item := range resp.Output {
+		switch item.Type {
+		case "message":
+			for _, c := range item.Content {
+				if c.Type != "output_text" {
+					continue
+				}
+				for _, a := range c.Annotations {
+					if a.Type != "url_citation" {
+						continue
+					}
+					start, end := len(content)+a.StartIndex, len(content)+a.EndIndex
+					openAIResp.Citations = append(openAIResp.Citations, types.Citation{
+						Type:       a.Type,
+						URL:        a.URL,
+						Title:      a.Title,
+						StartIndex: &start,
+						EndIndex:   &end,
+					})
+				}
+				content += c.Text
+			}
+		case "function_call":
+			toolCalls = append(toolCalls, types.OpenAIToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: types.OpenAIFunctionCall{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+
+	openAIResp.Choices = []types.OpenAIChoice{{
+		Message:      types.OpenAIMessage{Role: "assistant", Content: content, ToolCalls: toolCalls},
+		FinishReason: responsesFinishReason(resp, len(toolCalls) > 0),
+	}}
+	openAIResp.Usage = types.OpenAIUsage{
+		PromptTokens:     resp.Usage.InputTokens,
+		CompletionTokens: resp.Usage.OutputTokens,
+		TotalTokens:      resp.Usage.InputTokens + resp.Usage.OutputTokens,
+	}
+	return openAIResp
+}
+
+// responsesFinishReason derives a finish_reason from the response status,
+// which the Responses API reports instead.
+func responsesFinishReason(resp types.ResponsesResponse, calledTools bool) string {
+	switch {
+	case calledTools:
+		return "tool_calls"
+	case resp.Status == "incomplete" && resp.IncompleteDetails != nil && resp.IncompleteDetails.Reason == "max_output_tokens":
+		return "length"
+	case resp.Status == "incomplete" && resp.IncompleteDetails != nil && resp.IncompleteDetails.Reason == "content_filter":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
@@ -0,0 +1,114 @@
+package translator
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"tokentracer-proxy/pkg/types"
+)
+
+func TestOpenAIToResponsesRequest(t *testing.T) {
+	temp := 0.2
+	req := types.OpenAIRequest{
+		Model: "gpt-4.1",
+		Messages: []types.OpenAIMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Weather in Paris?"},
+			{Role: "assistant", ToolCalls: []types.OpenAIToolCall{{ID: "call_1", Type: "function", Function: types.OpenAIFunctionCall{Name: "weather", Arguments: `{"city":"Paris"}`}}}},
+			{Role: "tool", ToolCallID: "call_1", Content: "18C"},
+		},
+		MaxTokens:      100,
+		Temperature:    &temp,
+		Tools:          []types.OpenAITool{{Type: "function", Function: types.OpenAIFunction{Name: "weather", Parameters: json.RawMessage(`{"type":"object"}`)}}},
+		ToolChoice:     json.RawMessage(`{"type":"function","function":{"name":"weather"}}`),
+		ResponseFormat: &types.OpenAIResponseFormat{Type: "json_schema", JSONSchema: json.RawMessage(`{"name":"w","schema":{"type":"object"}}`)},
+	}
+
+	got, err := OpenAIToResponsesRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Instructions != "Be brief." {
+		t.Errorf("Expected the system message as instructions, got %q", got.Instructions)
+	}
+	wantInput := []types.ResponsesInputItem{
+		{Role: "user", Content: "Weather in Paris?"},
+		{Type: "function_call", CallID: "call_1", Name: "weather", Arguments: `{"city":"Paris"}`},
+		{Type: "function_call_output", CallID: "call_1", Output: "18C"},
+	}
+	if !reflect.DeepEqual(got.Input, wantInput) {
+		t.Errorf("Expected input %+v, got %+v", wantInput, got.Input)
+	}
+	if got.MaxOutputTokens != 100 || got.Temperature != &temp || got.Store {
+		t.Errorf("Expected max_output_tokens 100, the temperature and store false, got %+v", got)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Name != "weather" || got.Tools[0].Type != "function" {
+		t.Errorf("Expected a flattened weather function tool, got %+v", got.Tools)
+	}
+	if string(got.ToolChoice) != `{"name":"weather","type":"function"}` {
+		t.Errorf("Expected a flattened tool_choice, got %s", got.ToolChoice)
+	}
+	if got.Text == nil || string(got.Text.Format) != `{"name":"w","schema":{"type":"object"},"type":"json_schema"}` {
+		t.Errorf("Expected the schema in text.format, got %+v", got.Text)
+	}
+}
+
+func TestResponsesToOpenAIResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		resp       types.ResponsesResponse
+		wantText   string
+		wantCalls  int
+		wantFinish string
+	}{
+		{
+			name: "message",
+			resp: types.ResponsesResponse{Status: "completed", Output: []types.ResponsesOutputItem{
+				{Type: "reasoning"},
+				{Type: "message", Role: "assistant", Content: []types.ResponsesOutputContent{{Type: "output_text", Text: "Hello"}}},
+			}},
+			wantText:   "Hello",
+			wantFinish: "stop",
+		},
+		{
+			name: "function call",
+			resp: types.ResponsesResponse{Status: "completed", Output: []types.ResponsesOutputItem{
+				{Type: "function_call", CallID: "call_1", Name: "weather", Arguments: `{}`},
+			}},
+			wantCalls:  1,
+			wantFinish: "tool_calls",
+		},
+		{
+			name: "truncated",
+			resp: types.ResponsesResponse{Status: "incomplete", IncompleteDetails: &types.ResponsesIncomplete{Reason: "max_output_tokens"}, Output: []types.ResponsesOutputItem{
+				{Type: "message", Content: []types.ResponsesOutputContent{{Type: "output_text", Text: "Hel"}}},
+			}},
+			wantText:   "Hel",
+			wantFinish: "length",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.resp.ID = "resp_1"
+			tt.resp.Usage = types.ResponsesUsage{InputTokens: 10, OutputTokens: 5}
+			got := ResponsesToOpenAIResponse(context.Background(), tt.resp)
+
+			if got.ID != "resp_1" || got.Object != "chat.completion" {
+				t.Errorf("Expected a chat.completion with id resp_1, got %q %q", got.ID, got.Object)
+			}
+			msg := got.Choices[0].Message
+			if msg.Content != tt.wantText || len(msg.ToolCalls) != tt.wantCalls {
+				t.Errorf("Expected text %q and %d tool calls, got %+v", tt.wantText, tt.wantCalls, msg)
+			}
+			if got.Choices[0].FinishReason != tt.wantFinish {
+				t.Errorf("Expected finish_reason %q, got %q", tt.wantFinish, got.Choices[0].FinishReason)
+			}
+			if got.Usage != (types.OpenAIUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}) {
+				t.Errorf("Unexpected usage %+v", got.Usage)
+			}
+		})
+	}
+}
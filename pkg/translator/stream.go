@@ -0,0 +1,93 @@
+package translator
+
+import (
+	"context"
+	"tokentracer-proxy/pkg/types"
+)
+
+// AnthropicStreamTranslator converts the events of one streaming Anthropic
+// response into OpenAI chat.completion.chunk objects, tracking token usage as
+// it goes.
+type AnthropicStreamTranslator struct {
+	id    string
+	model string
+	// toolCalls maps the content block index of each tool_use block to its
+	// index among the response's tool calls.
+	toolCalls map[int]int
+	Usage     types.OpenAIUsage
+}
+
+// Translate returns the chunk for ev, or nil for events that have no OpenAI
+// equivalent (pings, text block start, block stop, message_stop).
+func (t *AnthropicStreamTranslator) Translate(ctx context.Context, ev types.AnthropicStreamEvent) *types.OpenAIStreamChunk {
+	switch ev.Type {
+	case "message_start":
+		if ev.Message != nil {
+			t.id = responseID(ctx, ev.Message.ID)
+			t.model = ev.Message.Model
+			t.setUsage(ev.Message.Usage.InputTokens, ev.Message.Usage.OutputTokens)
+		}
+		return t.chunk(types.OpenAIDelta{Role: "assistant"}, nil)
+	case "content_block_start":
+		if ev.ContentBlock == nil || ev.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		if t.toolCalls == nil {
+			t.toolCalls = make(map[int]int)
+		}
+		index := len(t.toolCalls)
+		t.toolCalls[ev.Index] = index
+		return t.chunk(types.OpenAIDelta{ToolCalls: []types.OpenAIToolCallDelta{{
+			Index:    index,
+			ID:       ev.ContentBlock.ID,
+			Type:     "function",
+			Function: types.OpenAIFunctionCallDelta{Name: ev.ContentBlock.Name},
+		}}}, nil)
+	case "content_block_delta":
+		if ev.Delta == nil {
+			return nil
+		}
+		switch ev.Delta.Type {
+		case "text_delta":
+			return t.chunk(types.OpenAIDelta{Content: ev.Delta.Text}, nil)
+		case "input_json_delta":
+			index, ok := t.toolCalls[ev.Index]
+			if !ok || ev.Delta.PartialJSON == "" {
+				return nil
+			}
+			return t.chunk(types.OpenAIDelta{ToolCalls: []types.OpenAIToolCallDelta{{
+				Index:    index,
+				Function: types.OpenAIFunctionCallDelta{Arguments: ev.Delta.PartialJSON},
+			}}}, nil)
+		}
+		return nil
+	case "message_delta":
+		if ev.Usage != nil {
+			// output_tokens in message_delta is cumulative
+			t.setUsage(t.Usage.PromptTokens, ev.Usage.OutputTokens)
+		}
+		if ev.Delta == nil || ev.Delta.StopReason == "" {
+			return nil
+		}
+		reason := finishReason(ev.Delta.StopReason)
+		return t.chunk(types.OpenAIDelta{}, &reason)
+	}
+	return nil
+}
+
+func (t *AnthropicStreamTranslator) setUsage(input, output int) {
+	t.Usage = types.OpenAIUsage{
+		PromptTokens:     input,
+		CompletionTokens: output,
+		TotalTokens:      input + output,
+	}
+}
+
+func (t *AnthropicStreamTranslator) chunk(delta types.OpenAIDelta, finishReason *string) *types.OpenAIStreamChunk {
+	return &types.OpenAIStreamChunk{
+		ID:      t.id,
+		Object:  "chat.completion.chunk",
+		Model:   t.model,
+		Choices: []types.OpenAIStreamChoice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+	}
+}
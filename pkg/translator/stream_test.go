@@ -0,0 +1,130 @@
+package translator
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"tokentracer-proxy/pkg/types"
+)
+
+func TestAnthropicStreamTranslator(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-3","content":[],"usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" World"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+		`{"type":"message_stop"}`,
+	}
+
+	var tr AnthropicStreamTranslator
+	var chunks []*types.OpenAIStreamChunk
+	for _, e := range events {
+		var ev types.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(e), &ev); err != nil {
+			t.Fatalf("unmarshal %s: %v", e, err)
+		}
+		if c := tr.Translate(context.Background(), ev); c != nil {
+			chunks = append(chunks, c)
+		}
+	}
+
+	if len(chunks) != 4 {
+		t.Fatalf("Expected 4 chunks (role, 2 deltas, finish), got %d", len(chunks))
+	}
+	if chunks[0].Choices[0].Delta.Role != "assistant" || chunks[0].ID != "msg_1" || chunks[0].Object != "chat.completion.chunk" {
+		t.Errorf("Unexpected first chunk: %+v", chunks[0])
+	}
+	if got := chunks[1].Choices[0].Delta.Content + chunks[2].Choices[0].Delta.Content; got != "Hello World" {
+		t.Errorf("Content mismatch: got %q", got)
+	}
+	if fr := chunks[3].Choices[0].FinishReason; fr == nil || *fr != "end_turn" {
+		t.Errorf("Expected finish_reason end_turn, got %v", fr)
+	}
+	if tr.Usage.PromptTokens != 12 || tr.Usage.CompletionTokens != 5 || tr.Usage.TotalTokens != 17 {
+		t.Errorf("Usage mismatch: got %+v", tr.Usage)
+	}
+}
+
+func TestAnthropicStreamTranslator_ToolUse(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_2","type":"message","role":"assistant","model":"claude-3","content":[],"usage":{"input_tokens":30,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\": "}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"get_time","input":{}}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{}"}}`,
+		`{"type":"content_block_stop","index":2}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":40}}`,
+		`{"type":"message_stop"}`,
+	}
+
+	var tr AnthropicStreamTranslator
+	var chunks []*types.OpenAIStreamChunk
+	for _, e := range events {
+		var ev types.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(e), &ev); err != nil {
+			t.Fatalf("unmarshal %s: %v", e, err)
+		}
+		if c := tr.Translate(context.Background(), ev); c != nil {
+			chunks = append(chunks, c)
+		}
+	}
+
+	// role, text, tool call 0 start and two fragments, tool call 1 start and
+	// one fragment, finish
+	if len(chunks) != 8 {
+		t.Fatalf("Expected 8 chunks, got %d", len(chunks))
+	}
+	first, err := json.Marshal(chunks[2].Choices[0].Delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"get_weather","arguments":""}}]}`; string(first) != want {
+		t.Errorf("Expected the first tool call delta %s, got %s", want, first)
+	}
+	fragment, err := json.Marshal(chunks[3].Choices[0].Delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\": "}}]}`; string(fragment) != want {
+		t.Errorf("Expected an arguments fragment %s, got %s", want, fragment)
+	}
+
+	// Concatenating the deltas per index gives each complete call, the way
+	// clients accumulate them
+	type call struct{ id, name, args string }
+	calls := map[int]*call{}
+	for _, c := range chunks {
+		for _, tc := range c.Choices[0].Delta.ToolCalls {
+			if calls[tc.Index] == nil {
+				calls[tc.Index] = &call{}
+			}
+			calls[tc.Index].id += tc.ID
+			calls[tc.Index].name += tc.Function.Name
+			calls[tc.Index].args += tc.Function.Arguments
+		}
+	}
+	want := map[int]call{
+		0: {id: "toolu_1", name: "get_weather", args: `{"city": "Paris"}`},
+		1: {id: "toolu_2", name: "get_time", args: `{}`},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("Expected %d tool calls, got %d", len(want), len(calls))
+	}
+	for i, w := range want {
+		if got := calls[i]; got == nil || *got != w {
+			t.Errorf("Tool call %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if fr := chunks[7].Choices[0].FinishReason; fr == nil || *fr != "tool_calls" {
+		t.Errorf("Expected finish_reason tool_calls, got %v", fr)
+	}
+}
@@ -1,6 +1,9 @@
 package translator
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"strings"
 	"tokentracer-proxy/pkg/types"
 )
@@ -32,16 +35,65 @@ func OpenAIToAnthropicRequest(req types.OpenAIRequest) (types.AnthropicRequest,
 	var systemPrompt string
 
 	for _, msg := range req.Messages {
-		if msg.Role == "system" {
+		switch msg.Role {
+		case "system":
 			systemPrompt += msg.Content + "\n"
-		} else {
-			messages = append(messages, types.AnthropicMessage(msg))
+		case "tool":
+			// Tool results go back to Anthropic as tool_result blocks in a user turn.
+			// Consecutive results share one user message.
+			block, err := toolResultBlock(msg)
+			if err != nil {
+				return anthropicReq, err
+			}
+			if n := len(messages); n > 0 && messages[n-1].Role == "user" && isToolResultMessage(messages[n-1]) {
+				messages[n-1].Blocks = append(messages[n-1].Blocks, block)
+			} else {
+				messages = append(messages, types.AnthropicMessage{Role: "user", Blocks: []types.AnthropicBlock{block}})
+			}
+		default:
+			if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
+				messages = append(messages, types.AnthropicMessage{Role: msg.Role, Blocks: toolUseBlocks(msg)})
+				continue
+			}
+			if msg.Parts != nil {
+				// Array content, possibly with images, is sent as content blocks
+				blocks, err := contentPartsToBlocks(msg.Parts)
+				if err != nil {
+					return anthropicReq, err
+				}
+				messages = append(messages, types.AnthropicMessage{Role: msg.Role, Blocks: blocks})
+				continue
+			}
+			messages = append(messages, types.AnthropicMessage{Role: msg.Role, Content: msg.Content})
 		}
 	}
 
 	anthropicReq.System = strings.TrimSpace(systemPrompt)
 	anthropicReq.Messages = messages
 
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			return anthropicReq, fmt.Errorf("unsupported tool type %q", tool.Type)
+		}
+		schema := tool.Function.Parameters
+		if len(schema) == 0 {
+			// Anthropic requires an input schema; OpenAI allows omitting it
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		anthropicReq.Tools = append(anthropicReq.Tools, types.AnthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	if len(req.ToolChoice) > 0 {
+		choice, err := toolChoice(req.ToolChoice)
+		if err != nil {
+			return anthropicReq, err
+		}
+		anthropicReq.ToolChoice = choice
+	}
+
 	if req.MaxTokens > 0 {
 		anthropicReq.MaxTokens = req.MaxTokens
 	} else {
@@ -49,22 +101,161 @@ func OpenAIToAnthropicRequest(req types.OpenAIRequest) (types.AnthropicRequest,
 	}
 
 	anthropicReq.Stream = req.Stream
+	anthropicReq.Temperature = req.Temperature
+	anthropicReq.TopP = req.TopP
+	anthropicReq.StopSequences = req.Stop
 
 	return anthropicReq, nil
 }
 
-func AnthropicToOpenAIResponse(resp types.AnthropicResponse) (types.OpenAIResponse, error) {
+// toolChoice maps an OpenAI tool_choice, either a string or a named function,
+// to Anthropic's tool_choice.
+func toolChoice(raw json.RawMessage) (*types.AnthropicToolChoice, error) {
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "auto":
+			return &types.AnthropicToolChoice{Type: "auto"}, nil
+		case "required":
+			return &types.AnthropicToolChoice{Type: "any"}, nil
+		case "none":
+			return &types.AnthropicToolChoice{Type: "none"}, nil
+		}
+		return nil, fmt.Errorf("unsupported tool_choice %q", mode)
+	}
+
+	var named types.OpenAIToolChoice
+	if err := json.Unmarshal(raw, &named); err != nil || named.Type != "function" || named.Function.Name == "" {
+		return nil, fmt.Errorf("tool_choice must be a string or a named function")
+	}
+	return &types.AnthropicToolChoice{Type: "tool", Name: named.Function.Name}, nil
+}
+
+// toolUseBlocks converts an assistant message that called tools into
+// Anthropic content blocks, so earlier tool calls can be sent back upstream.
+func toolUseBlocks(msg types.OpenAIMessage) []types.AnthropicBlock {
+	blocks := make([]types.AnthropicBlock, 0, len(msg.ToolCalls)+1)
+	if msg.Content != "" {
+		blocks = append(blocks, types.AnthropicBlock{Type: "text", Text: msg.Content})
+	}
+	for _, call := range msg.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if len(input) == 0 {
+			input = json.RawMessage(`{}`)
+		}
+		blocks = append(blocks, types.AnthropicBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: input,
+		})
+	}
+	return blocks
+}
+
+func isToolResultMessage(m types.AnthropicMessage) bool {
+	return len(m.Blocks) > 0 && m.Blocks[0].Type == "tool_result"
+}
+
+// toolResultBlock converts an OpenAI "tool" role message into an Anthropic
+// tool_result block, keeping any image parts of multimodal content.
+func toolResultBlock(msg types.OpenAIMessage) (types.AnthropicBlock, error) {
+	block := types.AnthropicBlock{Type: "tool_result", ToolUseID: msg.ToolCallID}
+	if msg.Parts == nil {
+		if msg.Content != "" {
+			block.Content = []types.AnthropicBlock{{Type: "text", Text: msg.Content}}
+		}
+		return block, nil
+	}
+
+	content, err := contentPartsToBlocks(msg.Parts)
+	if err != nil {
+		return block, err
+	}
+	block.Content = content
+	return block, nil
+}
+
+// contentPartsToBlocks maps OpenAI content parts to Anthropic content blocks.
+func contentPartsToBlocks(parts []types.OpenAIContentPart) ([]types.AnthropicBlock, error) {
+	blocks := make([]types.AnthropicBlock, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			blocks = append(blocks, types.AnthropicBlock{Type: "text", Text: p.Text})
+		case "image_url":
+			if p.ImageURL == nil {
+				return nil, fmt.Errorf("image_url part is missing its url")
+			}
+			source, err := imageSource(p.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, types.AnthropicBlock{Type: "image", Source: source})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// imageSource converts an OpenAI image URL, either a data URL or a remote
+// URL, into an Anthropic image source.
+func imageSource(url string) (*types.AnthropicImageSource, error) {
+	if !strings.HasPrefix(url, "data:") {
+		return &types.AnthropicImageSource{Type: "url", URL: url}, nil
+	}
+
+	// data:<media type>;base64,<data>
+	meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok {
+		return nil, fmt.Errorf("malformed image data URL")
+	}
+	mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+	if !isBase64 {
+		return nil, fmt.Errorf("image data URLs must be base64 encoded")
+	}
+	return &types.AnthropicImageSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+}
+
+func AnthropicToOpenAIResponse(ctx context.Context, resp types.AnthropicResponse) (types.OpenAIResponse, error) {
 	var openAIResp types.OpenAIResponse
 
-	openAIResp.ID = resp.ID
+	openAIResp.ID = responseID(ctx, resp.ID)
+	if openAIResp.ID != resp.ID {
+		openAIResp.UpstreamID = resp.ID
+	}
 	openAIResp.Object = "chat.completion"
 	openAIResp.Created = 0        // timestamp logic if needed, or 0
 	openAIResp.Model = resp.Model // This isn't returned by Anthropic in the body usually, but let's leave it empty or fill from context if needed.
 
 	// Helper to extract text content
 	content := ""
+	var toolCalls []types.OpenAIToolCall
 	for _, block := range resp.Content {
+		if block.Type == "tool_use" {
+			toolCalls = append(toolCalls, types.OpenAIToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: types.OpenAIFunctionCall{Name: block.Name, Arguments: string(block.Input)},
+			})
+		}
 		if block.Type == "text" {
+			start, end := len(content), len(content)+len(block.Text)
+			for _, c := range block.Citations {
+				title := c.Title
+				if title == "" {
+					title = c.DocumentTitle
+				}
+				openAIResp.Citations = append(openAIResp.Citations, types.Citation{
+					Type:       c.Type,
+					URL:        c.URL,
+					Title:      title,
+					CitedText:  c.CitedText,
+					StartIndex: &start,
+					EndIndex:   &end,
+				})
+			}
 			content += block.Text
 		}
 	}
@@ -73,10 +264,11 @@ func AnthropicToOpenAIResponse(resp types.AnthropicResponse) (types.OpenAIRespon
 		{
 			Index: 0,
 			Message: types.OpenAIMessage{
-				Role:    "assistant",
-				Content: content,
+				Role:      "assistant",
+				Content:   content,
+				ToolCalls: toolCalls,
 			},
-			FinishReason: resp.StopReason,
+			FinishReason: finishReason(resp.StopReason),
 		},
 	}
 
@@ -88,3 +280,34 @@ func AnthropicToOpenAIResponse(resp types.AnthropicResponse) (types.OpenAIRespon
 
 	return openAIResp, nil
 }
+
+// finishReason maps an Anthropic stop_reason to an OpenAI finish_reason.
+// Clients look for "tool_calls" to know they must run the requested tools;
+// other stop reasons are passed through.
+func finishReason(stopReason string) string {
+	if stopReason == "tool_use" {
+		return "tool_calls"
+	}
+	return stopReason
+}
+
+// CitationsFromAnnotations fills resp.Citations from the url_citation
+// annotations OpenAI-compatible upstreams attach to the first choice.
+func CitationsFromAnnotations(resp *types.OpenAIResponse) {
+	if len(resp.Choices) == 0 {
+		return
+	}
+	for _, a := range resp.Choices[0].Message.Annotations {
+		if a.Type != "url_citation" || a.URLCitation == nil {
+			continue
+		}
+		start, end := a.URLCitation.StartIndex, a.URLCitation.EndIndex
+		resp.Citations = append(resp.Citations, types.Citation{
+			Type:       a.Type,
+			URL:        a.URLCitation.URL,
+			Title:      a.URLCitation.Title,
+			StartIndex: &start,
+			EndIndex:   &end,
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package translator
 
 import (
+	"context"
+	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 	"tokentracer-proxy/pkg/types"
 )
@@ -97,7 +100,7 @@ func TestAnthropicToOpenAIResponse(t *testing.T) {
 		},
 	}
 
-	got, err := AnthropicToOpenAIResponse(resp)
+	got, err := AnthropicToOpenAIResponse(context.Background(), resp)
 	if err != nil {
 		t.Fatalf("AnthropicToOpenAIResponse() error = %v", err)
 	}
@@ -115,3 +118,338 @@ func TestAnthropicToOpenAIResponse(t *testing.T) {
 		t.Errorf("TotalTokens mismatch: got %d", got.Usage.TotalTokens)
 	}
 }
+
+func TestAnthropicToOpenAIResponse_StrictIDs(t *testing.T) {
+	strictResponseIDs = true
+	defer func() { strictResponseIDs = false }()
+
+	got, err := AnthropicToOpenAIResponse(context.Background(), types.AnthropicResponse{
+		ID:      "msg_123",
+		Content: []types.AnthropicBlock{{Type: "text", Text: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("AnthropicToOpenAIResponse() error = %v", err)
+	}
+	if !strings.HasPrefix(got.ID, "chatcmpl-") || len(got.ID) != len("chatcmpl-")+24 {
+		t.Errorf("Expected a chatcmpl- id, got %q", got.ID)
+	}
+	if got.UpstreamID != "msg_123" {
+		t.Errorf("Expected the upstream id to be kept, got %q", got.UpstreamID)
+	}
+
+	var st AnthropicStreamTranslator
+	chunk := st.Translate(context.Background(), types.AnthropicStreamEvent{Type: "message_start", Message: &types.AnthropicResponse{ID: "msg_456"}})
+	if chunk == nil || !strings.HasPrefix(chunk.ID, "chatcmpl-") {
+		t.Errorf("Expected stream chunks to get a chatcmpl- id, got %+v", chunk)
+	}
+}
+
+func TestOpenAIToAnthropicRequest_ToolResultWithImage(t *testing.T) {
+	body := `{
+		"model": "claude-3-unknown",
+		"messages": [
+			{"role": "user", "content": "Plot the sales data"},
+			{"role": "tool", "tool_call_id": "toolu_01", "content": [
+				{"type": "text", "text": "Chart rendered"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]}
+		]
+	}`
+	var req types.OpenAIRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+
+	got, err := OpenAIToAnthropicRequest(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropicRequest() error = %v", err)
+	}
+
+	want := []types.AnthropicMessage{
+		{Role: "user", Content: "Plot the sales data"},
+		{Role: "user", Blocks: []types.AnthropicBlock{
+			{
+				Type:      "tool_result",
+				ToolUseID: "toolu_01",
+				Content: []types.AnthropicBlock{
+					{Type: "text", Text: "Chart rendered"},
+					{Type: "image", Source: &types.AnthropicImageSource{Type: "base64", MediaType: "image/png", Data: "iVBORw0KGgo="}},
+				},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(got.Messages, want) {
+		t.Errorf("Messages = %+v, want %+v", got.Messages, want)
+	}
+
+	// The tool_result must serialize as a content array
+	encoded, err := json.Marshal(got.Messages[1])
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	wantJSON := `{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_01","content":[{"type":"text","text":"Chart rendered"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}}]}]}`
+	if string(encoded) != wantJSON {
+		t.Errorf("encoded message = %s, want %s", encoded, wantJSON)
+	}
+}
+
+func TestAnthropicToOpenAIResponse_Citations(t *testing.T) {
+	// Sample grounded response using web search results
+	body := `{
+		"id": "msg_456",
+		"model": "claude-3",
+		"content": [
+			{"type": "text", "text": "Go 1.22 changed loop variables. "},
+			{"type": "text", "text": "Each iteration now has its own variable.", "citations": [
+				{"type": "web_search_result_location", "url": "https://go.dev/blog/loopvar-preview", "title": "Fixing For Loops in Go 1.22", "cited_text": "each iteration has its own separate declared variable"}
+			]}
+		],
+		"stop_reason": "end_turn",
+		"usage": {"input_tokens": 20, "output_tokens": 12}
+	}`
+	var resp types.AnthropicResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	got, err := AnthropicToOpenAIResponse(context.Background(), resp)
+	if err != nil {
+		t.Fatalf("AnthropicToOpenAIResponse() error = %v", err)
+	}
+	if len(got.Citations) != 1 {
+		t.Fatalf("Citations length: got %d", len(got.Citations))
+	}
+	c := got.Citations[0]
+	if c.URL != "https://go.dev/blog/loopvar-preview" || c.Title != "Fixing For Loops in Go 1.22" {
+		t.Errorf("Citation source mismatch: got %+v", c)
+	}
+	content := got.Choices[0].Message.Content
+	if span := content[*c.StartIndex:*c.EndIndex]; span != "Each iteration now has its own variable." {
+		t.Errorf("Citation span mismatch: got %q", span)
+	}
+
+	out, _ := json.Marshal(got)
+	var raw map[string]json.RawMessage
+	json.Unmarshal(out, &raw)
+	if _, ok := raw["x_citations"]; !ok {
+		t.Errorf("x_citations missing from %s", out)
+	}
+}
+
+func TestAnthropicToOpenAIResponse_NoCitations(t *testing.T) {
+	got, err := AnthropicToOpenAIResponse(context.Background(), types.AnthropicResponse{
+		Content: []types.AnthropicBlock{{Type: "text", Text: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("AnthropicToOpenAIResponse() error = %v", err)
+	}
+	out, _ := json.Marshal(got)
+	var raw map[string]json.RawMessage
+	json.Unmarshal(out, &raw)
+	if _, ok := raw["x_citations"]; ok {
+		t.Errorf("x_citations should be omitted, got %s", out)
+	}
+}
+
+func TestCitationsFromAnnotations(t *testing.T) {
+	body := `{
+		"id": "chatcmpl-1",
+		"choices": [{"index": 0, "message": {
+			"role": "assistant",
+			"content": "Rust 1.0 shipped in 2015.",
+			"annotations": [
+				{"type": "url_citation", "url_citation": {"url": "https://blog.rust-lang.org/2015/05/15/Rust-1.0.html", "title": "Announcing Rust 1.0", "start_index": 0, "end_index": 25}}
+			]
+		}, "finish_reason": "stop"}]
+	}`
+	var resp types.OpenAIResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	CitationsFromAnnotations(&resp)
+	if len(resp.Citations) != 1 {
+		t.Fatalf("Citations length: got %d", len(resp.Citations))
+	}
+	c := resp.Citations[0]
+	if c.Type != "url_citation" || c.Title != "Announcing Rust 1.0" || *c.StartIndex != 0 || *c.EndIndex != 25 {
+		t.Errorf("Citation mismatch: got %+v", c)
+	}
+}
+
+func TestToolCalling_RoundTrip(t *testing.T) {
+	body := `{
+		"model": "gpt-4o",
+		"messages": [{"role": "user", "content": "What's the weather in Paris?"}],
+		"tools": [{"type": "function", "function": {
+			"name": "get_weather",
+			"description": "Get the current weather for a city",
+			"parameters": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}
+		}}],
+		"tool_choice": {"type": "function", "function": {"name": "get_weather"}}
+	}`
+	var req types.OpenAIRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal request: %v", err)
+	}
+
+	anthropicReq, err := OpenAIToAnthropicRequest(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropicRequest() error = %v", err)
+	}
+	if len(anthropicReq.Tools) != 1 || anthropicReq.Tools[0].Name != "get_weather" {
+		t.Fatalf("Tools mismatch: got %+v", anthropicReq.Tools)
+	}
+	if string(anthropicReq.Tools[0].InputSchema) != string(req.Tools[0].Function.Parameters) {
+		t.Errorf("input_schema = %s, want %s", anthropicReq.Tools[0].InputSchema, req.Tools[0].Function.Parameters)
+	}
+	if want := (types.AnthropicToolChoice{Type: "tool", Name: "get_weather"}); anthropicReq.ToolChoice == nil || *anthropicReq.ToolChoice != want {
+		t.Errorf("ToolChoice = %+v, want %+v", anthropicReq.ToolChoice, want)
+	}
+
+	respBody := `{
+		"id": "msg_789",
+		"model": "claude-3-5-sonnet-20240620",
+		"content": [
+			{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"city": "Paris"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 50, "output_tokens": 15}
+	}`
+	var resp types.AnthropicResponse
+	if err := json.Unmarshal([]byte(respBody), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	got, err := AnthropicToOpenAIResponse(context.Background(), resp)
+	if err != nil {
+		t.Fatalf("AnthropicToOpenAIResponse() error = %v", err)
+	}
+	choice := got.Choices[0]
+	if choice.FinishReason != "tool_calls" {
+		t.Errorf("FinishReason = %q, want tool_calls", choice.FinishReason)
+	}
+	if len(choice.Message.ToolCalls) != 1 {
+		t.Fatalf("ToolCalls length: got %d", len(choice.Message.ToolCalls))
+	}
+	call := choice.Message.ToolCalls[0]
+	if call.ID != "toolu_01" || call.Type != "function" || call.Function.Name != "get_weather" {
+		t.Errorf("ToolCall mismatch: got %+v", call)
+	}
+	if call.Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("Arguments = %s", call.Function.Arguments)
+	}
+
+	// Sending the call back in the history should give the original tool_use block
+	history, err := OpenAIToAnthropicRequest(types.OpenAIRequest{
+		Model:    "gpt-4o",
+		Messages: []types.OpenAIMessage{choice.Message, {Role: "tool", ToolCallID: "toolu_01", Content: "18C, sunny"}},
+	})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropicRequest() error = %v", err)
+	}
+	encoded, err := json.Marshal(history.Messages[0])
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	wantJSON := `{"role":"assistant","content":[{"type":"tool_use","id":"toolu_01","name":"get_weather","input":{"city":"Paris"}}]}`
+	if string(encoded) != wantJSON {
+		t.Errorf("encoded message = %s, want %s", encoded, wantJSON)
+	}
+}
+
+func TestOpenAIToAnthropicRequest_ToolChoice(t *testing.T) {
+	tests := []struct {
+		choice  string
+		want    types.AnthropicToolChoice
+		wantErr bool
+	}{
+		{choice: `"auto"`, want: types.AnthropicToolChoice{Type: "auto"}},
+		{choice: `"required"`, want: types.AnthropicToolChoice{Type: "any"}},
+		{choice: `"none"`, want: types.AnthropicToolChoice{Type: "none"}},
+		{choice: `"sometimes"`, wantErr: true},
+		{choice: `{"type": "function"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.choice, func(t *testing.T) {
+			got, err := OpenAIToAnthropicRequest(types.OpenAIRequest{Model: "gpt-4o", ToolChoice: json.RawMessage(tt.choice)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *got.ToolChoice != tt.want {
+				t.Errorf("ToolChoice = %+v, want %+v", *got.ToolChoice, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIToAnthropicRequest_SamplingParams(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		stop []string
+	}{
+		{"stop as string", `{"model":"gpt-4o","messages":[],"temperature":0.2,"top_p":0.9,"stop":"END"}`, []string{"END"}},
+		{"stop as array", `{"model":"gpt-4o","messages":[],"temperature":0.2,"top_p":0.9,"stop":["END","\n\n"]}`, []string{"END", "\n\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req types.OpenAIRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			got, err := OpenAIToAnthropicRequest(req)
+			if err != nil {
+				t.Fatalf("OpenAIToAnthropicRequest() error = %v", err)
+			}
+			if got.Temperature == nil || *got.Temperature != 0.2 || got.TopP == nil || *got.TopP != 0.9 {
+				t.Errorf("sampling params mismatch: temperature %v, top_p %v", got.Temperature, got.TopP)
+			}
+			if !reflect.DeepEqual(got.StopSequences, tt.stop) {
+				t.Errorf("StopSequences = %q, want %q", got.StopSequences, tt.stop)
+			}
+		})
+	}
+
+	var req types.OpenAIRequest
+	if err := json.Unmarshal([]byte(`{"model":"gpt-4o","messages":[],"stop":42}`), &req); err == nil {
+		t.Error("expected an error for a numeric stop")
+	}
+}
+
+func TestOpenAIToAnthropicRequest_MultimodalUserMessage(t *testing.T) {
+	body := `{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is in these images?"},
+				{"type": "image_url", "image_url": {"url": "https://example.com/cat.jpg"}},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]},
+			{"role": "assistant", "content": "A cat and a chart."},
+			{"role": "user", "content": "Hello world"}
+		]
+	}`
+	var req types.OpenAIRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	got, err := OpenAIToAnthropicRequest(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropicRequest() error = %v", err)
+	}
+	encoded, err := json.Marshal(got.Messages)
+	if err != nil {
+		t.Fatalf("failed to encode messages: %v", err)
+	}
+	wantJSON := `[{"role":"user","content":[{"type":"text","text":"What is in these images?"},{"type":"image","source":{"type":"url","url":"https://example.com/cat.jpg"}},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}}]},` +
+		`{"role":"assistant","content":"A cat and a chart."},{"role":"user","content":"Hello world"}]`
+	if string(encoded) != wantJSON {
+		t.Errorf("encoded messages = %s\nwant %s", encoded, wantJSON)
+	}
+
+	req.Messages[0].Parts = append(req.Messages[0].Parts, types.OpenAIContentPart{Type: "input_audio"})
+	if _, err := OpenAIToAnthropicRequest(req); err == nil {
+		t.Error("expected an error for an unsupported content part")
+	}
+}
@@ -1,17 +1,69 @@
 package types
 
+import "encoding/json"
+
 // AnthropicRequest mimicking the Anthropic Messages API request
 type AnthropicRequest struct {
-	Model     string             `json:"model"`
-	Messages  []AnthropicMessage `json:"messages"`
-	System    string             `json:"system,omitempty"`
-	MaxTokens int                `json:"max_tokens,omitempty"`
-	Stream    bool               `json:"stream,omitempty"`
+	Model         string               `json:"model"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	System        string               `json:"system,omitempty"`
+	MaxTokens     int                  `json:"max_tokens,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// AnthropicToolChoice is one of auto, any, tool (with Name) or none
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
 }
 
 type AnthropicMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Blocks, when set, is sent as the content array instead of Content.
+	Blocks []AnthropicBlock `json:"-"`
+}
+
+func (m AnthropicMessage) MarshalJSON() ([]byte, error) {
+	var content interface{} = m.Content
+	if m.Blocks != nil {
+		content = m.Blocks
+	}
+	return json.Marshal(struct {
+		Role    string      `json:"role"`
+		Content interface{} `json:"content"`
+	}{m.Role, content})
+}
+
+func (m *AnthropicMessage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role = raw.Role
+	m.Content = ""
+	m.Blocks = nil
+	if len(raw.Content) > 0 && raw.Content[0] == '[' {
+		return json.Unmarshal(raw.Content, &m.Blocks)
+	}
+	if len(raw.Content) > 0 && string(raw.Content) != "null" {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+	return nil
 }
 
 // AnthropicResponse mimicking the Anthropic Messages API response
@@ -25,12 +77,68 @@ type AnthropicResponse struct {
 	Usage      AnthropicUsage   `json:"usage"`
 }
 
+// AnthropicBlock is a content block in either a request or a response
 type AnthropicBlock struct {
-	Type string `json:"type"`
-	Text string `json:"text,omitempty"`
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *AnthropicImageSource `json:"source,omitempty"`
+	// Citations on response text blocks (document and web search citations)
+	Citations []AnthropicCitation `json:"citations,omitempty"`
+	// tool_use fields
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// tool_result fields
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   []AnthropicBlock `json:"content,omitempty"`
+}
+
+// AnthropicImageSource is the source of an image block, either inline base64
+// data or a URL.
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicCitation is a citation on a text block. Which fields are set
+// depends on Type (char_location, page_location, web_search_result_location, ...).
+type AnthropicCitation struct {
+	Type          string `json:"type"`
+	CitedText     string `json:"cited_text,omitempty"`
+	DocumentTitle string `json:"document_title,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Title         string `json:"title,omitempty"`
 }
 
 type AnthropicUsage struct {
 	InputTokens  int `json:"input_tokens"`
 	OutputTokens int `json:"output_tokens"`
 }
+
+// AnthropicStreamEvent is the data of one server-sent event from a streaming
+// Messages API call. Which fields are set depends on Type.
+type AnthropicStreamEvent struct {
+	Type         string                `json:"type"`
+	Message      *AnthropicResponse    `json:"message,omitempty"`       // message_start
+	Index        int                   `json:"index"`                   // content_block_*
+	ContentBlock *AnthropicBlock       `json:"content_block,omitempty"` // content_block_start
+	Delta        *AnthropicStreamDelta `json:"delta,omitempty"`         // content_block_delta, message_delta
+	Usage        *AnthropicUsage       `json:"usage,omitempty"`         // message_delta
+	Error        *AnthropicStreamError `json:"error,omitempty"`         // error
+}
+
+// AnthropicStreamDelta is a text_delta or input_json_delta for
+// content_block_delta events, or the stop reason for message_delta events.
+type AnthropicStreamDelta struct {
+	Type        string `json:"type,omitempty"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+	StopReason  string `json:"stop_reason,omitempty"`
+}
+
+type AnthropicStreamError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
@@ -1,16 +1,194 @@
 package types
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // OpenAIRequest mimicking the OpenAI Chat Completion request
 type OpenAIRequest struct {
-	Model     string          `json:"model"`
-	Messages  []OpenAIMessage `json:"messages"`
-	Stream    bool            `json:"stream,omitempty"`
-	MaxTokens int             `json:"max_tokens,omitempty"`
+	Model       string          `json:"model"`
+	Messages    []OpenAIMessage `json:"messages"`
+	Stream      bool            `json:"stream,omitempty"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	Stop        StopSequences   `json:"stop,omitempty"`
+	// Penalties are passed through to OpenAI-compatible providers only
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	// StreamOptions is passed through on streaming requests
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	// Tools lists the functions the model may call. ToolChoice is either a
+	// string ("auto", "none", "required") or a named function object.
+	Tools      []OpenAITool    `json:"tools,omitempty"`
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
+	// Store and Metadata are passed through to OpenAI; the proxy also keeps
+	// stored responses itself so they work with any provider.
+	Store    *bool             `json:"store,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ResponseFormat asks for JSON output ("json_object" or "json_schema")
+	ResponseFormat *OpenAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type OpenAIResponseFormat struct {
+	Type       string          `json:"type"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+}
+
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// StopSequences is the stop parameter, which OpenAI accepts as either a
+// single string or an array of strings. It is always sent as an array.
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var one string
+		if err := json.Unmarshal(data, &one); err != nil {
+			return err
+		}
+		*s = StopSequences{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// OpenAITool is a tool the model may call. Only function tools exist.
+type OpenAITool struct {
+	Type     string         `json:"type"`
+	Function OpenAIFunction `json:"function"`
+}
+
+type OpenAIFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// OpenAIToolChoice is the object form of tool_choice, naming one function
+type OpenAIToolChoice struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+	} `json:"function"`
+}
+
+// OpenAIToolCall is a function call made by the assistant. Arguments is the
+// JSON-encoded argument object, as a string.
+type OpenAIToolCall struct {
+	ID       string             `json:"id"`
+	Type     string             `json:"type"`
+	Function OpenAIFunctionCall `json:"function"`
+}
+
+type OpenAIFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 type OpenAIMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Parts holds the content when it was sent in the array form. Content
+	// still carries the concatenated text parts so text-only callers work.
+	Parts      []OpenAIContentPart `json:"-"`
+	ToolCallID string              `json:"tool_call_id,omitempty"`
+	ToolCalls  []OpenAIToolCall    `json:"tool_calls,omitempty"`
+	// Annotations are returned by OpenAI-compatible upstreams, e.g. url_citation
+	Annotations []OpenAIAnnotation `json:"annotations,omitempty"`
+}
+
+// OpenAIAnnotation is an annotation on an assistant message
+type OpenAIAnnotation struct {
+	Type        string             `json:"type"`
+	URLCitation *OpenAIURLCitation `json:"url_citation,omitempty"`
+}
+
+type OpenAIURLCitation struct {
+	URL        string `json:"url"`
+	Title      string `json:"title,omitempty"`
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+}
+
+// OpenAIContentPart is one element of the array form of message content
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+}
+
+type OpenAIImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// openAIMessageJSON is the wire form of OpenAIMessage, where content may be a
+// string, an array of parts, or null.
+type openAIMessageJSON struct {
+	Role        string             `json:"role"`
+	Content     json.RawMessage    `json:"content"`
+	ToolCallID  string             `json:"tool_call_id,omitempty"`
+	ToolCalls   []OpenAIToolCall   `json:"tool_calls,omitempty"`
+	Annotations []OpenAIAnnotation `json:"annotations,omitempty"`
+}
+
+func (m *OpenAIMessage) UnmarshalJSON(data []byte) error {
+	var raw openAIMessageJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role = raw.Role
+	m.ToolCallID = raw.ToolCallID
+	m.ToolCalls = raw.ToolCalls
+	m.Annotations = raw.Annotations
+	m.Content = ""
+	m.Parts = nil
+
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	switch raw.Content[0] {
+	case '"':
+		return json.Unmarshal(raw.Content, &m.Content)
+	case '[':
+		if err := json.Unmarshal(raw.Content, &m.Parts); err != nil {
+			return err
+		}
+		for _, p := range m.Parts {
+			if p.Type == "text" {
+				m.Content += p.Text
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("message content must be a string or an array of parts")
+	}
+}
+
+func (m OpenAIMessage) MarshalJSON() ([]byte, error) {
+	var content interface{} = m.Content
+	if m.Parts != nil {
+		content = m.Parts
+	} else if m.Content == "" && len(m.ToolCalls) > 0 {
+		// Assistant messages that only call tools have null content
+		content = nil
+	}
+	return json.Marshal(struct {
+		Role        string             `json:"role"`
+		Content     interface{}        `json:"content"`
+		ToolCallID  string             `json:"tool_call_id,omitempty"`
+		ToolCalls   []OpenAIToolCall   `json:"tool_calls,omitempty"`
+		Annotations []OpenAIAnnotation `json:"annotations,omitempty"`
+	}{m.Role, content, m.ToolCallID, m.ToolCalls, m.Annotations})
 }
 
 // OpenAIResponse mimicking the OpenAI Chat Completion response
@@ -21,6 +199,23 @@ type OpenAIResponse struct {
 	Model   string         `json:"model"`
 	Choices []OpenAIChoice `json:"choices"`
 	Usage   OpenAIUsage    `json:"usage"`
+	// Citations is a vendor extension carrying the sources the upstream cited,
+	// normalized across providers. Only set when the upstream returned any.
+	Citations []Citation `json:"x_citations,omitempty"`
+	// UpstreamID is the provider's own id when ID was rewritten; it is only
+	// logged, never sent to the client.
+	UpstreamID string `json:"-"`
+}
+
+// Citation is a source cited by the response. StartIndex and EndIndex locate
+// the supported span in the first choice's message content, when known.
+type Citation struct {
+	Type       string `json:"type"`
+	URL        string `json:"url,omitempty"`
+	Title      string `json:"title,omitempty"`
+	CitedText  string `json:"cited_text,omitempty"`
+	StartIndex *int   `json:"start_index,omitempty"`
+	EndIndex   *int   `json:"end_index,omitempty"`
 }
 
 type OpenAIChoice struct {
@@ -29,8 +224,78 @@ type OpenAIChoice struct {
 	FinishReason string        `json:"finish_reason"`
 }
 
+// OpenAIStreamChunk is a chat.completion.chunk sent as one server-sent event
+// of a streaming response
+type OpenAIStreamChunk struct {
+	ID      string               `json:"id"`
+	Object  string               `json:"object"`
+	Created int64                `json:"created"`
+	Model   string               `json:"model"`
+	Choices []OpenAIStreamChoice `json:"choices"`
+	Usage   *OpenAIUsage         `json:"usage,omitempty"`
+}
+
+type OpenAIStreamChoice struct {
+	Index        int         `json:"index"`
+	Delta        OpenAIDelta `json:"delta"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type OpenAIDelta struct {
+	Role      string                `json:"role,omitempty"`
+	Content   string                `json:"content,omitempty"`
+	ToolCalls []OpenAIToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+// OpenAIToolCallDelta is part of a tool call in a streamed chunk. The first
+// delta for a call carries its ID and function name; later ones with the same
+// Index carry fragments of the arguments, to be concatenated.
+type OpenAIToolCallDelta struct {
+	Index    int                     `json:"index"`
+	ID       string                  `json:"id,omitempty"`
+	Type     string                  `json:"type,omitempty"`
+	Function OpenAIFunctionCallDelta `json:"function"`
+}
+
+type OpenAIFunctionCallDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
 type OpenAIUsage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
 }
+
+// OpenAIErrorResponse is the OpenAI error envelope, {"error": {...}}
+type OpenAIErrorResponse struct {
+	Error OpenAIError `json:"error"`
+}
+
+type OpenAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// ModerationRequest is an OpenAI /v1/moderations request. Input is a string,
+// an array of strings, or an array of multimodal input parts.
+type ModerationRequest struct {
+	Model string          `json:"model,omitempty"`
+	Input json.RawMessage `json:"input"`
+}
+
+type ModerationResponse struct {
+	ID      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
+
+type ModerationResult struct {
+	Flagged                   bool                `json:"flagged"`
+	Categories                map[string]bool     `json:"categories"`
+	CategoryScores            map[string]float64  `json:"category_scores"`
+	CategoryAppliedInputTypes map[string][]string `json:"category_applied_input_types,omitempty"`
+}
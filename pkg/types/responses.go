@@ -0,0 +1,105 @@
+package types
+
+import "encoding/json"
+
+// ResponsesRequest is an OpenAI Responses API (/v1/responses) request
+type ResponsesRequest struct {
+	Model           string               `json:"model"`
+	Input           []ResponsesInputItem `json:"input"`
+	Instructions    string               `json:"instructions,omitempty"`
+	MaxOutputTokens int                  `json:"max_output_tokens,omitempty"`
+	Temperature     *float64             `json:"temperature,omitempty"`
+	TopP            *float64             `json:"top_p,omitempty"`
+	Tools           []ResponsesTool      `json:"tools,omitempty"`
+	ToolChoice      json.RawMessage      `json:"tool_choice,omitempty"`
+	Text            *ResponsesText       `json:"text,omitempty"`
+	// Store is always sent: the Responses API stores by default, and the
+	// proxy only uses it statelessly unless the client asked otherwise
+	Store    bool              `json:"store"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ResponsesInputItem is one element of a Responses input: a message (Role and
+// Content), a function_call made by the model, or a function_call_output.
+type ResponsesInputItem struct {
+	Type      string      `json:"type,omitempty"`
+	Role      string      `json:"role,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+	CallID    string      `json:"call_id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Arguments string      `json:"arguments,omitempty"`
+	Output    string      `json:"output,omitempty"`
+}
+
+// ResponsesInputContent is one part of a message's content array
+type ResponsesInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ResponsesTool is a function tool. Unlike chat completions, the function's
+// fields are not nested under "function".
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ResponsesText configures the output format, the counterpart of
+// response_format
+type ResponsesText struct {
+	Format json.RawMessage `json:"format"`
+}
+
+// ResponsesResponse is a Responses API response
+type ResponsesResponse struct {
+	ID                string                `json:"id"`
+	Object            string                `json:"object"`
+	CreatedAt         int64                 `json:"created_at"`
+	Model             string                `json:"model"`
+	Status            string                `json:"status"`
+	IncompleteDetails *ResponsesIncomplete  `json:"incomplete_details"`
+	Output            []ResponsesOutputItem `json:"output"`
+	Usage             ResponsesUsage        `json:"usage"`
+}
+
+type ResponsesIncomplete struct {
+	Reason string `json:"reason"`
+}
+
+// ResponsesOutputItem is an item the model produced: a "message" with
+// Content, or a "function_call". Other types, such as reasoning, are ignored.
+type ResponsesOutputItem struct {
+	Type      string                   `json:"type"`
+	ID        string                   `json:"id"`
+	Role      string                   `json:"role,omitempty"`
+	Content   []ResponsesOutputContent `json:"content,omitempty"`
+	CallID    string                   `json:"call_id,omitempty"`
+	Name      string                   `json:"name,omitempty"`
+	Arguments string                   `json:"arguments,omitempty"`
+}
+
+type ResponsesOutputContent struct {
+	Type        string                `json:"type"`
+	Text        string                `json:"text"`
+	Annotations []ResponsesAnnotation `json:"annotations,omitempty"`
+}
+
+// ResponsesAnnotation is an annotation on output text, e.g. url_citation.
+// The citation's fields are not nested as they are in chat completions.
+type ResponsesAnnotation struct {
+	Type       string `json:"type"`
+	URL        string `json:"url,omitempty"`
+	Title      string `json:"title,omitempty"`
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+}
+
+type ResponsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
@@ -0,0 +1,7 @@
+// Package version holds build metadata set at link time, e.g.
+//
+//	go build -ldflags "-X tokentracer-proxy/pkg/version.Version=v1.2.3"
+package version
+
+// Version is the release version of the binary, "dev" for local builds.
+var Version = "dev"
@@ -158,6 +158,35 @@ class TestProviderKeys:
         # encrypted key should NOT be returned
         assert "encrypted_key" not in pk
 
+    def test_delete(self, base_url, unique_user, provider_key):
+        headers = unique_user["headers"]
+        pk_id = provider_key[0]["id"]
+
+        # Blocked while an alias still routes to the key
+        alias_name = f"test-alias-{uuid.uuid4().hex[:8]}"
+        r = requests.post(
+            f"{base_url}/manage/aliases",
+            headers=headers,
+            json={"alias": alias_name, "target_model": "gpt-4", "provider_key_id": pk_id},
+        )
+        assert r.status_code == 200, f"Create alias failed: {r.text}"
+        r = requests.delete(f"{base_url}/manage/providers/{pk_id}", headers=headers)
+        assert r.status_code == 409
+        assert alias_name in r.text
+
+        # A key with no aliases is deleted
+        r = requests.post(
+            f"{base_url}/manage/providers",
+            headers=headers,
+            json={"provider": "openai", "api_key": "sk-fake-test-key-2", "label": "Spare"},
+        )
+        assert r.status_code == 201
+        spare = [k for k in requests.get(f"{base_url}/manage/providers", headers=headers).json() if k["label"] == "Spare"][0]
+        r = requests.delete(f"{base_url}/manage/providers/{spare['id']}", headers=headers)
+        assert r.status_code == 204
+        r = requests.delete(f"{base_url}/manage/providers/{spare['id']}", headers=headers)
+        assert r.status_code == 404
+
 
 # ---------------------------------------------------------------------------
 # 5. Alias CRUD
@@ -388,6 +417,38 @@ class TestAliasAdvanced:
         assert match["light_model_threshold"] == 50
         assert match["light_model"] == "gpt-3.5-turbo"
 
+    def test_delete_clears_fallbacks(self, base_url, unique_user, provider_key):
+        headers = unique_user["headers"]
+        pk_id = provider_key[0]["id"]
+
+        fallback_name = f"fb-{uuid.uuid4().hex[:8]}"
+        requests.post(
+            f"{base_url}/manage/aliases",
+            headers=headers,
+            json={"alias": fallback_name, "target_model": "gpt-3.5-turbo", "provider_key_id": pk_id},
+        )
+        r = requests.get(f"{base_url}/manage/aliases", headers=headers)
+        fb_id = [a for a in r.json() if a["alias"] == fallback_name][0]["id"]
+
+        alias_name = f"primary-{uuid.uuid4().hex[:8]}"
+        requests.post(
+            f"{base_url}/manage/aliases",
+            headers=headers,
+            json={"alias": alias_name, "target_model": "gpt-4", "provider_key_id": pk_id, "fallback_alias_id": fb_id},
+        )
+
+        r = requests.delete(f"{base_url}/manage/aliases/{fallback_name}", headers=headers)
+        assert r.status_code == 204
+
+        r = requests.get(f"{base_url}/manage/aliases", headers=headers)
+        names = [a["alias"] for a in r.json()]
+        assert fallback_name not in names
+        primary = [a for a in r.json() if a["alias"] == alias_name][0]
+        assert primary["fallback_alias_id"] is None
+
+        r = requests.delete(f"{base_url}/manage/aliases/{fallback_name}", headers=headers)
+        assert r.status_code == 404
+
 
 # ---------------------------------------------------------------------------
 # 11. Alias validation
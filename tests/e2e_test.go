@@ -11,6 +11,7 @@ import (
 	"tokentracer-proxy/pkg/auth"
 	"tokentracer-proxy/pkg/crypto"
 	"tokentracer-proxy/pkg/db"
+	"tokentracer-proxy/pkg/db/dbtest"
 	"tokentracer-proxy/pkg/handler"
 	"tokentracer-proxy/pkg/types"
 
@@ -91,10 +92,9 @@ func TestProxyEndToEnd(t *testing.T) {
 
 	// Expect DB calls for ProxyHandler
 	// 1. Model Alias
-	mockDB.ExpectQuery("SELECT target_model, provider_key_id, fallback_alias_id, use_light_model, light_model_threshold, light_model FROM model_aliases").
+	mockDB.ExpectQuery("SELECT (.+) FROM model_aliases").
 		WithArgs(123, "gpt-4").
-		WillReturnRows(mockDB.NewRows([]string{"target_model", "provider_key_id", "fallback_alias_id", "use_light_model", "light_model_threshold", "light_model"}).
-			AddRow("claude-3-opus-20240229", 10, nil, false, 100, nil))
+		WillReturnRows(dbtest.AliasRows(mockDB, db.ModelAlias{ID: 1, Alias: "gpt-4", TargetModel: "claude-3-opus-20240229", ProviderKeyID: 10}))
 
 	// 2. Provider Key (Lookup for type)
 	mockDB.ExpectQuery("SELECT provider, encrypted_key FROM provider_keys").